@@ -0,0 +1,374 @@
+// Package acl decides which clients may use the proxy and which upstream
+// destinations they may reach.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// DeniedError is returned for a client or destination an ACL refuses
+type DeniedError struct {
+	Kind   string // "client" or "destination"
+	Target string // e.g. 10.0.0.5 or 169.254.169.254:80
+	Reason string
+}
+
+func (e *DeniedError) Error() string {
+	return e.Kind + " " + e.Target + " denied: " + e.Reason
+}
+
+// Clients allows or denies clients by address. Deny entries win over allow
+// entries; when there are allow entries, clients matching none of them are
+// denied. A nil *Clients allows every client.
+type Clients struct {
+	allow, deny []netip.Prefix
+}
+
+// NewClients parses allow and deny lists of addresses and CIDR prefixes
+// such as 10.0.0.0/8, 192.168.1.20 or fd00::/8
+func NewClients(allow, deny []string) (*Clients, error) {
+	c := &Clients{}
+	var err error
+	if c.allow, err = parsePrefixes(allow); err != nil {
+		return nil, err
+	}
+	if c.deny, err = parsePrefixes(deny); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Check returns a *DeniedError if the client at addr may not use the proxy
+func (c *Clients) Check(addr netip.Addr) error {
+	if c == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	if p, ok := matchPrefix(c.deny, addr); ok {
+		return &DeniedError{Kind: "client", Target: addr.String(), Reason: "denied by " + p.String()}
+	}
+	if len(c.allow) > 0 {
+		if _, ok := matchPrefix(c.allow, addr); !ok {
+			return &DeniedError{Kind: "client", Target: addr.String(), Reason: "not in the allow list"}
+		}
+	}
+	return nil
+}
+
+// CheckRemoteAddr checks a client by its host:port address, as found in
+// http.Request.RemoteAddr
+func (c *Clients) CheckRemoteAddr(remoteAddr string) error {
+	if c == nil {
+		return nil
+	}
+	ap, err := netip.ParseAddrPort(remoteAddr)
+	if err != nil {
+		return &DeniedError{Kind: "client", Target: remoteAddr, Reason: "unknown address"}
+	}
+	return c.Check(ap.Addr())
+}
+
+func parsePrefixes(entries []string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, e := range entries {
+		p, err := parsePrefix(e)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p)
+	}
+	return prefixes, nil
+}
+
+// parsePrefix parses a CIDR prefix or a single address
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not a CIDR prefix such as 10.0.0.0/8", s)
+		}
+		return p.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or CIDR prefix", s)
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+func matchPrefix(prefixes []netip.Prefix, addr netip.Addr) (netip.Prefix, bool) {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return p, true
+		}
+	}
+	return netip.Prefix{}, false
+}
+
+// internalPrefixes are the loopback, private, shared, link-local (which
+// holds cloud metadata endpoints such as 169.254.169.254), unspecified and
+// other special-purpose ranges that Destinations blocks unless told
+// otherwise. The NAT64 and 6to4 ranges are included whole, since they embed
+// IPv4 addresses that a gateway would reach, internal ones among them.
+var internalPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"), // reserved, and broadcast
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("64:ff9b::/96"),   // NAT64
+	netip.MustParsePrefix("64:ff9b:1::/48"), // local-use NAT64
+	netip.MustParsePrefix("2002::/16"),      // 6to4
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+}
+
+// Destinations allows or denies upstream destinations by host name, address
+// and port. A destination is checked by name before it is resolved and
+// again for every address it resolves to, so a name can't be used to reach
+// an address that is denied:
+//
+//   - a matching deny entry denies it
+//   - an allow entry naming the host or matching the address allows it,
+//     including internal addresses
+//   - internal addresses are denied when blockInternal is set
+//   - when there are allow entries, destinations matching none of them,
+//     counting * entries, are denied
+//
+// A nil *Destinations allows every destination.
+type Destinations struct {
+	allow, deny   []destRule
+	blockInternal bool
+}
+
+// NewDestinations parses allow and deny lists. Each entry is a host name
+// (example.com), a wildcard for its subdomains (*.example.com), * for any
+// host, an address or a CIDR prefix, optionally followed by a port or port
+// range: example.com:443, *:8000-8999, 10.0.0.0/8:22, [fd00::/8]:22.
+func NewDestinations(allow, deny []string, blockInternal bool) (*Destinations, error) {
+	d := &Destinations{blockInternal: blockInternal}
+	var err error
+	if d.allow, err = parseDestRules(allow); err != nil {
+		return nil, err
+	}
+	if d.deny, err = parseDestRules(deny); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// CheckName checks host and port before host is resolved. It returns a
+// *DeniedError for denied destinations and reports whether an allow entry
+// named the host, which must be passed on to CheckAddr.
+func (d *Destinations) CheckName(host string, port int) (named bool, err error) {
+	if d == nil {
+		return false, nil
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return false, d.CheckAddr(addr, port, false)
+	}
+	name := normalizeHost(host)
+	for _, r := range d.deny {
+		if r.matchName(name, port) {
+			return false, deniedDestination(hostPort(host, port), "denied by "+r.text)
+		}
+	}
+	for _, r := range d.allow {
+		if !r.any && r.matchName(name, port) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckAddr checks an address a destination resolved to. named is the
+// result of CheckName for the host it was resolved from.
+func (d *Destinations) CheckAddr(addr netip.Addr, port int, named bool) error {
+	if d == nil {
+		return nil
+	}
+	addr = addr.Unmap()
+	target := hostPort(addr.String(), port)
+	for _, r := range d.deny {
+		if r.matchAddr(addr, port) {
+			return deniedDestination(target, "denied by "+r.text)
+		}
+	}
+	if named {
+		return nil
+	}
+	listed := false
+	for _, r := range d.allow {
+		if r.any {
+			// * doesn't single out internal addresses, so it doesn't
+			// lift the block on them
+			listed = listed || r.matchPort(port)
+		} else if r.matchAddr(addr, port) {
+			return nil
+		}
+	}
+	if _, ok := matchPrefix(internalPrefixes, addr); ok && d.blockInternal {
+		return deniedDestination(target, "internal address")
+	}
+	if len(d.allow) > 0 && !listed {
+		return deniedDestination(target, "not in the allow list")
+	}
+	return nil
+}
+
+// CheckUnresolved checks a destination that is reached through an upstream
+// proxy, which resolves host itself. Only entries that match the name, or
+// the address when host is one, apply: internal addresses can't be told
+// from names, so they are blocked only when host is an address.
+func (d *Destinations) CheckUnresolved(host string, port int) error {
+	if d == nil {
+		return nil
+	}
+	named, err := d.CheckName(host, port)
+	if err != nil || named || isAddr(strings.Trim(host, "[]")) {
+		return err
+	}
+	if len(d.allow) == 0 {
+		return nil
+	}
+	for _, r := range d.allow {
+		if r.any && r.matchPort(port) {
+			return nil
+		}
+	}
+	return deniedDestination(hostPort(host, port), "not in the allow list")
+}
+
+func deniedDestination(target, reason string) error {
+	return &DeniedError{Kind: "destination", Target: target, Reason: reason}
+}
+
+func hostPort(host string, port int) string {
+	return net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(port))
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// destRule is one allow or deny entry
+type destRule struct {
+	text string
+
+	// exactly one of these is set
+	name   string // exact host name
+	suffix string // .example.com for *.example.com
+	prefix netip.Prefix
+	any    bool
+
+	minPort, maxPort int // 0 for any port
+}
+
+func parseDestRules(entries []string) ([]destRule, error) {
+	var rules []destRule
+	for _, e := range entries {
+		r, err := parseDestRule(e)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, r)
+	}
+	return rules, nil
+}
+
+func parseDestRule(s string) (destRule, error) {
+	r := destRule{text: s}
+	host, ports := s, ""
+	switch {
+	case strings.HasPrefix(s, "["):
+		end := strings.Index(s, "]")
+		if end < 0 || (end+1 < len(s) && s[end+1] != ':') {
+			return r, fmt.Errorf("%q: expected [address]:port", s)
+		}
+		host = s[1:end]
+		ports = strings.TrimPrefix(s[end+1:], ":")
+		if ports == "" && end+1 < len(s) {
+			return r, fmt.Errorf("%q: missing port after the colon", s)
+		}
+	case strings.Count(s, ":") == 1:
+		host, ports, _ = strings.Cut(s, ":")
+		if ports == "" {
+			return r, fmt.Errorf("%q: missing port after the colon", s)
+		}
+	}
+
+	switch {
+	case host == "*":
+		r.any = true
+	case strings.HasPrefix(host, "*."):
+		r.suffix = normalizeHost(host[1:])
+	case strings.ContainsAny(host, "*"):
+		return r, fmt.Errorf("%q: wildcards are only allowed as *.domain or *", s)
+	case strings.Contains(host, "/") || isAddr(host):
+		p, err := parsePrefix(host)
+		if err != nil {
+			return r, err
+		}
+		r.prefix = p
+	case host == "":
+		return r, fmt.Errorf("%q: missing host", s)
+	default:
+		r.name = normalizeHost(host)
+	}
+
+	if ports != "" {
+		lo, hi, isRange := strings.Cut(ports, "-")
+		if !isRange {
+			hi = lo
+		}
+		var err1, err2 error
+		r.minPort, err1 = strconv.Atoi(lo)
+		r.maxPort, err2 = strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || r.minPort < 1 || r.maxPort > 65535 || r.minPort > r.maxPort {
+			return r, fmt.Errorf("%q: port %q must be a number or range from 1 to 65535", s, ports)
+		}
+	}
+	return r, nil
+}
+
+func isAddr(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+func (r destRule) matchPort(port int) bool {
+	return r.minPort == 0 || (port >= r.minPort && port <= r.maxPort)
+}
+
+func (r destRule) matchName(name string, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	switch {
+	case r.any:
+		return true
+	case r.suffix != "":
+		return strings.HasSuffix(name, r.suffix)
+	default:
+		return r.name != "" && name == r.name
+	}
+}
+
+func (r destRule) matchAddr(addr netip.Addr, port int) bool {
+	if !r.matchPort(port) {
+		return false
+	}
+	return r.any || (r.prefix.IsValid() && r.prefix.Contains(addr))
+}
@@ -0,0 +1,186 @@
+package acl
+
+import (
+	"errors"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestClients(t *testing.T) {
+	c, err := NewClients([]string{"10.0.0.0/8", "192.168.1.20", "fd00::/8"}, []string{"10.0.5.0/24"})
+	if err != nil {
+		t.Fatalf("NewClients: %v", err)
+	}
+	tests := []struct {
+		addr string
+		want string // empty when allowed
+	}{
+		{"10.1.2.3", ""},
+		{"192.168.1.20", ""},
+		{"::ffff:10.1.2.3", ""},
+		{"fd00::1", ""},
+		{"10.0.5.7", "client 10.0.5.7 denied: denied by 10.0.5.0/24"},
+		{"192.168.1.21", "client 192.168.1.21 denied: not in the allow list"},
+		{"8.8.8.8", "client 8.8.8.8 denied: not in the allow list"},
+	}
+	for _, tt := range tests {
+		err := c.Check(netip.MustParseAddr(tt.addr))
+		if got := errString(err); got != tt.want {
+			t.Errorf("Check(%s) = %q, want %q", tt.addr, got, tt.want)
+		}
+	}
+
+	if err := c.CheckRemoteAddr("10.1.2.3:51234"); err != nil {
+		t.Errorf("Expected the remote address to be allowed, got %v", err)
+	}
+	var denied *DeniedError
+	if err := c.CheckRemoteAddr("garbage"); !errors.As(err, &denied) {
+		t.Errorf("Expected an unparseable address to be denied, got %v", err)
+	}
+
+	var none *Clients
+	if err := none.CheckRemoteAddr("8.8.8.8:1"); err != nil {
+		t.Errorf("Expected a nil *Clients to allow everyone, got %v", err)
+	}
+
+	// Deny lists alone allow everything else
+	c, _ = NewClients(nil, []string{"203.0.113.0/24"})
+	if err := c.Check(netip.MustParseAddr("8.8.8.8")); err != nil {
+		t.Errorf("Expected clients outside the deny list to be allowed, got %v", err)
+	}
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+func TestDestinations(t *testing.T) {
+	d, err := NewDestinations(nil, []string{"*.evil.example", "10.9.0.0/16", "*:25", "db.example.com:5432"}, true)
+	if err != nil {
+		t.Fatalf("NewDestinations: %v", err)
+	}
+	tests := []struct {
+		host string
+		port int
+		ip   string // resolved address; empty for an address literal
+		want string
+	}{
+		{"example.com", 443, "93.184.216.34", ""},
+		{"www.evil.example", 443, "", "destination www.evil.example:443 denied: denied by *.evil.example"},
+		{"evil.example", 443, "93.184.216.35", ""}, // *. only matches subdomains
+		{"mail.example.com", 25, "", "destination mail.example.com:25 denied: denied by *:25"},
+		{"DB.Example.com.", 5432, "", "destination DB.Example.com.:5432 denied: denied by db.example.com:5432"},
+		{"db.example.com", 443, "93.184.216.36", ""},
+		{"169.254.169.254", 80, "", "destination 169.254.169.254:80 denied: internal address"},
+		{"metadata.google.internal", 80, "169.254.169.254", "destination 169.254.169.254:80 denied: internal address"},
+		{"localhost", 8080, "::1", "destination [::1]:8080 denied: internal address"},
+		{"rebind.example", 80, "::ffff:192.168.0.1", "destination 192.168.0.1:80 denied: internal address"},
+		{"[fe80::1]", 443, "", "destination [fe80::1]:443 denied: internal address"},
+		{"[64:ff9b::a9fe:a9fe]", 80, "", "destination [64:ff9b::a9fe:a9fe]:80 denied: internal address"},
+		{"nat64.example", 80, "64:ff9b:1::a00:1", "destination [64:ff9b:1::a00:1]:80 denied: internal address"},
+		{"[2002:7f00:1::]", 8080, "", "destination [2002:7f00:1::]:8080 denied: internal address"},
+		{"192.0.0.170", 443, "", "destination 192.0.0.170:443 denied: internal address"},
+		{"bench.example", 80, "198.18.0.1", "destination 198.18.0.1:80 denied: internal address"},
+		{"255.255.255.255", 80, "", "destination 255.255.255.255:80 denied: internal address"},
+		{"[2606:4700::1111]", 443, "", ""},
+		{"10.9.1.1", 443, "", "destination 10.9.1.1:443 denied: denied by 10.9.0.0/16"},
+	}
+	for _, tt := range tests {
+		if got := errString(check(d, tt.host, tt.port, tt.ip)); got != tt.want {
+			t.Errorf("%s:%d (%s) = %q, want %q", tt.host, tt.port, tt.ip, got, tt.want)
+		}
+	}
+
+	var none *Destinations
+	if err := check(none, "169.254.169.254", 80, ""); err != nil {
+		t.Errorf("Expected a nil *Destinations to allow everything, got %v", err)
+	}
+	open, _ := NewDestinations(nil, nil, false)
+	if err := check(open, "localhost", 80, "127.0.0.1"); err != nil {
+		t.Errorf("Expected internal addresses to be allowed without the block, got %v", err)
+	}
+}
+
+func TestDestinationsAllowList(t *testing.T) {
+	d, err := NewDestinations([]string{"*:443", "*.corp.example:8000-8999", "10.1.0.0/16:22"}, []string{"10.1.2.0/24"}, true)
+	if err != nil {
+		t.Fatalf("NewDestinations: %v", err)
+	}
+	tests := []struct {
+		host string
+		port int
+		ip   string
+		want string
+	}{
+		{"example.com", 443, "93.184.216.34", ""},
+		{"example.com", 80, "93.184.216.34", "destination 93.184.216.34:80 denied: not in the allow list"},
+		// * doesn't lift the internal block, but naming the host does
+		{"intranet", 443, "10.2.0.1", "destination 10.2.0.1:443 denied: internal address"},
+		{"app.corp.example", 8080, "10.2.0.1", ""},
+		{"app.corp.example", 9000, "10.2.0.1", "destination 10.2.0.1:9000 denied: internal address"},
+		{"10.1.9.9", 22, "", ""},
+		{"bastion", 22, "10.1.9.9", ""},
+		{"10.1.2.3", 22, "", "destination 10.1.2.3:22 denied: denied by 10.1.2.0/24"},
+	}
+	for _, tt := range tests {
+		if got := errString(check(d, tt.host, tt.port, tt.ip)); got != tt.want {
+			t.Errorf("%s:%d (%s) = %q, want %q", tt.host, tt.port, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestDestinationsUnresolved(t *testing.T) {
+	d, err := NewDestinations([]string{"*:443", "*.corp.example"}, []string{"*.evil.example"}, true)
+	if err != nil {
+		t.Fatalf("NewDestinations: %v", err)
+	}
+	tests := []struct {
+		host string
+		port int
+		want string
+	}{
+		{"example.com", 443, ""},
+		{"example.com", 80, "destination example.com:80 denied: not in the allow list"},
+		{"app.corp.example", 8080, ""},
+		{"www.evil.example", 443, "destination www.evil.example:443 denied: denied by *.evil.example"},
+		// Names aren't resolved, but addresses are still checked
+		{"10.0.0.1", 443, "destination 10.0.0.1:443 denied: internal address"},
+		{"intranet", 443, ""},
+	}
+	for _, tt := range tests {
+		if got := errString(d.CheckUnresolved(tt.host, tt.port)); got != tt.want {
+			t.Errorf("CheckUnresolved(%s, %d) = %q, want %q", tt.host, tt.port, got, tt.want)
+		}
+	}
+
+	var none *Destinations
+	if err := none.CheckUnresolved("10.0.0.1", 443); err != nil {
+		t.Errorf("Expected a nil *Destinations to allow everything, got %v", err)
+	}
+}
+
+// check runs both stages the way the proxy does
+func check(d *Destinations, host string, port int, ip string) error {
+	named, err := d.CheckName(host, port)
+	if err != nil || ip == "" {
+		return err
+	}
+	return d.CheckAddr(netip.MustParseAddr(ip), port, named)
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, entry := range []string{"10.0.0.0/33", "host:", "host:0", "host:99999", "host:20-10", "ho*st", "[::1", "[::1]x", ":443"} {
+		if _, err := NewDestinations([]string{entry}, nil, false); err == nil || !strings.Contains(err.Error(), entry) {
+			t.Errorf("Expected an error naming %q, got %v", entry, err)
+		}
+	}
+	for _, entry := range []string{"10.0.0.0/33", "example.com"} {
+		if _, err := NewClients(nil, []string{entry}); err == nil {
+			t.Errorf("Expected %q to be rejected as a client entry", entry)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"nproxy/app/config"
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type healthResponse struct {
+	Status             string  `json:"status"`
+	UptimeSeconds      float64 `json:"uptime_seconds"`
+	Flows              int     `json:"flows"`
+	ActiveTunnels      int64   `json:"active_tunnels"`
+	CachedCertificates int     `json:"cached_certificates"`
+}
+
+type ruleResponse struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	Filter  string `json:"filter,omitempty"`
+}
+
+type configResponse struct {
+	Addr             string         `json:"addr"`
+	CertDir          string         `json:"cert_dir"`
+	ServerTiming     bool           `json:"server_timing"`
+	Tracing          bool           `json:"tracing"`
+	BodyCaptureLimit int            `json:"body_capture_limit"`
+	Recording        bool           `json:"recording"`
+	FlowHistory      int            `json:"flow_history"`
+	Rules            []ruleResponse `json:"rules"`
+}
+
+type changeResponse struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+type reloadResponse struct {
+	Changes []changeResponse `json:"changes"`
+}
+
+type problemResponse struct {
+	Location string `json:"location"`
+	Path     string `json:"path,omitempty"`
+	Message  string `json:"message"`
+}
+
+type reloadErrorResponse struct {
+	Error    string            `json:"error"`
+	Problems []problemResponse `json:"problems"`
+}
+
+type flowListResponse struct {
+	Flows []flow.Summary `json:"flows"`
+	Total int            `json:"total"`
+}
+
+type clearedResponse struct {
+	Cleared int `json:"cleared"`
+}
+
+type toggleRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+type toggleResponse struct {
+	Enabled bool `json:"enabled"`
+}
+
+type cachesResponse struct {
+	Certificates int `json:"certificates"`
+	Responses    int `json:"responses"`
+}
+
+type upstreamResponse struct {
+	URL            string `json:"url"`
+	Healthy        bool   `json:"healthy"`
+	Ejected        bool   `json:"ejected"`
+	ActiveRequests int64  `json:"active_requests"`
+}
+
+type poolResponse struct {
+	Name      string             `json:"name"`
+	Balance   string             `json:"balance"`
+	Upstreams []upstreamResponse `json:"upstreams"`
+}
+
+type poolsResponse struct {
+	Pools []poolResponse `json:"pools"`
+}
+
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, healthResponse{
+		Status:             "ok",
+		UptimeSeconds:      time.Since(s.started).Seconds(),
+		Flows:              s.Flows.Len(),
+		ActiveTunnels:      s.Proxy.ActiveTunnels(),
+		CachedCertificates: s.Proxy.CachedCerts(),
+	})
+}
+
+func (s *Server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	settings := s.Proxy.Settings()
+	writeJSON(w, http.StatusOK, configResponse{
+		Addr:             s.Proxy.Addr,
+		CertDir:          s.Proxy.CertDir,
+		ServerTiming:     settings.ServerTiming,
+		Tracing:          s.Proxy.Tracer != nil,
+		BodyCaptureLimit: settings.BodyCaptureLimit,
+		Recording:        s.Flows.Recording(),
+		FlowHistory:      s.Flows.Capacity(),
+		Rules:            s.rules(),
+	})
+}
+
+// handleReload applies the configuration again. An invalid configuration
+// is rejected with every problem and the running one is kept.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if s.Reload == nil {
+		writeError(w, http.StatusNotImplemented, "reloading is not available")
+		return
+	}
+
+	changes, err := s.Reload()
+	var problems config.Problems
+	switch {
+	case errors.As(err, &problems):
+		resp := reloadErrorResponse{Error: "invalid configuration", Problems: []problemResponse{}}
+		for _, p := range problems {
+			resp.Problems = append(resp.Problems, problemResponse{Location: p.Location, Path: p.Path, Message: p.Message})
+		}
+		writeJSON(w, http.StatusUnprocessableEntity, resp)
+		return
+	case err != nil:
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	resp := reloadResponse{Changes: []changeResponse{}}
+	for _, ch := range changes {
+		resp.Changes = append(resp.Changes, changeResponse{Path: ch.Path, Message: ch.Message})
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Write(schema)
+}
+
+func (s *Server) handleCA(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Header().Set("Content-Disposition", `attachment; filename="nproxy-ca.crt"`)
+	w.Write(s.Proxy.CAPEM())
+}
+
+// handleListFlows lists stored flows, newest first, narrowed by the query
+// parameters host, method, status (e.g. 404 or 5xx), content_type, filter
+// (a filter expression) and limit
+func (s *Server) handleListFlows(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	limit := 100
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a positive integer")
+			return
+		}
+		limit = n
+	}
+
+	match, err := queryFilter(q)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	resp := flowListResponse{Flows: []flow.Summary{}}
+	flows := s.Flows.List()
+	for i := len(flows) - 1; i >= 0; i-- {
+		if !match(flows[i]) {
+			continue
+		}
+		resp.Total++
+		if len(resp.Flows) < limit {
+			resp.Flows = append(resp.Flows, flows[i].Summary())
+		}
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) handleGetFlow(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "flow id must be a positive integer")
+		return
+	}
+	f, ok := s.Flows.Get(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, "flow not found")
+		return
+	}
+	writeJSON(w, http.StatusOK, f)
+}
+
+// streamHeartbeat is how often an idle flow stream sends a comment so that
+// intermediaries and clients don't time the connection out
+var streamHeartbeat = 15 * time.Second
+
+// handleStreamFlows sends the summary of every new flow as a server-sent
+// "flow" event until the client disconnects. It accepts the same filters
+// as handleListFlows.
+func (s *Server) handleStreamFlows(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+	match, err := queryFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	flows, cancel := s.Flows.Subscribe(256)
+	defer cancel()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(streamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case f := <-flows:
+			if !match(f) {
+				continue
+			}
+			data, err := json.Marshal(f.Summary())
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %d\nevent: flow\ndata: %s\n\n", f.ID, data)
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) handleClearFlows(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, clearedResponse{Cleared: s.Flows.Clear()})
+}
+
+func (s *Server) handleListRules(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.rules())
+}
+
+func (s *Server) handleUpdateRule(w http.ResponseWriter, r *http.Request) {
+	var req toggleRequest
+	if err := readJSON(r, &req); err != nil || req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, `body must be {"enabled": true|false}`)
+		return
+	}
+
+	name := r.PathValue("name")
+	if err := s.Proxy.Rules.SetEnabled(name, *req.Enabled); err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, ruleResponse{Name: name, Enabled: *req.Enabled})
+}
+
+func (s *Server) handleGetRecording(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, toggleResponse{Enabled: s.Flows.Recording()})
+}
+
+func (s *Server) handleSetRecording(w http.ResponseWriter, r *http.Request) {
+	var req toggleRequest
+	if err := readJSON(r, &req); err != nil || req.Enabled == nil {
+		writeError(w, http.StatusBadRequest, `body must be {"enabled": true|false}`)
+		return
+	}
+	s.Flows.SetRecording(*req.Enabled)
+	writeJSON(w, http.StatusOK, toggleResponse{Enabled: *req.Enabled})
+}
+
+func (s *Server) handleClearCaches(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, cachesResponse{
+		Certificates: s.Proxy.ClearCertCache(),
+		Responses:    s.Proxy.Cache.Clear(),
+	})
+}
+
+func (s *Server) handleUpstreams(w http.ResponseWriter, r *http.Request) {
+	pools := []poolResponse{}
+	for _, p := range s.Proxy.Settings().Reverse.Status() {
+		pr := poolResponse{Name: p.Name, Balance: p.Balance, Upstreams: []upstreamResponse{}}
+		for _, u := range p.Upstreams {
+			pr.Upstreams = append(pr.Upstreams, upstreamResponse(u))
+		}
+		pools = append(pools, pr)
+	}
+	writeJSON(w, http.StatusOK, poolsResponse{Pools: pools})
+}
+
+func (s *Server) rules() []ruleResponse {
+	rules := []ruleResponse{}
+	for _, rule := range s.Proxy.Rules.List() {
+		rules = append(rules, ruleResponse{Name: rule.Name, Enabled: rule.Enabled, Filter: rule.Filter.String()})
+	}
+	return rules
+}
+
+// queryFilter builds a flow predicate from the list endpoint's parameters.
+// Empty parameters match everything.
+func queryFilter(q url.Values) (func(*flow.Flow) bool, error) {
+	host, method, status, contentType := q.Get("host"), q.Get("method"), q.Get("status"), q.Get("content_type")
+	expr, err := filter.Parse(q.Get("filter"))
+	if err != nil {
+		return nil, err
+	}
+
+	statusMatch := func(int) bool { return true }
+	switch {
+	case status == "":
+	case len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx") && status[0] >= '1' && status[0] <= '5':
+		class := int(status[0] - '0')
+		statusMatch = func(code int) bool { return code/100 == class }
+	default:
+		code, err := strconv.Atoi(status)
+		if err != nil {
+			return nil, errInvalidStatus
+		}
+		statusMatch = func(c int) bool { return c == code }
+	}
+
+	host = strings.ToLower(host)
+	contentType = strings.ToLower(contentType)
+	return func(f *flow.Flow) bool {
+		return strings.Contains(strings.ToLower(f.Host), host) &&
+			(method == "" || strings.EqualFold(f.Method, method)) &&
+			statusMatch(f.Status) &&
+			strings.Contains(f.ContentType(), contentType) &&
+			expr.Match(f)
+	}, nil
+}
+
+var errInvalidStatus = errors.New("status must be a code such as 404 or a class such as 5xx")
@@ -0,0 +1,169 @@
+// Package admin serves the proxy's management interface: Prometheus metrics,
+// a token-protected JSON API for inspecting flows and changing runtime
+// settings, and a web UI built on that API.
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"embed"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"nproxy/app/config"
+	"nproxy/app/flow"
+	"nproxy/app/proxy"
+)
+
+//go:embed schema.json
+var schema []byte
+
+// shutdownTimeout bounds how long Start waits for API requests once its
+// context is done
+const shutdownTimeout = 5 * time.Second
+
+// ui holds the web UI's static assets. They are served without
+// authentication; the UI asks for the token and sends it with API calls.
+//
+//go:embed ui
+var ui embed.FS
+
+// Server is the admin HTTP server for a MITM proxy
+type Server struct {
+	Addr  string
+	Token string // Bearer token required for /api/ endpoints; empty disables authentication
+	Proxy *proxy.MITMProxy
+	Flows *flow.Store
+
+	// Reload re-reads and applies the configuration; nil disables
+	// POST /api/config/reload
+	Reload func() ([]config.Change, error)
+
+	started time.Time
+}
+
+// NewServer creates an admin server for p, reading flows from flows
+func NewServer(addr string, p *proxy.MITMProxy, flows *flow.Store) *Server {
+	return &Server{
+		Addr:    addr,
+		Proxy:   p,
+		Flows:   flows,
+		started: time.Now(),
+	}
+}
+
+// route is an API endpoint; every pattern has an entry in schema.json
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+func (s *Server) routes() []route {
+	return []route{
+		{"GET /api/health", s.handleHealth},
+		{"GET /api/config", s.handleConfig},
+		{"POST /api/config/reload", s.handleReload},
+		{"GET /api/schema", s.handleSchema},
+		{"GET /api/ca.crt", s.handleCA},
+		{"GET /api/flows", s.handleListFlows},
+		{"DELETE /api/flows", s.handleClearFlows},
+		{"GET /api/flows/stream", s.handleStreamFlows},
+		{"GET /api/flows/{id}", s.handleGetFlow},
+		{"GET /api/rules", s.handleListRules},
+		{"PUT /api/rules/{name}", s.handleUpdateRule},
+		{"GET /api/recording", s.handleGetRecording},
+		{"PUT /api/recording", s.handleSetRecording},
+		{"DELETE /api/caches", s.handleClearCaches},
+		{"GET /api/upstreams", s.handleUpstreams},
+	}
+}
+
+// Handler returns the admin routes
+func (s *Server) Handler() http.Handler {
+	api := http.NewServeMux()
+	for _, r := range s.routes() {
+		api.HandleFunc(r.pattern, r.handler)
+	}
+	api.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "unknown endpoint")
+	})
+
+	mux := http.NewServeMux()
+	if s.Proxy.Metrics != nil {
+		mux.Handle("GET /metrics", s.Proxy.Metrics.Registry)
+	}
+	mux.Handle("/api/", s.authenticate(api))
+
+	assets, _ := fs.Sub(ui, "ui")
+	mux.Handle("GET /ui/", http.StripPrefix("/ui/", http.FileServerFS(assets)))
+	mux.Handle("GET /{$}", http.RedirectHandler("/ui/", http.StatusFound))
+	return mux
+}
+
+// Start serves the admin API until ctx is done. Request contexts derive from
+// ctx, so flow streams end as soon as shutdown begins.
+func (s *Server) Start(ctx context.Context) error {
+	if s.Token == "" {
+		log.Printf("Warning: admin API on %s is not protected by a token", s.Addr)
+	}
+	log.Printf("Starting admin server on %s", s.Addr)
+
+	srv := &http.Server{
+		Addr:        s.Addr,
+		Handler:     s.Handler(),
+		BaseContext: func(net.Listener) context.Context { return ctx },
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), shutdownTimeout)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// authenticate rejects requests without the configured bearer token
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Token != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="nproxy admin"`)
+				writeError(w, http.StatusUnauthorized, "missing or invalid token")
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// writeJSON writes v as a JSON response with the given status
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding admin response: %v", err)
+	}
+}
+
+// writeError writes an error response in the API's error format
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, errorResponse{Error: message})
+}
+
+// readJSON decodes a request body into v, rejecting unknown fields
+func readJSON(r *http.Request, v any) error {
+	dec := json.NewDecoder(http.MaxBytesReader(nil, r.Body, 1<<20))
+	dec.DisallowUnknownFields()
+	return dec.Decode(v)
+}
@@ -0,0 +1,559 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+
+	"nproxy/app/cache"
+	"nproxy/app/config"
+	"nproxy/app/flow"
+	"nproxy/app/proxy"
+	"nproxy/app/reverse"
+)
+
+func newTestServer(t *testing.T) (*Server, *flow.Store) {
+	t.Helper()
+
+	p, err := proxy.NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Rules.Add("modify", func(*http.Request, *http.Response) {})
+
+	store := flow.NewStore(100)
+	return NewServer(":0", p, store), store
+}
+
+func addFlow(store *flow.Store, method, url, host string, status int, contentType string) *flow.Flow {
+	f := flow.New(method, url, host)
+	f.Status = status
+	f.ResponseHeader = http.Header{"Content-Type": {contentType}}
+	f.ResponseBody = []byte("body")
+	store.Add(f)
+	return f
+}
+
+// do performs a request against the admin handler and validates the
+// response body against the endpoint's schema
+func do(t *testing.T, s *Server, method, target, body, endpoint string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req := httptest.NewRequest(method, target, reader)
+	if s.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.Token)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if endpoint != "" && rr.Code < 300 && strings.HasPrefix(rr.Header().Get("Content-Type"), "application/json") {
+		validateResponse(t, endpoint, rr.Body.Bytes())
+	}
+	return rr
+}
+
+func TestHealth(t *testing.T) {
+	s, store := newTestServer(t)
+	addFlow(store, "GET", "http://a.example/", "a.example", 200, "text/plain")
+
+	rr := do(t, s, "GET", "/api/health", "", "GET /api/health")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	var health healthResponse
+	json.Unmarshal(rr.Body.Bytes(), &health)
+	if health.Status != "ok" || health.Flows != 1 {
+		t.Errorf("Unexpected health response: %+v", health)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rr := do(t, s, "GET", "/api/config", "", "GET /api/config")
+	var config configResponse
+	json.Unmarshal(rr.Body.Bytes(), &config)
+
+	if config.CertDir != "./certs" || !config.Recording || config.FlowHistory != 100 {
+		t.Errorf("Unexpected config: %+v", config)
+	}
+	if len(config.Rules) != 1 || config.Rules[0].Name != "modify" {
+		t.Errorf("Expected the modify rule in the config, got %+v", config.Rules)
+	}
+}
+
+func TestListFlowsFilters(t *testing.T) {
+	s, store := newTestServer(t)
+	addFlow(store, "GET", "http://api.example/users", "api.example", 200, "application/json")
+	addFlow(store, "POST", "http://api.example/users", "api.example", 503, "application/json")
+	addFlow(store, "GET", "http://cdn.example/logo.png", "cdn.example", 200, "image/png")
+	addFlow(store, "GET", "http://api.example/missing", "api.example", 404, "text/html; charset=utf-8")
+
+	tests := []struct {
+		query    string
+		expected []string
+	}{
+		{"", []string{"GET http://api.example/missing", "GET http://cdn.example/logo.png", "POST http://api.example/users", "GET http://api.example/users"}},
+		{"host=API", []string{"GET http://api.example/missing", "POST http://api.example/users", "GET http://api.example/users"}},
+		{"method=post", []string{"POST http://api.example/users"}},
+		{"status=5xx", []string{"POST http://api.example/users"}},
+		{"status=404", []string{"GET http://api.example/missing"}},
+		{"content_type=image", []string{"GET http://cdn.example/logo.png"}},
+		{"host=api&status=2xx", []string{"GET http://api.example/users"}},
+		{"limit=1", []string{"GET http://api.example/missing"}},
+		{"filter=" + url.QueryEscape(`host ~ "^api\." && status >= 400 && !method GET`), []string{"POST http://api.example/users"}},
+		{"host=api&filter=" + url.QueryEscape(`content_type contains html || status 5xx`), []string{"GET http://api.example/missing", "POST http://api.example/users"}},
+	}
+
+	for _, test := range tests {
+		rr := do(t, s, "GET", "/api/flows?"+test.query, "", "GET /api/flows")
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected status 200, got %d", test.query, rr.Code)
+			continue
+		}
+
+		var list flowListResponse
+		json.Unmarshal(rr.Body.Bytes(), &list)
+
+		var got []string
+		for _, f := range list.Flows {
+			got = append(got, f.Method+" "+f.URL)
+		}
+		if strings.Join(got, ",") != strings.Join(test.expected, ",") {
+			t.Errorf("%s: expected %v, got %v", test.query, test.expected, got)
+		}
+	}
+
+	rr := do(t, s, "GET", "/api/flows?limit=1", "", "")
+	var list flowListResponse
+	json.Unmarshal(rr.Body.Bytes(), &list)
+	if list.Total != 4 {
+		t.Errorf("Expected total of 4 before the limit, got %d", list.Total)
+	}
+}
+
+func TestListFlowsInvalidParameters(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	for _, query := range []string{"limit=0", "limit=abc", "status=abc", "status=9xx", "filter=status+%3E"} {
+		rr := do(t, s, "GET", "/api/flows?"+query, "", "")
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status 400, got %d", query, rr.Code)
+		}
+		validateResponse(t, "Error", rr.Body.Bytes())
+	}
+}
+
+func TestGetFlow(t *testing.T) {
+	s, store := newTestServer(t)
+	f := addFlow(store, "GET", "http://api.example/users", "api.example", 200, "application/json")
+
+	rr := do(t, s, "GET", fmt.Sprintf("/api/flows/%d", f.ID), "", "GET /api/flows/{id}")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", rr.Code)
+	}
+
+	var got flow.Flow
+	json.Unmarshal(rr.Body.Bytes(), &got)
+	if got.ID != f.ID || string(got.ResponseBody) != "body" {
+		t.Errorf("Unexpected flow: %+v", got)
+	}
+
+	if rr := do(t, s, "GET", "/api/flows/999999", "", ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown flow, got %d", rr.Code)
+	}
+	if rr := do(t, s, "GET", "/api/flows/abc", "", ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for invalid id, got %d", rr.Code)
+	}
+}
+
+func TestClearFlows(t *testing.T) {
+	s, store := newTestServer(t)
+	addFlow(store, "GET", "http://a.example/", "a.example", 200, "text/plain")
+	addFlow(store, "GET", "http://b.example/", "b.example", 200, "text/plain")
+
+	rr := do(t, s, "DELETE", "/api/flows", "", "DELETE /api/flows")
+	var cleared clearedResponse
+	json.Unmarshal(rr.Body.Bytes(), &cleared)
+
+	if cleared.Cleared != 2 || store.Len() != 0 {
+		t.Errorf("Expected 2 flows cleared and an empty store, got %d and %d", cleared.Cleared, store.Len())
+	}
+}
+
+func TestRules(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rr := do(t, s, "PUT", "/api/rules/modify", `{"enabled": false}`, "PUT /api/rules/{name}")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+	validateRequest(t, "PUT /api/rules/{name}", []byte(`{"enabled": false}`))
+
+	rr = do(t, s, "GET", "/api/rules", "", "GET /api/rules")
+	var rules []ruleResponse
+	json.Unmarshal(rr.Body.Bytes(), &rules)
+	if len(rules) != 1 || rules[0].Enabled {
+		t.Errorf("Expected the rule to be disabled, got %+v", rules)
+	}
+
+	if rr := do(t, s, "PUT", "/api/rules/missing", `{"enabled": true}`, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404 for unknown rule, got %d", rr.Code)
+	}
+	for _, body := range []string{"", "{}", `{"enabled": "yes"}`, `{"enabled": true, "extra": 1}`} {
+		if rr := do(t, s, "PUT", "/api/rules/modify", body, ""); rr.Code != http.StatusBadRequest {
+			t.Errorf("Body %q: expected status 400, got %d", body, rr.Code)
+		}
+	}
+}
+
+func TestRecording(t *testing.T) {
+	s, store := newTestServer(t)
+
+	rr := do(t, s, "PUT", "/api/recording", `{"enabled": false}`, "PUT /api/recording")
+	if rr.Code != http.StatusOK || store.Recording() {
+		t.Fatalf("Expected recording to be paused, got status %d", rr.Code)
+	}
+
+	rr = do(t, s, "GET", "/api/recording", "", "GET /api/recording")
+	var toggle toggleResponse
+	json.Unmarshal(rr.Body.Bytes(), &toggle)
+	if toggle.Enabled {
+		t.Error("Expected recording to be reported as paused")
+	}
+}
+
+func TestReload(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rr := do(t, s, "POST", "/api/config/reload", "", "")
+	if rr.Code != http.StatusNotImplemented {
+		t.Errorf("Expected status 501 without a reload function, got %d", rr.Code)
+	}
+
+	s.Reload = func() ([]config.Change, error) {
+		return []config.Change{{Path: "logging.filter", Message: `"" -> "status >= 500"`}}, nil
+	}
+	rr = do(t, s, "POST", "/api/config/reload", "", "POST /api/config/reload")
+	var reload reloadResponse
+	json.Unmarshal(rr.Body.Bytes(), &reload)
+	if rr.Code != http.StatusOK || len(reload.Changes) != 1 || reload.Changes[0].Path != "logging.filter" {
+		t.Errorf("Unexpected reload response: %d %s", rr.Code, rr.Body)
+	}
+
+	s.Reload = func() ([]config.Change, error) {
+		return nil, config.Problems{
+			{Location: "nproxy.yaml:3:11", Path: "logging.filter", Message: "filter: column 1: expected a field"},
+			{Location: "environment NPROXY_NOPE", Message: "no setting is named by this variable"},
+		}
+	}
+	rr = do(t, s, "POST", "/api/config/reload", "", "")
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("Expected status 422 for an invalid configuration, got %d", rr.Code)
+	}
+	validateResponse(t, "ReloadError", rr.Body.Bytes())
+	var failed reloadErrorResponse
+	json.Unmarshal(rr.Body.Bytes(), &failed)
+	if len(failed.Problems) != 2 || failed.Problems[0].Location != "nproxy.yaml:3:11" {
+		t.Errorf("Expected every problem to be reported, got %+v", failed)
+	}
+}
+
+func TestClearCaches(t *testing.T) {
+	s, _ := newTestServer(t)
+	c, err := cache.New(cache.Default())
+	if err != nil {
+		t.Fatalf("cache.New: %v", err)
+	}
+	s.Proxy.Cache = c
+	rt := c.Transport(roundTripper(func(r *http.Request) (*http.Response, error) {
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Cache-Control", "max-age=60")
+		return rec.Result(), nil
+	}))
+	resp, err := rt.RoundTrip(httptest.NewRequest("GET", "http://example.test/", nil))
+	if err != nil {
+		t.Fatalf("RoundTrip: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	rr := do(t, s, "DELETE", "/api/caches", "", "DELETE /api/caches")
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", rr.Code)
+	}
+
+	var caches cachesResponse
+	json.Unmarshal(rr.Body.Bytes(), &caches)
+	if caches.Certificates != 0 || s.Proxy.CachedCerts() != 0 {
+		t.Errorf("Expected an empty certificate cache, got %+v", caches)
+	}
+	if entries, _ := c.Stats(); caches.Responses != 1 || entries != 0 {
+		t.Errorf("Expected the stored response dropped, got %+v and %d left", caches, entries)
+	}
+}
+
+// roundTripper is a transport answering through a function
+type roundTripper func(*http.Request) (*http.Response, error)
+
+func (f roundTripper) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func TestUpstreams(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rr := do(t, s, "GET", "/api/upstreams", "", "GET /api/upstreams")
+	if rr.Code != http.StatusOK || strings.TrimSpace(rr.Body.String()) != `{"pools":[]}` {
+		t.Errorf("Expected no pools without a reverse proxy, got %d %s", rr.Code, rr.Body)
+	}
+
+	table, err := reverse.NewTable(nil, []reverse.Pool{{Name: "web", Balance: reverse.LeastConn, Upstreams: []string{"http://10.0.0.5", "http://10.0.0.6"}}})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	s.Proxy.Reload(proxy.Settings{Reverse: table})
+	rr = do(t, s, "GET", "/api/upstreams", "", "GET /api/upstreams")
+	var pools poolsResponse
+	json.Unmarshal(rr.Body.Bytes(), &pools)
+	if len(pools.Pools) != 1 || pools.Pools[0].Balance != "least_conn" || len(pools.Pools[0].Upstreams) != 2 ||
+		pools.Pools[0].Upstreams[1] != (upstreamResponse{URL: "http://10.0.0.6", Healthy: true}) {
+		t.Errorf("Unexpected pools: %+v", pools)
+	}
+}
+
+func TestCA(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rr := do(t, s, "GET", "/api/ca.crt", "", "")
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "-----BEGIN CERTIFICATE-----") {
+		t.Errorf("Expected a PEM certificate, got status %d", rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/x-pem-file" {
+		t.Errorf("Unexpected Content-Type: %s", ct)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Token = "secret"
+
+	// Metrics stay scrapeable without the API token
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "nproxy_requests_total") {
+		t.Errorf("Expected metrics, got status %d", rr.Code)
+	}
+}
+
+func TestTokenAuthentication(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Token = "secret"
+
+	tests := []struct {
+		header   string
+		expected int
+	}{
+		{"", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic c2VjcmV0", http.StatusUnauthorized},
+		{"Bearer secret", http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/api/health", nil)
+		if test.header != "" {
+			req.Header.Set("Authorization", test.header)
+		}
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != test.expected {
+			t.Errorf("Authorization %q: expected status %d, got %d", test.header, test.expected, rr.Code)
+		}
+		if rr.Code == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Authorization %q: expected a WWW-Authenticate challenge", test.header)
+		}
+	}
+}
+
+func TestUnknownEndpoint(t *testing.T) {
+	s, _ := newTestServer(t)
+
+	rr := do(t, s, "GET", "/api/nope", "", "")
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("Expected status 404, got %d", rr.Code)
+	}
+	validateResponse(t, "Error", rr.Body.Bytes())
+}
+
+func TestSchemaCoversEveryRoute(t *testing.T) {
+	s, _ := newTestServer(t)
+	doc := loadSchema(t)
+
+	for _, r := range s.routes() {
+		if _, ok := doc.Endpoints[r.pattern]; !ok {
+			t.Errorf("Route %s has no schema", r.pattern)
+		}
+	}
+	if len(doc.Endpoints) != len(s.routes()) {
+		t.Errorf("Schema documents %d endpoints but %d routes are registered", len(doc.Endpoints), len(s.routes()))
+	}
+
+	rr := do(t, s, "GET", "/api/schema", "", "")
+	if rr.Code != http.StatusOK || rr.Header().Get("Content-Type") != "application/schema+json" {
+		t.Errorf("Unexpected schema response: %d %s", rr.Code, rr.Header().Get("Content-Type"))
+	}
+}
+
+// schemaDoc is the layout of schema.json
+type schemaDoc struct {
+	Endpoints map[string]struct {
+		Request  map[string]any `json:"request"`
+		Response map[string]any `json:"response"`
+	} `json:"endpoints"`
+	Defs map[string]map[string]any `json:"$defs"`
+}
+
+func loadSchema(t *testing.T) schemaDoc {
+	t.Helper()
+	var doc schemaDoc
+	if err := json.Unmarshal(schema, &doc); err != nil {
+		t.Fatalf("schema.json is not valid JSON: %v", err)
+	}
+	return doc
+}
+
+// validateResponse checks body against the response schema of endpoint, or
+// against the named definition when endpoint is not a route
+func validateResponse(t *testing.T, endpoint string, body []byte) {
+	t.Helper()
+	doc := loadSchema(t)
+
+	s := doc.Defs[endpoint]
+	if e, ok := doc.Endpoints[endpoint]; ok {
+		s = e.Response
+	}
+	validate(t, doc, endpoint, s, body)
+}
+
+// validateRequest checks body against the request schema of endpoint
+func validateRequest(t *testing.T, endpoint string, body []byte) {
+	t.Helper()
+	doc := loadSchema(t)
+	validate(t, doc, endpoint, doc.Endpoints[endpoint].Request, body)
+}
+
+func validate(t *testing.T, doc schemaDoc, name string, s map[string]any, body []byte) {
+	t.Helper()
+	if s == nil {
+		t.Fatalf("No schema for %s", name)
+	}
+
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		t.Fatalf("%s: response is not JSON: %v", name, err)
+	}
+	for _, problem := range checkSchema(doc, s, v, "$") {
+		t.Errorf("%s: %s", name, problem)
+	}
+}
+
+var refPattern = regexp.MustCompile(`^#/\$defs/(\w+)$`)
+
+// checkSchema implements the subset of JSON Schema used by schema.json:
+// $ref, type, enum, properties, required, additionalProperties and items
+func checkSchema(doc schemaDoc, s map[string]any, v any, path string) []string {
+	if ref, ok := s["$ref"].(string); ok {
+		m := refPattern.FindStringSubmatch(ref)
+		if m == nil || doc.Defs[m[1]] == nil {
+			return []string{path + ": unresolvable $ref " + ref}
+		}
+		return checkSchema(doc, doc.Defs[m[1]], v, path)
+	}
+
+	var problems []string
+	if typ, ok := s["type"].(string); ok && !hasType(v, typ) {
+		return []string{fmt.Sprintf("%s: expected %s, got %T", path, typ, v)}
+	}
+	if enum, ok := s["enum"].([]any); ok {
+		found := false
+		for _, e := range enum {
+			found = found || e == v
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("%s: %v not in %v", path, v, enum))
+		}
+	}
+
+	switch val := v.(type) {
+	case map[string]any:
+		props, _ := s["properties"].(map[string]any)
+		for _, r := range asSlice(s["required"]) {
+			if _, ok := val[r.(string)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing required property %s", path, r))
+			}
+		}
+		for key, child := range val {
+			if ps, ok := props[key].(map[string]any); ok {
+				problems = append(problems, checkSchema(doc, ps, child, path+"."+key)...)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					problems = append(problems, fmt.Sprintf("%s: unexpected property %s", path, key))
+				}
+			case map[string]any:
+				problems = append(problems, checkSchema(doc, extra, child, path+"."+key)...)
+			}
+		}
+	case []any:
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, child := range val {
+				problems = append(problems, checkSchema(doc, items, child, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+	}
+	return problems
+}
+
+func hasType(v any, typ string) bool {
+	switch typ {
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "string":
+		_, ok := v.(string)
+		return ok
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		n, ok := v.(float64)
+		return ok && n == float64(int64(n))
+	}
+	return false
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
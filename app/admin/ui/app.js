@@ -0,0 +1,446 @@
+// nproxy web UI. Talks to the admin API with the bearer token kept in
+// localStorage and streams new flows from /api/flows/stream. The stream is
+// read with fetch rather than EventSource so the token never has to appear
+// in a URL.
+"use strict";
+
+const api = "../api";
+const maxRows = 5000;
+const phases = [
+  ["client_read", "Client read"],
+  ["dns", "DNS"],
+  ["connect", "Connect"],
+  ["tls", "TLS"],
+  ["request_write", "Request write"],
+  ["ttfb", "Waiting (TTFB)"],
+  ["body_transfer", "Body transfer"],
+  ["handler", "Handler"],
+];
+
+const state = {
+  token: localStorage.getItem("nproxy.token") || "",
+  flows: [],
+  selected: null,
+  detail: null,
+  paused: false,
+  pending: [],
+  expr: "", // filter expression applied by the server
+  abort: null, // aborts the current stream so it reconnects with a new filter
+};
+
+const $ = (id) => document.getElementById(id);
+
+function el(tag, attrs, ...children) {
+  const node = document.createElement(tag);
+  for (const [k, v] of Object.entries(attrs || {})) {
+    if (k === "class") node.className = v;
+    else node.setAttribute(k, v);
+  }
+  for (const c of children) {
+    if (c != null) node.append(c);
+  }
+  return node;
+}
+
+// request calls the admin API, asking for the token again on 401
+async function request(path, options = {}) {
+  const headers = new Headers(options.headers);
+  if (state.token) headers.set("Authorization", "Bearer " + state.token);
+  const resp = await fetch(api + path, { ...options, headers });
+  if (resp.status === 401) {
+    await login();
+    return request(path, options);
+  }
+  if (!resp.ok) {
+    const body = await resp.json().catch(() => ({}));
+    throw new Error(body.error || resp.statusText);
+  }
+  return resp;
+}
+
+function login() {
+  return new Promise((resolve) => {
+    const dialog = $("login");
+    dialog.addEventListener("close", () => {
+      state.token = $("token").value;
+      localStorage.setItem("nproxy.token", state.token);
+      resolve();
+    }, { once: true });
+    dialog.showModal();
+  });
+}
+
+function setStatus(text, cls) {
+  const s = $("status");
+  s.textContent = text;
+  s.className = "status " + (cls || "");
+}
+
+// Flow list
+
+// exprQuery returns the query string for the server-side filter expression
+function exprQuery(sep) {
+  return state.expr ? sep + "filter=" + encodeURIComponent(state.expr) : "";
+}
+
+async function loadFlows() {
+  const resp = await request("/flows?limit=500" + exprQuery("&"));
+  const body = await resp.json();
+  state.flows = body.flows.reverse();
+  render();
+}
+
+function addFlow(summary) {
+  if (state.paused) {
+    state.pending.push(summary);
+    setStatus(`paused (${state.pending.length})`);
+    return;
+  }
+  state.flows.push(summary);
+  if (state.flows.length > maxRows) state.flows.shift();
+  if (matches(summary)) $("flows").prepend(row(summary));
+}
+
+function filters() {
+  return {
+    host: $("filter-host").value.trim().toLowerCase(),
+    status: $("filter-status").value.trim().toLowerCase(),
+    method: $("filter-method").value,
+    type: $("filter-type").value.trim().toLowerCase(),
+  };
+}
+
+function matches(f, flt = filters()) {
+  if (flt.host && !f.host.toLowerCase().includes(flt.host)) return false;
+  if (flt.method && f.method !== flt.method) return false;
+  if (flt.type && !(f.content_type || "").includes(flt.type)) return false;
+  if (flt.status) {
+    const code = String(f.status);
+    if (/^[1-5]xx$/.test(flt.status)) {
+      if (code[0] !== flt.status[0]) return false;
+    } else if (code !== flt.status) {
+      return false;
+    }
+  }
+  return true;
+}
+
+function render() {
+  const flt = filters();
+  const body = $("flows");
+  const rows = [];
+  for (let i = state.flows.length - 1; i >= 0; i--) {
+    if (matches(state.flows[i], flt)) rows.push(row(state.flows[i]));
+  }
+  body.replaceChildren(...rows);
+}
+
+function row(f) {
+  let path = f.url;
+  try {
+    const u = new URL(f.url);
+    path = u.pathname + u.search;
+  } catch (e) {
+    // keep the raw URL
+  }
+  const tr = el("tr", { "data-id": f.id },
+    el("td", { class: "num" }, String(f.id)),
+    el("td", {}, f.method),
+    el("td", { class: "s" + Math.floor(f.status / 100) }, f.status ? String(f.status) : "—"),
+    el("td", {}, f.host),
+    el("td", { title: f.url }, path),
+    el("td", {}, f.content_type || ""),
+    el("td", { class: "num" }, formatBytes(f.response_size)),
+    el("td", { class: "num" }, formatDuration(f.duration)),
+  );
+  if (f.id === state.selected) tr.classList.add("selected");
+  if (f.error) tr.title = f.error;
+  return tr;
+}
+
+// Live stream
+
+async function stream() {
+  for (;;) {
+    const controller = new AbortController();
+    state.abort = controller;
+    try {
+      const resp = await request("/flows/stream" + exprQuery("?"), {
+        headers: { Accept: "text/event-stream" },
+        signal: controller.signal,
+      });
+      setStatus("live", "live");
+      await readEvents(resp.body, (event, data) => {
+        if (event === "flow") addFlow(JSON.parse(data));
+      });
+    } catch (e) {
+      if (controller.signal.aborted) continue;
+      console.error(e);
+    }
+    setStatus("reconnecting…", "error");
+    await new Promise((r) => setTimeout(r, 2000));
+  }
+}
+
+// readEvents parses a text/event-stream body, calling onEvent per event
+async function readEvents(body, onEvent) {
+  const reader = body.pipeThrough(new TextDecoderStream()).getReader();
+  let buf = "";
+  for (;;) {
+    const { value, done } = await reader.read();
+    if (done) return;
+    buf += value.replace(/\r\n?/g, "\n");
+    let end;
+    while ((end = buf.indexOf("\n\n")) >= 0) {
+      const block = buf.slice(0, end);
+      buf = buf.slice(end + 2);
+      let event = "message";
+      const data = [];
+      for (const line of block.split("\n")) {
+        if (line.startsWith(":")) continue;
+        const i = line.indexOf(":");
+        const field = i < 0 ? line : line.slice(0, i);
+        const val = i < 0 ? "" : line.slice(i + 1).replace(/^ /, "");
+        if (field === "event") event = val;
+        else if (field === "data") data.push(val);
+      }
+      if (data.length) onEvent(event, data.join("\n"));
+    }
+  }
+}
+
+// Detail pane
+
+async function select(id) {
+  state.selected = id;
+  for (const tr of document.querySelectorAll("#flows tr")) {
+    tr.classList.toggle("selected", Number(tr.dataset.id) === id);
+  }
+  let f;
+  try {
+    f = await (await request("/flows/" + id)).json();
+  } catch (e) {
+    setStatus(e.message, "error");
+    return;
+  }
+  if (state.selected !== id) return;
+  state.detail = f;
+
+  $("detail").hidden = false;
+  $("detail-title").textContent = `${f.method} ${f.url}`;
+  $("tab-request").replaceChildren(
+    section("Headers", headers(f.request_header)),
+    section("Body", bodyView(f.request_body, f.request_header, f.request_size, f.request_truncated)),
+  );
+  $("tab-response").replaceChildren(
+    f.error ? section("Error", el("pre", {}, f.error)) : null,
+    section("Status", String(f.status || "—")),
+    section("Headers", headers(f.response_header)),
+    section("Body", bodyView(f.response_body, f.response_header, f.response_size, f.response_truncated)),
+  );
+  $("tab-timing").replaceChildren(waterfall(f.timings));
+}
+
+function section(title, content) {
+  return el("div", {}, el("h3", {}, title), content);
+}
+
+function headers(h) {
+  if (!h || !Object.keys(h).length) return el("p", { class: "note" }, "No headers");
+  const dl = el("dl", { class: "headers" });
+  for (const name of Object.keys(h).sort()) {
+    for (const v of h[name]) dl.append(el("dt", {}, name), el("dd", {}, v));
+  }
+  return dl;
+}
+
+function headerValue(h, name) {
+  if (!h) return "";
+  for (const k of Object.keys(h)) {
+    if (k.toLowerCase() === name) return h[k][0] || "";
+  }
+  return "";
+}
+
+// bodyView renders a captured body (base64 in the API) by media type
+function bodyView(b64, h, size, truncated) {
+  if (!b64) return el("p", { class: "note" }, size ? `${formatBytes(size)} not captured` : "No body");
+  const type = headerValue(h, "content-type").split(";")[0].trim().toLowerCase();
+  const note = truncated ? el("p", { class: "note" }, `Showing the first ${formatBytes(atob(b64).length)} of ${formatBytes(size)}`) : null;
+
+  if (type.startsWith("image/") && !truncated) {
+    return el("div", {}, el("img", { class: "body-image", src: `data:${type};base64,${b64}`, alt: "" }));
+  }
+  const text = decodeText(b64);
+  if (text == null) return el("div", {}, note, el("p", { class: "note" }, `Binary ${type || "data"}, ${formatBytes(size)}`));
+
+  let pretty = text;
+  if (type.includes("json")) {
+    try {
+      pretty = JSON.stringify(JSON.parse(text), null, 2);
+    } catch (e) {
+      // show as received, e.g. when truncated
+    }
+  } else if (type.includes("html") || type.includes("xml")) {
+    pretty = indentMarkup(text);
+  }
+  return el("div", {}, note, el("pre", {}, pretty));
+}
+
+function decodeText(b64) {
+  const bytes = Uint8Array.from(atob(b64), (c) => c.charCodeAt(0));
+  try {
+    return new TextDecoder("utf-8", { fatal: true }).decode(bytes);
+  } catch (e) {
+    return null;
+  }
+}
+
+// indentMarkup puts each tag on its own line, indented by nesting depth
+function indentMarkup(src) {
+  const voids = /^<(area|base|br|col|embed|hr|img|input|link|meta|source|track|wbr|!|\?)/i;
+  const out = [];
+  let depth = 0;
+  for (const token of src.replace(/>\s*</g, ">\n<").split("\n")) {
+    const t = token.trim();
+    if (!t) continue;
+    if (/^<\//.test(t)) depth = Math.max(0, depth - 1);
+    out.push("  ".repeat(depth) + t);
+    if (/^<[^/]/.test(t) && !voids.test(t) && !/\/>$/.test(t) && !/<\/[^>]+>$/.test(t)) depth++;
+  }
+  return out.join("\n");
+}
+
+function waterfall(t) {
+  const total = t.total || 1;
+  const grid = el("div", { class: "waterfall" });
+  let offset = 0;
+  for (const [key, label] of phases) {
+    const d = t[key] || 0;
+    if (!d) continue;
+    const bar = el("div", { class: "bar " + key.replace("_", "-") });
+    bar.style.left = (100 * Math.min(offset, total)) / total + "%";
+    bar.style.width = (100 * Math.min(d, total - Math.min(offset, total))) / total + "%";
+    grid.append(el("span", {}, label), el("div", { class: "track" }, bar), el("span", { class: "num" }, formatDuration(d)));
+    // The handler runs alongside the exchange, the rest happen in sequence
+    if (key !== "handler") offset += d;
+  }
+  const bar = el("div", { class: "bar total" });
+  bar.style.left = "0";
+  bar.style.width = "100%";
+  grid.append(el("strong", {}, "Total"), el("div", { class: "track" }, bar), el("strong", { class: "num" }, formatDuration(t.total)));
+  return el("div", {},
+    grid,
+    el("p", { class: "note" }, "Phases can overlap when bodies are streamed, so they need not add up to the total."),
+  );
+}
+
+// curl builds a shell command reproducing the captured request
+function curl(f) {
+  const quote = (s) => "'" + String(s).replace(/'/g, "'\\''") + "'";
+  const parts = ["curl", "-X", f.method, quote(f.url)];
+  const skip = new Set(["content-length", "connection", "proxy-connection", "accept-encoding", "traceparent", "tracestate"]);
+  for (const [name, values] of Object.entries(f.request_header || {})) {
+    if (skip.has(name.toLowerCase())) continue;
+    for (const v of values) parts.push("-H", quote(`${name}: ${v}`));
+  }
+  if (f.request_body) {
+    const text = decodeText(f.request_body);
+    if (text != null) parts.push("--data-binary", quote(text));
+  }
+  return parts.join(" ");
+}
+
+function formatBytes(n) {
+  if (!n) return "0 B";
+  const units = ["B", "KB", "MB", "GB"];
+  let i = 0;
+  while (n >= 1024 && i < units.length - 1) {
+    n /= 1024;
+    i++;
+  }
+  return (i ? n.toFixed(1) : n) + " " + units[i];
+}
+
+// formatDuration formats nanoseconds from the API
+function formatDuration(ns) {
+  if (!ns) return "—";
+  const ms = ns / 1e6;
+  if (ms < 1) return Math.round(ns / 1e3) + " µs";
+  if (ms < 1000) return ms.toFixed(1) + " ms";
+  return (ms / 1000).toFixed(2) + " s";
+}
+
+// Wiring
+
+$("flows").addEventListener("click", (e) => {
+  const tr = e.target.closest("tr");
+  if (tr) select(Number(tr.dataset.id));
+});
+$("filters").addEventListener("input", render);
+$("filter-expr").addEventListener("change", async () => {
+  const input = $("filter-expr");
+  const previous = state.expr;
+  state.expr = input.value.trim();
+  try {
+    await loadFlows();
+  } catch (e) {
+    // Keep streaming with the last valid expression
+    state.expr = previous;
+    input.classList.add("invalid");
+    input.title = e.message;
+    setStatus("invalid filter", "error");
+    return;
+  }
+  input.classList.remove("invalid");
+  input.title = "Filter expression, applied by the server. Press Enter to apply.";
+  if (state.abort) state.abort.abort();
+});
+$("filters").addEventListener("submit", (e) => e.preventDefault());
+$("pause").addEventListener("click", () => {
+  state.paused = !state.paused;
+  $("pause").textContent = state.paused ? "Resume" : "Pause";
+  if (!state.paused) {
+    const pending = state.pending;
+    state.pending = [];
+    setStatus("live", "live");
+    pending.forEach(addFlow);
+  } else {
+    setStatus("paused");
+  }
+});
+$("clear").addEventListener("click", async () => {
+  await request("/flows", { method: "DELETE" });
+  state.flows = [];
+  state.pending = [];
+  render();
+});
+$("close-detail").addEventListener("click", () => {
+  $("detail").hidden = true;
+  state.selected = null;
+  render();
+});
+$("copy-curl").addEventListener("click", async () => {
+  if (!state.detail) return;
+  await navigator.clipboard.writeText(curl(state.detail));
+  $("copy-curl").textContent = "Copied";
+  setTimeout(() => ($("copy-curl").textContent = "Copy as curl"), 1500);
+});
+for (const btn of document.querySelectorAll("#detail nav [data-tab]")) {
+  btn.addEventListener("click", () => {
+    for (const b of document.querySelectorAll("#detail nav [data-tab]")) {
+      b.classList.toggle("active", b === btn);
+      $("tab-" + b.dataset.tab).hidden = b !== btn;
+    }
+  });
+}
+$("ca-link").addEventListener("click", async (e) => {
+  // The CA endpoint needs the token too, so download it through fetch
+  e.preventDefault();
+  const blob = await (await request("/ca.crt")).blob();
+  const a = el("a", { href: URL.createObjectURL(blob), download: "nproxy-ca.crt" });
+  a.click();
+  URL.revokeObjectURL(a.href);
+});
+
+loadFlows().then(stream).catch((e) => setStatus(e.message, "error"));
@@ -0,0 +1,131 @@
+package admin
+
+import (
+	"bufio"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUIServed(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Token = "secret"
+
+	tests := []struct {
+		path        string
+		contentType string
+	}{
+		{"/ui/", "text/html"},
+		{"/ui/app.js", "text/javascript"},
+		{"/ui/app.css", "text/css"},
+	}
+	for _, tt := range tests {
+		// The static assets load without a token; the API calls carry it
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", tt.path, nil))
+		if rr.Code != http.StatusOK {
+			t.Errorf("GET %s: expected status 200, got %d", tt.path, rr.Code)
+			continue
+		}
+		if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.contentType) {
+			t.Errorf("GET %s: expected content type %s, got %s", tt.path, tt.contentType, ct)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusFound || rr.Header().Get("Location") != "/ui/" {
+		t.Errorf("Expected / to redirect to /ui/, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+}
+
+var externalRef = regexp.MustCompile(`(?i)(src|href)\s*=\s*["']?(https?:)?//|url\(\s*["']?(https?:)?//|@import`)
+
+func TestUIHasNoExternalAssets(t *testing.T) {
+	err := fs.WalkDir(ui, "ui", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(ui, path)
+		if err != nil {
+			return err
+		}
+		if m := externalRef.Find(data); m != nil {
+			t.Errorf("%s references an external asset: %s", path, m)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestStreamFlows(t *testing.T) {
+	s, store := newTestServer(t)
+	s.Token = "secret"
+	streamHeartbeat = 20 * time.Millisecond
+	defer func() { streamHeartbeat = 15 * time.Second }()
+
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL+"/api/flows/stream?filter=status+5xx", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Failed to open stream: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Expected text/event-stream, got %s", ct)
+	}
+
+	// The subscription exists once the connected comment has been sent
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != ": connected" {
+		t.Fatalf("Expected connected comment, got %q", lines.Text())
+	}
+	addFlow(store, "GET", "https://a.example/ok", "a.example", 200, "application/json")
+	f := addFlow(store, "GET", "https://a.example/x", "a.example", 503, "application/json")
+
+	var event, data string
+	heartbeats := 0
+	for lines.Scan() {
+		line := lines.Text()
+		switch {
+		case line == ": heartbeat":
+			heartbeats++
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = strings.TrimPrefix(line, "data: ")
+		}
+		if data != "" && heartbeats > 0 {
+			break
+		}
+	}
+
+	if event != "flow" {
+		t.Errorf("Expected a flow event, got %q", event)
+	}
+	validateResponse(t, "GET /api/flows/stream", []byte(data))
+	if !strings.Contains(data, `"status":503`) || !strings.Contains(data, `"host":"a.example"`) {
+		t.Errorf("Event does not describe flow %d: %s", f.ID, data)
+	}
+}
+
+func TestStreamFlowsRequiresToken(t *testing.T) {
+	s, _ := newTestServer(t)
+	s.Token = "secret"
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, httptest.NewRequest("GET", "/api/flows/stream", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status 401, got %d", rr.Code)
+	}
+}
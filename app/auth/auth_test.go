@@ -0,0 +1,185 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestSHACrypt(t *testing.T) {
+	// Vectors from the SHA-crypt specification, also produced by openssl passwd
+	tests := []string{
+		"$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5",
+		"$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA",
+		"$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+		"$6$rounds=10000$saltstringsaltst$OW1/O6BYHV6BcXZu8QVeXbDWra3Oeqh0sbHbbMCVNSnCM/UrjmM0Dp8vOuZeHBy/YTBmSK6H9qs/y3RnOaw5v.",
+	}
+	for _, want := range tests {
+		c, err := parseSHACrypt(want)
+		if err != nil {
+			t.Fatalf("parseSHACrypt(%q): %v", want, err)
+		}
+		if got := c.hash("Hello world!"); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+}
+
+func TestSHACryptLongSaltIsTruncated(t *testing.T) {
+	c, err := parseSHACrypt("$5$saltstringsaltstring$x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.salt != "saltstringsaltst" {
+		t.Errorf("Expected the salt to be cut to 16 characters, got %q", c.salt)
+	}
+}
+
+func bcryptHash(t *testing.T, password string) string {
+	t.Helper()
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+func TestHtpasswdVerify(t *testing.T) {
+	file := strings.Join([]string{
+		"# office users",
+		"alice:" + bcryptHash(t, "wonderland"),
+		"",
+		"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=",
+		"carol:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1",
+	}, "\n")
+	h, err := ParseHtpasswd(strings.NewReader(file), "users")
+	if err != nil {
+		t.Fatalf("Failed to parse: %v", err)
+	}
+	if h.Len() != 3 {
+		t.Errorf("Expected 3 users, got %d", h.Len())
+	}
+
+	tests := []struct {
+		user, password string
+		want           bool
+	}{
+		{"alice", "wonderland", true},
+		{"alice", "wonderland", true}, // from the cache
+		{"alice", "looking-glass", false},
+		{"bob", "secret", true},
+		{"bob", "Secret", false},
+		{"carol", "Hello world!", true},
+		{"carol", "Hello world", false},
+		{"dave", "", false},
+	}
+	for _, tt := range tests {
+		if got := h.Verify(tt.user, tt.password); got != tt.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tt.user, tt.password, got, tt.want)
+		}
+	}
+
+	// Expired verifications are checked against the hash again and
+	// dropped once another succeeds
+	for mac := range h.verified {
+		h.verified[mac] = time.Now().Add(-time.Second)
+	}
+	h.verified[[32]byte{}] = time.Now().Add(-time.Second)
+	if h.Verify("alice", "looking-glass") || !h.Verify("alice", "wonderland") {
+		t.Error("Expected an expired verification to be checked against the hash")
+	}
+	if len(h.verified) != 1 {
+		t.Errorf("Expected 1 remembered verification, got %d", len(h.verified))
+	}
+}
+
+func TestParseHtpasswdErrors(t *testing.T) {
+	tests := []struct {
+		file string
+		want string
+	}{
+		{"alice", "users:1: expected user:hash"},
+		{"\n:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", "users:2: expected user:hash"},
+		{"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\nbob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=", `users:2: user "bob" is listed twice`},
+		{"bob:{SHA}nope", `users:1: user "bob": malformed {SHA} hash`},
+		{"bob:$apr1$salt$hash", `users:1: user "bob": MD5 hashes are not supported; use bcrypt (htpasswd -B)`},
+		{"bob:plain", `users:1: user "bob": unsupported hash`},
+		{"bob:$6$rounds=many$salt$hash", `users:1: user "bob": malformed SHA-crypt rounds "many"`},
+	}
+	for _, tt := range tests {
+		_, err := ParseHtpasswd(strings.NewReader(tt.file), "users")
+		if err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseHtpasswd(%q): expected error starting %q, got %v", tt.file, tt.want, err)
+		}
+	}
+}
+
+func basicRequest(credentials string) *http.Request {
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	if credentials != "" {
+		r.Header.Set("Proxy-Authorization", credentials)
+	}
+	return r
+}
+
+func encode(user, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(user+":"+password))
+}
+
+func TestBasicAuthenticate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := os.WriteFile(path, []byte("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	b, err := NewBasic(path, "")
+	if err != nil {
+		t.Fatalf("NewBasic: %v", err)
+	}
+	if b.Realm != DefaultRealm {
+		t.Errorf("Expected the default realm, got %q", b.Realm)
+	}
+
+	if user, err := b.Authenticate(basicRequest(encode("bob", "secret"))); err != nil || user != "bob" {
+		t.Errorf("Expected bob to authenticate, got %q, %v", user, err)
+	}
+	tests := []struct {
+		credentials string
+		want        error
+	}{
+		{"", ErrNoCredentials},
+		{encode("bob", "wrong"), ErrInvalidCredentials},
+		{encode("eve", "secret"), ErrInvalidCredentials},
+		{"Bearer token", ErrInvalidCredentials},
+		{"Basic !!!", ErrInvalidCredentials},
+		{"Basic " + base64.StdEncoding.EncodeToString([]byte("bob")), ErrInvalidCredentials},
+	}
+	for _, tt := range tests {
+		if _, err := b.Authenticate(basicRequest(tt.credentials)); !errors.Is(err, tt.want) {
+			t.Errorf("Authenticate(%q): expected %v, got %v", tt.credentials, tt.want, err)
+		}
+	}
+
+	var none *Basic
+	if user, err := none.Authenticate(basicRequest("")); err != nil || user != "" {
+		t.Errorf("Expected a nil *Basic to accept anonymous clients, got %q, %v", user, err)
+	}
+}
+
+func TestBasicChallenge(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Basic{Realm: "office"}).Challenge(w)
+	if w.Code != http.StatusProxyAuthRequired {
+		t.Errorf("Expected 407, got %d", w.Code)
+	}
+	if got, want := w.Header().Get("Proxy-Authenticate"), `Basic realm="office", charset="UTF-8"`; got != want {
+		t.Errorf("Expected Proxy-Authenticate %s, got %s", want, got)
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// DefaultRealm is the realm announced when none is configured
+const DefaultRealm = "nproxy"
+
+var (
+	// ErrNoCredentials means the request had no Proxy-Authorization header
+	ErrNoCredentials = errors.New("no credentials")
+	// ErrInvalidCredentials means the credentials were malformed or wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+)
+
+// Basic authenticates proxy clients with Basic credentials in the
+// Proxy-Authorization header (RFC 9110, section 11.7.1). All methods are
+// safe to call on a nil *Basic, which accepts every client anonymously.
+type Basic struct {
+	Realm string
+	Users *Htpasswd
+}
+
+// NewBasic creates a Basic authenticator for the users in the htpasswd file
+// at path
+func NewBasic(path, realm string) (*Basic, error) {
+	users, err := LoadHtpasswd(path)
+	if err != nil {
+		return nil, err
+	}
+	if realm == "" {
+		realm = DefaultRealm
+	}
+	return &Basic{Realm: realm, Users: users}, nil
+}
+
+// Authenticate returns the user named by r's Proxy-Authorization header.
+// The error wraps ErrNoCredentials or ErrInvalidCredentials.
+func (b *Basic) Authenticate(r *http.Request) (string, error) {
+	if b == nil {
+		return "", nil
+	}
+	header := r.Header.Get("Proxy-Authorization")
+	if header == "" {
+		return "", ErrNoCredentials
+	}
+	scheme, encoded, _ := strings.Cut(header, " ")
+	if !strings.EqualFold(scheme, "Basic") {
+		return "", fmt.Errorf("%w: unsupported scheme %q", ErrInvalidCredentials, scheme)
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return "", fmt.Errorf("%w: malformed Basic credentials", ErrInvalidCredentials)
+	}
+	user, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", fmt.Errorf("%w: malformed Basic credentials", ErrInvalidCredentials)
+	}
+	if !b.Users.Verify(user, password) {
+		return "", fmt.Errorf("%w: wrong user name or password for %q", ErrInvalidCredentials, user)
+	}
+	return user, nil
+}
+
+// Challenge responds with 407 Proxy Authentication Required, asking the
+// client for credentials
+func (b *Basic) Challenge(w http.ResponseWriter) {
+	realm := DefaultRealm
+	if b != nil && b.Realm != "" {
+		realm = b.Realm
+	}
+	w.Header().Set("Proxy-Authenticate", "Basic realm="+strconv.Quote(realm)+`, charset="UTF-8"`)
+	http.Error(w, "Proxy authentication required", http.StatusProxyAuthRequired)
+}
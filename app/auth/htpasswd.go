@@ -0,0 +1,178 @@
+// Package auth authenticates proxy clients with Basic credentials checked
+// against an htpasswd file.
+package auth
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd is a set of users and password hashes in the format written by
+// Apache's htpasswd. Supported hashes are bcrypt ($2a$, $2b$, $2y$; htpasswd
+// -B), SHA-256 and SHA-512 crypt ($5$, $6$; htpasswd -2 and -5 or openssl
+// passwd -5 and -6) and unsalted SHA-1 ({SHA}; htpasswd -s).
+type Htpasswd struct {
+	users map[string]string // hash by user name
+
+	// Recent successful verifications, so that bcrypt's deliberately slow
+	// hashing doesn't run on every request. They are kept as HMACs of the
+	// user and password under a key that never leaves the process, and
+	// expire after verifiedTTL.
+	mu       sync.Mutex
+	key      []byte
+	verified map[[sha256.Size]byte]time.Time
+}
+
+// verifiedTTL is how long a successful verification is remembered
+const verifiedTTL = time.Minute
+
+// unknownUserHash is checked for users that aren't in the file, so that
+// they take as long to refuse as a wrong password. Its cost is htpasswd
+// -B's default.
+const unknownUserHash = "$2a$05$SQU8SVZgPEz00EikrN0y2edbS5rl84mJGjM6WNXTEYPnYtqFd2PvS"
+
+// LoadHtpasswd reads an htpasswd file
+func LoadHtpasswd(path string) (*Htpasswd, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseHtpasswd(f, path)
+}
+
+// ParseHtpasswd reads "user:hash" lines from r. Blank lines and lines
+// starting with # are ignored. Errors are prefixed with name and the line
+// number.
+func ParseHtpasswd(r io.Reader, name string) (*Htpasswd, error) {
+	h := &Htpasswd{users: make(map[string]string), key: make([]byte, sha256.Size)}
+	if _, err := rand.Read(h.key); err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		switch {
+		case !ok || user == "":
+			return nil, fmt.Errorf("%s:%d: expected user:hash", name, n)
+		case h.users[user] != "":
+			return nil, fmt.Errorf("%s:%d: user %q is listed twice", name, n, user)
+		}
+		if err := checkHash(hash); err != nil {
+			return nil, fmt.Errorf("%s:%d: user %q: %v", name, n, user, err)
+		}
+		h.users[user] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return h, nil
+}
+
+// Len returns the number of users
+func (h *Htpasswd) Len() int {
+	return len(h.users)
+}
+
+// Verify reports whether password is user's password
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := h.users[user]
+	if !ok {
+		verifyHash(unknownUserHash, password)
+		return false
+	}
+	mac := h.mac(user, password)
+	now := time.Now()
+
+	h.mu.Lock()
+	expires, cached := h.verified[mac]
+	h.mu.Unlock()
+	if cached && now.Before(expires) {
+		return true
+	}
+
+	if !verifyHash(hash, password) {
+		return false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.verified == nil {
+		h.verified = make(map[[sha256.Size]byte]time.Time)
+	}
+	for k, expires := range h.verified {
+		if !now.Before(expires) {
+			delete(h.verified, k)
+		}
+	}
+	h.verified[mac] = now.Add(verifiedTTL)
+	return true
+}
+
+// mac returns the HMAC of user and password under h's key
+func (h *Htpasswd) mac(user, password string) [sha256.Size]byte {
+	m := hmac.New(sha256.New, h.key)
+	// Users in the file have no colon, so the first one ends the user
+	m.Write([]byte(user + ":" + password))
+	var sum [sha256.Size]byte
+	m.Sum(sum[:0])
+	return sum
+}
+
+// checkHash rejects hashes that verifyHash can't check
+func checkHash(hash string) error {
+	switch {
+	case isBcrypt(hash):
+		_, err := bcrypt.Cost([]byte(hash))
+		return err
+	case strings.HasPrefix(hash, "$5$"), strings.HasPrefix(hash, "$6$"):
+		_, err := parseSHACrypt(hash)
+		return err
+	case strings.HasPrefix(hash, "{SHA}"):
+		if sum, err := base64.StdEncoding.DecodeString(hash[len("{SHA}"):]); err != nil || len(sum) != sha1.Size {
+			return fmt.Errorf("malformed {SHA} hash")
+		}
+		return nil
+	case strings.HasPrefix(hash, "$apr1$"):
+		return fmt.Errorf("MD5 hashes are not supported; use bcrypt (htpasswd -B)")
+	default:
+		return fmt.Errorf("unsupported hash; use bcrypt (htpasswd -B), SHA-256/512 crypt ($5$, $6$) or {SHA}")
+	}
+}
+
+func verifyHash(hash, password string) bool {
+	switch {
+	case isBcrypt(hash):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		want := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(want), []byte(hash[len("{SHA}"):])) == 1
+	default:
+		c, err := parseSHACrypt(hash)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(c.hash(password)), []byte(hash)) == 1
+	}
+}
+
+func isBcrypt(hash string) bool {
+	return strings.HasPrefix(hash, "$2a$") || strings.HasPrefix(hash, "$2b$") || strings.HasPrefix(hash, "$2y$")
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt as specified by Ulrich Drepper in "Unix crypt using SHA-256 and
+// SHA-512" (https://www.akkadia.org/drepper/SHA-crypt.txt)
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+)
+
+// shaCryptOrder is the order in which the final digest's bytes are encoded,
+// in groups of three
+var shaCryptOrder = map[string][]int{
+	"5": {
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+		-1, 31, 30,
+	},
+	"6": {
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41, -1, -1, 63,
+	},
+}
+
+const cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// shaCrypt is a parsed $5$ or $6$ hash
+type shaCrypt struct {
+	id       string // "5" or "6"
+	rounds   int
+	explicit bool // rounds= was given and is repeated in the output
+	salt     string
+}
+
+func parseSHACrypt(s string) (*shaCrypt, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) < 4 || parts[0] != "" || (parts[1] != "5" && parts[1] != "6") {
+		return nil, fmt.Errorf("malformed SHA-crypt hash")
+	}
+	c := &shaCrypt{id: parts[1], rounds: shaCryptDefaultRounds}
+	rest := parts[2:]
+	if r, ok := strings.CutPrefix(rest[0], "rounds="); ok {
+		n, err := strconv.Atoi(r)
+		if err != nil {
+			return nil, fmt.Errorf("malformed SHA-crypt rounds %q", r)
+		}
+		c.rounds = min(max(n, shaCryptMinRounds), shaCryptMaxRounds)
+		c.explicit = true
+		rest = rest[1:]
+	}
+	if len(rest) != 2 || rest[1] == "" {
+		return nil, fmt.Errorf("malformed SHA-crypt hash")
+	}
+	c.salt = rest[0]
+	if len(c.salt) > shaCryptMaxSalt {
+		c.salt = c.salt[:shaCryptMaxSalt]
+	}
+	return c, nil
+}
+
+// hash computes the full hash string of password with c's parameters
+func (c *shaCrypt) hash(password string) string {
+	newHash := sha256.New
+	if c.id == "6" {
+		newHash = sha512.New
+	}
+	p, s := []byte(password), []byte(c.salt)
+
+	// Digest B
+	b := digest(newHash, p, s, p)
+
+	// Digest A
+	h := newHash()
+	h.Write(p)
+	h.Write(s)
+	h.Write(repeat(b, len(p)))
+	for n := len(p); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(p)
+		}
+	}
+	a := h.Sum(nil)
+
+	// The P and S sequences
+	dp := newHash()
+	for range len(p) {
+		dp.Write(p)
+	}
+	pSeq := repeat(dp.Sum(nil), len(p))
+	ds := newHash()
+	for range 16 + int(a[0]) {
+		ds.Write(s)
+	}
+	sSeq := repeat(ds.Sum(nil), len(s))
+
+	sum := a
+	for i := range c.rounds {
+		h := newHash()
+		if i%2 != 0 {
+			h.Write(pSeq)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write(sSeq)
+		}
+		if i%7 != 0 {
+			h.Write(pSeq)
+		}
+		if i%2 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pSeq)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var out strings.Builder
+	out.WriteString("$" + c.id + "$")
+	if c.explicit {
+		fmt.Fprintf(&out, "rounds=%d$", c.rounds)
+	}
+	out.WriteString(c.salt + "$")
+	order := shaCryptOrder[c.id]
+	for i := 0; i < len(order); i += 3 {
+		var w uint32
+		chars := 4
+		for _, j := range order[i : i+3] {
+			w <<= 8
+			if j < 0 {
+				chars--
+			} else {
+				w |= uint32(sum[j])
+			}
+		}
+		for range chars {
+			out.WriteByte(cryptAlphabet[w&0x3f])
+			w >>= 6
+		}
+	}
+	return out.String()
+}
+
+func digest(newHash func() hash.Hash, parts ...[]byte) []byte {
+	h := newHash()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// repeat returns n bytes of b repeated
+func repeat(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		out = append(out, b[:min(len(b), n-len(out))]...)
+	}
+	return out
+}
@@ -0,0 +1,183 @@
+// Package breaker keeps a circuit breaker per upstream host so that
+// requests to a host that keeps failing are refused at once instead of
+// piling up behind it.
+package breaker
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Defaults used for zero Settings fields
+const (
+	DefaultOpenTime         = 30 * time.Second
+	DefaultHalfOpenRequests = 1
+)
+
+// State is the state of a host's circuit
+type State int
+
+const (
+	Closed   State = iota // requests pass
+	Open                  // requests are refused
+	HalfOpen              // a few trial requests pass to see if the host has recovered
+)
+
+func (s State) String() string {
+	switch s {
+	case Open:
+		return "open"
+	case HalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// Settings configure the circuit breakers. A host's circuit opens after
+// Failures failed requests in a row and refuses requests for OpenTime. It
+// then lets HalfOpenRequests trial requests through: it closes once they
+// have all succeeded, and opens again as soon as one fails.
+type Settings struct {
+	Failures         int // zero disables the breakers
+	OpenTime         time.Duration
+	HalfOpenRequests int
+}
+
+// Check checks the settings
+func Check(s Settings) error {
+	switch {
+	case s.Failures < 0, s.HalfOpenRequests < 0:
+		return errors.New("thresholds must not be negative")
+	case s.OpenTime < 0:
+		return errors.New("open_time must not be negative")
+	}
+	return nil
+}
+
+// OpenError is returned by Allow for a host whose circuit is open
+type OpenError struct {
+	Host       string
+	RetryAfter time.Duration // until trial requests are let through; zero when they already are
+}
+
+func (e *OpenError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("circuit breaker for %s is open after repeated failures; retrying in %s", e.Host, e.RetryAfter.Round(time.Second))
+	}
+	return fmt.Sprintf("circuit breaker for %s is half-open and waiting for trial requests", e.Host)
+}
+
+// Set holds the circuits of every host. All methods are safe to call on a
+// nil *Set, which lets every request through.
+type Set struct {
+	settings Settings
+
+	mu       sync.Mutex
+	circuits map[string]*circuit
+}
+
+// circuit is the state of one host. Only hosts with recent failures have
+// one.
+type circuit struct {
+	state     State
+	failures  int       // failures in a row while closed
+	until     time.Time // end of the open period
+	trials    int       // trial requests let through while half-open
+	successes int       // trial requests that succeeded
+	gen       int       // bumped on every state change so that stale results are ignored
+}
+
+// New returns the breakers for s, or nil when s disables them
+func New(s Settings) *Set {
+	if s.Failures <= 0 {
+		return nil
+	}
+	if s.OpenTime == 0 {
+		s.OpenTime = DefaultOpenTime
+	}
+	if s.HalfOpenRequests == 0 {
+		s.HalfOpenRequests = DefaultHalfOpenRequests
+	}
+	return &Set{settings: s, circuits: make(map[string]*circuit)}
+}
+
+// Allow asks to send a request to host. It returns an *OpenError when the
+// host's circuit refuses the request; otherwise done must be called with
+// the request's outcome, and reports whether it opened the circuit.
+func (s *Set) Allow(host string) (done func(failed bool) (opened bool), err error) {
+	if s == nil {
+		return func(bool) bool { return false }, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := s.circuits[host]
+	if c == nil {
+		c = &circuit{}
+		s.circuits[host] = c
+	}
+	now := time.Now()
+	if c.state == Open {
+		if now.Before(c.until) {
+			return nil, &OpenError{Host: host, RetryAfter: c.until.Sub(now)}
+		}
+		c.set(HalfOpen)
+	}
+	if c.state == HalfOpen {
+		if c.trials >= s.settings.HalfOpenRequests {
+			return nil, &OpenError{Host: host}
+		}
+		c.trials++
+	}
+	gen := c.gen
+	return func(failed bool) bool { return s.done(host, c, gen, failed) }, nil
+}
+
+// done records the outcome of a request allowed in generation gen of c
+func (s *Set) done(host string, c *circuit, gen int, failed bool) (opened bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.circuits[host] != c || c.gen != gen {
+		return false
+	}
+	switch {
+	case failed && c.state == HalfOpen, failed && c.failures+1 >= s.settings.Failures:
+		c.set(Open)
+		c.until = time.Now().Add(s.settings.OpenTime)
+		return true
+	case failed:
+		c.failures++
+	case c.state == HalfOpen:
+		if c.successes++; c.successes >= s.settings.HalfOpenRequests {
+			delete(s.circuits, host)
+		}
+	default:
+		// A host that is doing fine needn't be remembered
+		delete(s.circuits, host)
+	}
+	return false
+}
+
+func (c *circuit) set(state State) {
+	c.state, c.failures, c.trials, c.successes = state, 0, 0, 0
+	c.gen++
+}
+
+// State returns the state of host's circuit
+func (s *Set) State(host string) State {
+	if s == nil {
+		return Closed
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.circuits[host]
+	if c == nil {
+		return Closed
+	}
+	if c.state == Open && !time.Now().Before(c.until) {
+		return HalfOpen
+	}
+	return c.state
+}
@@ -0,0 +1,94 @@
+package breaker
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSet(t *testing.T) {
+	s := New(Settings{Failures: 3, OpenTime: time.Hour, HalfOpenRequests: 2})
+	fail := func(host string) bool {
+		t.Helper()
+		done, err := s.Allow(host)
+		if err != nil {
+			t.Fatalf("Allow(%s): %v", host, err)
+		}
+		return done(true)
+	}
+
+	// A success in between resets the count
+	fail("a:80")
+	fail("a:80")
+	done, _ := s.Allow("a:80")
+	done(false)
+	if fail("a:80") || fail("a:80") {
+		t.Fatal("Expected the circuit to stay closed before three failures in a row")
+	}
+	if !fail("a:80") {
+		t.Fatal("Expected the third failure in a row to open the circuit")
+	}
+	var open *OpenError
+	if _, err := s.Allow("a:80"); !errors.As(err, &open) || open.Host != "a:80" || open.RetryAfter <= 0 {
+		t.Fatalf("Expected an OpenError, got %v", err)
+	}
+	if st := s.State("a:80"); st != Open {
+		t.Errorf("Expected the circuit to be open, got %s", st)
+	}
+	// Other hosts are unaffected
+	if _, err := s.Allow("b:80"); err != nil {
+		t.Errorf("Expected other hosts to be allowed, got %v", err)
+	}
+
+	// Once the open time is over, trial requests go through one batch at a time
+	s.circuits["a:80"].until = time.Now()
+	first, err := s.Allow("a:80")
+	if err != nil {
+		t.Fatalf("Expected a trial request, got %v", err)
+	}
+	second, _ := s.Allow("a:80")
+	if _, err := s.Allow("a:80"); !errors.As(err, &open) || open.RetryAfter != 0 {
+		t.Errorf("Expected requests beyond the trials to be refused, got %v", err)
+	}
+	first(false)
+	if st := s.State("a:80"); st != HalfOpen {
+		t.Errorf("Expected the circuit to stay half-open until every trial succeeds, got %s", st)
+	}
+	second(false)
+	if st := s.State("a:80"); st != Closed {
+		t.Errorf("Expected the circuit to close, got %s", st)
+	}
+
+	// A failed trial opens the circuit again
+	for range 3 {
+		fail("a:80")
+	}
+	s.circuits["a:80"].until = time.Now()
+	if !fail("a:80") || s.State("a:80") != Open {
+		t.Errorf("Expected a failed trial to open the circuit, got %s", s.State("a:80"))
+	}
+}
+
+func TestSetStaleResults(t *testing.T) {
+	s := New(Settings{Failures: 1})
+	slow, _ := s.Allow("a:80")
+	if done, _ := s.Allow("a:80"); !done(true) {
+		t.Fatal("Expected the failure to open the circuit")
+	}
+	// A request that started before the circuit opened can't close it
+	slow(false)
+	if st := s.State("a:80"); st != Open {
+		t.Errorf("Expected the circuit to stay open, got %s", st)
+	}
+}
+
+func TestNilSet(t *testing.T) {
+	var s *Set
+	if s != New(Settings{}) {
+		t.Error("Expected zero settings to disable the breakers")
+	}
+	done, err := s.Allow("a:80")
+	if err != nil || done(true) || s.State("a:80") != Closed {
+		t.Error("Expected a nil *Set to let every request through")
+	}
+}
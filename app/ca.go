@@ -0,0 +1,52 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"nproxy/app/config"
+	"nproxy/app/proxy"
+)
+
+// runCA loads the persistent CA, creating it on first use, and writes its
+// certificate in PEM format for installing in clients
+func runCA(args []string) error {
+	var out string
+	c, _, err := loadConfig("ca", args, func(fs *flag.FlagSet, c *config.Config) {
+		fs.StringVar(&c.CA.Cert, "cert", c.CA.Cert, "CA certificate file")
+		fs.StringVar(&c.CA.Key, "key", c.CA.Key, "CA private key file")
+		fs.StringVar(&out, "o", "", "write the certificate to this file instead of stdout")
+	})
+	if err != nil {
+		return err
+	}
+	if c.CA.Cert == "" {
+		return errors.New("no persistent CA configured; set ca.cert and ca.key in the config file or pass -cert and -key")
+	}
+
+	p, err := proxy.NewMITMProxy(c.Listen)
+	if err != nil {
+		return err
+	}
+	if err := p.UseCAFiles(c.CA.Cert, c.CA.Key); err != nil {
+		return err
+	}
+
+	fingerprint := sha256.Sum256(p.CA.Raw)
+	hex := make([]string, len(fingerprint))
+	for i, b := range fingerprint {
+		hex[i] = fmt.Sprintf("%02X", b)
+	}
+	fmt.Fprintf(os.Stderr, "Subject:  %s\nExpires:  %s\nSHA-256:  %s\n",
+		p.CA.Subject, p.CA.NotAfter.Format("2006-01-02"), strings.Join(hex, ":"))
+
+	if out != "" {
+		return os.WriteFile(out, p.CAPEM(), 0644)
+	}
+	_, err = os.Stdout.Write(p.CAPEM())
+	return err
+}
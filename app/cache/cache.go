@@ -0,0 +1,439 @@
+// Package cache stores HTTP responses passing through a proxy and answers
+// later requests with them, following RFC 9111: freshness from
+// Cache-Control, Expires or Last-Modified, Vary, revalidation with ETag
+// and Last-Modified, and no-store. Responses are kept in memory or on disk
+// up to a size limit. Overrides cache matching requests regardless of what
+// their responses say, for working against slow or unreachable servers.
+// Every response that passes through tells how it was served in
+// Cache-Status (RFC 9211) and X-Cache headers.
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+	"nproxy/app/hop"
+)
+
+// Name identifies the cache in Cache-Status headers
+const Name = "nproxy"
+
+// Values of the X-Cache header
+const (
+	Hit         = "HIT"         // answered from the cache
+	Miss        = "MISS"        // answered by the server
+	Revalidated = "REVALIDATED" // answered from the cache once the server confirmed the stored response
+	Stale       = "STALE"       // answered from the cache with a stale response the server couldn't be asked about
+)
+
+// Settings configure a Cache
+type Settings struct {
+	Dir          string     // Keep responses in files in this directory; in memory when empty
+	MaxSize      int64      // Bytes of stored responses in all; the least recently used ones are evicted beyond
+	MaxEntrySize int64      // Largest response body stored
+	Private      bool       // Act as a private cache: store private responses and ignore s-maxage
+	Overrides    []Override // Requests cached regardless of what their responses say
+}
+
+// Override forces the caching of GET requests its filter matches. Their
+// responses, but for server errors, are stored whatever their headers
+// say, and stay fresh for TTL whatever the request says. When the server
+// can't be reached the stored response is served even once it is stale.
+type Override struct {
+	Filter *filter.Filter // Evaluated on the request; nil matches every request
+	TTL    time.Duration  // How long responses stay fresh; 0 keeps them fresh for good
+}
+
+// Default returns the settings of a cache that isn't configured otherwise
+func Default() Settings {
+	return Settings{MaxSize: 64 << 20, MaxEntrySize: 8 << 20}
+}
+
+// Check checks the settings
+func Check(s Settings) error {
+	switch {
+	case s.MaxSize <= 0:
+		return errors.New("max_size must be positive")
+	case s.MaxEntrySize <= 0:
+		return errors.New("max_entry_size must be positive")
+	case s.MaxEntrySize > s.MaxSize:
+		return errors.New("max_entry_size must not be more than max_size")
+	}
+	for _, o := range s.Overrides {
+		if o.TTL < 0 {
+			return errors.New("override ttl must not be negative; use 0 to keep responses fresh for good")
+		}
+	}
+	return nil
+}
+
+// Cache is a response cache, shared by the proxies whose transports it
+// wraps. Its methods may be called on a nil *Cache, which caches nothing.
+type Cache struct {
+	settings Settings
+	store    store
+	now      func() time.Time
+}
+
+// New creates a cache with the settings s, opening the directory of a
+// disk cache and taking over the responses stored in it
+func New(s Settings) (*Cache, error) {
+	if err := Check(s); err != nil {
+		return nil, err
+	}
+	c := &Cache{settings: s, now: time.Now}
+	if s.Dir == "" {
+		c.store = newMemoryStore(s.MaxSize)
+		return c, nil
+	}
+	ds, err := openDiskStore(s.Dir, s.MaxSize)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache directory: %v", err)
+	}
+	c.store = ds
+	return c, nil
+}
+
+// Stats returns the number of stored responses and their size in bytes
+func (c *Cache) Stats() (entries int, size int64) {
+	if c == nil {
+		return 0, 0
+	}
+	return c.store.stats()
+}
+
+// Clear drops every stored response and returns how many there were
+func (c *Cache) Clear() int {
+	if c == nil {
+		return 0
+	}
+	return c.store.clear()
+}
+
+// Transport returns a transport that answers requests from the cache and
+// sends the others on with base, storing the responses it may. It returns
+// base itself for a nil *Cache.
+func (c *Cache) Transport(base http.RoundTripper) http.RoundTripper {
+	if c == nil {
+		return base
+	}
+	return &transport{cache: c, base: base}
+}
+
+// entry is a stored response and what it was stored for
+type entry struct {
+	Key          string
+	Status       int
+	Header       http.Header
+	Body         []byte
+	RequestTime  time.Time   // when the request that got the response was sent
+	ResponseTime time.Time   // when the response was received
+	Vary         http.Header // the request's values of the headers named by Vary
+	Override     bool        // stored by an override
+}
+
+// key returns the cache key of req, its target URI with the scheme and
+// host in lower case and without a default port. The host comes from the
+// Host header, which names the server when the URL holds an address.
+func key(req *http.Request) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	host = strings.ToLower(host)
+	scheme := strings.ToLower(req.URL.Scheme)
+	if h, port, err := net.SplitHostPort(host); err == nil && (scheme == "https" && port == "443" || scheme == "http" && port == "80") {
+		host = h
+		if strings.Contains(h, ":") {
+			host = "[" + h + "]"
+		}
+	}
+	return scheme + "://" + host + req.URL.RequestURI()
+}
+
+// load returns the entry stored for key, if any
+func (c *Cache) load(key string) *entry {
+	data, ok := c.store.get(key)
+	if !ok {
+		return nil
+	}
+	var e entry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&e); err != nil || e.Key != key {
+		// Written by another version or a hash collision
+		c.store.remove(key)
+		return nil
+	}
+	return &e
+}
+
+// save stores e under its key
+func (c *Cache) save(e *entry) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(e); err != nil {
+		return
+	}
+	c.store.set(e.Key, buf.Bytes())
+}
+
+// override returns the override that applies to req, or nil
+func (c *Cache) override(req *http.Request) *Override {
+	if len(c.settings.Overrides) == 0 {
+		return nil
+	}
+	f := &flow.Flow{Method: req.Method, URL: key(req), Host: req.Host, RequestHeader: req.Header}
+	if f.Host == "" {
+		f.Host = req.URL.Host
+	}
+	for i, o := range c.settings.Overrides {
+		if o.Filter.Match(f) {
+			return &c.settings.Overrides[i]
+		}
+	}
+	return nil
+}
+
+// varyValues returns the values in req of the headers that vary names
+func varyValues(vary []string, req *http.Request) http.Header {
+	h := http.Header{}
+	for _, v := range vary {
+		for _, name := range splitList(v) {
+			if name != "" {
+				h[http.CanonicalHeaderKey(name)] = req.Header.Values(name)
+			}
+		}
+	}
+	return h
+}
+
+// varies reports whether req selects a different response than the one
+// stored in e, because a header named by Vary differs
+func (e *entry) varies(req *http.Request) bool {
+	for name, values := range e.Vary {
+		if normalize(values) != normalize(req.Header.Values(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalize joins header values, leaving out the whitespace around list
+// members
+func normalize(values []string) string {
+	var parts []string
+	for _, v := range values {
+		parts = append(parts, splitList(v)...)
+	}
+	return strings.Join(parts, ",")
+}
+
+// transport is the RoundTripper of a Cache
+type transport struct {
+	cache *Cache
+	base  http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := t.cache
+	k := key(req)
+	if req.Method != http.MethodGet {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil && req.Method != http.MethodHead && req.Method != http.MethodOptions && resp.StatusCode < 400 {
+			// An unsafe request that succeeded invalidates what is stored
+			// for its target (RFC 9111, section 4.4)
+			c.store.remove(k)
+		}
+		return resp, err
+	}
+	if req.Header.Get("Range") != "" || hop.UpgradeType(req.Header) != "" {
+		resp, err := t.base.RoundTrip(req)
+		if err == nil {
+			setStatus(resp.Header, Miss, "fwd=bypass")
+		}
+		return resp, err
+	}
+
+	shared := !c.settings.Private
+	reqCC := parseDirectives(req.Header)
+	o := c.override(req)
+	now := c.now()
+	fwd := "uri-miss"
+	e := c.load(k)
+	if e != nil && e.Override && o == nil {
+		// Stored regardless of its headers for an override that no
+		// longer applies
+		e = nil
+	}
+	if e != nil && e.varies(req) {
+		e, fwd = nil, "vary-miss"
+	}
+	if e != nil {
+		age := e.age(now)
+		fresh := e.fresh(reqCC, age, shared)
+		if o != nil {
+			fresh = o.TTL == 0 || age < o.TTL
+		}
+		if fresh {
+			ttl := e.lifetime(shared) - age
+			if o != nil && o.TTL > 0 {
+				ttl = o.TTL - age
+			}
+			return c.serve(req, e, age, Hit, fmt.Sprintf("hit; ttl=%d", seconds(ttl))), nil
+		}
+		fwd = "stale"
+		if reqCC.has("no-cache") {
+			fwd = "request"
+		}
+	}
+	if reqCC.has("only-if-cached") {
+		// The client doesn't want the server asked (RFC 9111, section 5.2.1.7)
+		resp := &http.Response{
+			Status:     "504 Gateway Timeout",
+			StatusCode: http.StatusGatewayTimeout,
+			Proto:      "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+			Header:  http.Header{},
+			Body:    http.NoBody,
+			Request: req,
+		}
+		setStatus(resp.Header, Miss, "fwd=miss; detail=only-if-cached")
+		return resp, nil
+	}
+
+	// A stored response with validators is revalidated, unless the client
+	// has conditions of its own
+	out := req
+	if e != nil && !conditional(req) {
+		etag, lm := e.Header.Get("ETag"), e.Header.Get("Last-Modified")
+		if etag != "" || lm != "" {
+			out = req.Clone(req.Context())
+			if etag != "" {
+				out.Header.Set("If-None-Match", etag)
+			}
+			if lm != "" {
+				out.Header.Set("If-Modified-Since", lm)
+			}
+		}
+	}
+	requestTime := c.now()
+	resp, err := t.base.RoundTrip(out)
+	if err != nil {
+		if e != nil && o != nil {
+			age := e.age(c.now())
+			status := "hit; detail=unreachable"
+			if o.TTL > 0 {
+				status = fmt.Sprintf("hit; ttl=%d; detail=unreachable", seconds(o.TTL-age))
+			}
+			return c.serve(req, e, age, Stale, status), nil
+		}
+		return nil, err
+	}
+	responseTime := c.now()
+
+	if out != req && resp.StatusCode == http.StatusNotModified {
+		// The stored response is still good; it takes the updated header
+		// fields (RFC 9111, section 4.3.4)
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		for name, values := range resp.Header {
+			if name != "Content-Length" {
+				e.Header[name] = values
+			}
+		}
+		e.RequestTime, e.ResponseTime = requestTime, responseTime
+		c.save(e)
+		return c.serve(req, e, e.age(c.now()), Revalidated, "fwd=stale; fwd-status=304"), nil
+	}
+
+	status := fmt.Sprintf("fwd=%s; fwd-status=%d", fwd, resp.StatusCode)
+	store := storable(req, resp.StatusCode, resp.Header, shared)
+	if o != nil {
+		store = resp.StatusCode >= 200 && resp.StatusCode < 500 && resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusNotModified
+	}
+	if store && resp.ContentLength <= c.settings.MaxEntrySize {
+		stored := &entry{
+			Key:          k,
+			Status:       resp.StatusCode,
+			Header:       resp.Header.Clone(),
+			RequestTime:  requestTime,
+			ResponseTime: responseTime,
+			Vary:         varyValues(resp.Header.Values("Vary"), req),
+			Override:     o != nil,
+		}
+		resp.Body = &storingBody{ReadCloser: resp.Body, max: c.settings.MaxEntrySize, done: func(body []byte) {
+			stored.Body = body
+			c.save(stored)
+		}}
+		status += "; stored"
+	}
+	setStatus(resp.Header, Miss, status)
+	return resp, nil
+}
+
+// serve answers req with the stored response e, whose current age is age,
+// or with 304 Not Modified when it satisfies the request's conditions
+func (c *Cache) serve(req *http.Request, e *entry, age time.Duration, xCache, status string) *http.Response {
+	resp := &http.Response{
+		StatusCode: e.Status,
+		Proto:      "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header:        e.Header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(e.Body)),
+		ContentLength: int64(len(e.Body)),
+		Request:       req,
+	}
+	if e.Status == http.StatusOK && e.notModified(req) {
+		resp.StatusCode, resp.Body, resp.ContentLength = http.StatusNotModified, http.NoBody, 0
+		resp.Header.Del("Content-Length")
+	}
+	resp.Status = strconv.Itoa(resp.StatusCode) + " " + http.StatusText(resp.StatusCode)
+	resp.Header.Set("Age", strconv.FormatInt(seconds(age), 10))
+	setStatus(resp.Header, xCache, status)
+	return resp
+}
+
+// setStatus reports how the response with header h was served
+func setStatus(h http.Header, xCache, status string) {
+	h.Set("X-Cache", xCache)
+	// Caches nearer the client come first (RFC 9211, section 2)
+	h.Set("Cache-Status", strings.Join(append([]string{Name + "; " + status}, h.Values("Cache-Status")...), ", "))
+}
+
+// seconds returns d in whole seconds
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
+
+// storingBody is the body of a response being stored. Once it has been
+// read to the end, done is called with it, unless it turned out larger
+// than max.
+type storingBody struct {
+	io.ReadCloser
+	max  int64
+	buf  bytes.Buffer
+	over bool
+	done func([]byte)
+}
+
+func (b *storingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if !b.over {
+		b.buf.Write(p[:n])
+		if int64(b.buf.Len()) > b.max {
+			b.over = true
+			b.buf = bytes.Buffer{}
+		}
+	}
+	if err == io.EOF && !b.over && b.done != nil {
+		b.done(bytes.Clone(b.buf.Bytes()))
+		b.done = nil
+	}
+	return n, err
+}
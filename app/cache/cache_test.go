@@ -0,0 +1,315 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nproxy/app/filter"
+)
+
+// origin is an upstream server answering through a handler, which counts
+// the requests that reach it
+type origin struct {
+	handler  http.HandlerFunc
+	requests int
+	err      error // returned instead of a response when set
+}
+
+func (o *origin) RoundTrip(req *http.Request) (*http.Response, error) {
+	if o.err != nil {
+		return nil, o.err
+	}
+	o.requests++
+	rec := httptest.NewRecorder()
+	o.handler(rec, req)
+	return rec.Result(), nil
+}
+
+// clock is a cache's time, moved on by tests
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func newCache(t *testing.T, s Settings) (*Cache, *clock) {
+	t.Helper()
+	c, err := New(s)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	clk := &clock{t: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)}
+	c.now = clk.now
+	return c, clk
+}
+
+// fetch sends a GET for url through rt with the headers in kv and reads the
+// response
+func fetch(t *testing.T, rt http.RoundTripper, url string, kv ...string) (*http.Response, string) {
+	t.Helper()
+	req := httptest.NewRequest("GET", url, nil)
+	for i := 0; i+1 < len(kv); i += 2 {
+		req.Header.Set(kv[i], kv[i+1])
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	return resp, string(body)
+}
+
+func expectServed(t *testing.T, resp *http.Response, body, xCache, status, wantBody string) {
+	t.Helper()
+	if got := resp.Header.Get("X-Cache"); got != xCache {
+		t.Errorf("Expected X-Cache %s, got %s", xCache, got)
+	}
+	if got := resp.Header.Get("Cache-Status"); got != Name+"; "+status {
+		t.Errorf("Expected Cache-Status %q, got %q", Name+"; "+status, got)
+	}
+	if body != wantBody {
+		t.Errorf("Expected body %q, got %q", wantBody, body)
+	}
+}
+
+func TestCache_Freshness(t *testing.T) {
+	c, clk := newCache(t, Default())
+	n := 0
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Date", clk.t.Format(http.TimeFormat))
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprintf(w, "v%d", n)
+	}}
+	rt := c.Transport(o)
+
+	resp, body := fetch(t, rt, "http://example.test/a")
+	expectServed(t, resp, body, Miss, "fwd=uri-miss; fwd-status=200; stored", "v1")
+	clk.t = clk.t.Add(20 * time.Second)
+	resp, body = fetch(t, rt, "http://EXAMPLE.test:80/a")
+	expectServed(t, resp, body, Hit, "hit; ttl=40", "v1")
+	if resp.Header.Get("Age") != "20" {
+		t.Errorf("Expected Age 20, got %q", resp.Header.Get("Age"))
+	}
+
+	// The client may ask for a fresher response, or accept a stale one
+	resp, body = fetch(t, rt, "http://example.test/a", "Cache-Control", "max-age=10")
+	expectServed(t, resp, body, Miss, "fwd=stale; fwd-status=200; stored", "v2")
+	clk.t = clk.t.Add(90 * time.Second)
+	resp, body = fetch(t, rt, "http://example.test/a", "Cache-Control", "max-stale=60")
+	expectServed(t, resp, body, Hit, "hit; ttl=-30", "v2")
+	resp, body = fetch(t, rt, "http://example.test/a", "Cache-Control", "no-cache")
+	expectServed(t, resp, body, Miss, "fwd=request; fwd-status=200; stored", "v3")
+	resp, _ = fetch(t, rt, "http://example.test/b", "Cache-Control", "only-if-cached")
+	if resp.StatusCode != http.StatusGatewayTimeout || o.requests != 3 {
+		t.Errorf("Expected only-if-cached to get 504 without asking the server, got %d after %d requests", resp.StatusCode, o.requests)
+	}
+
+	if entries, size := c.Stats(); entries != 1 || size == 0 {
+		t.Errorf("Expected 1 stored response, got %d of %d bytes", entries, size)
+	}
+	if n := c.Clear(); n != 1 {
+		t.Errorf("Expected Clear to report 1 dropped response, got %d", n)
+	}
+	if entries, _ := c.Stats(); entries != 0 {
+		t.Errorf("Expected Clear to drop every response, got %d", entries)
+	}
+}
+
+func TestCache_NotStored(t *testing.T) {
+	tests := []struct {
+		name    string
+		private bool
+		reqCC   string
+		header  http.Header
+		status  int
+	}{
+		{"no-store", false, "", http.Header{"Cache-Control": {"max-age=60, no-store"}}, 200},
+		{"request no-store", false, "no-store", http.Header{"Cache-Control": {"max-age=60"}}, 200},
+		{"private in shared cache", false, "", http.Header{"Cache-Control": {"private, max-age=60"}}, 200},
+		{"cookie", false, "", http.Header{"Cache-Control": {"max-age=60"}, "Set-Cookie": {"a=1"}}, 200},
+		{"vary star", false, "", http.Header{"Cache-Control": {"max-age=60"}, "Vary": {"*"}}, 200},
+		{"no freshness", false, "", http.Header{}, 200},
+		{"heuristic status only", false, "", http.Header{"Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}}, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := Default()
+			s.Private = tt.private
+			c, _ := newCache(t, s)
+			rt := c.Transport(&origin{handler: func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.status)
+			}})
+			for range 2 {
+				fetch(t, rt, "http://example.test/", "Cache-Control", tt.reqCC)
+			}
+			if entries, _ := c.Stats(); entries != 0 {
+				t.Errorf("Expected nothing stored, got %d responses", entries)
+			}
+		})
+	}
+
+	// A private cache keeps private responses
+	s := Default()
+	s.Private = true
+	c, _ := newCache(t, s)
+	rt := c.Transport(&origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private, max-age=60")
+	}})
+	fetch(t, rt, "http://example.test/")
+	if resp, _ := fetch(t, rt, "http://example.test/"); resp.Header.Get("X-Cache") != Hit {
+		t.Errorf("Expected a private cache to serve private responses, got %v", resp.Header)
+	}
+}
+
+func TestCache_Vary(t *testing.T) {
+	c, _ := newCache(t, Default())
+	rt := c.Transport(&origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Language")
+		fmt.Fprint(w, r.Header.Get("Accept-Language"))
+	}})
+
+	fetch(t, rt, "http://example.test/", "Accept-Language", "en")
+	resp, body := fetch(t, rt, "http://example.test/", "Accept-Language", "en")
+	expectServed(t, resp, body, Hit, "hit; ttl=60", "en")
+	resp, body = fetch(t, rt, "http://example.test/", "Accept-Language", "fr")
+	expectServed(t, resp, body, Miss, "fwd=vary-miss; fwd-status=200; stored", "fr")
+}
+
+func TestCache_Revalidation(t *testing.T) {
+	c, clk := newCache(t, Default())
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=10")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("X-Served", clk.t.Format(time.RFC3339))
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fmt.Fprint(w, "body")
+	}}
+	rt := c.Transport(o)
+
+	fetch(t, rt, "http://example.test/")
+	clk.t = clk.t.Add(time.Minute)
+	resp, body := fetch(t, rt, "http://example.test/")
+	expectServed(t, resp, body, Revalidated, "fwd=stale; fwd-status=304", "body")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Served") != clk.t.Format(time.RFC3339) {
+		t.Errorf("Expected the stored response with the updated headers, got %d %v", resp.StatusCode, resp.Header)
+	}
+	// The revalidated response is fresh again, and answers the client's own
+	// conditional requests
+	resp, body = fetch(t, rt, "http://example.test/", "If-None-Match", `W/"v1"`)
+	if resp.StatusCode != http.StatusNotModified || body != "" || o.requests != 2 {
+		t.Errorf("Expected 304 from the cache, got %d %q after %d requests", resp.StatusCode, body, o.requests)
+	}
+}
+
+func TestCache_Invalidation(t *testing.T) {
+	c, _ := newCache(t, Default())
+	rt := c.Transport(&origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+	}})
+	fetch(t, rt, "http://example.test/a")
+	resp, err := rt.RoundTrip(httptest.NewRequest("POST", "http://example.test/a", strings.NewReader("x")))
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if entries, _ := c.Stats(); entries != 0 {
+		t.Errorf("Expected a POST to invalidate the stored response, got %d", entries)
+	}
+}
+
+func TestCache_MaxEntrySize(t *testing.T) {
+	s := Default()
+	s.MaxEntrySize = 4
+	c, _ := newCache(t, s)
+	rt := c.Transport(&origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.URL.Path)
+	}})
+	fetch(t, rt, "http://example.test/a")
+	fetch(t, rt, "http://example.test/toolong")
+	if entries, _ := c.Stats(); entries != 1 {
+		t.Errorf("Expected only the small response stored, got %d", entries)
+	}
+}
+
+func TestCache_Override(t *testing.T) {
+	s := Default()
+	s.Overrides = []Override{{Filter: filter.MustParse(`host == "api.example.test"`), TTL: time.Hour}}
+	c, clk := newCache(t, s)
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-cache")
+		fmt.Fprint(w, r.URL.Path)
+	}}
+	rt := c.Transport(o)
+
+	fetch(t, rt, "http://api.example.test/users")
+	clk.t = clk.t.Add(time.Minute)
+	resp, body := fetch(t, rt, "http://api.example.test/users", "Cache-Control", "no-cache")
+	expectServed(t, resp, body, Hit, "hit; ttl=3540", "/users")
+	fetch(t, rt, "http://other.example.test/users")
+	if resp, _ := fetch(t, rt, "http://other.example.test/users"); resp.Header.Get("X-Cache") != Miss {
+		t.Errorf("Expected requests the override doesn't match to follow the headers, got %v", resp.Header)
+	}
+
+	// Once stale, the stored response stands in for an unreachable server
+	clk.t = clk.t.Add(2 * time.Hour)
+	o.err = errors.New("connection refused")
+	resp, body = fetch(t, rt, "http://api.example.test/users")
+	expectServed(t, resp, body, Stale, "hit; ttl=-3660; detail=unreachable", "/users")
+	if _, err := rt.RoundTrip(httptest.NewRequest("GET", "http://api.example.test/other", nil)); err == nil {
+		t.Error("Expected the error for a request nothing is stored for")
+	}
+}
+
+func TestCache_Disk(t *testing.T) {
+	s := Default()
+	s.Dir = t.TempDir()
+	c, _ := newCache(t, s)
+	o := &origin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		fmt.Fprint(w, "stored")
+	}}
+	fetch(t, c.Transport(o), "http://example.test/")
+
+	// Another cache on the directory takes over what is stored in it
+	c, _ = newCache(t, s)
+	resp, body := fetch(t, c.Transport(o), "http://example.test/")
+	expectServed(t, resp, body, Hit, "hit; ttl=60", "stored")
+	if o.requests != 1 {
+		t.Errorf("Expected 1 request to reach the server, got %d", o.requests)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	for _, s := range []Settings{
+		{MaxSize: 0, MaxEntrySize: 1},
+		{MaxSize: 1, MaxEntrySize: 0},
+		{MaxSize: 1, MaxEntrySize: 2},
+		{MaxSize: 2, MaxEntrySize: 1, Overrides: []Override{{TTL: -time.Second}}},
+	} {
+		if err := Check(s); err == nil {
+			t.Errorf("Expected %+v to be rejected", s)
+		}
+	}
+	if err := Check(Default()); err != nil {
+		t.Errorf("Expected the default settings to be valid, got %v", err)
+	}
+	var c *Cache
+	base := &origin{}
+	if c.Transport(base) != http.RoundTripper(base) {
+		t.Error("Expected a nil cache to leave the transport alone")
+	}
+}
@@ -0,0 +1,259 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHeuristic caps the freshness lifetime guessed from Last-Modified
+const maxHeuristic = 24 * time.Hour
+
+// heuristicStatus are the status codes whose responses may be stored and
+// given a heuristic freshness lifetime without explicit freshness
+// information (RFC 9110, section 15.1)
+var heuristicStatus = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// directives are the Cache-Control directives of a message by lowercase
+// name, with their arguments unquoted
+type directives map[string]string
+
+// parseDirectives returns the Cache-Control directives in h. A request
+// without Cache-Control but with Pragma: no-cache has no-cache.
+func parseDirectives(h http.Header) directives {
+	d := directives{}
+	for _, v := range h.Values("Cache-Control") {
+		for _, part := range splitList(v) {
+			name, arg, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "" {
+				continue
+			}
+			if _, ok := d[name]; !ok {
+				d[name] = strings.Trim(strings.TrimSpace(arg), `"`)
+			}
+		}
+	}
+	if len(d) == 0 && strings.EqualFold(strings.TrimSpace(h.Get("Pragma")), "no-cache") {
+		d["no-cache"] = ""
+	}
+	return d
+}
+
+// splitList splits a comma-separated header value, leaving commas within
+// quoted strings alone
+func splitList(v string) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i := 0; i < len(v); i++ {
+		switch v[i] {
+		case '"':
+			quoted = !quoted
+		case '\\':
+			if quoted {
+				i++
+			}
+		case ',':
+			if !quoted {
+				parts = append(parts, strings.TrimSpace(v[start:i]))
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, strings.TrimSpace(v[start:]))
+}
+
+func (d directives) has(name string) bool {
+	_, ok := d[name]
+	return ok
+}
+
+// seconds returns the delta-seconds argument of the directive name and
+// whether it is present. An argument that isn't a number counts as zero,
+// which makes a response stale rather than fresh for too long.
+func (d directives) seconds(name string) (time.Duration, bool) {
+	arg, ok := d[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	if n > int64(maxDelta/time.Second) {
+		return maxDelta, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// maxDelta is the largest delta-seconds value honored, 2^31 seconds
+const maxDelta = (1 << 31) * time.Second
+
+// storable reports whether the response with status and header h to req
+// may be stored (RFC 9111, section 3). A shared cache doesn't store
+// private responses, responses to requests with credentials unless they
+// are marked for it, or responses that set cookies.
+func storable(req *http.Request, status int, h http.Header, shared bool) bool {
+	reqCC, cc := parseDirectives(req.Header), parseDirectives(h)
+	switch {
+	case req.Method != http.MethodGet,
+		reqCC.has("no-store"), cc.has("no-store"),
+		status < 200, status == http.StatusPartialContent, status == http.StatusNotModified,
+		hasStar(h.Values("Vary")):
+		return false
+	}
+	if shared {
+		switch {
+		case cc.has("private"),
+			req.Header.Get("Authorization") != "" && !cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate"),
+			h.Get("Set-Cookie") != "" && !cc.has("public"):
+			return false
+		}
+	}
+	explicit := cc.has("max-age") || shared && cc.has("s-maxage") || h.Get("Expires") != "" || cc.has("public")
+	if explicit {
+		return true
+	}
+	// Without explicit freshness a response is only worth storing when it
+	// can be freshened heuristically or revalidated
+	return heuristicStatus[status] && (h.Get("Last-Modified") != "" || h.Get("ETag") != "")
+}
+
+// lifetime returns the freshness lifetime of a stored response (RFC 9111,
+// section 4.2.1), from s-maxage in a shared cache, max-age, Expires or,
+// failing those, a tenth of the time since Last-Modified
+func (e *entry) lifetime(shared bool) time.Duration {
+	cc := parseDirectives(e.Header)
+	if shared {
+		if d, ok := cc.seconds("s-maxage"); ok {
+			return d
+		}
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d
+	}
+	if exp := e.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			// An invalid Expires, such as 0, is in the past
+			return 0
+		}
+		return max(0, t.Sub(e.date()))
+	}
+	if heuristicStatus[e.Status] || cc.has("public") {
+		if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil {
+			return min(max(0, e.date().Sub(lm)/10), maxHeuristic)
+		}
+	}
+	return 0
+}
+
+// age returns the current age of the stored response at now (RFC 9111,
+// section 4.2.3)
+func (e *entry) age(now time.Time) time.Duration {
+	apparent := max(0, e.ResponseTime.Sub(e.date()))
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(strings.TrimSpace(e.Header.Get("Age")), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	corrected := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparent, corrected) + now.Sub(e.ResponseTime)
+}
+
+// date returns the Date of the stored response, or the time it was
+// received when it has none
+func (e *entry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// fresh reports whether the stored response, whose current age is age,
+// may answer a request with the directives reqCC without validation
+// (RFC 9111, section 4.2, and 5.2.1 for the request directives)
+func (e *entry) fresh(reqCC directives, age time.Duration, shared bool) bool {
+	cc := parseDirectives(e.Header)
+	if cc.has("no-cache") || reqCC.has("no-cache") {
+		return false
+	}
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		return false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok {
+		age += d
+	}
+	lifetime := e.lifetime(shared)
+	if age < lifetime {
+		return true
+	}
+	// A stale response may be served when the client accepts it, unless
+	// the server says otherwise
+	arg, ok := reqCC["max-stale"]
+	if !ok || cc.has("must-revalidate") || shared && (cc.has("proxy-revalidate") || cc.has("s-maxage")) {
+		return false
+	}
+	if arg == "" {
+		return true
+	}
+	d, _ := reqCC.seconds("max-stale")
+	return age-lifetime <= d
+}
+
+// notModified reports whether the stored response satisfies the
+// conditional headers of req, so that it can be answered with 304 Not
+// Modified (RFC 9110, section 13.2.2)
+func (e *entry) notModified(req *http.Request) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.Header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, tag := range splitList(inm) {
+			if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(req.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.Header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// conditional reports whether req carries conditional headers of its own
+func conditional(req *http.Request) bool {
+	for _, name := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if req.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func hasStar(values []string) bool {
+	for _, v := range values {
+		for _, name := range splitList(v) {
+			if name == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,280 @@
+package cache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// store keeps encoded entries by key up to a size limit, evicting the
+// least recently used ones to make room
+type store interface {
+	get(key string) ([]byte, bool)
+	set(key string, data []byte)
+	remove(key string)
+	clear() (entries int)
+	stats() (entries int, size int64)
+}
+
+// lru orders keys by use and sums their sizes
+type lru struct {
+	max   int64
+	size  int64
+	order *list.List // of *lruItem, most recently used first
+	items map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	size int64
+	data []byte // the entry itself for the memory store, nil on disk
+}
+
+func newLRU(max int64) *lru {
+	return &lru{max: max, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns the item for key and marks it as used
+func (l *lru) get(key string) (*lruItem, bool) {
+	el, ok := l.items[key]
+	if !ok {
+		return nil, false
+	}
+	l.order.MoveToFront(el)
+	return el.Value.(*lruItem), true
+}
+
+// add adds or replaces the item for key and returns the keys evicted to
+// stay within the size limit. An item larger than the limit isn't added;
+// its key is returned as evicted instead.
+func (l *lru) add(key string, size int64, data []byte) []string {
+	l.remove(key)
+	if size > l.max {
+		return []string{key}
+	}
+	l.items[key] = l.order.PushFront(&lruItem{key: key, size: size, data: data})
+	l.size += size
+	var evicted []string
+	for l.size > l.max {
+		item := l.order.Back().Value.(*lruItem)
+		l.remove(item.key)
+		evicted = append(evicted, item.key)
+	}
+	return evicted
+}
+
+// remove drops the item for key, reporting whether there was one
+func (l *lru) remove(key string) bool {
+	el, ok := l.items[key]
+	if !ok {
+		return false
+	}
+	l.order.Remove(el)
+	delete(l.items, key)
+	l.size -= el.Value.(*lruItem).size
+	return true
+}
+
+// memoryStore keeps entries in memory
+type memoryStore struct {
+	mu  sync.Mutex
+	lru *lru
+}
+
+func newMemoryStore(max int64) *memoryStore {
+	return &memoryStore{lru: newLRU(max)}
+}
+
+func (s *memoryStore) get(key string) ([]byte, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.lru.get(key)
+	if !ok {
+		return nil, false
+	}
+	return item.data, true
+}
+
+func (s *memoryStore) set(key string, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.add(key, int64(len(data)), data)
+}
+
+func (s *memoryStore) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lru.remove(key)
+}
+
+func (s *memoryStore) clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.lru.items)
+	s.lru = newLRU(s.lru.max)
+	return n
+}
+
+func (s *memoryStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lru.items), s.lru.size
+}
+
+// diskStore keeps each entry in a file of its own in dir, named by the
+// SHA-256 of its key. Use is tracked in memory; the files found when the
+// store is opened count as used in the order of their modification times.
+type diskStore struct {
+	dir string
+
+	mu  sync.Mutex
+	lru *lru // by file name
+}
+
+// entrySuffix ends the names of entry files
+const entrySuffix = ".entry"
+
+// openDiskStore opens the store in dir, creating dir if need be, and
+// evicts what exceeds max
+func openDiskStore(dir string, max int64) (*diskStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type found struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []found
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(f.Name(), ".tmp-") {
+			// Left over by a write that didn't finish
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		if !strings.HasSuffix(f.Name(), entrySuffix) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, found{f.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].modTime.Before(entries[j].modTime) })
+
+	s := &diskStore{dir: dir, lru: newLRU(max)}
+	for _, e := range entries {
+		s.removeFiles(s.lru.add(e.name, e.size, nil))
+	}
+	return s, nil
+}
+
+func fileName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:]) + entrySuffix
+}
+
+func (s *diskStore) get(key string) ([]byte, bool) {
+	name := fileName(key)
+	s.mu.Lock()
+	_, ok := s.lru.get(name)
+	s.mu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	path := filepath.Join(s.dir, name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		s.remove(key)
+		return nil, false
+	}
+	// Keep the order of use for the next time the store is opened
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return data, true
+}
+
+func (s *diskStore) set(key string, data []byte) {
+	name := fileName(key)
+	if err := s.write(name, data); err != nil {
+		log.Printf("Failed to store cache entry for %s: %v", key, err)
+		return
+	}
+	s.mu.Lock()
+	evicted := s.lru.add(name, int64(len(data)), nil)
+	s.mu.Unlock()
+	s.removeFiles(evicted)
+}
+
+// write replaces the file name with data, so that readers never see a
+// partial entry
+func (s *diskStore) write(name string, data []byte) error {
+	f, err := os.CreateTemp(s.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("writing %s: %w", s.dir, err)
+	}
+	return nil
+}
+
+func (s *diskStore) remove(key string) {
+	name := fileName(key)
+	s.mu.Lock()
+	removed := s.lru.remove(name)
+	s.mu.Unlock()
+	if removed {
+		s.removeFiles([]string{name})
+	}
+}
+
+func (s *diskStore) clear() int {
+	s.mu.Lock()
+	names := make([]string, 0, len(s.lru.items))
+	for name := range s.lru.items {
+		names = append(names, name)
+	}
+	s.lru = newLRU(s.lru.max)
+	s.mu.Unlock()
+	s.removeFiles(names)
+	return len(names)
+}
+
+func (s *diskStore) stats() (int, int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.lru.items), s.lru.size
+}
+
+func (s *diskStore) removeFiles(names []string) {
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove cache entry %s: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	disk, err := openDiskStore(t.TempDir(), 10)
+	if err != nil {
+		t.Fatalf("openDiskStore: %v", err)
+	}
+	for name, s := range map[string]store{"memory": newMemoryStore(10), "disk": disk} {
+		t.Run(name, func(t *testing.T) {
+			s.set("a", []byte("aaaa"))
+			s.set("b", []byte("bbbb"))
+			s.get("a")
+			// c evicts b, the least recently used
+			s.set("c", []byte("cccc"))
+			if _, ok := s.get("b"); ok {
+				t.Error("Expected b to be evicted")
+			}
+			if data, ok := s.get("a"); !ok || string(data) != "aaaa" {
+				t.Errorf("Expected a to be kept, got %q", data)
+			}
+			// An entry larger than the whole store isn't kept
+			s.set("d", []byte("ddddddddddd"))
+			if _, ok := s.get("d"); ok {
+				t.Error("Expected an entry over the limit to be dropped")
+			}
+			s.remove("a")
+			if entries, size := s.stats(); entries != 1 || size != 4 {
+				t.Errorf("Expected c alone to be left, got %d entries of %d bytes", entries, size)
+			}
+			if n := s.clear(); n != 1 {
+				t.Errorf("Expected clear to report 1 entry, got %d", n)
+			}
+			if entries, _ := s.stats(); entries != 0 {
+				t.Errorf("Expected clear to drop everything, got %d entries", entries)
+			}
+		})
+	}
+}
+
+func TestOpenDiskStore(t *testing.T) {
+	dir := t.TempDir()
+	s, err := openDiskStore(dir, 100)
+	if err != nil {
+		t.Fatalf("openDiskStore: %v", err)
+	}
+	s.set("a", []byte("aaaa"))
+	s.set("b", []byte("bbbb"))
+	os.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("partial"), 0o644)
+
+	// Reopened with less room, the store keeps what fits
+	s, err = openDiskStore(dir, 6)
+	if err != nil {
+		t.Fatalf("openDiskStore: %v", err)
+	}
+	if entries, size := s.stats(); entries != 1 || size != 4 {
+		t.Errorf("Expected 1 entry of 4 bytes, got %d of %d", entries, size)
+	}
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("Expected the evicted entry and the leftover temporary file removed, got %d files", len(files))
+	}
+}
@@ -0,0 +1,731 @@
+// Package config loads nproxy's configuration from a YAML, JSON or TOML
+// file, applies environment variable overrides and validates the result,
+// reporting every problem with where the offending value came from.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+
+	"nproxy/app/breaker"
+	"nproxy/app/cache"
+	"nproxy/app/filter"
+	"nproxy/app/limits"
+	"nproxy/app/retry"
+	"nproxy/app/reverse"
+	"nproxy/app/trace"
+	"nproxy/app/transport"
+)
+
+// Config is the complete proxy configuration. Field names in files are
+// the yaml/toml tags; nested keys are written with dots in paths and
+// environment variables, e.g. admin.listen and NPROXY_ADMIN_LISTEN.
+type Config struct {
+	Listen         string               `yaml:"listen" toml:"listen"`
+	DrainTimeout   time.Duration        `yaml:"drain_timeout" toml:"drain_timeout"` // how long shutdown waits for in-flight requests and tunnels
+	Auth           AuthConfig           `yaml:"auth" toml:"auth"`
+	ACL            ACLConfig            `yaml:"acl" toml:"acl"`
+	Upstream       UpstreamConfig       `yaml:"upstream" toml:"upstream"`
+	Retry          RetryConfig          `yaml:"retry" toml:"retry"`
+	CircuitBreaker CircuitBreakerConfig `yaml:"circuit_breaker" toml:"circuit_breaker"`
+	ErrorPages     bool                 `yaml:"error_pages" toml:"error_pages"` // describe upstream failures in HTML or JSON to clients that accept them
+	Limits         LimitsConfig         `yaml:"limits" toml:"limits"`
+	Transport      TransportConfig      `yaml:"transport" toml:"transport"`
+	Cache          CacheConfig          `yaml:"cache" toml:"cache"`
+	Headers        HeadersConfig        `yaml:"headers" toml:"headers"`
+	SOCKS          SOCKSConfig          `yaml:"socks" toml:"socks"`
+	Transparent    TransparentConfig    `yaml:"transparent" toml:"transparent"`
+	Reverse        ReverseConfig        `yaml:"reverse" toml:"reverse"`
+	CA             CAConfig             `yaml:"ca" toml:"ca"`
+	MITM           MITMConfig           `yaml:"mitm" toml:"mitm"`
+	Rules          []RuleConfig         `yaml:"rules" toml:"rules"`
+	Recording      RecordingConfig      `yaml:"recording" toml:"recording"`
+	Logging        LoggingConfig        `yaml:"logging" toml:"logging"`
+	Admin          AdminConfig          `yaml:"admin" toml:"admin"`
+	Tracing        TracingConfig        `yaml:"tracing" toml:"tracing"`
+
+	// locations maps setting paths to where their values came from
+	locations map[string]string
+	file      string
+}
+
+// AuthConfig requires proxy clients to authenticate with Basic credentials
+// from an htpasswd file. Authentication is off when Htpasswd is empty.
+type AuthConfig struct {
+	Htpasswd string `yaml:"htpasswd" toml:"htpasswd"`
+	Realm    string `yaml:"realm" toml:"realm"` // shown by clients when asking for credentials
+}
+
+// ACLConfig restricts which clients may use the proxy and which
+// destinations they may reach
+type ACLConfig struct {
+	Clients      ClientACLConfig      `yaml:"clients" toml:"clients"`
+	Destinations DestinationACLConfig `yaml:"destinations" toml:"destinations"`
+}
+
+// ClientACLConfig lists client addresses and CIDR prefixes. Deny entries
+// win; when there are allow entries every other client is refused.
+type ClientACLConfig struct {
+	Allow []string `yaml:"allow" toml:"allow"`
+	Deny  []string `yaml:"deny" toml:"deny"`
+}
+
+// DestinationACLConfig lists upstream hosts, addresses and CIDR prefixes,
+// each optionally with a port. Once enabled, internal addresses such as
+// private ranges and 169.254.169.254 are blocked unless AllowInternal is
+// set or an allow entry names them.
+type DestinationACLConfig struct {
+	Enabled       bool     `yaml:"enabled" toml:"enabled"`
+	AllowInternal bool     `yaml:"allow_internal" toml:"allow_internal"`
+	Allow         []string `yaml:"allow" toml:"allow"`
+	Deny          []string `yaml:"deny" toml:"deny"`
+}
+
+// UpstreamConfig chains the proxy to other proxies. Every outbound
+// connection goes through the proxy of the first route matching its host,
+// or directly for hosts in NoProxy, or through Default.
+type UpstreamConfig struct {
+	Proxies map[string]string     `yaml:"proxies" toml:"proxies"`   // http://, https:// or socks5:// URLs by name
+	Default string                `yaml:"default" toml:"default"`   // proxy name, or empty or "direct" to connect directly
+	NoProxy string                `yaml:"no_proxy" toml:"no_proxy"` // NO_PROXY-style list; the NO_PROXY variable when empty
+	Routes  []UpstreamRouteConfig `yaml:"routes" toml:"routes"`
+}
+
+// UpstreamRouteConfig sends connections to Hosts, written as in NO_PROXY,
+// through the proxy named Via, or directly when Via is "direct"
+type UpstreamRouteConfig struct {
+	Hosts []string `yaml:"hosts" toml:"hosts"`
+	Via   string   `yaml:"via" toml:"via"`
+}
+
+// RetryConfig retries upstream requests whose connection failed or whose
+// response status is in Statuses, up to Attempts tries in all. Only Methods
+// are retried, the idempotent ones when it is empty. Retries wait Backoff,
+// doubled after each one up to MaxBackoff, less random jitter. Request
+// bodies up to MaxBody bytes are kept for replay; bigger ones are sent once.
+type RetryConfig struct {
+	Attempts   int           `yaml:"attempts" toml:"attempts"` // 0 or 1 never retries
+	Methods    []string      `yaml:"methods" toml:"methods"`
+	Statuses   []int         `yaml:"statuses" toml:"statuses"`
+	Backoff    time.Duration `yaml:"backoff" toml:"backoff"`         // 100ms when zero
+	MaxBackoff time.Duration `yaml:"max_backoff" toml:"max_backoff"` // 2s when zero
+	MaxBody    int           `yaml:"max_body" toml:"max_body"`       // 64 KiB when zero
+}
+
+// Policy returns the retry policy for the retry package
+func (rc RetryConfig) Policy() retry.Policy {
+	return retry.Policy{Attempts: rc.Attempts, Methods: rc.Methods, Statuses: rc.Statuses,
+		Backoff: rc.Backoff, MaxBackoff: rc.MaxBackoff, MaxBody: int64(rc.MaxBody)}
+}
+
+// CircuitBreakerConfig opens the circuit of an upstream host after Failures
+// failed requests in a row, refusing requests to it with 503 for OpenTime.
+// HalfOpenRequests trial requests are then let through, and the circuit
+// closes once they succeed. The breakers are off when Failures is zero.
+type CircuitBreakerConfig struct {
+	Failures         int           `yaml:"failures" toml:"failures"`
+	OpenTime         time.Duration `yaml:"open_time" toml:"open_time"`                   // 30s when zero
+	HalfOpenRequests int           `yaml:"half_open_requests" toml:"half_open_requests"` // 1 when zero
+}
+
+// Settings returns the settings for the breaker package
+func (cc CircuitBreakerConfig) Settings() breaker.Settings {
+	return breaker.Settings{Failures: cc.Failures, OpenTime: cc.OpenTime, HalfOpenRequests: cc.HalfOpenRequests}
+}
+
+// LimitsConfig bounds each phase of the connections from clients and to
+// upstreams, the size of requests and responses and the connections a
+// client may hold open. A zero value turns its limit off.
+type LimitsConfig struct {
+	Client            ClientTimeoutsConfig   `yaml:"client" toml:"client"`
+	Upstream          UpstreamTimeoutsConfig `yaml:"upstream" toml:"upstream"`
+	MaxHeaderBytes    int                    `yaml:"max_header_bytes" toml:"max_header_bytes"` // 1 MiB when zero
+	MaxRequestBody    int                    `yaml:"max_request_body" toml:"max_request_body"`
+	MaxResponseBody   int                    `yaml:"max_response_body" toml:"max_response_body"`
+	MaxConnsPerClient int                    `yaml:"max_conns_per_client" toml:"max_conns_per_client"`
+}
+
+// ClientTimeoutsConfig bounds the phases of client connections
+type ClientTimeoutsConfig struct {
+	TLSHandshake time.Duration `yaml:"tls_handshake" toml:"tls_handshake"` // of intercepted connections
+	Header       time.Duration `yaml:"header" toml:"header"`               // reading a request head
+	Idle         time.Duration `yaml:"idle" toml:"idle"`                   // waiting for the next request
+	Request      time.Duration `yaml:"request" toml:"request"`             // reading a whole request, body included
+}
+
+// UpstreamTimeoutsConfig bounds the phases of upstream connections
+type UpstreamTimeoutsConfig struct {
+	Dial         time.Duration `yaml:"dial" toml:"dial"`
+	TLSHandshake time.Duration `yaml:"tls_handshake" toml:"tls_handshake"`
+	Header       time.Duration `yaml:"header" toml:"header"`   // waiting for the response head once the request is sent
+	Idle         time.Duration `yaml:"idle" toml:"idle"`       // how long pooled connections are kept
+	Request      time.Duration `yaml:"request" toml:"request"` // a whole exchange, response body included
+}
+
+// Limits returns the limits for the limits package
+func (lc LimitsConfig) Limits() limits.Limits {
+	c, u := lc.Client, lc.Upstream
+	return limits.Limits{
+		Client: limits.Timeouts{TLSHandshake: c.TLSHandshake, Header: c.Header, Idle: c.Idle, Request: c.Request},
+		Upstream: limits.Timeouts{Dial: u.Dial, TLSHandshake: u.TLSHandshake, Header: u.Header,
+			Idle: u.Idle, Request: u.Request},
+		MaxHeaderBytes:    lc.MaxHeaderBytes,
+		MaxRequestBody:    int64(lc.MaxRequestBody),
+		MaxResponseBody:   int64(lc.MaxResponseBody),
+		MaxConnsPerClient: lc.MaxConnsPerClient,
+	}
+}
+
+// TransportConfig sets up the connections to upstream servers, which are
+// pooled across all flows. Dial, handshake and idle timeouts are limits.
+type TransportConfig struct {
+	MaxIdleConns        int                `yaml:"max_idle_conns" toml:"max_idle_conns"`                   // in all; 0 for no limit
+	MaxIdleConnsPerHost int                `yaml:"max_idle_conns_per_host" toml:"max_idle_conns_per_host"` // 2 when zero
+	MaxConnsPerHost     int                `yaml:"max_conns_per_host" toml:"max_conns_per_host"`           // busy or idle; 0 for no limit
+	KeepAlive           time.Duration      `yaml:"keep_alive" toml:"keep_alive"`                           // TCP keep-alive interval; negative turns it off
+	HTTP2               bool               `yaml:"http2" toml:"http2"`                                     // negotiate HTTP/2 with servers over TLS
+	TLS                 TransportTLSConfig `yaml:"tls" toml:"tls"`
+}
+
+// TransportTLSConfig sets up TLS to upstream servers
+type TransportTLSConfig struct {
+	VerifyIntercepted bool   `yaml:"verify_intercepted" toml:"verify_intercepted"` // check the certificates of intercepted servers too
+	CA                string `yaml:"ca" toml:"ca"`                                 // PEM file of trusted roots; the system's when empty
+	MinVersion        string `yaml:"min_version" toml:"min_version"`               // 1.0 to 1.3
+}
+
+// Settings returns the settings for the transport package, loading the
+// trusted roots
+func (tc TransportConfig) Settings() (transport.Settings, error) {
+	s := transport.Settings{
+		MaxIdleConns:        tc.MaxIdleConns,
+		MaxIdleConnsPerHost: tc.MaxIdleConnsPerHost,
+		MaxConnsPerHost:     tc.MaxConnsPerHost,
+		KeepAlive:           tc.KeepAlive,
+		HTTP2:               tc.HTTP2,
+		TLS:                 transport.TLS{VerifyIntercepted: tc.TLS.VerifyIntercepted},
+	}
+	var err error
+	if s.TLS.MinVersion, err = transport.ParseVersion(tc.TLS.MinVersion); err != nil {
+		return s, err
+	}
+	if tc.TLS.CA != "" {
+		if s.TLS.RootCAs, err = transport.LoadRoots(tc.TLS.CA); err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+// CacheConfig sets up the response cache shared by forwarded and
+// intercepted requests
+type CacheConfig struct {
+	Enabled      bool                  `yaml:"enabled" toml:"enabled"`
+	Dir          string                `yaml:"dir" toml:"dir"`                       // keep responses on disk here; in memory when empty
+	MaxSize      int                   `yaml:"max_size" toml:"max_size"`             // bytes of stored responses in all
+	MaxEntrySize int                   `yaml:"max_entry_size" toml:"max_entry_size"` // largest response body stored
+	Private      bool                  `yaml:"private" toml:"private"`               // store private responses, as a browser cache would
+	Overrides    []CacheOverrideConfig `yaml:"overrides" toml:"overrides"`
+}
+
+// CacheOverrideConfig caches the GET requests Filter matches regardless of
+// what their responses say, keeping them fresh for TTL, or for good when
+// TTL is zero
+type CacheOverrideConfig struct {
+	Filter string        `yaml:"filter" toml:"filter"`
+	TTL    time.Duration `yaml:"ttl" toml:"ttl"`
+}
+
+// Settings returns the settings for the cache package, parsing the
+// override filters
+func (cc CacheConfig) Settings() (cache.Settings, error) {
+	s := cache.Settings{Dir: cc.Dir, MaxSize: int64(cc.MaxSize), MaxEntrySize: int64(cc.MaxEntrySize), Private: cc.Private}
+	for i, o := range cc.Overrides {
+		f, err := filter.Parse(o.Filter)
+		if err != nil {
+			return s, fmt.Errorf("overrides[%d].filter: %v", i, err)
+		}
+		s.Overrides = append(s.Overrides, cache.Override{Filter: f, TTL: o.TTL})
+	}
+	return s, nil
+}
+
+// HeadersConfig sets the headers with which the proxy records itself and
+// its clients in the messages it forwards. Hop-by-hop headers are always
+// removed.
+type HeadersConfig struct {
+	Via       string `yaml:"via" toml:"via"`             // pseudonym added to Via in requests and responses; none when empty
+	Forwarded bool   `yaml:"forwarded" toml:"forwarded"` // describe clients in Forwarded and X-Forwarded-* of forwarded requests
+}
+
+// SOCKSConfig configures the mitm command's SOCKS5 listener, which is off
+// when Listen is empty
+type SOCKSConfig struct {
+	Listen string `yaml:"listen" toml:"listen"`
+	UDP    bool   `yaml:"udp" toml:"udp"` // relay UDP ASSOCIATE datagrams
+}
+
+// TransparentConfig configures the mitm command's listener for connections
+// redirected by the firewall, which is off when Listen is empty
+type TransparentConfig struct {
+	Listen string `yaml:"listen" toml:"listen"`
+}
+
+// ReverseConfig configures the mitm command's reverse proxy listener, which
+// is off when Listen is empty. With TLS on, certificates come from Cert and
+// Key when they are set, and are issued by the CA otherwise.
+type ReverseConfig struct {
+	Listen string               `yaml:"listen" toml:"listen"`
+	TLS    bool                 `yaml:"tls" toml:"tls"`
+	Cert   string               `yaml:"cert" toml:"cert"`
+	Key    string               `yaml:"key" toml:"key"`
+	Routes []ReverseRouteConfig `yaml:"routes" toml:"routes"`
+	Pools  []ReversePoolConfig  `yaml:"pools" toml:"pools"`
+}
+
+// ReverseRouteConfig sends requests for Host whose path starts with Path to
+// Upstream, or to an upstream of the named Pool. The first matching route is
+// used.
+type ReverseRouteConfig struct {
+	Host         string       `yaml:"host" toml:"host"` // example.com or *.example.com; any host when empty
+	Path         string       `yaml:"path" toml:"path"` // path prefix; every path when empty
+	Upstream     string       `yaml:"upstream" toml:"upstream"`
+	Pool         string       `yaml:"pool" toml:"pool"`                   // instead of upstream
+	StripPrefix  bool         `yaml:"strip_prefix" toml:"strip_prefix"`   // remove Path before passing the path on
+	PreserveHost bool         `yaml:"preserve_host" toml:"preserve_host"` // pass the Host header on instead of the upstream's
+	Retry        *RetryConfig `yaml:"retry" toml:"retry"`                 // replaces the top-level retry policy for this route
+}
+
+// ReversePoolConfig is a named group of upstreams that routes balance
+// requests over
+type ReversePoolConfig struct {
+	Name        string            `yaml:"name" toml:"name"`
+	Upstreams   []string          `yaml:"upstreams" toml:"upstreams"`
+	Balance     string            `yaml:"balance" toml:"balance"`         // round_robin (default), least_conn or hash
+	HashHeader  string            `yaml:"hash_header" toml:"hash_header"` // with hash, the header that picks the upstream
+	HashCookie  string            `yaml:"hash_cookie" toml:"hash_cookie"` // with hash, the cookie used without the header
+	HealthCheck HealthCheckConfig `yaml:"health_check" toml:"health_check"`
+	Outlier     OutlierConfig     `yaml:"outlier" toml:"outlier"`
+}
+
+// Pool returns the pool for the reverse package
+func (pc ReversePoolConfig) Pool() reverse.Pool {
+	hc, o := pc.HealthCheck, pc.Outlier
+	return reverse.Pool{
+		Name: pc.Name, Upstreams: pc.Upstreams, Balance: pc.Balance, HashHeader: pc.HashHeader, HashCookie: pc.HashCookie,
+		HealthCheck: reverse.HealthCheck{Path: hc.Path, Interval: hc.Interval, Timeout: hc.Timeout,
+			HealthyThreshold: hc.HealthyThreshold, UnhealthyThreshold: hc.UnhealthyThreshold},
+		Outlier: reverse.Outlier{ConsecutiveErrors: o.ConsecutiveErrors, EjectionTime: o.EjectionTime},
+	}
+}
+
+// HealthCheckConfig sends GET Path to each upstream of a pool every
+// Interval; it is off when Path is empty. Zero values take the defaults:
+// every 10s, a 2s timeout, healthy after 2 passes and unhealthy after 3
+// failures in a row.
+type HealthCheckConfig struct {
+	Path               string        `yaml:"path" toml:"path"`
+	Interval           time.Duration `yaml:"interval" toml:"interval"`
+	Timeout            time.Duration `yaml:"timeout" toml:"timeout"`
+	HealthyThreshold   int           `yaml:"healthy_threshold" toml:"healthy_threshold"`
+	UnhealthyThreshold int           `yaml:"unhealthy_threshold" toml:"unhealthy_threshold"`
+}
+
+// OutlierConfig ejects an upstream whose requests fail ConsecutiveErrors
+// times in a row for EjectionTime (30s when zero). It is off when
+// ConsecutiveErrors is zero.
+type OutlierConfig struct {
+	ConsecutiveErrors int           `yaml:"consecutive_errors" toml:"consecutive_errors"`
+	EjectionTime      time.Duration `yaml:"ejection_time" toml:"ejection_time"`
+}
+
+// CAConfig locates the MITM certificate authority. When Cert and Key are
+// set the CA is loaded from them, or created there on first use; otherwise
+// a new CA is generated on every start.
+type CAConfig struct {
+	Dir  string `yaml:"dir" toml:"dir"` // where ca.crt is published for clients
+	Cert string `yaml:"cert" toml:"cert"`
+	Key  string `yaml:"key" toml:"key"`
+}
+
+// MITMConfig holds settings specific to the MITM proxy
+type MITMConfig struct {
+	ServerTiming     bool `yaml:"server_timing" toml:"server_timing"`
+	BodyCaptureLimit int  `yaml:"body_capture_limit" toml:"body_capture_limit"`
+}
+
+// RuleConfig is a declarative modification rule applied to flows matching
+// Filter
+type RuleConfig struct {
+	Name                  string            `yaml:"name" toml:"name"`
+	Enabled               *bool             `yaml:"enabled" toml:"enabled"` // defaults to true
+	Filter                string            `yaml:"filter" toml:"filter"`
+	SetRequestHeaders     map[string]string `yaml:"set_request_headers" toml:"set_request_headers"`
+	RemoveRequestHeaders  []string          `yaml:"remove_request_headers" toml:"remove_request_headers"`
+	SetResponseHeaders    map[string]string `yaml:"set_response_headers" toml:"set_response_headers"`
+	RemoveResponseHeaders []string          `yaml:"remove_response_headers" toml:"remove_response_headers"`
+	Log                   bool              `yaml:"log" toml:"log"` // log request and response headers
+}
+
+// IsEnabled reports whether the rule starts enabled
+func (r RuleConfig) IsEnabled() bool {
+	return r.Enabled == nil || *r.Enabled
+}
+
+// RecordingConfig controls the in-memory flow history
+type RecordingConfig struct {
+	Enabled bool   `yaml:"enabled" toml:"enabled"`
+	History int    `yaml:"history" toml:"history"`
+	Filter  string `yaml:"filter" toml:"filter"`
+	File    string `yaml:"file" toml:"file"` // recorded flows are written here on shutdown
+}
+
+// LoggingConfig controls log output
+type LoggingConfig struct {
+	Verbose bool   `yaml:"verbose" toml:"verbose"`
+	Filter  string `yaml:"filter" toml:"filter"` // flows whose timing line is logged
+	File    string `yaml:"file" toml:"file"`     // log file instead of stderr
+}
+
+// AdminConfig configures the admin listener
+type AdminConfig struct {
+	Listen string `yaml:"listen" toml:"listen"`
+	Token  string `yaml:"token" toml:"token"`
+}
+
+// TracingConfig configures span export. Zero sizes and interval select the
+// exporter's defaults.
+type TracingConfig struct {
+	OTLP          string        `yaml:"otlp" toml:"otlp"`                     // OTLP/HTTP traces endpoint
+	BatchSize     int           `yaml:"batch_size" toml:"batch_size"`         // spans per export request
+	QueueSize     int           `yaml:"queue_size" toml:"queue_size"`         // spans buffered before dropping
+	FlushInterval time.Duration `yaml:"flush_interval" toml:"flush_interval"` // longest a span waits in the queue
+	DropPolicy    string        `yaml:"drop_policy" toml:"drop_policy"`       // newest or oldest: which span a full queue discards
+}
+
+// Options returns the options of the trace exporter
+func (tc TracingConfig) Options() (trace.ExporterOptions, error) {
+	opts := trace.ExporterOptions{BatchSize: tc.BatchSize, QueueSize: tc.QueueSize, FlushInterval: tc.FlushInterval}
+	var err error
+	opts.DropPolicy, err = trace.ParseDropPolicy(tc.DropPolicy)
+	return opts, err
+}
+
+// Default returns the configuration used when no file is given
+func Default() *Config {
+	return &Config{
+		Listen:       ":8080",
+		DrainTimeout: 30 * time.Second,
+		Auth:         AuthConfig{Realm: "nproxy"},
+		Limits:       defaultLimits(),
+		Transport:    defaultTransport(),
+		Cache:        defaultCache(),
+		CA:           CAConfig{Dir: "./certs"},
+		MITM:         MITMConfig{BodyCaptureLimit: 128 << 10},
+		Recording: RecordingConfig{
+			Enabled: true,
+			History: 1000,
+		},
+		locations: make(map[string]string),
+	}
+}
+
+// defaultLimits returns the default limits of the limits package as
+// settings
+func defaultLimits() LimitsConfig {
+	l := limits.Default()
+	c, u := l.Client, l.Upstream
+	return LimitsConfig{
+		Client:   ClientTimeoutsConfig{TLSHandshake: c.TLSHandshake, Header: c.Header, Idle: c.Idle, Request: c.Request},
+		Upstream: UpstreamTimeoutsConfig{Dial: u.Dial, TLSHandshake: u.TLSHandshake, Header: u.Header, Idle: u.Idle, Request: u.Request},
+	}
+}
+
+// defaultTransport returns the default settings of the transport package
+func defaultTransport() TransportConfig {
+	s := transport.Default()
+	return TransportConfig{MaxIdleConns: s.MaxIdleConns, MaxIdleConnsPerHost: s.MaxIdleConnsPerHost,
+		MaxConnsPerHost: s.MaxConnsPerHost, KeepAlive: s.KeepAlive, HTTP2: s.HTTP2}
+}
+
+// defaultCache returns the default size limits of the cache package
+func defaultCache() CacheConfig {
+	s := cache.Default()
+	return CacheConfig{MaxSize: int(s.MaxSize), MaxEntrySize: int(s.MaxEntrySize)}
+}
+
+// Problem is a configuration error and where it was found
+type Problem struct {
+	Location string // file:line:column, environment variable or flag
+	Path     string // setting path such as rules[0].filter; empty for syntax errors
+	Message  string
+}
+
+func (p Problem) String() string {
+	if p.Path == "" {
+		return fmt.Sprintf("%s: %s", p.Location, p.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", p.Location, p.Path, p.Message)
+}
+
+// Problems is a list of configuration problems usable as an error
+type Problems []Problem
+
+func (ps Problems) Error() string {
+	lines := make([]string, len(ps))
+	for i, p := range ps {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Load reads the configuration file at path on top of the defaults. The
+// format is chosen by extension: .yaml, .yml, .json or .toml. All problems
+// found while decoding are returned together; the returned Config holds
+// whatever could be decoded.
+func Load(path string) (*Config, Problems) {
+	c := Default()
+	c.file = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return c, Problems{{Location: path, Message: err.Error()}}
+	}
+
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		return c, c.decodeYAML(data)
+	case ".json":
+		if problem, ok := c.checkJSON(data); !ok {
+			return c, Problems{problem}
+		}
+		// JSON is YAML except that YAML rejects tabs as indentation. Raw
+		// tabs can only be whitespace in valid JSON, so replacing them
+		// changes nothing else.
+		return c, c.decodeYAML(bytes.ReplaceAll(data, []byte("\t"), []byte(" ")))
+	case ".toml":
+		return c, c.decodeTOML(data)
+	default:
+		return c, Problems{{Location: path, Message: fmt.Sprintf("unsupported file type %q; use .yaml, .yml, .json or .toml", ext)}}
+	}
+}
+
+// checkJSON rejects input that YAML would accept but JSON doesn't, such
+// as trailing commas or comments
+func (c *Config) checkJSON(data []byte) (Problem, bool) {
+	var v any
+	err := json.Unmarshal(data, &v)
+	var syntaxErr *json.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return Problem{}, true
+	}
+	line, col := 1, 1
+	for _, b := range data[:max(syntaxErr.Offset-1, 0)] {
+		if b == '\n' {
+			line, col = line+1, 1
+		} else {
+			col++
+		}
+	}
+	return Problem{Location: fmt.Sprintf("%s:%d:%d", c.file, line, col), Message: syntaxErr.Error()}, false
+}
+
+// decodeYAML decodes YAML or JSON, which YAML accepts as well, recording
+// the position of every setting
+func (c *Config) decodeYAML(data []byte) Problems {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return Problems{{Location: c.yamlErrorLocation(err.Error()), Message: trimYAMLError(err.Error())}}
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+
+	root := doc.Content[0]
+	problems := c.walkYAML(root, reflect.TypeOf(*c), "")
+	if err := root.Decode(c); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return append(problems, Problem{Location: c.file, Message: err.Error()})
+		}
+		for _, msg := range typeErr.Errors {
+			problems = append(problems, Problem{Location: c.yamlErrorLocation(msg), Message: trimYAMLError(msg)})
+		}
+	}
+	return problems
+}
+
+// walkYAML records the position of each setting under n and reports keys
+// that don't correspond to a setting
+func (c *Config) walkYAML(n *yaml.Node, t reflect.Type, path string) Problems {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if path != "" {
+		c.locations[path] = fmt.Sprintf("%s:%d:%d", c.file, n.Line, n.Column)
+	}
+
+	var problems Problems
+	switch {
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Struct:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key, value := n.Content[i], n.Content[i+1]
+			field, ok := fieldByTag(t, "yaml", key.Value)
+			if !ok {
+				problems = append(problems, Problem{
+					Location: fmt.Sprintf("%s:%d:%d", c.file, key.Line, key.Column),
+					Path:     join(path, key.Value),
+					Message:  unknownKeyMessage(t, "yaml", key.Value),
+				})
+				continue
+			}
+			problems = append(problems, c.walkYAML(value, field.Type, join(path, key.Value))...)
+		}
+	case n.Kind == yaml.MappingNode && t.Kind() == reflect.Map:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			problems = append(problems, c.walkYAML(n.Content[i+1], t.Elem(), join(path, n.Content[i].Value))...)
+		}
+	case n.Kind == yaml.SequenceNode && t.Kind() == reflect.Slice:
+		for i, item := range n.Content {
+			problems = append(problems, c.walkYAML(item, t.Elem(), fmt.Sprintf("%s[%d]", path, i))...)
+		}
+	}
+	return problems
+}
+
+// yamlErrorLocation turns the "line N:" prefix of a yaml.v3 error into a
+// file location
+func (c *Config) yamlErrorLocation(msg string) string {
+	var line int
+	if i := strings.Index(msg, "line "); i >= 0 {
+		fmt.Sscanf(msg[i:], "line %d", &line)
+	}
+	if line == 0 {
+		return c.file
+	}
+	return fmt.Sprintf("%s:%d", c.file, line)
+}
+
+// trimYAMLError drops the package and line prefixes from a yaml.v3 error
+func trimYAMLError(msg string) string {
+	msg = strings.TrimPrefix(msg, "yaml: ")
+	if strings.HasPrefix(msg, "line ") {
+		if i := strings.Index(msg, ": "); i >= 0 {
+			msg = msg[i+2:]
+		}
+	}
+	return msg
+}
+
+func (c *Config) decodeTOML(data []byte) Problems {
+	md, err := toml.Decode(string(data), c)
+	if err != nil {
+		var parseErr toml.ParseError
+		if errors.As(err, &parseErr) {
+			loc := fmt.Sprintf("%s:%d:%d", c.file, parseErr.Position.Line, parseErr.Position.Col)
+			return Problems{{Location: loc, Message: parseErr.Message}}
+		}
+		return Problems{{Location: c.file, Message: err.Error()}}
+	}
+
+	// TOML keys carry no positions, so problems are located by path
+	var problems Problems
+	for _, key := range md.Keys() {
+		c.locations[tomlPath(key)] = c.file
+	}
+	for _, key := range md.Undecoded() {
+		parent := reflect.TypeOf(*c)
+		for _, k := range key[:len(key)-1] {
+			if f, ok := fieldByTag(parent, "toml", k); ok {
+				parent = f.Type
+				for parent.Kind() == reflect.Slice || parent.Kind() == reflect.Pointer {
+					parent = parent.Elem()
+				}
+			}
+		}
+		problems = append(problems, Problem{
+			Location: c.file,
+			Path:     tomlPath(key),
+			Message:  unknownKeyMessage(parent, "toml", key[len(key)-1]),
+		})
+	}
+	return problems
+}
+
+// tomlPath formats a TOML key as a setting path. Array indexes are not
+// part of TOML keys, so rules are reported as rules.name rather than
+// rules[0].name.
+func tomlPath(key toml.Key) string {
+	return strings.Join(key, ".")
+}
+
+// fieldByTag finds the struct field of t whose tag of the given kind is name
+func fieldByTag(t reflect.Type, tag, name string) (reflect.StructField, bool) {
+	if t.Kind() != reflect.Struct {
+		return reflect.StructField{}, false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.IsExported() && strings.Split(f.Tag.Get(tag), ",")[0] == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func unknownKeyMessage(t reflect.Type, tag, name string) string {
+	var known []string
+	if t.Kind() == reflect.Struct {
+		for i := 0; i < t.NumField(); i++ {
+			if k := strings.Split(t.Field(i).Tag.Get(tag), ",")[0]; k != "" {
+				known = append(known, k)
+			}
+		}
+	}
+	return fmt.Sprintf("unknown key %q; expected one of %s", name, strings.Join(known, ", "))
+}
+
+func join(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+// Locate records where the value at path came from, e.g. "flag -addr",
+// so that validation problems point there
+func (c *Config) Locate(path, location string) {
+	c.locations[path] = location
+}
+
+// location returns where the setting at path, or its closest parent, was
+// set. Defaults are reported against the file, or as defaults.
+func (c *Config) location(path string) string {
+	for p := path; p != ""; p = parentPath(p) {
+		if loc, ok := c.locations[p]; ok {
+			return loc
+		}
+	}
+	if c.file != "" {
+		return c.file
+	}
+	return "default"
+}
+
+func parentPath(p string) string {
+	i := strings.LastIndexAny(p, ".[")
+	if i < 0 {
+		return ""
+	}
+	return p[:i]
+}
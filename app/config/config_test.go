@@ -0,0 +1,500 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// problemStrings formats problems without the temporary directory
+func problemStrings(ps Problems, dir string) []string {
+	var out []string
+	for _, p := range ps {
+		out = append(out, strings.ReplaceAll(p.String(), dir+string(filepath.Separator), ""))
+	}
+	return out
+}
+
+func expectProblems(t *testing.T, got Problems, dir string, want ...string) {
+	t.Helper()
+	lines := problemStrings(got, dir)
+	if len(lines) != len(want) {
+		t.Fatalf("Expected %d problems, got %d:\n%s", len(want), len(lines), strings.Join(lines, "\n"))
+	}
+	for i := range want {
+		if !strings.HasPrefix(lines[i], want[i]) {
+			t.Errorf("Problem %d:\n got: %s\nwant: %s...", i, lines[i], want[i])
+		}
+	}
+}
+
+func TestDefaultIsValid(t *testing.T) {
+	if problems := Default().Validate(); len(problems) != 0 {
+		t.Errorf("Expected the defaults to be valid, got:\n%v", problems)
+	}
+}
+
+const validYAML = `
+listen: ":8081"
+ca:
+  cert: ca/ca.crt
+  key: ca/ca.key
+mitm:
+  server_timing: true
+  body_capture_limit: 0
+rules:
+  - name: tag-api
+    filter: 'host ~ "api\."'
+    set_request_headers:
+      X-Debug: "1"
+  - name: quiet
+    enabled: false
+    log: true
+recording:
+  history: 50
+admin:
+  listen: 127.0.0.1:9091
+  token: secret
+tracing:
+  otlp: http://localhost:4318/v1/traces
+`
+
+func TestLoadYAML(t *testing.T) {
+	c, problems := Load(writeFile(t, "nproxy.yaml", validYAML))
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected problems:\n%v", problems)
+	}
+	if problems := c.Validate(); len(problems) != 0 {
+		t.Fatalf("Unexpected validation problems:\n%v", problems)
+	}
+
+	if c.Listen != ":8081" || c.CA.Cert != "ca/ca.crt" || c.Admin.Token != "secret" || c.Recording.History != 50 {
+		t.Errorf("Settings not loaded: %+v", c)
+	}
+	if !c.MITM.ServerTiming || c.MITM.BodyCaptureLimit != 0 {
+		t.Errorf("Expected explicit zero and true to override defaults, got %+v", c.MITM)
+	}
+	// Settings missing from the file keep their defaults
+	if c.CA.Dir != "./certs" || !c.Recording.Enabled {
+		t.Errorf("Expected defaults for unset settings, got %+v %+v", c.CA, c.Recording)
+	}
+	if len(c.Rules) != 2 || c.Rules[0].SetRequestHeaders["X-Debug"] != "1" || !c.Rules[0].IsEnabled() || c.Rules[1].IsEnabled() {
+		t.Errorf("Rules not loaded: %+v", c.Rules)
+	}
+}
+
+func TestLoadJSONAndTOML(t *testing.T) {
+	jsonPath := writeFile(t, "nproxy.json", "{\n\t\"listen\": \":8082\",\n\t\"rules\": [{\"name\": \"a\", \"log\": true}]\n}\n")
+	c, problems := Load(jsonPath)
+	if len(problems) != 0 || c.Listen != ":8082" || len(c.Rules) != 1 {
+		t.Errorf("JSON not loaded: %v %+v", problems, c)
+	}
+
+	tomlPath := writeFile(t, "nproxy.toml", `
+listen = ":8083"
+
+[admin]
+listen = ":9091"
+
+[[rules]]
+name = "a"
+remove_response_headers = ["Server"]
+`)
+	c, problems = Load(tomlPath)
+	if len(problems) != 0 || c.Listen != ":8083" || c.Admin.Listen != ":9091" || c.Rules[0].RemoveResponseHeaders[0] != "Server" {
+		t.Errorf("TOML not loaded: %v %+v", problems, c)
+	}
+}
+
+func TestLoadReportsEveryDecodeProblem(t *testing.T) {
+	path := writeFile(t, "bad.yaml", `
+listen: ":8080"
+admin:
+  tokn: secret
+recording:
+  history: many
+rules:
+  - name: a
+    lgo: true
+`)
+	_, problems := Load(path)
+	expectProblems(t, problems, filepath.Dir(path),
+		`bad.yaml:4:3: admin.tokn: unknown key "tokn"; expected one of listen, token`,
+		`bad.yaml:9:5: rules[0].lgo: unknown key "lgo"`,
+		"bad.yaml:6: cannot unmarshal !!str `many` into int",
+	)
+}
+
+func TestLoadSyntaxErrors(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"bad.yaml": "listen: [\n",
+		"bad.toml": "listen = \n",
+		"bad.json": `{"listen": ":8080",}`,
+		"bad.ini":  "listen=:8080",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(content), 0644)
+		_, problems := Load(path)
+		if len(problems) != 1 || !strings.HasPrefix(problems[0].Location, path) {
+			t.Errorf("%s: expected one problem located in the file, got %v", name, problems)
+		}
+	}
+
+	_, problems := Load(filepath.Join(dir, "missing.yaml"))
+	if len(problems) != 1 || !strings.Contains(problems[0].Message, "no such file") {
+		t.Errorf("Expected a missing file problem, got %v", problems)
+	}
+}
+
+func TestLoadTOMLUnknownKeys(t *testing.T) {
+	path := writeFile(t, "nproxy.toml", `
+[[rules]]
+name = "a"
+log = true
+enabld = false
+`)
+	_, problems := Load(path)
+	expectProblems(t, problems, filepath.Dir(path), `nproxy.toml: rules.enabld: unknown key "enabld"; expected one of name, enabled`)
+}
+
+func TestApplyEnv(t *testing.T) {
+	c := Default()
+	problems := c.ApplyEnv([]string{
+		"NPROXY_LISTEN=:7070",
+		"NPROXY_ADMIN_TOKEN=from-env",
+		"NPROXY_RECORDING_HISTORY=5",
+		"NPROXY_MITM_SERVER_TIMING=true",
+		"NPROXY_DRAIN_TIMEOUT=5s",
+		"NPROXY_CONFIG=ignored.yaml",
+		"NPROXY_RECORDING_ENABLED=maybe",
+		"NPROXY_NOPE=1",
+		"PATH=/usr/bin",
+	})
+
+	if c.Listen != ":7070" || c.Admin.Token != "from-env" || c.Recording.History != 5 || !c.MITM.ServerTiming || c.DrainTimeout != 5*time.Second {
+		t.Errorf("Environment not applied: %+v", c)
+	}
+	expectProblems(t, problems, "",
+		`environment NPROXY_RECORDING_ENABLED: recording.enabled: "maybe" is not a boolean`,
+		`environment NPROXY_NOPE: no setting is named by this variable`,
+	)
+
+	// Validation problems point at the variable that set the value
+	c.ApplyEnv([]string{"NPROXY_ADMIN_LISTEN=nowhere"})
+	expectProblems(t, c.Validate(), "", `environment NPROXY_ADMIN_LISTEN: admin.listen: "nowhere" is not a host:port address`)
+}
+
+func TestValidate(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+listen: "8080"
+ca:
+  cert: ca.crt
+mitm:
+  body_capture_limit: -1
+rules:
+  - name: a
+    filter: 'hots ~ "api"'
+    set_request_headers:
+      "Bad Header": x
+    remove_response_headers: ["ok", "a:b"]
+  - name: a
+  - filter: 'status 5xx'
+    log: true
+recording:
+  history: 0
+  filter: 'status >'
+logging:
+  file: /nonexistent/dir/nproxy.log
+tracing:
+  otlp: localhost:4318
+auth:
+  htpasswd: /nonexistent/users
+  realm: ""
+acl:
+  clients:
+    allow: [10.0.0.0/33]
+  destinations:
+    deny: ["host:0"]
+upstream:
+  proxies:
+    corp: ftp://proxy
+  default: nope
+  no_proxy: "host:0"
+  routes:
+    - hosts: []
+      via: corp
+    - hosts: ["a*b"]
+socks:
+  listen: nowhere
+transparent:
+  listen: ":0"
+reverse:
+  cert: site.crt
+  routes:
+    - host: "a:b"
+      path: api
+    - upstream: ftp://files
+headers:
+  via: my proxy
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	c.Locate("listen", "flag -addr")
+
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`flag -addr: listen: "8080" is not a host:port address`,
+		`nproxy.yaml:24:13: auth.htpasswd: open /nonexistent/users: no such file or directory`,
+		`nproxy.yaml:25:10: auth.realm: must be a non-empty single line`,
+		`nproxy.yaml:28:13: acl.clients.allow[0]: "10.0.0.0/33" is not a CIDR prefix`,
+		`nproxy.yaml:30:12: acl.destinations.deny[0]: "host:0": port "0" must be a number or range from 1 to 65535`,
+		`nproxy.yaml:30:5: acl.destinations: allow and deny only apply with enabled: true`,
+		`nproxy.yaml:33:11: upstream.proxies.corp: "ftp://proxy": scheme must be http, https or socks5`,
+		`nproxy.yaml:34:12: upstream.default: "nope" is not a proxy in upstream.proxies or "direct"`,
+		`nproxy.yaml:35:13: upstream.no_proxy: "host:0": port "0" must be a number from 1 to 65535`,
+		`nproxy.yaml:37:14: upstream.routes[0].hosts: is required`,
+		`nproxy.yaml:39:15: upstream.routes[1].hosts[0]: "a*b" is not a host name`,
+		`nproxy.yaml:39:7: upstream.routes[1].via: is required`,
+		`nproxy.yaml:51:8: headers.via: must be a token or host[:port], without spaces or commas`,
+		`nproxy.yaml:41:11: socks.listen: "nowhere" is not a host:port address`,
+		`nproxy.yaml:43:11: transparent.listen: port "0" must be a number from 1 to 65535`,
+		`nproxy.yaml:47:5: reverse.routes: only apply with a listen address`,
+		`nproxy.yaml:45:3: reverse: cert and key must be set together`,
+		`nproxy.yaml:47:13: reverse.routes[0].host: "a:b" is not a host name or *.domain`,
+		`nproxy.yaml:48:13: reverse.routes[0].path: "api" must start with /`,
+		`nproxy.yaml:47:7: reverse.routes[0].upstream: is required`,
+		`nproxy.yaml:49:17: reverse.routes[1].upstream: "ftp://files": scheme must be http or https`,
+		`nproxy.yaml:4:3: ca: cert and key must be set together`,
+		`nproxy.yaml:6:23: mitm.body_capture_limit: must not be negative`,
+		`nproxy.yaml:9:13: rules[0].filter: filter: column 1: unknown field "hots"; did you mean "host"?`,
+		`nproxy.yaml:11:21: rules[0].set_request_headers.Bad Header: "Bad Header" is not a valid header name`,
+		`nproxy.yaml:12:37: rules[0].remove_response_headers[1]: "a:b" is not a valid header name`,
+		`nproxy.yaml:13:11: rules[1].name: "a" is already used by rules[0]`,
+		`nproxy.yaml:13:5: rules[1]: has no actions`,
+		`nproxy.yaml:14:5: rules[2].name: is required`,
+		`nproxy.yaml:17:12: recording.history: must be at least 1`,
+		`nproxy.yaml:18:11: recording.filter: filter: column 9: expected a value`,
+		`nproxy.yaml:20:9: logging.file: directory /nonexistent/dir does not exist`,
+		`nproxy.yaml:22:9: tracing.otlp: "localhost:4318" is not an http or https URL`,
+	)
+}
+
+func TestValidateReversePools(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+reverse:
+  listen: ":8443"
+  pools:
+    - name: web
+      upstreams: [http://10.0.0.5, "10.0.0.6"]
+      balance: hash
+    - name: web
+    - upstreams: []
+  routes:
+    - pool: web
+      upstream: http://10.0.0.7
+    - pool: api
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`nproxy.yaml:6:36: reverse.pools[0].upstreams[1]: "10.0.0.6" is not an upstream URL such as http://10.0.0.5:8080`,
+		`nproxy.yaml:5:7: reverse.pools[0]: hash balancing needs hash_header or hash_cookie`,
+		`nproxy.yaml:8:7: reverse.pools[1].upstreams: must list at least one upstream`,
+		`nproxy.yaml:8:13: reverse.pools[1].name: pool "web" is defined twice`,
+		`nproxy.yaml:9:7: reverse.pools[2].name: is required`,
+		`nproxy.yaml:9:18: reverse.pools[2].upstreams: must list at least one upstream`,
+		`nproxy.yaml:11:7: reverse.routes[0]: set either upstream or pool, not both`,
+		`nproxy.yaml:13:13: reverse.routes[1].pool: no pool named "api"`,
+	)
+}
+
+func TestValidateRetry(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+retry:
+  attempts: 3
+  statuses: [503, 600]
+circuit_breaker:
+  failures: 5
+  open_time: -1s
+reverse:
+  listen: ":8443"
+  routes:
+    - upstream: http://10.0.0.5
+      retry:
+        methods: [CONNECT]
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`nproxy.yaml:3:3: retry: status 600 must be from 100 to 599`,
+		`nproxy.yaml:6:3: circuit_breaker: open_time must not be negative`,
+		`nproxy.yaml:13:9: reverse.routes[0].retry: "CONNECT" is not a method that can be retried`,
+	)
+}
+
+func TestValidateLimits(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+limits:
+  client:
+    header: -1s
+  upstream:
+    dial: 5s
+  max_request_body: -1
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	if l := c.Limits.Limits(); l.Upstream.Dial != 5*time.Second || l.Client.Idle != 2*time.Minute {
+		t.Errorf("Expected the file to override only the limits it sets, got %+v", l)
+	}
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`nproxy.yaml:3:3: limits: client.header must not be negative; use 0 for no timeout`,
+		`nproxy.yaml:3:3: limits: max_request_body must not be negative; use 0 for no limit`,
+	)
+}
+
+func TestValidateTransport(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+transport:
+  max_idle_conns: 4
+  max_idle_conns_per_host: 8
+  http2: false
+  tls:
+    ca: missing.pem
+    min_version: "1.4"
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	if tc := c.Transport; tc.HTTP2 || tc.KeepAlive != 30*time.Second {
+		t.Errorf("Expected the file to override only the settings it sets, got %+v", tc)
+	}
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`nproxy.yaml:3:3: transport: max_idle_conns_per_host must not be more than max_idle_conns`,
+		`nproxy.yaml:8:18: transport.tls.min_version: unknown TLS version 1.4; expected 1.0, 1.1, 1.2 or 1.3`,
+		`nproxy.yaml:7:9: transport.tls.ca: open missing.pem: no such file or directory`,
+	)
+}
+
+func TestValidateCache(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+cache:
+  enabled: true
+  max_entry_size: 100000000
+  overrides:
+    - filter: 'host == "api.example.com"'
+      ttl: 1h
+    - filter: 'host =='
+    - filter: 'path ~ "^/static/"'
+      ttl: -1s
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	if cc := c.Cache; !cc.Enabled || cc.MaxSize != 64<<20 || cc.Overrides[0].TTL != time.Hour {
+		t.Errorf("Expected the file to override only the settings it sets, got %+v", cc)
+	}
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`nproxy.yaml:3:3: cache: max_entry_size must not be more than max_size`,
+		`nproxy.yaml:8:15: cache.overrides[1].filter: filter: column 8: expected a value after "==", found end of expression`,
+		`nproxy.yaml:10:12: cache.overrides[2].ttl: must not be negative; use 0 to keep responses fresh for good`,
+	)
+}
+
+func TestValidateTracing(t *testing.T) {
+	path := writeFile(t, "nproxy.yaml", `
+tracing:
+  otlp: http://localhost:4318/v1/traces
+  batch_size: 512
+  queue_size: 256
+  flush_interval: 1s
+  drop_policy: random
+`)
+	c, problems := Load(path)
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected decode problems:\n%v", problems)
+	}
+	if opts, _ := c.Tracing.Options(); opts.BatchSize != 512 || opts.FlushInterval != time.Second {
+		t.Errorf("Expected the exporter options from the file, got %+v", opts)
+	}
+	expectProblems(t, c.Validate(), filepath.Dir(path),
+		`nproxy.yaml:7:16: tracing.drop_policy: unknown drop policy "random"; expected newest or oldest`,
+		`nproxy.yaml:3:3: tracing: batch_size must not be more than queue_size`,
+	)
+}
+
+func TestDiff(t *testing.T) {
+	old, problems := Load(writeFile(t, "old.yaml", `
+listen: ":8080"
+logging:
+  filter: 'status >= 500'
+rules:
+  - name: a
+    log: true
+  - name: b
+    set_request_headers: {X-B: "1"}
+  - name: c
+    log: true
+`))
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+	new, problems := Load(writeFile(t, "new.yaml", `
+listen: ":9090"
+drain_timeout: 5s
+rules:
+  - name: b
+    enabled: false
+    set_request_headers: {X-B: "2"}
+  - name: a
+    log: true
+  - name: d
+    log: true
+`))
+	if len(problems) != 0 {
+		t.Fatalf("Unexpected problems: %v", problems)
+	}
+
+	var got []string
+	for _, ch := range Diff(old, new) {
+		got = append(got, ch.String())
+	}
+	want := []string{
+		`listen: ":8080" -> ":9090"`,
+		`drain_timeout: 30s -> 5s`,
+		`rules[b].enabled: unset -> false`,
+		`rules[b].set_request_headers: map[X-B:1] -> map[X-B:2]`,
+		`rules[d]: added`,
+		`rules[c]: removed`,
+		`rules: reordered`,
+		`logging.filter: "status >= 500" -> ""`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected diff:\n got: %s\nwant: %s", strings.Join(got, "\n      "), strings.Join(want, "\n      "))
+	}
+
+	if changes := Diff(old, old); len(changes) != 0 {
+		t.Errorf("Expected no changes between identical configs, got %v", changes)
+	}
+}
@@ -0,0 +1,99 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Change is a setting that differs between two configurations
+type Change struct {
+	Path    string // setting path; rules are identified by name, as in rules[api].filter
+	Message string // what happened, e.g. `"" -> "status >= 500"` or added
+}
+
+func (ch Change) String() string {
+	return ch.Path + ": " + ch.Message
+}
+
+// Diff lists the settings that differ from old to new in file order. Rules
+// are matched by name, so a renamed rule is reported as removed and added.
+func Diff(old, new *Config) []Change {
+	var changes []Change
+	diffStruct(reflect.ValueOf(*old), reflect.ValueOf(*new), "", &changes)
+	return changes
+}
+
+func diffStruct(old, new reflect.Value, path string, changes *[]Change) {
+	t := old.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if !f.IsExported() || key == "" {
+			continue
+		}
+		p := join(path, key)
+		o, n := old.Field(i), new.Field(i)
+		switch {
+		case f.Type == reflect.TypeOf([]RuleConfig(nil)):
+			diffRules(o.Interface().([]RuleConfig), n.Interface().([]RuleConfig), p, changes)
+		case f.Type.Kind() == reflect.Struct:
+			diffStruct(o, n, p, changes)
+		case !reflect.DeepEqual(o.Interface(), n.Interface()):
+			*changes = append(*changes, Change{Path: p, Message: formatValue(o) + " -> " + formatValue(n)})
+		}
+	}
+}
+
+func diffRules(old, new []RuleConfig, path string, changes *[]Change) {
+	oldByName := make(map[string]RuleConfig, len(old))
+	for _, r := range old {
+		oldByName[r.Name] = r
+	}
+	newNames := make(map[string]bool, len(new))
+	var oldOrder, newOrder []string
+
+	for _, r := range new {
+		newNames[r.Name] = true
+		p := fmt.Sprintf("%s[%s]", path, r.Name)
+		prev, ok := oldByName[r.Name]
+		if !ok {
+			*changes = append(*changes, Change{Path: p, Message: "added"})
+			continue
+		}
+		newOrder = append(newOrder, r.Name)
+		diffStruct(reflect.ValueOf(prev), reflect.ValueOf(r), p, changes)
+	}
+	for _, r := range old {
+		if !newNames[r.Name] {
+			*changes = append(*changes, Change{Path: fmt.Sprintf("%s[%s]", path, r.Name), Message: "removed"})
+		} else {
+			oldOrder = append(oldOrder, r.Name)
+		}
+	}
+	if !reflect.DeepEqual(oldOrder, newOrder) {
+		*changes = append(*changes, Change{Path: path, Message: "reordered"})
+	}
+}
+
+// formatValue renders a setting for a change message
+func formatValue(v reflect.Value) string {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return "unset"
+		}
+		return formatValue(v.Elem())
+	case reflect.String:
+		return fmt.Sprintf("%q", v.String())
+	case reflect.Map, reflect.Slice:
+		if v.Len() == 0 {
+			return "none"
+		}
+	}
+	if d, ok := v.Interface().(time.Duration); ok {
+		return d.String()
+	}
+	return fmt.Sprintf("%v", v.Interface())
+}
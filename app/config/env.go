@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvPrefix starts the name of every environment variable override
+const EnvPrefix = "NPROXY_"
+
+// ApplyEnv overrides settings from environment variables given as
+// KEY=value pairs, as returned by os.Environ. Every scalar setting can be
+// overridden, named after its path: admin.listen is NPROXY_ADMIN_LISTEN.
+// Lists such as rules can only be set in the file. Unknown NPROXY_
+// variables are reported, except NPROXY_CONFIG which names the file.
+func (c *Config) ApplyEnv(environ []string) Problems {
+	settings := make(map[string]envSetting)
+	collectEnv(reflect.ValueOf(c).Elem(), "", settings)
+
+	var problems Problems
+	for _, kv := range environ {
+		name, value, _ := strings.Cut(kv, "=")
+		if !strings.HasPrefix(name, EnvPrefix) || name == EnvPrefix+"CONFIG" {
+			continue
+		}
+		s, ok := settings[name]
+		if !ok {
+			problems = append(problems, Problem{Location: "environment " + name, Message: "no setting is named by this variable"})
+			continue
+		}
+		if err := setScalar(s.value, value); err != nil {
+			problems = append(problems, Problem{Location: "environment " + name, Path: s.path, Message: err.Error()})
+			continue
+		}
+		c.Locate(s.path, "environment "+name)
+	}
+	return problems
+}
+
+type envSetting struct {
+	path  string
+	value reflect.Value
+}
+
+// collectEnv maps environment variable names to the scalar settings of v
+func collectEnv(v reflect.Value, path string, out map[string]envSetting) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		key := strings.Split(f.Tag.Get("yaml"), ",")[0]
+		if !f.IsExported() || key == "" {
+			continue
+		}
+		p := join(path, key)
+		switch fv := v.Field(i); fv.Kind() {
+		case reflect.Struct:
+			collectEnv(fv, p, out)
+		case reflect.String, reflect.Bool, reflect.Int, reflect.Int64:
+			name := EnvPrefix + strings.ToUpper(strings.ReplaceAll(p, ".", "_"))
+			out[name] = envSetting{path: p, value: fv}
+		}
+	}
+}
+
+// setScalar parses s into a string, bool, int or duration setting
+func setScalar(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.Int64:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 30s", s)
+		}
+		v.SetInt(int64(d))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean; use true or false", s)
+		}
+		v.SetBool(b)
+	case reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", s)
+		}
+		v.SetInt(int64(n))
+	default:
+		v.SetString(s)
+	}
+	return nil
+}
@@ -0,0 +1,384 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/breaker"
+	"nproxy/app/cache"
+	"nproxy/app/filter"
+	"nproxy/app/hop"
+	"nproxy/app/limits"
+	"nproxy/app/retry"
+	"nproxy/app/reverse"
+	"nproxy/app/trace"
+	"nproxy/app/transport"
+	"nproxy/app/upstream"
+)
+
+// Validate checks every setting and returns all problems found
+func (c *Config) Validate() Problems {
+	v := &validator{c: c}
+
+	v.listenAddr("listen", c.Listen, true)
+	if c.DrainTimeout < 0 {
+		v.problem("drain_timeout", "must not be negative; use 0 to close connections at once")
+	}
+	if c.Admin.Listen != "" {
+		v.listenAddr("admin.listen", c.Admin.Listen, false)
+	}
+
+	if c.Auth.Htpasswd != "" {
+		if _, err := auth.LoadHtpasswd(c.Auth.Htpasswd); err != nil {
+			v.problem("auth.htpasswd", err.Error())
+		}
+	}
+	if c.Auth.Realm == "" || strings.ContainsAny(c.Auth.Realm, "\r\n") {
+		v.problem("auth.realm", "must be a non-empty single line")
+	}
+
+	v.aclEntries("acl.clients.allow", c.ACL.Clients.Allow, clientEntry)
+	v.aclEntries("acl.clients.deny", c.ACL.Clients.Deny, clientEntry)
+	v.aclEntries("acl.destinations.allow", c.ACL.Destinations.Allow, destinationEntry)
+	v.aclEntries("acl.destinations.deny", c.ACL.Destinations.Deny, destinationEntry)
+	if !c.ACL.Destinations.Enabled && len(c.ACL.Destinations.Allow)+len(c.ACL.Destinations.Deny) > 0 {
+		v.problem("acl.destinations", "allow and deny only apply with enabled: true")
+	}
+
+	v.upstream(c.Upstream)
+	v.retry("retry", c.Retry)
+	if err := breaker.Check(c.CircuitBreaker.Settings()); err != nil {
+		v.problem("circuit_breaker", err.Error())
+	}
+	if err := limits.Check(c.Limits.Limits()); err != nil {
+		for _, msg := range strings.Split(err.Error(), "\n") {
+			v.problem("limits", msg)
+		}
+	}
+	v.transport(c.Transport)
+	v.cache(c.Cache)
+	if c.Headers.Via != "" {
+		if err := hop.CheckPseudonym(c.Headers.Via); err != nil {
+			v.problem("headers.via", err.Error())
+		}
+	}
+	if c.SOCKS.Listen != "" {
+		v.listenAddr("socks.listen", c.SOCKS.Listen, false)
+	}
+	if c.Transparent.Listen != "" {
+		v.listenAddr("transparent.listen", c.Transparent.Listen, false)
+	}
+	v.reverse(c.Reverse)
+
+	if (c.CA.Cert == "") != (c.CA.Key == "") {
+		v.problem("ca", "cert and key must be set together")
+	}
+	if c.CA.Dir == "" {
+		v.problem("ca.dir", "must not be empty")
+	}
+
+	if c.MITM.BodyCaptureLimit < 0 {
+		v.problem("mitm.body_capture_limit", "must not be negative; use 0 to disable body capture")
+	}
+
+	names := make(map[string]int)
+	for i, r := range c.Rules {
+		path := fmt.Sprintf("rules[%d]", i)
+		switch prev, dup := names[r.Name]; {
+		case r.Name == "":
+			v.problem(path+".name", "is required")
+		case dup:
+			v.problem(path+".name", fmt.Sprintf("%q is already used by rules[%d]", r.Name, prev))
+		default:
+			names[r.Name] = i
+		}
+		v.filter(path+".filter", r.Filter)
+		v.headerMap(path+".set_request_headers", r.SetRequestHeaders)
+		v.headerList(path+".remove_request_headers", r.RemoveRequestHeaders)
+		v.headerMap(path+".set_response_headers", r.SetResponseHeaders)
+		v.headerList(path+".remove_response_headers", r.RemoveResponseHeaders)
+		if len(r.SetRequestHeaders)+len(r.RemoveRequestHeaders)+len(r.SetResponseHeaders)+len(r.RemoveResponseHeaders) == 0 && !r.Log {
+			v.problem(path, "has no actions; set or remove headers, or enable log")
+		}
+	}
+
+	if c.Recording.History < 1 {
+		v.problem("recording.history", "must be at least 1")
+	}
+	v.filter("recording.filter", c.Recording.Filter)
+	v.fileDir("recording.file", c.Recording.File)
+	v.filter("logging.filter", c.Logging.Filter)
+	v.fileDir("logging.file", c.Logging.File)
+
+	if c.Tracing.OTLP != "" {
+		u, err := url.Parse(c.Tracing.OTLP)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			v.problem("tracing.otlp", fmt.Sprintf("%q is not an http or https URL", c.Tracing.OTLP))
+		}
+	}
+	opts, err := c.Tracing.Options()
+	if err != nil {
+		v.problem("tracing.drop_policy", err.Error())
+	}
+	if err := trace.CheckOptions(opts); err != nil {
+		v.problem("tracing", err.Error())
+	}
+
+	return v.problems
+}
+
+type validator struct {
+	c        *Config
+	problems Problems
+}
+
+func (v *validator) problem(path, msg string) {
+	v.problems = append(v.problems, Problem{Location: v.c.location(path), Path: path, Message: msg})
+}
+
+// listenAddr checks a host:port listen address. Port 0 picks a free port,
+// which only makes sense for the main listener in tests.
+func (v *validator) listenAddr(path, addr string, allowZero bool) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		v.problem(path, fmt.Sprintf("%q is not a host:port address, e.g. :8080", addr))
+		return
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 0 || n > 65535 || (n == 0 && !allowZero) {
+		v.problem(path, fmt.Sprintf("port %q must be a number from 1 to 65535", port))
+	}
+}
+
+// aclEntries checks each entry of an ACL list with parse
+func (v *validator) aclEntries(path string, entries []string, parse func(string) error) {
+	for i, e := range entries {
+		if err := parse(e); err != nil {
+			v.problem(fmt.Sprintf("%s[%d]", path, i), err.Error())
+		}
+	}
+}
+
+func clientEntry(e string) error {
+	_, err := acl.NewClients([]string{e}, nil)
+	return err
+}
+
+func destinationEntry(e string) error {
+	_, err := acl.NewDestinations([]string{e}, nil, false)
+	return err
+}
+
+// upstream checks the proxy URLs, the host lists and that every route and
+// the default name a proxy
+func (v *validator) upstream(uc UpstreamConfig) {
+	names := make([]string, 0, len(uc.Proxies))
+	for name := range uc.Proxies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := "upstream.proxies." + name
+		if name == upstream.Direct {
+			v.problem(path, fmt.Sprintf("%q is reserved for connecting without a proxy", upstream.Direct))
+		} else if _, err := upstream.ParseURL(uc.Proxies[name]); err != nil {
+			v.problem(path, err.Error())
+		}
+	}
+	via := func(path, name string) {
+		if _, ok := uc.Proxies[name]; !ok && name != upstream.Direct {
+			v.problem(path, fmt.Sprintf("%q is not a proxy in upstream.proxies or %q", name, upstream.Direct))
+		}
+	}
+
+	if uc.Default != "" {
+		via("upstream.default", uc.Default)
+	}
+	if _, err := upstream.ParseHostList(upstream.SplitNoProxy(uc.NoProxy)); err != nil {
+		v.problem("upstream.no_proxy", err.Error())
+	}
+	for i, r := range uc.Routes {
+		path := fmt.Sprintf("upstream.routes[%d]", i)
+		if len(r.Hosts) == 0 {
+			v.problem(path+".hosts", "is required")
+		}
+		for j, h := range r.Hosts {
+			if _, err := upstream.ParseHostList([]string{h}); err != nil {
+				v.problem(fmt.Sprintf("%s.hosts[%d]", path, j), err.Error())
+			}
+		}
+		if r.Via == "" {
+			v.problem(path+".via", "is required")
+		} else {
+			via(path+".via", r.Via)
+		}
+	}
+}
+
+func (v *validator) reverse(rc ReverseConfig) {
+	if rc.Listen != "" {
+		v.listenAddr("reverse.listen", rc.Listen, false)
+	} else if len(rc.Routes) > 0 {
+		v.problem("reverse.routes", "only apply with a listen address")
+	} else if len(rc.Pools) > 0 {
+		v.problem("reverse.pools", "only apply with a listen address")
+	}
+	if (rc.Cert == "") != (rc.Key == "") {
+		v.problem("reverse", "cert and key must be set together")
+	} else if rc.Cert != "" && !rc.TLS {
+		v.problem("reverse", "cert and key only apply with tls: true")
+	}
+	pools := make(map[string]bool)
+	for i, pc := range rc.Pools {
+		path := fmt.Sprintf("reverse.pools[%d]", i)
+		v.pool(path, pc)
+		if pools[pc.Name] {
+			v.problem(path+".name", fmt.Sprintf("pool %q is defined twice", pc.Name))
+		}
+		pools[pc.Name] = true
+	}
+	for i, r := range rc.Routes {
+		path := fmt.Sprintf("reverse.routes[%d]", i)
+		if err := reverse.CheckHost(r.Host); err != nil {
+			v.problem(path+".host", err.Error())
+		}
+		if err := reverse.CheckPath(r.Path); err != nil {
+			v.problem(path+".path", err.Error())
+		}
+		if r.Retry != nil {
+			v.retry(path+".retry", *r.Retry)
+		}
+		switch {
+		case r.Upstream != "" && r.Pool != "":
+			v.problem(path, "set either upstream or pool, not both")
+		case r.Pool != "":
+			if _, ok := pools[r.Pool]; !ok {
+				v.problem(path+".pool", fmt.Sprintf("no pool named %q", r.Pool))
+			}
+		case r.Upstream == "":
+			v.problem(path+".upstream", "is required")
+		default:
+			if _, err := reverse.ParseUpstream(r.Upstream); err != nil {
+				v.problem(path+".upstream", err.Error())
+			}
+		}
+	}
+}
+
+// retry checks a retry policy
+func (v *validator) retry(path string, rc RetryConfig) {
+	if err := retry.Check(rc.Policy()); err != nil {
+		v.problem(path, err.Error())
+	}
+}
+
+// pool checks a reverse proxy pool
+func (v *validator) pool(path string, pc ReversePoolConfig) {
+	if pc.Name == "" {
+		v.problem(path+".name", "is required")
+	}
+	if len(pc.Upstreams) == 0 {
+		v.problem(path+".upstreams", "must list at least one upstream")
+	}
+	for i, u := range pc.Upstreams {
+		if _, err := reverse.ParseUpstream(u); err != nil {
+			v.problem(fmt.Sprintf("%s.upstreams[%d]", path, i), err.Error())
+		}
+	}
+	if err := reverse.CheckPool(pc.Pool()); err != nil {
+		v.problem(path, err.Error())
+	}
+}
+
+// transport checks the connection counts, TLS version and trusted roots
+// of the upstream transport
+func (v *validator) transport(tc TransportConfig) {
+	s, _ := tc.Settings()
+	if err := transport.Check(s); err != nil {
+		v.problem("transport", err.Error())
+	}
+	if _, err := transport.ParseVersion(tc.TLS.MinVersion); err != nil {
+		v.problem("transport.tls.min_version", err.Error())
+	}
+	if tc.TLS.CA != "" {
+		if _, err := transport.LoadRoots(tc.TLS.CA); err != nil {
+			v.problem("transport.tls.ca", err.Error())
+		}
+	}
+}
+
+// cache checks the size limits and overrides of the response cache
+func (v *validator) cache(cc CacheConfig) {
+	s, _ := cc.Settings()
+	s.Overrides = nil
+	if err := cache.Check(s); err != nil {
+		v.problem("cache", err.Error())
+	}
+	for i, o := range cc.Overrides {
+		path := fmt.Sprintf("cache.overrides[%d]", i)
+		v.filter(path+".filter", o.Filter)
+		if o.TTL < 0 {
+			v.problem(path+".ttl", "must not be negative; use 0 to keep responses fresh for good")
+		}
+	}
+}
+
+func (v *validator) filter(path, expr string) {
+	if _, err := filter.Parse(expr); err != nil {
+		v.problem(path, err.Error())
+	}
+}
+
+// fileDir checks that the directory a file is created in exists
+func (v *validator) fileDir(path, file string) {
+	if file == "" {
+		return
+	}
+	if info, err := os.Stat(filepath.Dir(file)); err != nil || !info.IsDir() {
+		v.problem(path, fmt.Sprintf("directory %s does not exist", filepath.Dir(file)))
+	}
+}
+
+// headerMap checks that the keys of a header map are valid field names
+func (v *validator) headerMap(path string, headers map[string]string) {
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if !validHeaderName(name) {
+			v.problem(path+"."+name, fmt.Sprintf("%q is not a valid header name", name))
+		}
+	}
+}
+
+// headerList checks that a list holds valid header field names
+func (v *validator) headerList(path string, names []string) {
+	for i, name := range names {
+		if !validHeaderName(name) {
+			v.problem(fmt.Sprintf("%s[%d]", path, i), fmt.Sprintf("%q is not a valid header name", name))
+		}
+	}
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		// token characters from RFC 9110, section 5.6.2
+		if c > 0x7e || c <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
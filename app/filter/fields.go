@@ -0,0 +1,147 @@
+package filter
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+type kind int
+
+const (
+	kindString kind = iota
+	kindNumber
+	kindDuration
+)
+
+func (k kind) String() string {
+	switch k {
+	case kindNumber:
+		return "number"
+	case kindDuration:
+		return "duration"
+	default:
+		return "text"
+	}
+}
+
+// field is something a predicate can test. Text fields may have several
+// values, e.g. a header on either side of the exchange; a test passes when
+// any value satisfies it.
+type field struct {
+	name string
+	kind kind
+	fold bool // compare case-insensitively
+
+	text     func(f *flow.Flow) []string
+	number   func(f *flow.Flow) int64
+	duration func(f *flow.Flow) time.Duration
+}
+
+func one(get func(f *flow.Flow) string) func(f *flow.Flow) []string {
+	return func(f *flow.Flow) []string {
+		if s := get(f); s != "" {
+			return []string{s}
+		}
+		return nil
+	}
+}
+
+var fields = map[string]*field{
+	"method":       {kind: kindString, fold: true, text: one(func(f *flow.Flow) string { return f.Method })},
+	"host":         {kind: kindString, fold: true, text: one(func(f *flow.Flow) string { return f.Host })},
+	"user":         {kind: kindString, text: one(func(f *flow.Flow) string { return f.User })},
+	"url":          {kind: kindString, text: one(func(f *flow.Flow) string { return f.URL })},
+	"path":         {kind: kindString, text: one(flowPath)},
+	"error":        {kind: kindString, text: one(func(f *flow.Flow) string { return f.Error })},
+	"content_type": {kind: kindString, fold: true, text: one(func(f *flow.Flow) string { return f.ContentType() })},
+	"req.body":     {kind: kindString, text: one(requestBody)},
+	"resp.body":    {kind: kindString, text: one(responseBody)},
+	"body": {kind: kindString, text: func(f *flow.Flow) []string {
+		return append(one(requestBody)(f), one(responseBody)(f)...)
+	}},
+
+	"status":    {kind: kindNumber, number: func(f *flow.Flow) int64 { return int64(f.Status) }},
+	"req.size":  {kind: kindNumber, number: func(f *flow.Flow) int64 { return f.RequestSize }},
+	"resp.size": {kind: kindNumber, number: func(f *flow.Flow) int64 { return f.ResponseSize }},
+
+	"duration": {kind: kindDuration, duration: func(f *flow.Flow) time.Duration { return f.Timings.Total }},
+	"ttfb":     {kind: kindDuration, duration: func(f *flow.Flow) time.Duration { return f.Timings.TTFB }},
+}
+
+// headerFields take a header name in brackets, e.g. req.header["Accept"]
+var headerFields = map[string]func(f *flow.Flow, name string) []string{
+	"req.header":  func(f *flow.Flow, name string) []string { return f.RequestHeader.Values(name) },
+	"resp.header": func(f *flow.Flow, name string) []string { return f.ResponseHeader.Values(name) },
+	"header": func(f *flow.Flow, name string) []string {
+		return append(f.RequestHeader.Values(name), f.ResponseHeader.Values(name)...)
+	},
+}
+
+func init() {
+	for name, fd := range fields {
+		fd.name = name
+	}
+}
+
+func requestBody(f *flow.Flow) string  { return string(f.RequestBody) }
+func responseBody(f *flow.Flow) string { return string(f.ResponseBody) }
+
+func flowPath(f *flow.Flow) string {
+	u, err := url.Parse(f.URL)
+	if err != nil {
+		return ""
+	}
+	return u.Path
+}
+
+// fieldNames lists every field for error messages
+func fieldNames() []string {
+	var names []string
+	for name := range fields {
+		names = append(names, name)
+	}
+	for name := range headerFields {
+		names = append(names, name+"[...]")
+	}
+	sort.Strings(names)
+	return names
+}
+
+// suggest returns the known field closest to name, if any is close enough
+// to be a likely typo
+func suggest(name string) string {
+	best, bestDist := "", 3
+	candidates := fieldNames()
+	for _, c := range candidates {
+		c = strings.TrimSuffix(c, "[...]")
+		if d := distance(strings.ToLower(name), c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+// distance is the Levenshtein edit distance between a and b
+func distance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,94 @@
+// Package filter implements the flow filter language shared by the
+// recorder, logs, rules, the admin API and the user interfaces.
+//
+// An expression combines predicates with &&, || and !, grouped with
+// parentheses:
+//
+//	host ~ "api\." && status >= 500 && !method GET
+//	req.header["X-Tenant"] == "a"
+//	body contains "error" || duration > 2s
+//
+// A predicate is a field, an operator and a value. Text fields (method,
+// host, url, path, error, content_type, body, req.body, resp.body and the
+// header fields req.header[name], resp.header[name] and header[name])
+// support ==, !=, ~ and !~ (regular expressions) and contains. Number
+// fields (status, req.size, resp.size) and duration fields (duration,
+// ttfb) support ==, !=, <, <=, > and >=; status also accepts a class such
+// as 5xx. A field followed directly by a value means ==, and a field on
+// its own tests that it is set. Values are bare words or quoted strings;
+// durations need a unit, e.g. 150ms or 2s.
+package filter
+
+import (
+	"fmt"
+
+	"nproxy/app/flow"
+)
+
+// Filter is a parsed filter expression. A nil Filter matches every flow.
+type Filter struct {
+	expr  string
+	match node
+}
+
+// Parse parses a filter expression. An empty expression matches
+// everything.
+func Parse(expr string) (*Filter, error) {
+	tokens, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{expr: expr, tokens: tokens}
+	f := &Filter{expr: expr, match: matchAll}
+	if p.peek().kind == tokEOF {
+		return f, nil
+	}
+	if f.match, err = p.parseOr(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return nil, p.errorf(t, "unexpected %s; combine conditions with && or ||", t)
+	}
+	return f, nil
+}
+
+// MustParse is like Parse but panics on error. It is meant for
+// expressions fixed at compile time.
+func MustParse(expr string) *Filter {
+	f, err := Parse(expr)
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+// Match reports whether fl satisfies the filter
+func (f *Filter) Match(fl *flow.Flow) bool {
+	if f == nil {
+		return true
+	}
+	return f.match(fl)
+}
+
+// String returns the expression the filter was parsed from
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.expr
+}
+
+// Error is a syntax or type error in a filter expression
+type Error struct {
+	Expr string
+	Pos  int // byte offset of the problem in Expr
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("filter: column %d: %s", e.Pos+1, e.Msg)
+}
+
+func errorf(expr string, pos int, format string, args ...any) *Error {
+	return &Error{Expr: expr, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,187 @@
+package filter
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+func testFlow() *flow.Flow {
+	f := flow.New("POST", "https://api.example.com/v1/users?page=2", "api.example.com")
+	f.Status = 503
+	f.User = "alice"
+	f.Error = ""
+	f.RequestHeader = http.Header{"X-Tenant": {"a"}, "Content-Type": {"application/json"}}
+	f.RequestBody = []byte(`{"name":"gopher"}`)
+	f.RequestSize = 17
+	f.ResponseHeader = http.Header{"Content-Type": {"application/json; charset=utf-8"}, "Retry-After": {"5"}}
+	f.ResponseBody = []byte(`{"error":"overloaded"}`)
+	f.ResponseSize = 22
+	f.Timings = flow.Timings{TTFB: 800 * time.Millisecond, Total: 2500 * time.Millisecond}
+	return f
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{``, true},
+		{`host ~ "api\." && status >= 500 && !method GET`, true},
+		{`host ~ "api\." && status >= 500 && !method POST`, false},
+		{`req.header["X-Tenant"] == "a"`, true},
+		{`req.header["x-tenant"] == "b"`, false},
+		{`body contains "error"`, true},
+		{`req.body contains "error"`, false},
+		{`resp.body contains "error"`, true},
+		{`duration > 2s`, true},
+		{`duration > 3s`, false},
+		{`ttfb <= 800ms`, true},
+
+		// Text operators
+		{`method == post`, true},
+		{`method post`, true},
+		{`method = POST`, true},
+		{`method != POST`, false},
+		{`host == API.EXAMPLE.COM`, true},
+		{`host ~ "^API"`, true},
+		{`url ~ "^https://api"`, true},
+		{`url ~ "^HTTPS"`, false},
+		{`url !~ "page=3"`, true},
+		{`path == /v1/users`, true},
+		{`content_type == application/json`, true},
+		{`content_type contains JSON`, true},
+		{`header["Content-Type"] ~ "charset"`, true},
+		{`header["Content-Type"] != "application/json"`, false},
+		{`resp.header["Content-Type"] != "application/json"`, true},
+		{`resp.header[Retry-After] == 5`, true},
+		{`host contains 'example' && url ~ 'users\?page'`, true},
+		{`user alice`, true},
+		{`user == Alice`, false},
+
+		// Numbers
+		{`status == 503`, true},
+		{`status 5xx`, true},
+		{`status == 4XX`, false},
+		{`status != 5xx`, false},
+		{`status < 500`, false},
+		{`req.size > 10 && resp.size >= 22`, true},
+
+		// Presence
+		{`error`, false},
+		{`!error`, true},
+		{`status`, true},
+		{`req.header["X-Tenant"]`, true},
+		{`resp.header["X-Tenant"]`, false},
+
+		// Precedence and grouping
+		{`method GET || status 5xx && host contains example`, true},
+		{`(method GET || status 5xx) && host contains nope`, false},
+		{`method GET || (status 5xx && host contains nope)`, false},
+		{`!(method GET || status 2xx)`, true},
+		{`!!method POST`, true},
+		{`method POST and not status 2xx or host nope`, true},
+	}
+
+	f := testFlow()
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			filter, err := Parse(tt.expr)
+			if err != nil {
+				t.Fatalf("Parse failed: %v", err)
+			}
+			if got := filter.Match(f); got != tt.want {
+				t.Errorf("Match = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchMissingParts(t *testing.T) {
+	// A flow that failed before any response was received
+	f := flow.New("GET", "http://down.example/", "down.example")
+	f.Error = "connection refused"
+
+	for expr, want := range map[string]bool{
+		`error contains refused`:           true,
+		`status`:                           false,
+		`status == 0`:                      true,
+		`resp.header["Content-Type"]`:      false,
+		`content_type == ""`:               false,
+		`body contains "x"`:                false,
+		`resp.header["Server"] !~ "nginx"`: true,
+		`duration < 1s`:                    true,
+	} {
+		if got := MustParse(expr).Match(f); got != want {
+			t.Errorf("%s: Match = %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestNilFilter(t *testing.T) {
+	var f *Filter
+	if !f.Match(testFlow()) || f.String() != "" {
+		t.Error("Expected a nil filter to match everything")
+	}
+	if s := MustParse(`status 5xx`).String(); s != `status 5xx` {
+		t.Errorf("Expected String to return the expression, got %q", s)
+	}
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		pos  int
+		msg  string
+	}{
+		{`hots ~ "api"`, 0, `unknown field "hots"; did you mean "host"?`},
+		{`zzzzzzzz`, 0, `fields are`},
+		{`host ==`, 7, `expected a value after "==", found end of expression`},
+		{`host ~ "api`, 7, `unterminated string`},
+		{`host ~ "("`, 7, `invalid regular expression`},
+		{`status >= 500 &&`, 16, `expected a condition`},
+		{`status >= 500 & method GET`, 14, `use "&&"`},
+		{`status >= 500 method GET`, 14, `unexpected "method"; combine conditions with && or ||`},
+		{`(status >= 500`, 14, `expected ")" to close the "(" at column 1`},
+		{`status ~ "5.."`, 7, `"~" works on text, but status is a number`},
+		{`status > 5xx`, 7, `status class such as 5xx can only be used with == or !=`},
+		{`status == abc`, 10, `status is a number, but "abc" is not`},
+		{`duration > 2`, 11, `duration 2 needs a unit`},
+		{`duration > soon`, 11, `duration is a duration such as 150ms or 2s`},
+		{`host > 5`, 5, `">" compares numbers and durations, but host is text`},
+		{`req.header == "a"`, 11, `expected ["Header-Name"] after req.header`},
+		{`req.header["a" == "b"`, 15, `expected "]" after the header name`},
+		{`== 5`, 0, `expected a field name such as host or status, found "=="`},
+		{`host $ x`, 5, `unexpected character '$'`},
+		{`)`, 0, `found ")"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := Parse(tt.expr)
+			var ferr *Error
+			if !errors.As(err, &ferr) {
+				t.Fatalf("Expected a *filter.Error, got %v", err)
+			}
+			if ferr.Pos != tt.pos || !strings.Contains(ferr.Msg, tt.msg) {
+				t.Errorf("Got error at %d: %s\nwant at %d containing: %s", ferr.Pos, ferr.Msg, tt.pos, tt.msg)
+			}
+			if ferr.Expr != tt.expr || !strings.HasPrefix(err.Error(), "filter: column ") {
+				t.Errorf("Unexpected error formatting: %v", err)
+			}
+		})
+	}
+}
+
+func TestMustParsePanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected MustParse to panic on an invalid expression")
+		}
+	}()
+	MustParse("status >")
+}
@@ -0,0 +1,166 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+)
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokLBracket
+	tokRBracket
+	tokAnd
+	tokOr
+	tokNot
+	tokEq
+	tokNe
+	tokMatch
+	tokNotMatch
+	tokLt
+	tokLe
+	tokGt
+	tokGe
+	tokContains
+)
+
+var tokenNames = map[tokenKind]string{
+	tokEOF:      "end of expression",
+	tokLParen:   `"("`,
+	tokRParen:   `")"`,
+	tokLBracket: `"["`,
+	tokRBracket: `"]"`,
+	tokAnd:      `"&&"`,
+	tokOr:       `"||"`,
+	tokNot:      `"!"`,
+	tokEq:       `"=="`,
+	tokNe:       `"!="`,
+	tokMatch:    `"~"`,
+	tokNotMatch: `"!~"`,
+	tokLt:       `"<"`,
+	tokLe:       `"<="`,
+	tokGt:       `">"`,
+	tokGe:       `">="`,
+	tokContains: `"contains"`,
+}
+
+type token struct {
+	kind tokenKind
+	text string // the word or the unquoted string
+	pos  int    // byte offset in the expression
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokWord:
+		return fmt.Sprintf("%q", t.text)
+	case tokString:
+		return fmt.Sprintf("string %q", t.text)
+	default:
+		return tokenNames[t.kind]
+	}
+}
+
+// keywords are words with a meaning of their own; quote them to use them
+// as values
+var keywords = map[string]tokenKind{
+	"and":      tokAnd,
+	"or":       tokOr,
+	"not":      tokNot,
+	"contains": tokContains,
+}
+
+// operators are matched longest first
+var operators = []struct {
+	text string
+	kind tokenKind
+}{
+	{"&&", tokAnd}, {"||", tokOr},
+	{"==", tokEq}, {"!=", tokNe}, {"!~", tokNotMatch},
+	{"<=", tokLe}, {">=", tokGe},
+	{"=", tokEq}, {"~", tokMatch}, {"!", tokNot}, {"<", tokLt}, {">", tokGt},
+	{"(", tokLParen}, {")", tokRParen}, {"[", tokLBracket}, {"]", tokRBracket},
+}
+
+// isWordByte reports whether c can be part of a bare word such as a field
+// name, number, duration, host name or path
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("._-/:*@%+", c) >= 0 || c >= 0x80
+}
+
+func lex(expr string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(expr); {
+		c := expr[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+
+		case c == '"' || c == '\'':
+			s, n, err := lexString(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, token{kind: tokString, text: s, pos: i})
+			i += n
+
+		case isWordByte(c):
+			start := i
+			for i < len(expr) && isWordByte(expr[i]) {
+				i++
+			}
+			word := expr[start:i]
+			kind, ok := keywords[strings.ToLower(word)]
+			if !ok {
+				kind = tokWord
+			}
+			tokens = append(tokens, token{kind: kind, text: word, pos: start})
+
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(expr[i:], op.text) {
+					tokens = append(tokens, token{kind: op.kind, text: op.text, pos: i})
+					i += len(op.text)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				if c == '&' || c == '|' {
+					return nil, errorf(expr, i, "unexpected %q; use %q", c, strings.Repeat(string(c), 2))
+				}
+				return nil, errorf(expr, i, "unexpected character %q", c)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, pos: len(expr)}), nil
+}
+
+// lexString reads the quoted string starting at expr[start] and returns
+// its value and length. Only the quote character and backslash can be
+// escaped; other backslashes are kept so regular expressions such as
+// "api\.example" need no doubling.
+func lexString(expr string, start int) (string, int, error) {
+	quote := expr[start]
+	var b strings.Builder
+	for i := start + 1; i < len(expr); i++ {
+		c := expr[i]
+		switch {
+		case c == quote:
+			return b.String(), i + 1 - start, nil
+		case c == '\\' && i+1 < len(expr) && (expr[i+1] == quote || expr[i+1] == '\\'):
+			b.WriteByte(expr[i+1])
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, errorf(expr, start, "unterminated string")
+}
@@ -0,0 +1,291 @@
+package filter
+
+import (
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+// node is a compiled expression
+type node func(f *flow.Flow) bool
+
+func matchAll(*flow.Flow) bool { return true }
+
+type parser struct {
+	expr   string
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return errorf(p.expr, t.pos, format, args...)
+}
+
+// parseOr parses: and { "||" and }
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *flow.Flow) bool { return l(f) || right(f) }
+	}
+	return left, nil
+}
+
+// parseAnd parses: unary { "&&" unary }
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokAnd {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *flow.Flow) bool { return l(f) && right(f) }
+	}
+	return left, nil
+}
+
+// parseUnary parses: "!" unary | "(" or ")" | predicate
+func (p *parser) parseUnary() (node, error) {
+	switch t := p.peek(); t.kind {
+	case tokNot:
+		p.next()
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *flow.Flow) bool { return !n(f) }, nil
+
+	case tokLParen:
+		p.next()
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return nil, p.errorf(c, "expected \")\" to close the \"(\" at column %d, found %s", t.pos+1, c)
+		}
+		return n, nil
+
+	case tokWord:
+		return p.parsePredicate()
+
+	case tokEOF:
+		return nil, p.errorf(t, "expected a condition, found end of expression")
+
+	default:
+		return nil, p.errorf(t, "expected a field name such as host or status, found %s", t)
+	}
+}
+
+// parsePredicate parses: field [ operator ] [ value ]
+func (p *parser) parsePredicate() (node, error) {
+	fd, err := p.parseField()
+	if err != nil {
+		return nil, err
+	}
+
+	op := p.peek()
+	switch op.kind {
+	case tokEq, tokNe, tokMatch, tokNotMatch, tokLt, tokLe, tokGt, tokGe, tokContains:
+		p.next()
+	case tokWord, tokString:
+		// A value straight after the field is shorthand for ==
+		op = token{kind: tokEq, pos: op.pos}
+	default:
+		return exists(fd), nil
+	}
+
+	value := p.next()
+	if value.kind != tokWord && value.kind != tokString {
+		return nil, p.errorf(value, "expected a value after %s, found %s", op, value)
+	}
+
+	switch fd.kind {
+	case kindNumber:
+		return p.numberPredicate(fd, op, value)
+	case kindDuration:
+		return p.durationPredicate(fd, op, value)
+	default:
+		return p.textPredicate(fd, op, value)
+	}
+}
+
+func (p *parser) parseField() (*field, error) {
+	t := p.next()
+	name := strings.ToLower(t.text)
+	if fd, ok := fields[name]; ok {
+		return fd, nil
+	}
+
+	get, ok := headerFields[name]
+	if !ok {
+		msg := "unknown field " + strconv.Quote(t.text)
+		if s := suggest(name); s != "" {
+			msg += "; did you mean " + strconv.Quote(s) + "?"
+		} else {
+			msg += "; fields are " + strings.Join(fieldNames(), ", ")
+		}
+		return nil, p.errorf(t, "%s", msg)
+	}
+
+	if b := p.next(); b.kind != tokLBracket {
+		return nil, p.errorf(b, "expected [\"Header-Name\"] after %s, found %s", t.text, b)
+	}
+	header := p.next()
+	if header.kind != tokString && header.kind != tokWord {
+		return nil, p.errorf(header, "expected a header name, found %s", header)
+	}
+	if b := p.next(); b.kind != tokRBracket {
+		return nil, p.errorf(b, "expected \"]\" after the header name, found %s", b)
+	}
+
+	return &field{
+		name: t.text + "[" + strconv.Quote(header.text) + "]",
+		kind: kindString,
+		text: func(f *flow.Flow) []string { return get(f, header.text) },
+	}, nil
+}
+
+// exists tests that a field is set: non-empty text, or a non-zero number
+// or duration
+func exists(fd *field) node {
+	switch fd.kind {
+	case kindNumber:
+		return func(f *flow.Flow) bool { return fd.number(f) != 0 }
+	case kindDuration:
+		return func(f *flow.Flow) bool { return fd.duration(f) != 0 }
+	default:
+		return func(f *flow.Flow) bool { return len(fd.text(f)) > 0 }
+	}
+}
+
+func (p *parser) textPredicate(fd *field, op, value token) (node, error) {
+	want := value.text
+	var test func(string) bool
+	switch op.kind {
+	case tokEq, tokNe:
+		test = func(s string) bool { return s == want }
+		if fd.fold {
+			test = func(s string) bool { return strings.EqualFold(s, want) }
+		}
+	case tokContains:
+		test = func(s string) bool { return strings.Contains(s, want) }
+		if fd.fold {
+			want = strings.ToLower(want)
+			test = func(s string) bool { return strings.Contains(strings.ToLower(s), want) }
+		}
+	case tokMatch, tokNotMatch:
+		pattern := want
+		if fd.fold {
+			pattern = "(?i)" + pattern
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, p.errorf(value, "invalid regular expression: %v", err)
+		}
+		test = re.MatchString
+	default:
+		return nil, p.errorf(op, "%s compares numbers and durations, but %s is %s; use ==, !=, ~, !~ or contains",
+			op, fd.name, fd.kind)
+	}
+
+	matches := func(f *flow.Flow) bool { return slices.ContainsFunc(fd.text(f), test) }
+	if op.kind == tokNe || op.kind == tokNotMatch {
+		return func(f *flow.Flow) bool { return !matches(f) }, nil
+	}
+	return matches, nil
+}
+
+func (p *parser) numberPredicate(fd *field, op, value token) (node, error) {
+	// A status class such as 5xx
+	if fd.name == "status" && len(value.text) == 3 && strings.EqualFold(value.text[1:], "xx") &&
+		value.text[0] >= '1' && value.text[0] <= '5' {
+		class := int64(value.text[0] - '0')
+		in := func(f *flow.Flow) bool { return fd.number(f)/100 == class }
+		switch op.kind {
+		case tokEq:
+			return in, nil
+		case tokNe:
+			return func(f *flow.Flow) bool { return !in(f) }, nil
+		default:
+			return nil, p.errorf(op, "a status class such as %s can only be used with == or !=", value.text)
+		}
+	}
+
+	if !isComparison(op.kind) {
+		return nil, p.errorf(op, "%s works on text, but %s is a number; use ==, !=, <, <=, > or >=", op, fd.name)
+	}
+	want, err := strconv.ParseInt(value.text, 10, 64)
+	if err != nil {
+		return nil, p.errorf(value, "%s is a number, but %s is not", fd.name, value)
+	}
+	return compare(op.kind, func(f *flow.Flow) int64 { return fd.number(f) }, want), nil
+}
+
+func (p *parser) durationPredicate(fd *field, op, value token) (node, error) {
+	if !isComparison(op.kind) {
+		return nil, p.errorf(op, "%s works on text, but %s is a duration; use ==, !=, <, <=, > or >=", op, fd.name)
+	}
+	want, err := time.ParseDuration(value.text)
+	if err != nil {
+		if _, numErr := strconv.ParseFloat(value.text, 64); numErr == nil {
+			return nil, p.errorf(value, "duration %s needs a unit, e.g. %sms or %ss", value.text, value.text, value.text)
+		}
+		return nil, p.errorf(value, "%s is a duration such as 150ms or 2s, but %s is not", fd.name, value)
+	}
+	return compare(op.kind, func(f *flow.Flow) time.Duration { return fd.duration(f) }, want), nil
+}
+
+func isComparison(k tokenKind) bool {
+	switch k {
+	case tokEq, tokNe, tokLt, tokLe, tokGt, tokGe:
+		return true
+	}
+	return false
+}
+
+func compare[T int64 | time.Duration](op tokenKind, get func(*flow.Flow) T, want T) node {
+	switch op {
+	case tokEq:
+		return func(f *flow.Flow) bool { return get(f) == want }
+	case tokNe:
+		return func(f *flow.Flow) bool { return get(f) != want }
+	case tokLt:
+		return func(f *flow.Flow) bool { return get(f) < want }
+	case tokLe:
+		return func(f *flow.Flow) bool { return get(f) <= want }
+	case tokGt:
+		return func(f *flow.Flow) bool { return get(f) > want }
+	default:
+		return func(f *flow.Flow) bool { return get(f) >= want }
+	}
+}
@@ -0,0 +1,167 @@
+// Package flow describes the request/response exchanges observed by the
+// proxy so that logging, metrics and inspection tools share one model.
+package flow
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var lastID atomic.Uint64
+
+// Flow is a single request/response exchange handled by the proxy
+type Flow struct {
+	ID      uint64    `json:"id"`
+	Start   time.Time `json:"start"`
+	Method  string    `json:"method"`
+	URL     string    `json:"url"`
+	Host    string    `json:"host"`
+	User    string    `json:"user,omitempty"` // authenticated proxy user
+	Status  int       `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	Timings Timings   `json:"timings"`
+
+	// W3C trace context of the proxy's span, set when tracing is enabled
+	TraceID      string `json:"trace_id,omitempty"`
+	SpanID       string `json:"span_id,omitempty"`
+	ParentSpanID string `json:"parent_span_id,omitempty"`
+
+	// Headers as sent upstream and returned to the client. Bodies are
+	// captured up to the proxy's limit; sizes are always the full length.
+	RequestHeader     http.Header `json:"request_header,omitempty"`
+	RequestBody       []byte      `json:"request_body,omitempty"`
+	RequestSize       int64       `json:"request_size"`
+	RequestTruncated  bool        `json:"request_truncated,omitempty"`
+	ResponseHeader    http.Header `json:"response_header,omitempty"`
+	ResponseBody      []byte      `json:"response_body,omitempty"`
+	ResponseSize      int64       `json:"response_size"`
+	ResponseTruncated bool        `json:"response_truncated,omitempty"`
+}
+
+// Summary is the lightweight view of a flow used in listings
+type Summary struct {
+	ID           uint64        `json:"id"`
+	Start        time.Time     `json:"start"`
+	Method       string        `json:"method"`
+	URL          string        `json:"url"`
+	Host         string        `json:"host"`
+	User         string        `json:"user,omitempty"`
+	Status       int           `json:"status"`
+	ContentType  string        `json:"content_type,omitempty"`
+	Duration     time.Duration `json:"duration"`
+	RequestSize  int64         `json:"request_size"`
+	ResponseSize int64         `json:"response_size"`
+	Error        string        `json:"error,omitempty"`
+	TraceID      string        `json:"trace_id,omitempty"`
+}
+
+// Summary returns the listing view of f
+func (f *Flow) Summary() Summary {
+	return Summary{
+		ID:           f.ID,
+		Start:        f.Start,
+		Method:       f.Method,
+		URL:          f.URL,
+		Host:         f.Host,
+		User:         f.User,
+		Status:       f.Status,
+		ContentType:  f.ContentType(),
+		Duration:     f.Timings.Total,
+		RequestSize:  f.RequestSize,
+		ResponseSize: f.ResponseSize,
+		Error:        f.Error,
+		TraceID:      f.TraceID,
+	}
+}
+
+// ContentType returns the response media type without parameters
+func (f *Flow) ContentType() string {
+	ct := f.ResponseHeader.Get("Content-Type")
+	if i := strings.IndexByte(ct, ';'); i >= 0 {
+		ct = ct[:i]
+	}
+	return strings.TrimSpace(strings.ToLower(ct))
+}
+
+// New creates a flow with a process-unique ID, starting now
+func New(method, url, host string) *Flow {
+	return &Flow{
+		ID:     lastID.Add(1),
+		Start:  time.Now(),
+		Method: method,
+		URL:    url,
+		Host:   host,
+	}
+}
+
+// Timings is the latency breakdown of a flow. Phases that did not happen,
+// such as DNS on a reused connection, are zero. Phases may overlap when
+// bodies are streamed, so they do not necessarily add up to Total.
+type Timings struct {
+	ClientRead   time.Duration `json:"client_read"`   // reading the request from the client
+	DNS          time.Duration `json:"dns"`           // resolving the upstream host
+	Connect      time.Duration `json:"connect"`       // TCP connect to upstream
+	TLS          time.Duration `json:"tls"`           // upstream TLS handshake
+	RequestWrite time.Duration `json:"request_write"` // sending the request upstream
+	TTFB         time.Duration `json:"ttfb"`          // request written to first response byte
+	BodyTransfer time.Duration `json:"body_transfer"` // relaying the response to the client
+	Handler      time.Duration `json:"handler"`       // time spent in proxy hooks
+	Total        time.Duration `json:"total"`         // whole exchange as seen by the proxy
+}
+
+// phase pairs a timing with its short name in logs and Server-Timing
+type phase struct {
+	name string
+	d    time.Duration
+}
+
+func (t Timings) phases() []phase {
+	return []phase{
+		{"client-read", t.ClientRead},
+		{"dns", t.DNS},
+		{"connect", t.Connect},
+		{"tls", t.TLS},
+		{"request-write", t.RequestWrite},
+		{"ttfb", t.TTFB},
+		{"body-transfer", t.BodyTransfer},
+		{"handler", t.Handler},
+		{"total", t.Total},
+	}
+}
+
+// String formats the non-zero phases for logging, e.g. "dns=1.2ms ttfb=30ms"
+func (t Timings) String() string {
+	var parts []string
+	for _, p := range t.phases() {
+		if p.d > 0 {
+			parts = append(parts, fmt.Sprintf("%s=%s", p.name, p.d.Round(time.Microsecond)))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// ServerTiming formats the non-zero phases as a Server-Timing header value
+// with millisecond durations, as understood by browser devtools
+func (t Timings) ServerTiming() string {
+	var parts []string
+	for _, p := range t.phases() {
+		if p.d > 0 {
+			ms := float64(p.d) / float64(time.Millisecond)
+			parts = append(parts, fmt.Sprintf("%s;dur=%.3f", p.name, ms))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Export writes flows as an indented JSON array in the admin API's flow
+// format, as read back by the replay command
+func Export(w io.Writer, flows []*Flow) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(flows)
+}
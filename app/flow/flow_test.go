@@ -0,0 +1,91 @@
+package flow
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	a := New("GET", "http://example.com/", "example.com")
+	b := New("POST", "http://example.com/api", "example.com")
+
+	if a.ID == 0 || b.ID <= a.ID {
+		t.Errorf("Expected increasing non-zero IDs, got %d and %d", a.ID, b.ID)
+	}
+	if a.Method != "GET" || a.URL != "http://example.com/" || a.Host != "example.com" {
+		t.Errorf("Unexpected flow fields: %+v", a)
+	}
+	if time.Since(a.Start) > time.Minute {
+		t.Errorf("Start is too old: %v", a.Start)
+	}
+}
+
+func TestTimingsString(t *testing.T) {
+	timings := Timings{
+		DNS:   1500 * time.Microsecond,
+		TTFB:  30 * time.Millisecond,
+		Total: 40 * time.Millisecond,
+	}
+
+	expected := "dns=1.5ms ttfb=30ms total=40ms"
+	if got := timings.String(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	if got := (Timings{}).String(); got != "" {
+		t.Errorf("Expected empty string for zero timings, got %q", got)
+	}
+}
+
+func TestTimingsServerTiming(t *testing.T) {
+	timings := Timings{
+		Connect: 2 * time.Millisecond,
+		Handler: 250 * time.Microsecond,
+	}
+
+	expected := "connect;dur=2.000, handler;dur=0.250"
+	if got := timings.ServerTiming(); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+}
+
+func TestFlowJSON(t *testing.T) {
+	f := New("GET", "https://example.com/", "example.com")
+	f.Status = 200
+	f.Timings.TTFB = time.Millisecond
+
+	data, err := json.Marshal(f)
+	if err != nil {
+		t.Fatalf("Failed to marshal flow: %v", err)
+	}
+
+	var decoded Flow
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal flow: %v", err)
+	}
+	if decoded.ID != f.ID || decoded.Status != 200 || decoded.Timings.TTFB != time.Millisecond {
+		t.Errorf("Round trip lost data: %+v", decoded)
+	}
+}
+
+func TestFlowSummary(t *testing.T) {
+	f := New("GET", "https://example.com/data", "example.com")
+	f.Status = 200
+	f.ResponseHeader = http.Header{"Content-Type": {"Application/JSON; charset=utf-8"}}
+	f.ResponseBody = []byte(`{"large":"payload"}`)
+	f.ResponseSize = 19
+	f.Timings.Total = 5 * time.Millisecond
+
+	s := f.Summary()
+	if s.ID != f.ID || s.Status != 200 || s.ResponseSize != 19 {
+		t.Errorf("Unexpected summary: %+v", s)
+	}
+	if s.ContentType != "application/json" {
+		t.Errorf("Expected content type application/json, got %q", s.ContentType)
+	}
+	if s.Duration != 5*time.Millisecond {
+		t.Errorf("Expected duration 5ms, got %v", s.Duration)
+	}
+}
@@ -0,0 +1,129 @@
+package flow
+
+import (
+	"sync"
+)
+
+// Store keeps the most recent flows in memory so they can be inspected
+// after the fact, and broadcasts new flows to live subscribers. Recording
+// can be paused, in which case new flows are ignored.
+type Store struct {
+	mu          sync.RWMutex
+	capacity    int
+	flows       []*Flow
+	recording   bool
+	subscribers map[chan *Flow]struct{}
+}
+
+// NewStore creates a store holding at most capacity flows, recording enabled
+func NewStore(capacity int) *Store {
+	if capacity <= 0 {
+		capacity = 1
+	}
+	return &Store{
+		capacity:    capacity,
+		recording:   true,
+		subscribers: make(map[chan *Flow]struct{}),
+	}
+}
+
+// Add records f if recording is enabled, evicting the oldest flow when full,
+// and passes it to every subscriber. Flows must not be modified once added.
+func (s *Store) Add(f *Flow) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.recording {
+		return
+	}
+	for len(s.flows) >= s.capacity {
+		// Clear the slot so the evicted flow can be collected before the
+		// backing array is reallocated
+		s.flows[0] = nil
+		s.flows = s.flows[1:]
+	}
+	s.flows = append(s.flows, f)
+
+	for ch := range s.subscribers {
+		select {
+		case ch <- f:
+		default:
+			// A slow subscriber misses flows rather than stalling the proxy
+		}
+	}
+}
+
+// Subscribe returns a channel that receives every flow recorded from now on
+// and a function that ends the subscription and closes the channel. Flows
+// are dropped for a subscriber whose buffer is full.
+func (s *Store) Subscribe(buffer int) (<-chan *Flow, func()) {
+	ch := make(chan *Flow, buffer)
+
+	s.mu.Lock()
+	s.subscribers[ch] = struct{}{}
+	s.mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			s.mu.Lock()
+			delete(s.subscribers, ch)
+			s.mu.Unlock()
+			close(ch)
+		})
+	}
+}
+
+// List returns the stored flows, oldest first
+func (s *Store) List() []*Flow {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]*Flow(nil), s.flows...)
+}
+
+// Get returns the flow with the given ID
+func (s *Store) Get(id uint64) (*Flow, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, f := range s.flows {
+		if f.ID == id {
+			return f, true
+		}
+	}
+	return nil, false
+}
+
+// Len returns the number of stored flows
+func (s *Store) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.flows)
+}
+
+// Capacity returns the maximum number of stored flows
+func (s *Store) Capacity() int {
+	return s.capacity
+}
+
+// Clear removes every stored flow and returns how many there were
+func (s *Store) Clear() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := len(s.flows)
+	s.flows = nil
+	return n
+}
+
+// Recording reports whether new flows are being stored
+func (s *Store) Recording() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.recording
+}
+
+// SetRecording pauses or resumes storing new flows
+func (s *Store) SetRecording(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recording = enabled
+}
@@ -0,0 +1,100 @@
+package flow
+
+import (
+	"testing"
+)
+
+func TestStoreEviction(t *testing.T) {
+	s := NewStore(3)
+
+	var added []*Flow
+	for i := 0; i < 5; i++ {
+		f := New("GET", "http://example.com/", "example.com")
+		added = append(added, f)
+		s.Add(f)
+	}
+
+	flows := s.List()
+	if len(flows) != 3 {
+		t.Fatalf("Expected 3 flows, got %d", len(flows))
+	}
+	for i, f := range flows {
+		if f != added[i+2] {
+			t.Errorf("Flow %d: expected ID %d, got %d", i, added[i+2].ID, f.ID)
+		}
+	}
+
+	if _, ok := s.Get(added[0].ID); ok {
+		t.Error("Expected evicted flow to be gone")
+	}
+	if f, ok := s.Get(added[4].ID); !ok || f != added[4] {
+		t.Error("Expected newest flow to be found")
+	}
+}
+
+func TestStoreRecording(t *testing.T) {
+	s := NewStore(10)
+	if !s.Recording() {
+		t.Error("Expected recording to be enabled by default")
+	}
+
+	s.SetRecording(false)
+	s.Add(New("GET", "http://example.com/", "example.com"))
+	if s.Len() != 0 {
+		t.Errorf("Expected no flows while paused, got %d", s.Len())
+	}
+
+	s.SetRecording(true)
+	s.Add(New("GET", "http://example.com/", "example.com"))
+	if s.Len() != 1 {
+		t.Errorf("Expected 1 flow after resuming, got %d", s.Len())
+	}
+}
+
+func TestStoreClear(t *testing.T) {
+	s := NewStore(10)
+	s.Add(New("GET", "http://example.com/a", "example.com"))
+	s.Add(New("GET", "http://example.com/b", "example.com"))
+
+	if n := s.Clear(); n != 2 {
+		t.Errorf("Expected Clear to report 2 flows, got %d", n)
+	}
+	if s.Len() != 0 {
+		t.Errorf("Expected empty store, got %d flows", s.Len())
+	}
+}
+
+func TestStoreSubscribe(t *testing.T) {
+	s := NewStore(10)
+	ch, cancel := s.Subscribe(1)
+
+	f := New("GET", "http://example.com/", "example.com")
+	s.Add(f)
+	if got := <-ch; got != f {
+		t.Errorf("Expected subscriber to receive flow %d, got %d", f.ID, got.ID)
+	}
+
+	// A full buffer drops flows instead of blocking Add
+	s.Add(New("GET", "http://example.com/1", "example.com"))
+	s.Add(New("GET", "http://example.com/2", "example.com"))
+	if got := <-ch; got.URL != "http://example.com/1" {
+		t.Errorf("Expected the buffered flow, got %s", got.URL)
+	}
+
+	// Paused recording is not broadcast
+	s.SetRecording(false)
+	s.Add(New("GET", "http://example.com/paused", "example.com"))
+	select {
+	case got := <-ch:
+		t.Errorf("Expected no flow while paused, got %s", got.URL)
+	default:
+	}
+
+	cancel()
+	cancel()
+	if _, ok := <-ch; ok {
+		t.Error("Expected the channel to be closed after cancel")
+	}
+	s.SetRecording(true)
+	s.Add(New("GET", "http://example.com/after", "example.com"))
+}
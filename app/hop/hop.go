@@ -0,0 +1,178 @@
+// Package hop handles the headers that only concern one hop of a message's
+// way between client and server (RFC 9110, section 7.6): the
+// connection-specific headers a proxy must not forward, and the Via and
+// Forwarded headers with which proxies record themselves and the client on
+// the way.
+package hop
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Headers are the hop-by-hop headers removed from every forwarded message,
+// besides those named in its Connection header
+var Headers = []string{
+	"Connection",
+	"Proxy-Connection", // not standard, but still sent by clients
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer", // the trailers themselves are forwarded
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// Strip removes the hop-by-hop headers from h: those named in its
+// Connection header and the Headers
+func Strip(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = connectionOption(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range Headers {
+		h.Del(name)
+	}
+}
+
+// StripRequest removes the hop-by-hop headers from h, the header of a
+// request to forward. A request to upgrade the connection keeps its
+// Upgrade header and Connection: Upgrade, and TE: trailers, which tells the
+// server that the client takes trailers, is kept too.
+func StripRequest(h http.Header) {
+	upgrade := UpgradeType(h)
+	trailers := hasToken(h["Te"], "trailers")
+	Strip(h)
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if trailers {
+		h.Set("Te", "trailers")
+	}
+}
+
+// StripResponse removes the hop-by-hop headers from h, the header of a
+// response with the given status to forward. A 101 Switching Protocols
+// response keeps its Upgrade header and Connection: Upgrade.
+func StripResponse(h http.Header, status int) {
+	upgrade := ""
+	if status == http.StatusSwitchingProtocols {
+		upgrade = UpgradeType(h)
+	}
+	Strip(h)
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+}
+
+// UpgradeType returns the protocol that a message with header h upgrades
+// the connection to, or "" when it doesn't
+func UpgradeType(h http.Header) string {
+	if !hasToken(h["Connection"], "upgrade") {
+		return ""
+	}
+	return h.Get("Upgrade")
+}
+
+// AddVia appends to the Via header in h the proxy named by pseudonym, as
+// the recipient of a message received over HTTP/major.minor
+func AddVia(h http.Header, major, minor int, pseudonym string) {
+	version := strconv.Itoa(major)
+	if major < 2 {
+		version += "." + strconv.Itoa(minor)
+	}
+	h.Add("Via", version+" "+pseudonym)
+}
+
+// CheckPseudonym checks a name for the proxy in Via headers, which is
+// either a token or a host with an optional port
+func CheckPseudonym(s string) error {
+	if s == "" {
+		return errors.New("must not be empty")
+	}
+	for _, c := range s {
+		if !isTokenChar(c) && !strings.ContainsRune(":[]", c) {
+			return errors.New("must be a token or host[:port], without spaces or commas")
+		}
+	}
+	return nil
+}
+
+// SetForwarded describes in, a request the proxy received, to the upstream
+// in the headers of the request sent on: the client address is appended to
+// X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto are set, and an
+// element is appended to Forwarded (RFC 7239)
+func SetForwarded(h http.Header, in *http.Request) {
+	proto := "http"
+	if in.TLS != nil {
+		proto = "https"
+	}
+	client, _, err := net.SplitHostPort(in.RemoteAddr)
+	if err != nil {
+		client = in.RemoteAddr
+	}
+
+	if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+		h.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+client)
+	} else {
+		h.Set("X-Forwarded-For", client)
+	}
+	h.Set("X-Forwarded-Host", in.Host)
+	h.Set("X-Forwarded-Proto", proto)
+
+	node := client
+	if strings.Contains(client, ":") {
+		node = "[" + client + "]"
+	}
+	h.Add("Forwarded", "for="+quote(node)+";host="+quote(in.Host)+";proto="+proto)
+}
+
+// hasToken reports whether the comma-separated lists in values contain
+// token, ignoring case
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// connectionOption returns the header name in an element of a Connection
+// header, or "" when it isn't one
+func connectionOption(name string) string {
+	name = strings.TrimSpace(name)
+	for _, c := range name {
+		if !isTokenChar(c) {
+			return ""
+		}
+	}
+	return name
+}
+
+// quote returns v as a Forwarded parameter value, quoted unless it is a
+// token
+func quote(v string) string {
+	for _, c := range v {
+		if !isTokenChar(c) {
+			return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(v) + `"`
+		}
+	}
+	return v
+}
+
+func isTokenChar(c rune) bool {
+	return c < 0x7f && (c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.ContainsRune("!#$%&'*+-.^_`|~", c))
+}
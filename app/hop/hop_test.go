@@ -0,0 +1,130 @@
+package hop
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestStripRequest(t *testing.T) {
+	tests := []struct {
+		name   string
+		header http.Header
+		want   http.Header
+	}{
+		{
+			name: "hop-by-hop headers",
+			header: http.Header{
+				"Connection":          {"keep-alive"},
+				"Proxy-Connection":    {"keep-alive"},
+				"Keep-Alive":          {"timeout=5"},
+				"Proxy-Authorization": {"Basic Ym9iOnNlY3JldA=="},
+				"Te":                  {"gzip"},
+				"Trailer":             {"X-Checksum"},
+				"Transfer-Encoding":   {"chunked"},
+				"Upgrade":             {"websocket"},
+				"Accept":              {"*/*"},
+			},
+			want: http.Header{"Accept": {"*/*"}},
+		},
+		{
+			name: "headers named in Connection",
+			header: http.Header{
+				"Connection": {"X-Hop, close", "x-other"},
+				"X-Hop":      {"1"},
+				"X-Other":    {"2"},
+				"X-End":      {"3"},
+			},
+			want: http.Header{"X-End": {"3"}},
+		},
+		{
+			name:   "TE: trailers",
+			header: http.Header{"Te": {"gzip, Trailers"}},
+			want:   http.Header{"Te": {"trailers"}},
+		},
+		{
+			name: "upgrade",
+			header: http.Header{
+				"Connection": {"keep-alive, Upgrade"},
+				"Upgrade":    {"websocket"},
+				"Keep-Alive": {"timeout=5"},
+			},
+			want: http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			StripRequest(tt.header)
+			if !equal(tt.header, tt.want) {
+				t.Errorf("got %v, want %v", tt.header, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripResponse(t *testing.T) {
+	h := http.Header{"Connection": {"Upgrade"}, "Upgrade": {"h2c"}, "Content-Type": {"text/plain"}}
+	StripResponse(h, http.StatusOK)
+	if !equal(h, http.Header{"Content-Type": {"text/plain"}}) {
+		t.Errorf("Expected an upgrade offer to be removed, got %v", h)
+	}
+
+	h = http.Header{"Connection": {"upgrade"}, "Upgrade": {"websocket"}, "Proxy-Authenticate": {"Basic"}}
+	StripResponse(h, http.StatusSwitchingProtocols)
+	if !equal(h, http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}}) {
+		t.Errorf("Expected a 101 to keep its upgrade, got %v", h)
+	}
+}
+
+func TestAddVia(t *testing.T) {
+	h := http.Header{"Via": {"1.0 fred"}}
+	AddVia(h, 1, 1, "nproxy")
+	AddVia(h, 2, 0, "edge:8080")
+	if got := strings.Join(h.Values("Via"), ", "); got != "1.0 fred, 1.1 nproxy, 2 edge:8080" {
+		t.Errorf("Via = %q", got)
+	}
+}
+
+func TestCheckPseudonym(t *testing.T) {
+	for _, s := range []string{"nproxy", "proxy.example.com:8080", "[::1]:8080"} {
+		if err := CheckPseudonym(s); err != nil {
+			t.Errorf("CheckPseudonym(%q): %v", s, err)
+		}
+	}
+	for _, s := range []string{"", "my proxy", "a,b"} {
+		if err := CheckPseudonym(s); err == nil {
+			t.Errorf("CheckPseudonym(%q): expected an error", s)
+		}
+	}
+}
+
+func TestSetForwarded(t *testing.T) {
+	in := &http.Request{Host: "app.example.com", RemoteAddr: "[2001:db8::1]:51234", TLS: &tls.ConnectionState{}}
+	h := http.Header{"X-Forwarded-For": {"203.0.113.9"}, "Forwarded": {"for=203.0.113.9"}}
+	SetForwarded(h, in)
+
+	want := map[string][]string{
+		"X-Forwarded-For":   {"203.0.113.9, 2001:db8::1"},
+		"X-Forwarded-Host":  {"app.example.com"},
+		"X-Forwarded-Proto": {"https"},
+		"Forwarded":         {"for=203.0.113.9", `for="[2001:db8::1]";host=app.example.com;proto=https`},
+	}
+	for name, values := range want {
+		if got := h.Values(name); strings.Join(got, "|") != strings.Join(values, "|") {
+			t.Errorf("%s = %q, want %q", name, got, values)
+		}
+	}
+}
+
+func equal(a, b http.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for name, values := range a {
+		if strings.Join(values, "|") != strings.Join(b[name], "|") {
+			return false
+		}
+	}
+	return true
+}
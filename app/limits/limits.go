@@ -0,0 +1,202 @@
+// Package limits bounds how long each phase of a proxied connection may
+// take, how big requests and responses may be and how many connections a
+// client may hold open, and names the limit a connection ran into.
+package limits
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Names of the limits, as used in errors, logs and the limit label of
+// nproxy_limit_exceeded_total. They are also the setting paths under
+// limits in the config file.
+const (
+	ClientTLSHandshake   = "client.tls_handshake"
+	ClientHeader         = "client.header"
+	ClientIdle           = "client.idle"
+	ClientRequest        = "client.request"
+	UpstreamDial         = "upstream.dial"
+	UpstreamTLSHandshake = "upstream.tls_handshake"
+	UpstreamHeader       = "upstream.header"
+	UpstreamIdle         = "upstream.idle"
+	UpstreamRequest      = "upstream.request"
+	MaxHeaderBytes       = "max_header_bytes"
+	MaxRequestBody       = "max_request_body"
+	MaxResponseBody      = "max_response_body"
+	MaxConnsPerClient    = "max_conns_per_client"
+)
+
+// Timeouts bound the phases of the connections on one side of the proxy.
+// A zero timeout leaves its phase unbounded.
+type Timeouts struct {
+	Dial         time.Duration // connecting; upstream only
+	TLSHandshake time.Duration
+	Header       time.Duration // reading a client's request head, or waiting for an upstream's response head once the request is sent
+	Idle         time.Duration // how long a keep-alive connection waits for its next request
+	Request      time.Duration // a whole exchange: reading a client's request, or an upstream's response, bodies included
+}
+
+// Limits are the timeouts of both sides of the proxy and the size and
+// connection limits on clients and upstreams. Zero sizes and counts are
+// unlimited.
+type Limits struct {
+	Client            Timeouts
+	Upstream          Timeouts
+	MaxHeaderBytes    int   // size of a client's request head; net/http's 1 MiB when zero
+	MaxRequestBody    int64 // bytes of a client's request body
+	MaxResponseBody   int64 // bytes of an upstream's response body
+	MaxConnsPerClient int   // open connections from one client IP address
+}
+
+// Default returns the limits of a proxy that isn't configured otherwise:
+// every phase that can hang on a silent peer is bounded, while bodies,
+// whole exchanges and connection counts are not
+func Default() Limits {
+	return Limits{
+		Client: Timeouts{
+			TLSHandshake: 10 * time.Second,
+			Header:       30 * time.Second,
+			Idle:         2 * time.Minute,
+		},
+		Upstream: Timeouts{
+			Dial:         30 * time.Second,
+			TLSHandshake: 10 * time.Second,
+			Header:       2 * time.Minute,
+			Idle:         90 * time.Second,
+		},
+	}
+}
+
+// Check checks the limits, reporting every problem on a line of its own
+func Check(l Limits) error {
+	var errs []error
+	timeouts := []struct {
+		name string
+		d    time.Duration
+	}{
+		{ClientTLSHandshake, l.Client.TLSHandshake}, {ClientHeader, l.Client.Header},
+		{ClientIdle, l.Client.Idle}, {ClientRequest, l.Client.Request},
+		{UpstreamDial, l.Upstream.Dial}, {UpstreamTLSHandshake, l.Upstream.TLSHandshake},
+		{UpstreamHeader, l.Upstream.Header}, {UpstreamIdle, l.Upstream.Idle}, {UpstreamRequest, l.Upstream.Request},
+	}
+	for _, t := range timeouts {
+		if t.d < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative; use 0 for no timeout", t.name))
+		}
+	}
+	if l.Client.Dial != 0 {
+		errs = append(errs, errors.New("client.dial is not a limit; clients connect to the proxy"))
+	}
+	sizes := []struct {
+		name string
+		n    int64
+	}{
+		{MaxHeaderBytes, int64(l.MaxHeaderBytes)}, {MaxRequestBody, l.MaxRequestBody},
+		{MaxResponseBody, l.MaxResponseBody}, {MaxConnsPerClient, int64(l.MaxConnsPerClient)},
+	}
+	for _, s := range sizes {
+		if s.n < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative; use 0 for no limit", s.name))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Error reports a connection or exchange that ran into a limit. It is a
+// net.Error whose Timeout method tells the timeouts from the other limits.
+type Error struct {
+	Limit string // one of the names above
+	Err   error  // what the limit caused, e.g. an i/o timeout; may be nil
+}
+
+func (e *Error) Error() string {
+	if e.Timeout() {
+		return e.Limit + " timeout exceeded"
+	}
+	return e.Limit + " limit exceeded"
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Timeout reports whether the limit is one of the timeouts
+func (e *Error) Timeout() bool {
+	switch e.Limit {
+	case MaxHeaderBytes, MaxRequestBody, MaxResponseBody, MaxConnsPerClient:
+		return false
+	}
+	return true
+}
+
+// Temporary is part of net.Error
+func (e *Error) Temporary() bool { return e.Timeout() }
+
+// Conns counts the open connections of each client IP address. All methods
+// are safe to call on a nil *Conns, which admits every connection.
+type Conns struct {
+	max int
+
+	mu   sync.Mutex
+	open map[string]int
+}
+
+// NewConns returns a counter that admits max connections per client, or
+// nil when max is zero
+func NewConns(max int) *Conns {
+	if max <= 0 {
+		return nil
+	}
+	return &Conns{max: max, open: make(map[string]int)}
+}
+
+// Acquire counts a new connection from the client at remote address addr.
+// It returns false, counting nothing, when the client already has the
+// maximum open.
+func (c *Conns) Acquire(addr string) bool {
+	if c == nil {
+		return true
+	}
+	ip := clientIP(addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open[ip] >= c.max {
+		return false
+	}
+	c.open[ip]++
+	return true
+}
+
+// Release stops counting a connection that Acquire admitted
+func (c *Conns) Release(addr string) {
+	if c == nil {
+		return
+	}
+	ip := clientIP(addr)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open[ip] <= 1 {
+		delete(c.open, ip)
+	} else {
+		c.open[ip]--
+	}
+}
+
+// Open returns the number of connections open from the client at addr
+func (c *Conns) Open(addr string) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.open[clientIP(addr)]
+}
+
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
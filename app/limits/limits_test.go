@@ -0,0 +1,78 @@
+package limits
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	if err := Check(Default()); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+	if err := Check(Limits{}); err != nil {
+		t.Errorf("Expected no limits to be valid, got %v", err)
+	}
+
+	l := Default()
+	l.Client.Dial = time.Second
+	l.Upstream.Header = -time.Second
+	l.MaxRequestBody = -1
+	err := Check(l)
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	for _, want := range []string{"client.dial", "upstream.header must not be negative", "max_request_body must not be negative"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q in %q", want, err)
+		}
+	}
+	if n := len(strings.Split(err.Error(), "\n")); n != 3 {
+		t.Errorf("Expected 3 problems, got %d", n)
+	}
+}
+
+func TestError(t *testing.T) {
+	var ne net.Error = &Error{Limit: UpstreamHeader}
+	if !ne.Timeout() || ne.Error() != "upstream.header timeout exceeded" {
+		t.Errorf("Unexpected timeout error %q, Timeout %v", ne, ne.Timeout())
+	}
+	ne = &Error{Limit: MaxResponseBody}
+	if ne.Timeout() || ne.Error() != "max_response_body limit exceeded" {
+		t.Errorf("Unexpected size error %q, Timeout %v", ne, ne.Timeout())
+	}
+
+	cause := errors.New("i/o timeout")
+	if err := error(&Error{Limit: ClientRequest, Err: cause}); !errors.Is(err, cause) {
+		t.Error("Expected the error to wrap its cause")
+	}
+}
+
+func TestConns(t *testing.T) {
+	c := NewConns(2)
+	if !c.Acquire("10.0.0.1:1000") || !c.Acquire("10.0.0.1:1001") {
+		t.Fatal("Expected the first two connections to be admitted")
+	}
+	if c.Acquire("10.0.0.1:1002") {
+		t.Error("Expected a third connection from the same address to be refused")
+	}
+	if !c.Acquire("10.0.0.2:1000") {
+		t.Error("Expected other clients to be admitted")
+	}
+	if n := c.Open("10.0.0.1:9999"); n != 2 {
+		t.Errorf("Expected 2 open connections, got %d", n)
+	}
+	c.Release("10.0.0.1:1000")
+	if !c.Acquire("10.0.0.1:1003") {
+		t.Error("Expected a connection to be admitted once another closed")
+	}
+
+	// No limit
+	var none *Conns = NewConns(0)
+	if none != nil || !none.Acquire("10.0.0.1:1000") || none.Open("10.0.0.1:1000") != 0 {
+		t.Error("Expected a zero maximum to admit everything")
+	}
+	none.Release("10.0.0.1:1000")
+}
@@ -1,141 +1,398 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
-	"net/http"
-	"regexp"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/breaker"
+	"nproxy/app/cache"
+	"nproxy/app/config"
 	"nproxy/app/mock"
 	"nproxy/app/proxy"
+	"nproxy/app/retry"
+	"nproxy/app/transport"
+	"nproxy/app/upstream"
 )
 
+// command is a subcommand of the nproxy binary
+type command struct {
+	name    string
+	summary string
+	run     func(args []string) error
+}
+
+var commands = []command{
+	{"proxy", "Run the simple forward proxy (default)", runProxy},
+	{"mitm", "Run the MITM proxy that intercepts HTTPS", runMITM},
+	{"mock", "Run the mock server for testing", runMock},
+	{"ca", "Print the MITM CA certificate, creating it if needed", runCA},
+	{"replay", "Re-send flows exported from the terminal UI or admin API", runReplay},
+	{"validate", "Check a configuration file and report every problem", runValidate},
+}
+
 func main() {
-	var (
-		addr    = flag.String("addr", ":8080", "proxy server address")
-		mitm    = flag.Bool("mitm", false, "start as MITM proxy")
-		modify  = flag.Bool("modify", false, "enable request/response modification")
-		verbose = flag.Bool("v", false, "output detailed logs")
-		mockSrv = flag.Bool("mock", false, "start as mock server")
-	)
-	flag.Parse()
-
-	if *mockSrv {
-		// Start mock server
-		log.Printf("Starting mock server on %s", *addr)
-		if err := mock.Start(*addr); err != nil {
-			log.Fatalf("Failed to start mock server: %v", err)
-		}
-	} else if *mitm {
-		// Start MITM proxy
-		mitmProxy, err := proxy.NewMITMProxy(*addr)
-		if err != nil {
-			log.Fatalf("Failed to create MITM proxy: %v", err)
+	args := os.Args[1:]
+	name := "proxy"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		name, args = args[0], args[1:]
+	}
+	if name == "help" {
+		usage()
+		return
+	}
+
+	for _, cmd := range commands {
+		if cmd.name == name {
+			if err := cmd.run(args); err != nil {
+				var problems config.Problems
+				if errors.As(err, &problems) {
+					fmt.Fprintf(os.Stderr, "Invalid configuration:\n%v\n", problems)
+					os.Exit(1)
+				}
+				log.Fatalf("%s: %v", name, err)
+			}
+			return
 		}
+	}
+
+	fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", name)
+	usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: nproxy <command> [flags]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", cmd.name, cmd.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 'nproxy <command> -h' for the flags of a command. Settings can also come\n"+
+		"from a config file (-config or %sCONFIG) and %s* environment variables;\n"+
+		"flags override the environment, which overrides the file.\n", config.EnvPrefix, config.EnvPrefix)
+}
+
+// flagPaths maps flags to the config settings they override, so that
+// validation problems can point at the flag
+var flagPaths = map[string]string{
+	"addr":          "listen",
+	"drain-timeout": "drain_timeout",
+	"htpasswd":      "auth.htpasswd",
+	"admin":         "admin.listen",
+	"socks":         "socks.listen",
+	"transparent":   "transparent.listen",
+	"reverse":       "reverse.listen",
+	"admin-token":   "admin.token",
+	"flow-history":  "recording.history",
+	"record-filter": "recording.filter",
+	"record-file":   "recording.file",
+	"log-filter":    "logging.filter",
+	"v":             "logging.verbose",
+	"server-timing": "mitm.server_timing",
+	"otlp":          "tracing.otlp",
+	"cert":          "ca.cert",
+	"key":           "ca.key",
+
+	"trace-batch-size":     "tracing.batch_size",
+	"trace-queue-size":     "tracing.queue_size",
+	"trace-flush-interval": "tracing.flush_interval",
+	"trace-drop-policy":    "tracing.drop_policy",
+}
+
+// loadConfig builds a command's configuration from, in increasing order of
+// precedence, the defaults, the config file, the environment and the flags
+// that bind registers. It returns every problem found as config.Problems.
+func loadConfig(name string, args []string, bind func(fs *flag.FlagSet, c *config.Config)) (*config.Config, *flag.FlagSet, error) {
+	path := configPath(args)
+	c, problems := config.Default(), config.Problems(nil)
+	if path != "" {
+		c, problems = config.Load(path)
+	}
+	problems = append(problems, c.ApplyEnv(os.Environ())...)
 
-		if *modify {
-			// Set request/response modification handler
-			mitmProxy.SetHandler(createModificationHandler(*verbose))
-		} else if *verbose {
-			// Set logging-only handler
-			mitmProxy.SetHandler(createLoggingHandler())
+	fs := flag.NewFlagSet("nproxy "+name, flag.ExitOnError)
+	fs.String("config", path, "configuration file (.yaml, .yml, .json or .toml)")
+	bind(fs, c)
+	fs.Parse(args)
+	fs.Visit(func(f *flag.Flag) {
+		if p, ok := flagPaths[f.Name]; ok {
+			c.Locate(p, "flag -"+f.Name)
 		}
+	})
 
-		log.Printf("Starting MITM proxy server on %s", *addr)
-		if err := mitmProxy.Start(); err != nil {
-			log.Fatalf("Failed to start MITM proxy: %v", err)
+	problems = append(problems, c.Validate()...)
+	if len(problems) > 0 {
+		return c, fs, problems
+	}
+	return c, fs, nil
+}
+
+// configPath finds the -config flag before the flags are parsed, since the
+// file provides their defaults
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(arg, "-"), "=")
+		if !strings.HasPrefix(arg, "-") || name != "config" {
+			continue
+		}
+		if hasValue {
+			return value
 		}
-	} else {
-		// Start normal proxy
-		log.Printf("Starting simple proxy server on %s", *addr)
-		if err := proxy.Start(*addr); err != nil {
-			log.Fatalf("Failed to start proxy: %v", err)
+		if i+1 < len(args) {
+			return args[i+1]
 		}
 	}
+	return os.Getenv(config.EnvPrefix + "CONFIG")
 }
 
-// createModificationHandler creates a handler for request/response modification
-func createModificationHandler(verbose bool) func(*http.Request, *http.Response) {
-	return func(req *http.Request, resp *http.Response) {
-		if req != nil {
-			if verbose {
-				log.Printf("Request: %s %s", req.Method, req.URL.String())
-				log.Printf("Request Headers: %v", req.Header)
-			}
-
-			// Example of request header modification
-			req.Header.Set("X-MITM-Proxy", "true")
-			req.Header.Set("User-Agent", "MITM-Proxy/1.0")
+// setupLogging directs log output to the configured file. The returned
+// function syncs and closes the file once the server has shut down.
+func setupLogging(c *config.Config) (func(), error) {
+	if c.Logging.File == "" {
+		return func() {}, nil
+	}
+	f, err := os.OpenFile(c.Logging.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open log file: %v", err)
+	}
+	log.SetOutput(f)
+	return func() {
+		log.SetOutput(os.Stderr)
+		f.Sync()
+		f.Close()
+	}, nil
+}
 
-			// Modify requests for specific patterns
-			if strings.Contains(req.URL.Path, "/api/") {
-				req.Header.Set("X-API-Modified", "true")
-			}
-		}
+// signalContext returns a context that is cancelled by SIGINT or SIGTERM.
+// After the first signal the default handling is restored, so a second one
+// exits at once instead of waiting for the drain.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+		log.Printf("Shutting down; signal again to exit immediately")
+	}()
+	return ctx, stop
+}
 
-		if resp != nil {
-			if verbose {
-				log.Printf("Response: %d %s", resp.StatusCode, resp.Status)
-				log.Printf("Response Headers: %v", resp.Header)
-			}
+// bindServer registers the flags shared by the commands that run a server
+func bindServer(fs *flag.FlagSet, c *config.Config) {
+	fs.StringVar(&c.Listen, "addr", c.Listen, "listen address")
+	fs.DurationVar(&c.DrainTimeout, "drain-timeout", c.DrainTimeout, "how long shutdown waits for in-flight requests and tunnels")
+}
 
-			// Example of response header modification
-			resp.Header.Set("X-MITM-Intercepted", "true")
-			resp.Header.Set("X-Proxy-Time", "2024-01-01")
+// bindAuth registers the flags of the commands that authenticate clients
+func bindAuth(fs *flag.FlagSet, c *config.Config) {
+	fs.StringVar(&c.Auth.Htpasswd, "htpasswd", c.Auth.Htpasswd, "require clients to authenticate as a user from this htpasswd file")
+}
 
-			// Add security headers
-			resp.Header.Set("X-Content-Type-Options", "nosniff")
-			resp.Header.Set("X-Frame-Options", "DENY")
-			resp.Header.Set("X-XSS-Protection", "1; mode=block")
+// loadAuth reads the htpasswd file, if one is configured. It returns nil,
+// which accepts every client, when authentication is off.
+func loadAuth(c *config.Config) (*auth.Basic, error) {
+	if c.Auth.Htpasswd == "" {
+		return nil, nil
+	}
+	a, err := auth.NewBasic(c.Auth.Htpasswd, c.Auth.Realm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load htpasswd file: %v", err)
+	}
+	return a, nil
+}
 
-			// Process text/html content type
-			if contentType := resp.Header.Get("Content-Type"); strings.Contains(contentType, "text/html") {
-				resp.Header.Set("X-HTML-Modified", "true")
-			}
+// loadACL builds the client and destination ACLs. Either is nil, allowing
+// everything, when it isn't configured.
+func loadACL(c *config.Config) (*acl.Clients, *acl.Destinations, error) {
+	var clients *acl.Clients
+	if cc := c.ACL.Clients; len(cc.Allow)+len(cc.Deny) > 0 {
+		var err error
+		if clients, err = acl.NewClients(cc.Allow, cc.Deny); err != nil {
+			return nil, nil, err
+		}
+	}
+	var destinations *acl.Destinations
+	if dc := c.ACL.Destinations; dc.Enabled {
+		var err error
+		if destinations, err = acl.NewDestinations(dc.Allow, dc.Deny, !dc.AllowInternal); err != nil {
+			return nil, nil, err
 		}
 	}
+	return clients, destinations, nil
 }
 
-// createLoggingHandler creates a handler for logging only
-func createLoggingHandler() func(*http.Request, *http.Response) {
-	return func(req *http.Request, resp *http.Response) {
-		if req != nil {
-			log.Printf("📤 Request: %s %s", req.Method, req.URL.String())
+// loadUpstream builds the router that chains outbound connections to
+// upstream proxies. It returns nil, connecting directly, when nothing is
+// routed through a proxy. no_proxy falls back to the NO_PROXY variable.
+func loadUpstream(c *config.Config) (*upstream.Router, error) {
+	uc := c.Upstream
+	if (uc.Default == "" || uc.Default == upstream.Direct) && len(uc.Routes) == 0 {
+		return nil, nil
+	}
+	noProxy := uc.NoProxy
+	if noProxy == "" {
+		noProxy = os.Getenv("NO_PROXY")
+	}
+	if noProxy == "" {
+		noProxy = os.Getenv("no_proxy")
+	}
+	routes := make([]upstream.Route, len(uc.Routes))
+	for i, r := range uc.Routes {
+		routes[i] = upstream.Route{Hosts: r.Hosts, Via: r.Via}
+	}
+	return upstream.NewRouter(uc.Proxies, routes, uc.Default, noProxy)
+}
 
-			// Log headers while masking sensitive information
-			logHeaders(req.Header, "Request")
-		}
+// loadTransport returns the settings of the upstream transport, with the
+// trusted roots loaded
+func loadTransport(c *config.Config) (transport.Settings, error) {
+	s, err := c.Transport.Settings()
+	if err != nil {
+		return s, fmt.Errorf("failed to load transport settings: %v", err)
+	}
+	return s, nil
+}
 
-		if resp != nil {
-			log.Printf("📥 Response: %d %s", resp.StatusCode, resp.Status)
+// loadCache opens the response cache, or returns nil when it is disabled
+func loadCache(c *config.Config) (*cache.Cache, error) {
+	if !c.Cache.Enabled {
+		return nil, nil
+	}
+	s, err := c.Cache.Settings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache settings: %v", err)
+	}
+	rc, err := cache.New(s)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start cache: %v", err)
+	}
+	if s.Dir != "" {
+		entries, size := rc.Stats()
+		log.Printf("Response cache in %s holds %d responses, %d bytes", s.Dir, entries, size)
+	}
+	return rc, nil
+}
 
-			// Log response headers
-			logHeaders(resp.Header, "Response")
-		}
+// loadRetry returns the retry policy for rc, or nil when it never retries
+func loadRetry(rc config.RetryConfig) *retry.Policy {
+	if rc.Attempts <= 1 {
+		return nil
+	}
+	p := rc.Policy()
+	return &p
+}
+
+func runProxy(args []string) error {
+	c, _, err := loadConfig("proxy", args, func(fs *flag.FlagSet, c *config.Config) {
+		bindServer(fs, c)
+		bindAuth(fs, c)
+	})
+	if err != nil {
+		return err
+	}
+	a, err := loadAuth(c)
+	if err != nil {
+		return err
+	}
+	clients, destinations, err := loadACL(c)
+	if err != nil {
+		return err
+	}
+	router, err := loadUpstream(c)
+	if err != nil {
+		return err
+	}
+	tr, err := loadTransport(c)
+	if err != nil {
+		return err
 	}
+	rc, err := loadCache(c)
+	if err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(c)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	ctx, stop := signalContext()
+	defer stop()
+	log.Printf("Starting simple proxy server on %s", c.Listen)
+	if a != nil {
+		log.Printf("Proxy authentication required for %d users", a.Users.Len())
+	}
+	err = proxy.NewServer(proxy.Options{
+		DrainTimeout: c.DrainTimeout,
+		Auth:         a,
+		Clients:      clients,
+		Destinations: destinations,
+		Upstream:     router,
+		Retry:        loadRetry(c.Retry),
+		Breakers:     breaker.New(c.CircuitBreaker.Settings()),
+		ErrorPages:   c.ErrorPages,
+		Limits:       c.Limits.Limits(),
+		Transport:    tr,
+		Via:          c.Headers.Via,
+		Forwarded:    c.Headers.Forwarded,
+		Cache:        rc,
+	}).Start(ctx, c.Listen)
+	return drained(err, c.DrainTimeout)
 }
 
-// logHeaders safely logs header information
-func logHeaders(headers http.Header, prefix string) {
-	sensitiveHeaders := []string{
-		"Authorization", "Cookie", "Set-Cookie", "X-API-Key", "X-Auth-Token",
+// drained reports a shutdown whose drain timed out, closing the requests and
+// tunnels still in progress, as such rather than as a failure; other errors
+// are returned as they are
+func drained(err error, timeout time.Duration) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("Drain timed out after %v; closed the requests and tunnels still in progress", timeout)
+		return nil
 	}
+	return err
+}
 
-	for key, values := range headers {
-		// Check if header contains sensitive information
-		isSensitive := false
-		for _, sensitive := range sensitiveHeaders {
-			if matched, _ := regexp.MatchString("(?i)"+sensitive, key); matched {
-				isSensitive = true
-				break
-			}
-		}
+func runMock(args []string) error {
+	c, _, err := loadConfig("mock", args, bindServer)
+	if err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(c)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
 
-		if isSensitive {
-			log.Printf("  %s Header %s: [MASKED]", prefix, key)
-		} else {
-			log.Printf("  %s Header %s: %v", prefix, key, values)
-		}
+	ctx, stop := signalContext()
+	defer stop()
+	log.Printf("Starting mock server on %s", c.Listen)
+	return mock.Start(ctx, c.Listen, c.DrainTimeout)
+}
+
+// runValidate checks the configuration, including environment overrides,
+// without starting anything
+func runValidate(args []string) error {
+	// Allow "nproxy validate file.yaml" as well as -config
+	if len(args) == 1 && !strings.HasPrefix(args[0], "-") {
+		args = []string{"-config", args[0]}
+	}
+	c, fs, err := loadConfig("validate", args, func(*flag.FlagSet, *config.Config) {})
+	if err != nil {
+		return err
+	}
+	if fs.Lookup("config").Value.String() == "" {
+		fmt.Println("No configuration file given; the defaults and environment are valid")
+		return nil
 	}
+	fmt.Printf("%s is valid (%d rules)\n", fs.Lookup("config").Value, len(c.Rules))
+	return nil
 }
@@ -0,0 +1,377 @@
+// Package metrics implements a small, dependency-free set of Prometheus
+// collectors (counters, gauges and histograms) and the text exposition
+// format used to scrape them.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are histogram buckets suited to network latencies in seconds
+var DefaultBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// collector is implemented by every metric type that can be registered
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Registry holds collectors and renders them in the Prometheus text format
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteTo writes all registered metrics to w in the text exposition format
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ServeHTTP serves the registry as a Prometheus scrape endpoint
+func (r *Registry) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	r.WriteTo(w)
+}
+
+// desc is the common metadata of a metric family
+type desc struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", d.name, escapeHelp(d.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", d.name, d.kind)
+}
+
+// key joins label values into a map key, panicking on a cardinality mismatch
+// since that is always a programming error
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labelNames), len(values)))
+	}
+	return strings.Join(values, "\xff")
+}
+
+// labels renders the label set, optionally with one extra label appended
+func (d *desc) labels(values []string, extraName, extraValue string) string {
+	if len(values) == 0 && extraName == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range d.labelNames {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", name, escapeLabel(values[i]))
+	}
+	if extraName != "" {
+		if len(values) > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=\"%s\"", extraName, escapeLabel(extraValue))
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// series is a single labelled value of a counter or gauge
+type series struct {
+	values []string
+	value  float64
+}
+
+// valueVec is the shared implementation of counters and gauges
+type valueVec struct {
+	desc
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+func (v *valueVec) get(values []string) *series {
+	k := v.key(values)
+	s, ok := v.series[k]
+	if !ok {
+		s = &series{values: append([]string(nil), values...)}
+		v.series[k] = s
+	}
+	return s
+}
+
+func (v *valueVec) write(w *bufio.Writer) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.writeHeader(w)
+	for _, k := range sortedKeys(v.series) {
+		s := v.series[k]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, v.labels(s.values, "", ""), formatFloat(s.value))
+	}
+}
+
+// CounterVec is a monotonically increasing counter partitioned by labels
+type CounterVec struct {
+	valueVec
+}
+
+// NewCounterVec creates a counter and registers it with reg
+func NewCounterVec(reg *Registry, name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{valueVec{
+		desc:   desc{name: name, help: help, kind: "counter", labelNames: labelNames},
+		series: make(map[string]*series),
+	}}
+	reg.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add increases the counter for the given label values by delta, which must
+// not be negative
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 {
+		panic("metrics: counter cannot decrease")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.get(labelValues).value += delta
+}
+
+// Value returns the current value for the given label values
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if s, ok := c.series[c.key(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// GaugeVec is a value that can go up and down, partitioned by labels
+type GaugeVec struct {
+	valueVec
+}
+
+// NewGaugeVec creates a gauge and registers it with reg
+func NewGaugeVec(reg *Registry, name, help string, labelNames ...string) *GaugeVec {
+	g := &GaugeVec{valueVec{
+		desc:   desc{name: name, help: help, kind: "gauge", labelNames: labelNames},
+		series: make(map[string]*series),
+	}}
+	reg.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *GaugeVec) Set(value float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value = value
+}
+
+// Add adds delta (which may be negative) to the gauge
+func (g *GaugeVec) Add(delta float64, labelValues ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(labelValues).value += delta
+}
+
+// Inc increments the gauge by one
+func (g *GaugeVec) Inc(labelValues ...string) {
+	g.Add(1, labelValues...)
+}
+
+// Dec decrements the gauge by one
+func (g *GaugeVec) Dec(labelValues ...string) {
+	g.Add(-1, labelValues...)
+}
+
+// Value returns the current value for the given label values
+func (g *GaugeVec) Value(labelValues ...string) float64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if s, ok := g.series[g.key(labelValues)]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// CounterFunc is a counter whose value is read from a function each time it
+// is scraped, for counts kept by code that doesn't know about metrics
+type CounterFunc struct {
+	desc
+	fn func() float64
+}
+
+// NewCounterFunc creates a counter reading its value from fn and registers
+// it with reg. fn must be safe to call concurrently and never decrease.
+func NewCounterFunc(reg *Registry, name, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{desc: desc{name: name, help: help, kind: "counter"}, fn: fn}
+	reg.register(c)
+	return c
+}
+
+func (c *CounterFunc) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	fmt.Fprintf(w, "%s %s\n", c.name, formatFloat(c.fn()))
+}
+
+// histogramSeries holds cumulative bucket counts for one label set
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec samples observations into buckets, partitioned by labels
+type HistogramVec struct {
+	desc
+	buckets []float64
+	mu      sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+// NewHistogramVec creates a histogram and registers it with reg. If buckets is
+// nil, DefaultBuckets is used.
+func NewHistogramVec(reg *Registry, name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	if buckets == nil {
+		buckets = DefaultBuckets
+	}
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &HistogramVec{
+		desc:    desc{name: name, help: help, kind: "histogram", labelNames: labelNames},
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	reg.register(h)
+	return h
+}
+
+// Observe records a single observation for the given label values
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	k := h.key(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{
+			values: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[k] = s
+	}
+	for i, upper := range h.buckets {
+		if value <= upper {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+// Count returns the number of observations for the given label values
+func (h *HistogramVec) Count(labelValues ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.series[h.key(labelValues)]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.writeHeader(w)
+	for _, k := range sortedKeys(h.series) {
+		s := h.series[k]
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.values, "le", formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labels(s.values, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labels(s.values, "", ""), formatFloat(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labels(s.values, "", ""), s.count)
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel escapes backslashes, quotes and newlines in a label value
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(strings.ToValidUTF8(v, "\uFFFD"))
+}
+
+func escapeHelp(v string) string {
+	v = strings.ReplaceAll(v, `\`, `\\`)
+	return strings.ReplaceAll(v, "\n", `\n`)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,164 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	reg := NewRegistry()
+	c := NewCounterVec(reg, "test_requests_total", "Requests seen.", "method", "status")
+
+	c.Inc("GET", "200")
+	c.Inc("GET", "200")
+	c.Add(3, "POST", "500")
+
+	if v := c.Value("GET", "200"); v != 2 {
+		t.Errorf("Expected GET/200 to be 2, got %v", v)
+	}
+	if v := c.Value("POST", "500"); v != 3 {
+		t.Errorf("Expected POST/500 to be 3, got %v", v)
+	}
+	if v := c.Value("PUT", "204"); v != 0 {
+		t.Errorf("Expected unseen series to be 0, got %v", v)
+	}
+
+	var buf bytes.Buffer
+	if _, err := reg.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	expected := `# HELP test_requests_total Requests seen.
+# TYPE test_requests_total counter
+test_requests_total{method="GET",status="200"} 2
+test_requests_total{method="POST",status="500"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestCounterFunc(t *testing.T) {
+	reg := NewRegistry()
+	n := 0.0
+	NewCounterFunc(reg, "test_dropped_total", "Things dropped.", func() float64 { return n })
+
+	n = 7
+	var buf bytes.Buffer
+	if _, err := reg.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	expected := `# HELP test_dropped_total Things dropped.
+# TYPE test_dropped_total counter
+test_dropped_total 7
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestCounterVecRejectsNegative(t *testing.T) {
+	c := NewCounterVec(NewRegistry(), "test_total", "Test.")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic when adding a negative value")
+		}
+	}()
+	c.Add(-1)
+}
+
+func TestCounterVecLabelMismatch(t *testing.T) {
+	c := NewCounterVec(NewRegistry(), "test_total", "Test.", "a", "b")
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected panic on label cardinality mismatch")
+		}
+	}()
+	c.Inc("only-one")
+}
+
+func TestGaugeVec(t *testing.T) {
+	reg := NewRegistry()
+	g := NewGaugeVec(reg, "test_active", "Active things.")
+
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	if v := g.Value(); v != 1 {
+		t.Errorf("Expected gauge to be 1, got %v", v)
+	}
+
+	g.Set(42)
+	if v := g.Value(); v != 42 {
+		t.Errorf("Expected gauge to be 42, got %v", v)
+	}
+
+	var buf bytes.Buffer
+	reg.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "# TYPE test_active gauge\ntest_active 42\n") {
+		t.Errorf("Unexpected exposition:\n%s", buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	reg := NewRegistry()
+	h := NewHistogramVec(reg, "test_seconds", "Durations.", []float64{0.1, 1}, "phase")
+
+	h.Observe(0.05, "dns")
+	h.Observe(0.5, "dns")
+	h.Observe(5, "dns")
+
+	if c := h.Count("dns"); c != 3 {
+		t.Errorf("Expected 3 observations, got %d", c)
+	}
+
+	var buf bytes.Buffer
+	reg.WriteTo(&buf)
+
+	expected := `# HELP test_seconds Durations.
+# TYPE test_seconds histogram
+test_seconds_bucket{phase="dns",le="0.1"} 1
+test_seconds_bucket{phase="dns",le="1"} 2
+test_seconds_bucket{phase="dns",le="+Inf"} 3
+test_seconds_sum{phase="dns"} 5.55
+test_seconds_count{phase="dns"} 3
+`
+	if buf.String() != expected {
+		t.Errorf("Unexpected exposition:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	reg := NewRegistry()
+	c := NewCounterVec(reg, "test_total", "Line one\nline two.", "host")
+	c.Inc("a\"b\\c\nd")
+
+	var buf bytes.Buffer
+	reg.WriteTo(&buf)
+
+	if !strings.Contains(buf.String(), `# HELP test_total Line one\nline two.`) {
+		t.Errorf("Help text was not escaped:\n%s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `test_total{host="a\"b\\c\nd"} 1`) {
+		t.Errorf("Label value was not escaped:\n%s", buf.String())
+	}
+}
+
+func TestRegistryServeHTTP(t *testing.T) {
+	reg := NewRegistry()
+	NewCounterVec(reg, "test_total", "Test.").Inc()
+
+	rr := httptest.NewRecorder()
+	reg.ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rr.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Unexpected Content-Type: %s", ct)
+	}
+	if !strings.Contains(rr.Body.String(), "test_total 1") {
+		t.Errorf("Metric missing from response:\n%s", rr.Body.String())
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"nproxy/app/admin"
+	"nproxy/app/breaker"
+	"nproxy/app/config"
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+	"nproxy/app/proxy"
+	"nproxy/app/reverse"
+	"nproxy/app/trace"
+	"nproxy/app/tui"
+)
+
+// mitmOptions are the mitm command's flags that are not config settings
+type mitmOptions struct {
+	modify       bool
+	modifyFilter *filter.Filter
+	tui          bool
+}
+
+// loadMITMConfig parses the mitm command's configuration and flags. It is
+// called again with the same arguments on every reload.
+func loadMITMConfig(args []string) (*config.Config, mitmOptions, error) {
+	var (
+		opts         mitmOptions
+		modifyFilter string
+	)
+	c, _, err := loadConfig("mitm", args, func(fs *flag.FlagSet, c *config.Config) {
+		bindServer(fs, c)
+		bindAuth(fs, c)
+		fs.BoolVar(&c.Logging.Verbose, "v", c.Logging.Verbose, "output detailed logs")
+		fs.StringVar(&c.Admin.Listen, "admin", c.Admin.Listen, "admin listener address serving /metrics and the admin API (disabled when empty)")
+		fs.StringVar(&c.SOCKS.Listen, "socks", c.SOCKS.Listen, "SOCKS5 listener address feeding the interception pipeline (disabled when empty)")
+		fs.StringVar(&c.Transparent.Listen, "transparent", c.Transparent.Listen, "listener address for connections redirected by the firewall (disabled when empty)")
+		fs.StringVar(&c.Reverse.Listen, "reverse", c.Reverse.Listen, "reverse proxy listener address serving reverse.routes (disabled when empty)")
+		fs.StringVar(&c.Admin.Token, "admin-token", c.Admin.Token, "bearer token required by the admin API")
+		fs.IntVar(&c.Recording.History, "flow-history", c.Recording.History, "number of recent flows kept for the admin API and terminal UI")
+		fs.StringVar(&c.Recording.Filter, "record-filter", c.Recording.Filter, "filter expression selecting the flows kept for the admin API and terminal UI")
+		fs.StringVar(&c.Recording.File, "record-file", c.Recording.File, "write the recorded flows to this file on shutdown")
+		fs.StringVar(&c.Logging.Filter, "log-filter", c.Logging.Filter, "filter expression selecting the flows whose timing is logged")
+		fs.BoolVar(&c.MITM.ServerTiming, "server-timing", c.MITM.ServerTiming, "inject a Server-Timing header into responses")
+		fs.StringVar(&c.Tracing.OTLP, "otlp", c.Tracing.OTLP, "OTLP/HTTP collector URL for trace export, e.g. http://localhost:4318/v1/traces")
+		fs.IntVar(&c.Tracing.BatchSize, "trace-batch-size", c.Tracing.BatchSize, "spans per trace export request (default 128)")
+		fs.IntVar(&c.Tracing.QueueSize, "trace-queue-size", c.Tracing.QueueSize, "spans buffered for export before dropping (default 2048)")
+		fs.DurationVar(&c.Tracing.FlushInterval, "trace-flush-interval", c.Tracing.FlushInterval, "longest a span waits for export (default 5s)")
+		fs.StringVar(&c.Tracing.DropPolicy, "trace-drop-policy", c.Tracing.DropPolicy, "which span a full export queue discards: newest or oldest")
+
+		fs.BoolVar(&opts.modify, "modify", false, "enable the example request/response modification rule")
+		fs.StringVar(&modifyFilter, "modify-filter", "", "filter expression selecting the flows -modify applies to")
+		fs.BoolVar(&opts.tui, "tui", false, "show flows in a full-screen terminal UI")
+	})
+	if err != nil {
+		return nil, opts, err
+	}
+	// -modify-filter is not a config setting, so Validate hasn't seen it
+	opts.modifyFilter, err = filter.Parse(modifyFilter)
+	if err != nil {
+		return nil, opts, config.Problems{{Location: "flag -modify-filter", Message: err.Error()}}
+	}
+	return c, opts, nil
+}
+
+// mitmSettings builds the proxy's reloadable settings: the rules enabled
+// by flags come first, then the rules from the config file. The htpasswd
+// file is read again every time.
+func mitmSettings(c *config.Config, opts mitmOptions) (proxy.Settings, error) {
+	a, err := loadAuth(c)
+	if err != nil {
+		return proxy.Settings{}, err
+	}
+	clients, destinations, err := loadACL(c)
+	if err != nil {
+		return proxy.Settings{}, err
+	}
+	router, err := loadUpstream(c)
+	if err != nil {
+		return proxy.Settings{}, err
+	}
+	table, err := loadReverse(c)
+	if err != nil {
+		return proxy.Settings{}, err
+	}
+	s := proxy.Settings{
+		Auth:             a,
+		Clients:          clients,
+		Destinations:     destinations,
+		Upstream:         router,
+		Reverse:          table,
+		Retry:            loadRetry(c.Retry),
+		Breakers:         breaker.New(c.CircuitBreaker.Settings()),
+		ErrorPages:       c.ErrorPages,
+		Via:              c.Headers.Via,
+		Forwarded:        c.Headers.Forwarded,
+		ServerTiming:     c.MITM.ServerTiming,
+		BodyCaptureLimit: c.MITM.BodyCaptureLimit,
+		LogFilter:        filter.MustParse(c.Logging.Filter),
+	}
+	if opts.modify {
+		// Add request/response modification rule
+		s.Rules = append(s.Rules, proxy.Rule{Name: "modify", Filter: opts.modifyFilter, Handler: createModificationHandler(c.Logging.Verbose), Enabled: true})
+	} else if c.Logging.Verbose {
+		// Add logging-only rule
+		s.Rules = append(s.Rules, proxy.Rule{Name: "log", Handler: createLoggingHandler(), Enabled: true})
+	}
+	for _, r := range c.Rules {
+		s.Rules = append(s.Rules, proxy.Rule{Name: r.Name, Filter: filter.MustParse(r.Filter), Handler: configRuleHandler(r), Enabled: r.IsEnabled()})
+	}
+	return s, nil
+}
+
+// loadReverse builds the reverse proxy route table. It returns nil when the
+// reverse proxy is off.
+func loadReverse(c *config.Config) (*reverse.Table, error) {
+	if c.Reverse.Listen == "" {
+		return nil, nil
+	}
+	routes := make([]reverse.Route, len(c.Reverse.Routes))
+	for i, r := range c.Reverse.Routes {
+		routes[i] = reverse.Route{Host: r.Host, Path: r.Path, Upstream: r.Upstream, Pool: r.Pool, StripPrefix: r.StripPrefix, PreserveHost: r.PreserveHost}
+		if r.Retry != nil {
+			// Even a policy that never retries replaces the default
+			p := r.Retry.Policy()
+			routes[i].Retry = &p
+		}
+	}
+	pools := make([]reverse.Pool, len(c.Reverse.Pools))
+	for i, p := range c.Reverse.Pools {
+		pools[i] = p.Pool()
+	}
+	return reverse.NewTable(routes, pools)
+}
+
+// listenReverse opens the reverse proxy listener, terminating TLS when it
+// is configured to
+func listenReverse(c *config.Config, p *proxy.MITMProxy) (net.Listener, error) {
+	ln, err := net.Listen("tcp", c.Reverse.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen for the reverse proxy: %v", err)
+	}
+	if !c.Reverse.TLS {
+		return ln, nil
+	}
+	tlsConfig := p.ReverseTLSConfig()
+	if c.Reverse.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(c.Reverse.Cert, c.Reverse.Key)
+		if err != nil {
+			ln.Close()
+			return nil, fmt.Errorf("failed to load reverse proxy certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	return tls.NewListener(ln, tlsConfig), nil
+}
+
+func runMITM(args []string) error {
+	c, opts, err := loadMITMConfig(args)
+	if err != nil {
+		return err
+	}
+	closeLog, err := setupLogging(c)
+	if err != nil {
+		return err
+	}
+	defer closeLog()
+
+	mitmProxy, err := proxy.NewMITMProxy(c.Listen)
+	if err != nil {
+		return fmt.Errorf("failed to create MITM proxy: %v", err)
+	}
+	mitmProxy.CertDir = c.CA.Dir
+	if c.CA.Cert != "" {
+		if err := mitmProxy.UseCAFiles(c.CA.Cert, c.CA.Key); err != nil {
+			return err
+		}
+	}
+	settings, err := mitmSettings(c, opts)
+	if err != nil {
+		return err
+	}
+	if settings.Auth != nil {
+		log.Printf("Proxy authentication required for %d users", settings.Auth.Users.Len())
+	}
+	if mitmProxy.Transport, err = loadTransport(c); err != nil {
+		return err
+	}
+	if mitmProxy.Cache, err = loadCache(c); err != nil {
+		return err
+	}
+	mitmProxy.Limits = c.Limits.Limits()
+	mitmProxy.Reload(settings)
+	mitmProxy.DrainTimeout = c.DrainTimeout
+	mitmProxy.SOCKSUDP = c.SOCKS.UDP
+	if c.Tracing.OTLP != "" {
+		opts, err := c.Tracing.Options()
+		if err != nil {
+			return fmt.Errorf("failed to load tracing settings: %v", err)
+		}
+		exporter := trace.NewExporter(c.Tracing.OTLP, opts)
+		mitmProxy.Metrics.ObserveExporter(exporter)
+		mitmProxy.Tracer = trace.NewTracer(exporter)
+	}
+
+	r := &reloader{args: args, proxy: mitmProxy, current: c}
+	r.recordFilter.Store(filter.MustParse(c.Recording.Filter))
+	if c.Admin.Listen != "" || opts.tui || c.Recording.File != "" {
+		r.flows = flow.NewStore(c.Recording.History)
+		r.flows.SetRecording(c.Recording.Enabled)
+		mitmProxy.OnFlow = func(f *flow.Flow) {
+			if r.recordFilter.Load().Match(f) {
+				r.flows.Add(f)
+			}
+		}
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	r.watchSignal(ctx)
+
+	if c.Admin.Listen != "" {
+		adminServer := admin.NewServer(c.Admin.Listen, mitmProxy, r.flows)
+		adminServer.Token = c.Admin.Token
+		adminServer.Reload = r.reload
+		go func() {
+			if err := adminServer.Start(ctx); err != nil {
+				log.Fatalf("Failed to start admin server: %v", err)
+			}
+		}()
+	}
+
+	if c.SOCKS.Listen != "" {
+		ln, err := net.Listen("tcp", c.SOCKS.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for SOCKS: %v", err)
+		}
+		log.Printf("SOCKS5 listener on %s", c.SOCKS.Listen)
+		go func() {
+			if err := mitmProxy.ServeSOCKS(ctx, ln); err != nil {
+				log.Printf("SOCKS listener failed: %v", err)
+			}
+		}()
+	}
+
+	if c.Transparent.Listen != "" {
+		ln, err := net.Listen("tcp", c.Transparent.Listen)
+		if err != nil {
+			return fmt.Errorf("failed to listen for redirected connections: %v", err)
+		}
+		log.Printf("Transparent listener on %s", c.Transparent.Listen)
+		go func() {
+			if err := mitmProxy.ServeTransparent(ctx, ln); err != nil {
+				log.Printf("Transparent listener failed: %v", err)
+			}
+		}()
+	}
+
+	if c.Reverse.Listen != "" {
+		ln, err := listenReverse(c, mitmProxy)
+		if err != nil {
+			return err
+		}
+		log.Printf("Reverse proxy listener on %s with %d routes", c.Reverse.Listen, len(c.Reverse.Routes))
+		go func() {
+			if err := mitmProxy.ServeReverse(ctx, ln); err != nil {
+				log.Printf("Reverse proxy listener failed: %v", err)
+			}
+		}()
+	}
+
+	if opts.tui {
+		err = runTUI(ctx, mitmProxy, r.flows)
+	} else {
+		log.Printf("Starting MITM proxy server on %s", c.Listen)
+		err = mitmProxy.Start(ctx)
+	}
+	err = drained(err, c.DrainTimeout)
+
+	// The proxy has drained, so every flow is recorded by now
+	if c.Recording.File != "" {
+		if saveErr := saveRecording(c.Recording.File, r.flows); saveErr != nil {
+			err = errors.Join(err, saveErr)
+		}
+	}
+	return err
+}
+
+// runTUI serves the proxy in the background while the terminal UI runs in
+// the foreground. Log output is shown in the UI's status bar. Quitting the
+// UI shuts the proxy down, and so does ctx.
+func runTUI(ctx context.Context, p *proxy.MITMProxy, flows *flow.Store) error {
+	ui := tui.New(flows)
+	logOutput := log.Writer()
+	log.SetOutput(ui.LogWriter())
+
+	proxyCtx, stopProxy := context.WithCancel(ctx)
+	defer stopProxy()
+	uiCtx, stopUI := context.WithCancel(ctx)
+	defer stopUI()
+
+	proxyErr := make(chan error, 1)
+	go func() {
+		proxyErr <- p.Start(proxyCtx)
+		stopUI()
+	}()
+
+	uiErr := ui.Run(uiCtx)
+
+	// Show the drain's progress on the terminal again
+	log.SetOutput(logOutput)
+	stopProxy()
+	err := <-proxyErr
+	if uiErr != nil {
+		return fmt.Errorf("failed to start terminal UI: %v", uiErr)
+	}
+	return err
+}
+
+// saveRecording writes the recorded flows to path in the export format
+func saveRecording(path string, flows *flow.Store) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to save recording: %v", err)
+	}
+	recorded := flows.List()
+	if err := flow.Export(file, recorded); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to save recording: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to save recording: %v", err)
+	}
+	log.Printf("Saved %d recorded flows to %s", len(recorded), path)
+	return nil
+}
+
+// configRuleHandler creates the handler of a rule declared in the config file
+func configRuleHandler(r config.RuleConfig) func(*http.Request, *http.Response) {
+	return func(req *http.Request, resp *http.Response) {
+		if req != nil {
+			for name, value := range r.SetRequestHeaders {
+				req.Header.Set(name, value)
+			}
+			for _, name := range r.RemoveRequestHeaders {
+				req.Header.Del(name)
+			}
+			if r.Log {
+				log.Printf("📤 [%s] Request: %s %s", r.Name, req.Method, req.URL.String())
+				logHeaders(req.Header, "Request")
+			}
+		}
+
+		if resp != nil {
+			for name, value := range r.SetResponseHeaders {
+				resp.Header.Set(name, value)
+			}
+			for _, name := range r.RemoveResponseHeaders {
+				resp.Header.Del(name)
+			}
+			if r.Log {
+				log.Printf("📥 [%s] Response: %s", r.Name, resp.Status)
+				logHeaders(resp.Header, "Response")
+			}
+		}
+	}
+}
+
+// createModificationHandler creates a handler for request/response modification
+func createModificationHandler(verbose bool) func(*http.Request, *http.Response) {
+	return func(req *http.Request, resp *http.Response) {
+		if req != nil {
+			if verbose {
+				log.Printf("Request: %s %s", req.Method, req.URL.String())
+				log.Printf("Request Headers: %v", req.Header)
+			}
+
+			// Example of request header modification
+			req.Header.Set("X-MITM-Proxy", "true")
+			req.Header.Set("User-Agent", "MITM-Proxy/1.0")
+
+			// Modify requests for specific patterns
+			if strings.Contains(req.URL.Path, "/api/") {
+				req.Header.Set("X-API-Modified", "true")
+			}
+		}
+
+		if resp != nil {
+			if verbose {
+				log.Printf("Response: %d %s", resp.StatusCode, resp.Status)
+				log.Printf("Response Headers: %v", resp.Header)
+			}
+
+			// Example of response header modification
+			resp.Header.Set("X-MITM-Intercepted", "true")
+			resp.Header.Set("X-Proxy-Time", "2024-01-01")
+
+			// Add security headers
+			resp.Header.Set("X-Content-Type-Options", "nosniff")
+			resp.Header.Set("X-Frame-Options", "DENY")
+			resp.Header.Set("X-XSS-Protection", "1; mode=block")
+
+			// Process text/html content type
+			if contentType := resp.Header.Get("Content-Type"); strings.Contains(contentType, "text/html") {
+				resp.Header.Set("X-HTML-Modified", "true")
+			}
+		}
+	}
+}
+
+// createLoggingHandler creates a handler for logging only
+func createLoggingHandler() func(*http.Request, *http.Response) {
+	return func(req *http.Request, resp *http.Response) {
+		if req != nil {
+			log.Printf("📤 Request: %s %s", req.Method, req.URL.String())
+
+			// Log headers while masking sensitive information
+			logHeaders(req.Header, "Request")
+		}
+
+		if resp != nil {
+			log.Printf("📥 Response: %d %s", resp.StatusCode, resp.Status)
+
+			// Log response headers
+			logHeaders(resp.Header, "Response")
+		}
+	}
+}
+
+// logHeaders safely logs header information
+func logHeaders(headers http.Header, prefix string) {
+	sensitiveHeaders := []string{
+		"Authorization", "Cookie", "Set-Cookie", "X-API-Key", "X-Auth-Token",
+	}
+
+	for key, values := range headers {
+		// Check if header contains sensitive information
+		isSensitive := false
+		for _, sensitive := range sensitiveHeaders {
+			if matched, _ := regexp.MatchString("(?i)"+sensitive, key); matched {
+				isSensitive = true
+				break
+			}
+		}
+
+		if isSensitive {
+			log.Printf("  %s Header %s: [MASKED]", prefix, key)
+		} else {
+			log.Printf("  %s Header %s: %v", prefix, key, values)
+		}
+	}
+}
@@ -1,10 +1,13 @@
 package mock
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"io"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -16,20 +19,31 @@ type HealthResponse struct {
 	Version   string    `json:"version"`
 }
 
+// DefaultDrainTimeout is how long the mock server waits for in-flight
+// requests once its context is done
+const DefaultDrainTimeout = 30 * time.Second
+
 // MockServer is the mock server structure
 type MockServer struct {
 	addr string
+
+	DrainTimeout time.Duration // How long Start waits for in-flight requests once its context is done
+
+	mu     sync.Mutex
+	server *http.Server
 }
 
 // NewMockServer creates a new mock server
 func NewMockServer(addr string) *MockServer {
 	return &MockServer{
-		addr: addr,
+		addr:         addr,
+		DrainTimeout: DefaultDrainTimeout,
 	}
 }
 
-// Start starts the mock server
-func (m *MockServer) Start() error {
+// Start serves the mock endpoints until ctx is done or Shutdown is called.
+// When ctx is done in-flight requests get DrainTimeout to finish.
+func (m *MockServer) Start(ctx context.Context) error {
 	mux := http.NewServeMux()
 
 	// Health check endpoint
@@ -46,7 +60,43 @@ func (m *MockServer) Start() error {
 	log.Printf("  GET %s/api/users - Mock users API", m.addr)
 	log.Printf("  POST %s/api/echo - Echo request body", m.addr)
 
-	return http.ListenAndServe(m.addr, mux)
+	srv := &http.Server{Addr: m.addr, Handler: mux}
+	m.mu.Lock()
+	m.server = srv
+	m.mu.Unlock()
+
+	served := make(chan error, 1)
+	go func() { served <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), m.DrainTimeout)
+		defer cancel()
+		return m.Shutdown(drainCtx)
+	}
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests
+// until ctx expires, then closes the remaining connections
+func (m *MockServer) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	srv := m.server
+	m.mu.Unlock()
+	if srv == nil {
+		return nil
+	}
+
+	log.Printf("Mock server shutting down")
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
 }
 
 // handleHealth handles health check
@@ -186,8 +236,10 @@ func (m *MockServer) handleDefault(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-// Start is a function to start mock server standalone
-func Start(addr string) error {
+// Start is a function to start mock server standalone. It runs until ctx is
+// done, then waits up to drain for in-flight requests.
+func Start(ctx context.Context, addr string, drain time.Duration) error {
 	server := NewMockServer(addr)
-	return server.Start()
+	server.DrainTimeout = drain
+	return server.Start(ctx)
 }
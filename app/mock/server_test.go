@@ -2,6 +2,7 @@ package mock
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
@@ -174,3 +175,22 @@ func TestDefaultEndpoint(t *testing.T) {
 		t.Errorf("Expected path '/unknown', got %v", response["path"])
 	}
 }
+
+func TestStartStopsWithContext(t *testing.T) {
+	server := NewMockServer("127.0.0.1:0")
+	ctx, cancel := context.WithCancel(context.Background())
+
+	done := make(chan error, 1)
+	go func() { done <- server.Start(ctx) }()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected Start to return nil after shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not return after the context was cancelled")
+	}
+}
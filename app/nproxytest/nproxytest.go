@@ -0,0 +1,344 @@
+// Package nproxytest runs an in-process MITM proxy for tests of code that
+// makes HTTP requests. The code's client is pointed at the proxy, which
+// records every exchange as a flow for the test to assert on, and answers
+// the requests the test stubs in place of their servers.
+//
+//	p := nproxytest.New(t)
+//	p.Stub("GET", "https://api.example.com/users/1", http.StatusOK, `{"name":"bob"}`)
+//	svc := NewService(p.Client())
+//	...
+//	p.ExpectRequest("GET", "https://api.example.com/users/1", nproxytest.Header("Accept", "application/json"))
+//	p.AssertNoRequestsTo("billing.example.com")
+package nproxytest
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nproxy/app/flow"
+	"nproxy/app/proxy"
+)
+
+// DefaultWait is how long ExpectRequest waits for a request by default
+const DefaultWait = time.Second
+
+// Proxy is a MITM proxy serving on a random loopback port for the duration
+// of a test. Its CA only lives in memory, so nothing is written to disk.
+// HTTPS requests are intercepted with certificates from that CA, which the
+// clients of Client and Transport trust, and upstream certificates aren't
+// verified, so test servers with self-signed ones can be reached.
+type Proxy struct {
+	URL  string           // Address of the proxy, e.g. http://127.0.0.1:54321
+	MITM *proxy.MITMProxy // The proxy itself, for settings the helpers don't cover
+	Wait time.Duration    // How long ExpectRequest waits for a matching request
+
+	t     testing.TB
+	mu    sync.Mutex
+	flows []*flow.Flow
+	stubs []stub
+}
+
+// stub answers the requests matching method and url with handler
+type stub struct {
+	method, url string
+	handler     http.Handler
+}
+
+// New starts a proxy for the test t, which shuts it down when it ends
+func New(t testing.TB) *Proxy {
+	t.Helper()
+	m, err := proxy.NewMITMProxy("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("nproxytest: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("nproxytest: %v", err)
+	}
+	p := &Proxy{URL: "http://" + ln.Addr().String(), MITM: m, Wait: DefaultWait, t: t}
+	m.Addr = ln.Addr().String()
+	m.CertDir = ""
+	m.Metrics = nil
+	m.DrainTimeout = time.Second
+	m.OnFlow = p.record
+	m.Responder = p.respond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- m.Serve(ctx, ln) }()
+	t.Cleanup(func() {
+		cancel()
+		<-served
+	})
+	return p
+}
+
+// Client returns a client that sends its requests through the proxy
+func (p *Proxy) Client() *http.Client {
+	return &http.Client{Transport: p.Transport(), Timeout: 10 * time.Second}
+}
+
+// Transport returns a transport that sends requests through the proxy, for
+// code under test that builds its own client. Its idle connections are
+// closed when the test ends.
+func (p *Proxy) Transport() *http.Transport {
+	u, _ := url.Parse(p.URL)
+	tr := &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{RootCAs: p.CertPool()},
+	}
+	p.t.Cleanup(tr.CloseIdleConnections)
+	return tr
+}
+
+// CertPool returns a pool holding the proxy's CA certificate
+func (p *Proxy) CertPool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.MITM.CA)
+	return pool
+}
+
+// Stub answers the requests for method and url with status and body, in
+// place of their server. See StubFunc.
+func (p *Proxy) Stub(method, url string, status int, body string) {
+	p.StubFunc(method, url, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+}
+
+// StubFunc answers the requests for method and url with h, in place of
+// their server. An empty method matches any, and a url ending in "*" every
+// URL it is a prefix of. The stub added last wins when several match;
+// requests no stub matches go to their server. The host of a stubbed URL
+// needn't exist.
+func (p *Proxy) StubFunc(method, url string, h http.HandlerFunc) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stubs = append(p.stubs, stub{method: method, url: url, handler: h})
+}
+
+// respond is the proxy's Responder, which runs the stub that matches req
+func (p *Proxy) respond(req *http.Request) *http.Response {
+	p.mu.Lock()
+	var h http.Handler
+	for i := len(p.stubs) - 1; i >= 0; i-- {
+		if s := p.stubs[i]; matches(s.method, s.url, req.Method, req.URL.String()) {
+			h = s.handler
+			break
+		}
+	}
+	p.mu.Unlock()
+	if h == nil {
+		return nil
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// record is the proxy's OnFlow hook
+func (p *Proxy) record(f *flow.Flow) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flows = append(p.flows, f)
+}
+
+// Flows returns the flows recorded so far, oldest first. A flow is
+// recorded once its response has been relayed, so one the client has just
+// read may be missing for a moment; ExpectRequest waits for it.
+func (p *Proxy) Flows() []*flow.Flow {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*flow.Flow(nil), p.flows...)
+}
+
+// Reset forgets the flows recorded so far. Stubs are kept.
+func (p *Proxy) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flows = nil
+}
+
+// ExpectRequest fails the test unless a request for method and url, as
+// matched by StubFunc, that satisfies all the matchers is recorded within
+// Wait. It returns the first such flow, or nil when the test failed.
+func (p *Proxy) ExpectRequest(method, url string, matchers ...Matcher) *flow.Flow {
+	p.t.Helper()
+	deadline := time.Now().Add(p.Wait)
+	for {
+		flows := p.Flows()
+		for _, f := range flows {
+			if matches(method, url, f.Method, f.URL) && failed(f, matchers) == nil {
+				return f
+			}
+		}
+		if time.Now().After(deadline) {
+			p.t.Errorf("nproxytest: expected a request %s %s%s; got%s", method, url, describe(matchers), p.report(flows, method, url, matchers))
+			return nil
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// AssertNoRequestsTo fails the test if any request to host was recorded.
+// A host without a port matches every port.
+func (p *Proxy) AssertNoRequestsTo(host string) {
+	p.t.Helper()
+	var sent []string
+	for _, f := range p.Flows() {
+		if strings.EqualFold(f.Host, host) || strings.EqualFold(hostname(f.Host), host) {
+			sent = append(sent, f.Method+" "+f.URL)
+		}
+	}
+	if len(sent) > 0 {
+		p.t.Errorf("nproxytest: expected no requests to %s, got:\n  %s", host, strings.Join(sent, "\n  "))
+	}
+}
+
+// report lists flows for a failed expectation, with the matchers failed
+// by those for the expected method and url
+func (p *Proxy) report(flows []*flow.Flow, method, url string, matchers []Matcher) string {
+	if len(flows) == 0 {
+		return " no requests"
+	}
+	var b strings.Builder
+	for _, f := range flows {
+		fmt.Fprintf(&b, "\n  %s %s -> %d", f.Method, f.URL, f.Status)
+		if !matches(method, url, f.Method, f.URL) {
+			continue
+		}
+		for _, m := range failed(f, matchers) {
+			fmt.Fprintf(&b, "\n    does not match %s", m)
+		}
+	}
+	return b.String()
+}
+
+// Matcher is a condition on a recorded request, as sent upstream
+type Matcher struct {
+	desc  string
+	match func(*flow.Flow) bool
+}
+
+func (m Matcher) String() string {
+	return m.desc
+}
+
+// Header matches requests whose header name has value among its values
+func Header(name, value string) Matcher {
+	return Matcher{
+		desc: fmt.Sprintf("header %s: %s", name, value),
+		match: func(f *flow.Flow) bool {
+			for _, v := range f.RequestHeader.Values(name) {
+				if v == value {
+					return true
+				}
+			}
+			return false
+		},
+	}
+}
+
+// Body matches requests whose body is body. Bodies are captured up to the
+// proxy's BodyCaptureLimit.
+func Body(body string) Matcher {
+	return Matcher{
+		desc:  fmt.Sprintf("body %q", body),
+		match: func(f *flow.Flow) bool { return string(f.RequestBody) == body },
+	}
+}
+
+// BodyContains matches requests whose body contains s
+func BodyContains(s string) Matcher {
+	return Matcher{
+		desc:  fmt.Sprintf("body containing %q", s),
+		match: func(f *flow.Flow) bool { return bytes.Contains(f.RequestBody, []byte(s)) },
+	}
+}
+
+// JSONBody matches requests whose body is the JSON encoding of v, whatever
+// its formatting and the order of object members
+func JSONBody(v any) Matcher {
+	want, err := json.Marshal(v)
+	return Matcher{
+		desc: fmt.Sprintf("JSON body %s", want),
+		match: func(f *flow.Flow) bool {
+			var a, b any
+			return err == nil && json.Unmarshal(want, &a) == nil && json.Unmarshal(f.RequestBody, &b) == nil && reflect.DeepEqual(a, b)
+		},
+	}
+}
+
+// failed returns the matchers f doesn't satisfy
+func failed(f *flow.Flow, matchers []Matcher) []Matcher {
+	var out []Matcher
+	for _, m := range matchers {
+		if !m.match(f) {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func describe(matchers []Matcher) string {
+	if len(matchers) == 0 {
+		return ""
+	}
+	descs := make([]string, len(matchers))
+	for i, m := range matchers {
+		descs[i] = m.desc
+	}
+	return " with " + strings.Join(descs, ", ")
+}
+
+// matches reports whether a request for method and rawURL is one for
+// wantMethod and wantURL: an empty wantMethod matches any method and a
+// wantURL ending in "*" every URL it is a prefix of. Default ports don't
+// count.
+func matches(wantMethod, wantURL, method, rawURL string) bool {
+	if wantMethod != "" && !strings.EqualFold(wantMethod, method) {
+		return false
+	}
+	got := canonical(rawURL)
+	if prefix, ok := strings.CutSuffix(wantURL, "*"); ok {
+		return strings.HasPrefix(got, canonical(prefix))
+	}
+	return got == canonical(wantURL)
+}
+
+// canonical returns rawURL without the default port of its scheme
+func canonical(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	if port := u.Port(); u.Scheme == "https" && port == "443" || u.Scheme == "http" && port == "80" {
+		u.Host = u.Hostname()
+		if strings.Contains(u.Host, ":") {
+			u.Host = "[" + u.Host + "]"
+		}
+	}
+	return u.String()
+}
+
+// hostname returns host without its port
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
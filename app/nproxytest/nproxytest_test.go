@@ -0,0 +1,146 @@
+package nproxytest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failures stands in for the test in assertions expected to fail
+type failures struct {
+	testing.TB
+	errors []string
+}
+
+func (f *failures) Helper() {}
+
+func (f *failures) Errorf(format string, args ...any) {
+	f.errors = append(f.errors, fmt.Sprintf(format, args...))
+}
+
+func get(t *testing.T, c *http.Client, url string) (int, string) {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestProxy(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "real")
+	}))
+	defer target.Close()
+
+	p := New(t)
+	p.Stub("GET", "https://api.example.test/users/*", http.StatusOK, `{"name":"bob"}`)
+	p.StubFunc("POST", "http://api.example.test/users", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Location", "/users/2")
+		w.WriteHeader(http.StatusCreated)
+	})
+	c := p.Client()
+
+	if status, body := get(t, c, "https://api.example.test/users/1"); status != http.StatusOK || body != `{"name":"bob"}` {
+		t.Errorf("Expected the stub's answer, got %d %q", status, body)
+	}
+	req, _ := http.NewRequest("POST", "http://api.example.test/users", strings.NewReader(`{ "name": "alice", "admin": false }`))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.Do(req)
+	if err != nil {
+		t.Fatalf("POST: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated || resp.Header.Get("Location") != "/users/2" {
+		t.Errorf("Expected the stub function's answer, got %d %v", resp.StatusCode, resp.Header)
+	}
+	// Requests no stub matches reach their server, whose certificate isn't
+	// checked
+	if status, body := get(t, c, target.URL+"/"); status != http.StatusOK || body != "real" {
+		t.Errorf("Expected the server's answer, got %d %q", status, body)
+	}
+
+	if f := p.ExpectRequest("GET", "https://api.example.test/users/1"); f == nil || f.Status != http.StatusOK {
+		t.Errorf("Expected the stubbed GET to be recorded, got %+v", f)
+	}
+	p.ExpectRequest("POST", "http://api.example.test/users",
+		Header("Content-Type", "application/json"),
+		BodyContains("alice"),
+		JSONBody(map[string]any{"admin": false, "name": "alice"}))
+	p.ExpectRequest("", target.URL+"/")
+	p.AssertNoRequestsTo("billing.example.test")
+	if n := len(p.Flows()); n != 3 {
+		t.Errorf("Expected 3 flows, got %d", n)
+	}
+	p.Reset()
+	if n := len(p.Flows()); n != 0 {
+		t.Errorf("Expected no flows after Reset, got %d", n)
+	}
+}
+
+func TestProxy_Failures(t *testing.T) {
+	p := New(t)
+	p.Wait = 50 * time.Millisecond
+	p.Stub("", "https://api.example.test/*", http.StatusNoContent, "")
+	p.Stub("DELETE", "https://api.example.test/*", http.StatusForbidden, "")
+	f := &failures{TB: t}
+	p.t = f
+
+	req, _ := http.NewRequest("DELETE", "https://api.example.test:443/users/1", strings.NewReader("why"))
+	resp, err := p.Client().Do(req)
+	if err != nil {
+		t.Fatalf("DELETE: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the stub added last to answer, got %d", resp.StatusCode)
+	}
+	p.ExpectRequest("DELETE", "https://api.example.test/users/1", Body("why"))
+	if len(f.errors) != 0 {
+		t.Fatalf("Expected the request to match, got %v", f.errors)
+	}
+
+	if p.ExpectRequest("DELETE", "https://api.example.test/users/1", Body("because"), Header("X-Reason", "1")) != nil {
+		t.Error("Expected no flow for an unmet expectation")
+	}
+	p.ExpectRequest("GET", "https://api.example.test/users/1")
+	p.AssertNoRequestsTo("api.example.test")
+	if len(f.errors) != 3 {
+		t.Fatalf("Expected 3 failures, got %q", f.errors)
+	}
+	for i, want := range []string{
+		`does not match body "because"`,
+		"expected a request GET https://api.example.test/users/1; got\n  DELETE https://api.example.test:443/users/1 -> 403",
+		"expected no requests to api.example.test, got:\n  DELETE https://api.example.test:443/users/1",
+	} {
+		if !strings.Contains(f.errors[i], want) {
+			t.Errorf("Expected failure %d to contain %q, got %q", i, want, f.errors[i])
+		}
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		method, url, reqMethod, reqURL string
+		want                           bool
+	}{
+		{"GET", "https://example.test/a", "GET", "https://example.test:443/a", true},
+		{"get", "http://example.test:80/a", "GET", "http://example.test/a", true},
+		{"GET", "https://example.test/a", "POST", "https://example.test/a", false},
+		{"", "https://example.test/a", "POST", "https://example.test/a", true},
+		{"GET", "https://example.test/a", "GET", "https://example.test/a?q=1", false},
+		{"GET", "https://example.test/a*", "GET", "https://example.test/a?q=1", true},
+		{"GET", "https://example.test/*", "GET", "https://example.test:8443/a", false},
+	}
+	for _, tt := range tests {
+		if got := matches(tt.method, tt.url, tt.reqMethod, tt.reqURL); got != tt.want {
+			t.Errorf("matches(%q, %q, %q, %q) = %v, want %v", tt.method, tt.url, tt.reqMethod, tt.reqURL, got, tt.want)
+		}
+	}
+}
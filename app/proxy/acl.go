@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"syscall"
+
+	"nproxy/app/acl"
+)
+
+type destinationsKey struct{}
+
+// withDestinations returns ctx carrying the destination ACL that dials made
+// with it must obey
+func withDestinations(ctx context.Context, d *acl.Destinations) context.Context {
+	if d == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, destinationsKey{}, d)
+}
+
+func destinationsFrom(ctx context.Context) *acl.Destinations {
+	d, _ := ctx.Value(destinationsKey{}).(*acl.Destinations)
+	return d
+}
+
+// dialForward connects to the targets of plain HTTP requests that aren't
+// sent through an upstream proxy with a copy of base. It checks every
+// address it connects to against the destination ACL in ctx. The dial is
+// bounded by ctx.
+func dialForward(ctx context.Context, base *net.Dialer, network, addr string) (net.Conn, error) {
+	dialer := *base
+	if d := destinationsFrom(ctx); d != nil {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		port, _ := strconv.Atoi(portStr)
+		named, err := d.CheckName(host, port)
+		if err != nil {
+			return nil, err
+		}
+		dialer.Control = func(_, address string, _ syscall.RawConn) error {
+			ap, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return d.CheckAddr(ap.Addr(), port, named)
+		}
+	}
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// denyAccess answers a request refused by an ACL with 403 Forbidden and
+// logs it, if err is an *acl.DeniedError. It returns false for any other
+// error.
+func denyAccess(mt *Metrics, w http.ResponseWriter, r *http.Request, err error) bool {
+	var denied *acl.DeniedError
+	if !errors.As(err, &denied) {
+		return false
+	}
+	log.Printf("Access denied for %s %s from %s: %v", r.Method, r.Host, r.RemoteAddr, denied)
+	mt.accessDenied(denied)
+	errType := "http_request_denied"
+	if denied.Kind == "destination" {
+		errType = "destination_ip_prohibited"
+	}
+	w.Header().Set("Proxy-Status", proxyStatus(errType, denied.Error()))
+	http.Error(w, "Forbidden: "+denied.Error(), http.StatusForbidden)
+	return true
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nproxy/app/acl"
+)
+
+func TestMITMProxy_DestinationACL(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "reached")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(plain.Config.Handler)
+	defer secure.Close()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	get := func(target string) (int, string, error) {
+		resp, err := client.Get(target)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+
+	// The test servers listen on loopback, which is internal
+	blocked, _ := acl.NewDestinations(nil, nil, true)
+	p.Reload(Settings{Destinations: blocked})
+	status, body, err := get(plain.URL)
+	if err != nil || status != http.StatusForbidden || !strings.Contains(body, "destination 127.0.0.1:") || !strings.Contains(body, "denied: internal address") {
+		t.Errorf("Expected HTTP to an internal address to be forbidden, got %d %q %v", status, body, err)
+	}
+	if _, _, err := get(secure.URL); err == nil || !strings.Contains(err.Error(), "Forbidden") {
+		t.Errorf("Expected CONNECT to an internal address to be forbidden, got %v", err)
+	}
+	// Names are checked too
+	named, _ := acl.NewDestinations(nil, []string{"localhost"}, false)
+	p.Reload(Settings{Destinations: named})
+	if status, _, err := get(strings.Replace(plain.URL, "127.0.0.1", "localhost", 1)); err != nil || status != http.StatusForbidden {
+		t.Errorf("Expected localhost to be forbidden by name, got %d %v", status, err)
+	}
+	if v := p.Metrics.accessDenials.Value("destination"); v != 3 {
+		t.Errorf("Expected 3 destination denials, got %v", v)
+	}
+
+	// An allow entry for the address lifts the block
+	allowed, _ := acl.NewDestinations([]string{"127.0.0.1"}, nil, true)
+	p.Reload(Settings{Destinations: allowed})
+	for _, target := range []string{plain.URL, secure.URL} {
+		if status, body, err := get(target); err != nil || status != http.StatusOK || body != "reached" {
+			t.Errorf("Expected %s to be allowed, got %d %q %v", target, status, body, err)
+		}
+	}
+}
+
+func TestMITMProxy_ClientACL(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	clients, _ := acl.NewClients([]string{"10.0.0.0/8"}, nil)
+	p.Reload(Settings{Clients: clients})
+
+	req := httptest.NewRequest("GET", target.URL, nil)
+	req.RemoteAddr = "192.0.2.7:40000"
+	w := httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusForbidden || !strings.Contains(w.Body.String(), "client 192.0.2.7 denied: not in the allow list") {
+		t.Errorf("Expected the client to be forbidden, got %d %q", w.Code, w.Body.String())
+	}
+
+	req.RemoteAddr = "10.1.2.3:40000"
+	w = httptest.NewRecorder()
+	p.handleRequest(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected an allowed client to be served, got %d %q", w.Code, w.Body.String())
+	}
+	if v := p.Metrics.accessDenials.Value("client"); v != 1 {
+		t.Errorf("Expected 1 client denial, got %v", v)
+	}
+}
@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"nproxy/app/auth"
+)
+
+// authenticate checks r's proxy credentials against a and returns the user.
+// When they are missing or wrong it logs the failure, answers with a 407
+// challenge and returns false. Proxy-Authorization is meant for this proxy
+// only, so it is removed before the request is forwarded.
+func authenticate(a *auth.Basic, mt *Metrics, w http.ResponseWriter, r *http.Request) (string, bool) {
+	if a == nil {
+		return "", true
+	}
+	user, err := a.Authenticate(r)
+	if err != nil {
+		// Clients send their first request without credentials and retry
+		// after the challenge, so only wrong credentials are worth logging
+		if !errors.Is(err, auth.ErrNoCredentials) {
+			log.Printf("Proxy authentication failed for %s %s from %s: %v", r.Method, r.Host, r.RemoteAddr, err)
+		}
+		mt.authFailure(err)
+		a.Challenge(w)
+		return "", false
+	}
+	r.Header.Del("Proxy-Authorization")
+	return user, true
+}
@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"nproxy/app/auth"
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+)
+
+// bobAuth accepts bob with the password "secret"
+func bobAuth(t *testing.T) *auth.Basic {
+	t.Helper()
+	users, err := auth.ParseHtpasswd(strings.NewReader("bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), "htpasswd")
+	if err != nil {
+		t.Fatalf("Failed to parse htpasswd: %v", err)
+	}
+	return &auth.Basic{Realm: "test", Users: users}
+}
+
+// withCredentials returns proxyURL with user and password set, which makes
+// the transport send Proxy-Authorization
+func withCredentials(t *testing.T, proxyURL, user, password string) string {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatalf("Failed to parse proxy URL: %v", err)
+	}
+	u.User = url.UserPassword(user, password)
+	return u.String()
+}
+
+func TestMITMProxy_Authentication(t *testing.T) {
+	var seen []string // Proxy-Authorization headers that reached the target
+	var mu sync.Mutex
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Header.Get("Proxy-Authorization"))
+		mu.Unlock()
+		w.Write([]byte(r.Header.Get("X-User-Rule")))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Reload(Settings{
+		Auth: bobAuth(t),
+		Rules: []Rule{{Name: "bob", Enabled: true, Filter: filter.MustParse("user bob"), Handler: func(req *http.Request, resp *http.Response) {
+			if req != nil {
+				req.Header.Set("X-User-Rule", "applied")
+			}
+		}}},
+	})
+	var flows []*flow.Flow
+	p.OnFlow = func(f *flow.Flow) {
+		mu.Lock()
+		flows = append(flows, f)
+		mu.Unlock()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxyURL, _ := startServing(t, ctx, p)
+
+	// Missing and wrong credentials are challenged, for plain HTTP and CONNECT
+	for _, u := range []string{proxyURL, withCredentials(t, proxyURL, "bob", "wrong")} {
+		resp, err := newProxiedClient(t, p, u).Get(plain.URL)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired {
+			t.Errorf("Expected 407, got %d", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Proxy-Authenticate"); !strings.HasPrefix(got, `Basic realm="test"`) {
+			t.Errorf("Expected a Basic challenge, got %q", got)
+		}
+		if _, err := newProxiedClient(t, p, u).Get(secure.URL); err == nil || !strings.Contains(err.Error(), "Proxy Authentication Required") {
+			t.Errorf("Expected CONNECT to be refused, got %v", err)
+		}
+	}
+	if v := p.Metrics.authFailures.Value("missing"); v != 2 {
+		t.Errorf("Expected 2 requests without credentials, got %v", v)
+	}
+	if v := p.Metrics.authFailures.Value("invalid"); v != 2 {
+		t.Errorf("Expected 2 requests with wrong credentials, got %v", v)
+	}
+
+	// Valid credentials are accepted and never forwarded
+	client := newProxiedClient(t, p, withCredentials(t, proxyURL, "bob", "secret"))
+	for _, target := range []string{plain.URL, secure.URL} {
+		resp, err := client.Get(target)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", target, err)
+		}
+		body := make([]byte, 16)
+		n, _ := resp.Body.Read(body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected 200 from %s, got %d", target, resp.StatusCode)
+		}
+		if string(body[:n]) != "applied" {
+			t.Errorf("Expected the per-user rule to apply to %s, got %q", target, body[:n])
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, h := range seen {
+		if h != "" {
+			t.Errorf("Proxy-Authorization was forwarded: %q", h)
+		}
+	}
+	if len(flows) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(flows))
+	}
+	for _, f := range flows {
+		if f.User != "bob" {
+			t.Errorf("Expected flow %s to belong to bob, got %q", f.URL, f.User)
+		}
+	}
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"nproxy/app/limits"
+)
+
+// ErrorKind classifies a failure to get a response from an upstream server.
+// The kinds are also the type label of nproxy_upstream_errors_total.
+type ErrorKind string
+
+const (
+	ErrorDNS         ErrorKind = "dns"         // the name couldn't be resolved
+	ErrorRefused     ErrorKind = "refused"     // the connection was refused
+	ErrorUnreachable ErrorKind = "unreachable" // no route to the address
+	ErrorReset       ErrorKind = "reset"       // the connection was reset
+	ErrorTLS         ErrorKind = "tls"         // the TLS handshake or certificate failed
+	ErrorTimeout     ErrorKind = "timeout"     // connecting or waiting for the response timed out
+	ErrorMalformed   ErrorKind = "malformed"   // the response wasn't valid HTTP
+	ErrorEOF         ErrorKind = "eof"         // the connection closed before a full response
+	ErrorOther       ErrorKind = "other"
+)
+
+// GatewayError is an upstream failure as the proxy reports it to the client:
+// with a status, 502 Bad Gateway or 504 Gateway Timeout, and an RFC 9209
+// Proxy-Status error type
+type GatewayError struct {
+	Kind   ErrorKind
+	Status int
+	Type   string   // Proxy-Status error type, e.g. connection_refused
+	Params []string // extra Proxy-Status parameters, e.g. rcode="NXDOMAIN"
+	Detail string   // what went wrong, for people
+	Err    error
+}
+
+func (e *GatewayError) Error() string { return e.Detail }
+func (e *GatewayError) Unwrap() error { return e.Err }
+
+// ClassifyError describes an error returned while connecting to an upstream
+// server, sending it a request or reading its response
+func ClassifyError(err error) *GatewayError {
+	e := &GatewayError{Kind: ErrorOther, Status: http.StatusBadGateway, Type: "destination_unavailable", Detail: err.Error(), Err: err}
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	var netErr net.Error
+	var limitErr *limits.Error
+	dialing := errors.As(err, &opErr) && opErr.Op == "dial"
+
+	switch {
+	case errors.As(err, &dnsErr):
+		e.Kind, e.Type = ErrorDNS, "dns_error"
+		switch {
+		case dnsErr.IsTimeout:
+			e.Status, e.Type = http.StatusGatewayTimeout, "dns_timeout"
+		case dnsErr.IsNotFound:
+			e.Params = []string{`rcode="NXDOMAIN"`}
+		}
+		e.Detail = fmt.Sprintf("DNS lookup for %s failed: %s", dnsErr.Name, dnsErr.Err)
+	case errors.As(err, &limitErr) && limitErr.Limit == limits.MaxResponseBody:
+		e.Type = "http_response_body_size"
+		e.Detail = "the upstream response is bigger than the proxy's max_response_body limit"
+	case errors.As(err, &limitErr) && limitErr.Timeout():
+		e.Kind, e.Status, e.Type = ErrorTimeout, http.StatusGatewayTimeout, "http_response_timeout"
+		e.Detail = fmt.Sprintf("the upstream server didn't respond within the proxy's %s timeout", limitErr.Limit)
+		switch limitErr.Limit {
+		case limits.UpstreamDial:
+			e.Type, e.Detail = "connection_timeout", "connecting to the upstream server took longer than the proxy's upstream.dial timeout"
+		case limits.UpstreamTLSHandshake:
+			e.Type, e.Detail = "connection_timeout", "the TLS handshake with the upstream server took longer than the proxy's upstream.tls_handshake timeout"
+		}
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		e.Kind, e.Status, e.Type = ErrorTimeout, http.StatusGatewayTimeout, "http_response_timeout"
+		e.Detail = "the upstream server didn't respond in time"
+		if dialing {
+			e.Type, e.Detail = "connection_timeout", "connecting to the upstream server timed out"
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		e.Kind, e.Type, e.Detail = ErrorRefused, "connection_refused", "the upstream server refused the connection"
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		e.Kind, e.Type, e.Detail = ErrorUnreachable, "destination_ip_unroutable", "the upstream server's address can't be reached"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		e.Kind, e.Type, e.Detail = ErrorReset, "connection_terminated", "the upstream server reset the connection"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr), errors.As(err, &invalidErr):
+		e.Kind, e.Type = ErrorTLS, "tls_certificate_error"
+		e.Detail = "the upstream server's certificate was rejected: " + certificateDiagnosis(err)
+	case errors.As(err, &alertErr):
+		e.Kind, e.Type = ErrorTLS, "tls_alert_received"
+		e.Params = []string{"alert-id=" + strconv.Itoa(int(alertErr))}
+		e.Detail = "the upstream server ended the TLS handshake: " + alertErr.Error()
+	case errors.As(err, &recordErr):
+		e.Kind, e.Type = ErrorTLS, "tls_protocol_error"
+		e.Detail = "the upstream server doesn't speak TLS: " + recordErr.Error()
+	case strings.Contains(err.Error(), "malformed HTTP"):
+		e.Kind, e.Type = ErrorMalformed, "http_protocol_error"
+		e.Detail = "the upstream server sent an invalid response: " + err.Error()
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		e.Kind, e.Type, e.Detail = ErrorEOF, "http_response_incomplete", "the upstream server closed the connection without a complete response"
+	case strings.HasPrefix(err.Error(), "tls: "), strings.Contains(err.Error(), ": tls: "):
+		e.Kind, e.Type = ErrorTLS, "tls_protocol_error"
+		e.Detail = "the TLS handshake with the upstream server failed: " + err.Error()
+	}
+	return e
+}
+
+// certificateDiagnosis explains a certificate verification failure with
+// the certificate it is about
+func certificateDiagnosis(err error) string {
+	var cert *x509.Certificate
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+	cause := err
+	switch {
+	case errors.As(err, &hostnameErr):
+		cert, cause = hostnameErr.Certificate, hostnameErr
+	case errors.As(err, &unknownAuthErr):
+		cert, cause = unknownAuthErr.Cert, unknownAuthErr
+	case errors.As(err, &invalidErr):
+		cert, cause = invalidErr.Cert, invalidErr
+	}
+	if errors.As(err, &certErr) && cert == nil && len(certErr.UnverifiedCertificates) > 0 {
+		cert = certErr.UnverifiedCertificates[0]
+	}
+	if cert == nil {
+		return cause.Error()
+	}
+	return fmt.Sprintf("%v (subject %q, issuer %q, valid %s to %s)", cause, cert.Subject, cert.Issuer,
+		cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+}
+
+// proxyStatus formats a Proxy-Status field value (RFC 9209) for an error
+// of type errType, explained by details
+func proxyStatus(errType, details string, params ...string) string {
+	v := "nproxy; error=" + errType
+	for _, p := range params {
+		v += "; " + p
+	}
+	if details != "" {
+		v += "; details=" + sfString(details)
+	}
+	return v
+}
+
+// sfString formats s as a structured field string (RFC 8941), which holds
+// printable ASCII only
+func sfString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range s {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(c)
+		case c >= 0x20 && c < 0x7f:
+			b.WriteRune(c)
+		default:
+			b.WriteByte('?')
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// gatewayResponse builds the response for a request to target that failed
+// upstream. With pages the body describes the failure as HTML or JSON when
+// the client accepts them; otherwise it is a line of text.
+func gatewayResponse(r *http.Request, target string, e *GatewayError, pages bool) (http.Header, []byte) {
+	h := http.Header{}
+	h.Set("Proxy-Status", proxyStatus(e.Type, e.Detail, e.Params...))
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Cache-Control", "no-store")
+	title := fmt.Sprintf("%d %s", e.Status, http.StatusText(e.Status))
+
+	var body []byte
+	switch format := negotiate(r); {
+	case pages && format == "application/json":
+		h.Set("Content-Type", "application/json")
+		body, _ = json.Marshal(struct {
+			Status int    `json:"status"`
+			Error  string `json:"error"`
+			Kind   string `json:"kind"`
+			Target string `json:"target"`
+			Detail string `json:"detail"`
+		}{e.Status, e.Type, string(e.Kind), target, e.Detail})
+		body = append(body, '\n')
+	case pages && format == "text/html":
+		h.Set("Content-Type", "text/html; charset=utf-8")
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "<!DOCTYPE html>\n<html><head><title>%s</title></head><body>\n<h1>%s</h1>\n", title, title)
+		fmt.Fprintf(&b, "<p>nproxy couldn't get a response from <code>%s</code>: %s.</p>\n", html.EscapeString(target), html.EscapeString(e.Detail))
+		fmt.Fprintf(&b, "<p>Error: <code>%s</code></p>\n</body></html>\n", html.EscapeString(e.Type))
+		body = b.Bytes()
+	default:
+		h.Set("Content-Type", "text/plain; charset=utf-8")
+		body = []byte(fmt.Sprintf("%s: %s: %s\n", title, target, e.Detail))
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	return h, body
+}
+
+// negotiate returns the first of the media types the client lists in
+// Accept that an error page can be written in, or ""
+func negotiate(r *http.Request) string {
+	if r == nil {
+		return ""
+	}
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/json", "text/html":
+			return mt
+		case "text/plain", "*/*":
+			return ""
+		}
+	}
+	return ""
+}
+
+// writeGatewayError answers r, which failed upstream with err
+func writeGatewayError(w http.ResponseWriter, r *http.Request, target string, err error, pages bool) *GatewayError {
+	e := ClassifyError(err)
+	h, body := gatewayResponse(r, target, e, pages)
+	for k, v := range h {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(e.Status)
+	w.Write(body)
+	return e
+}
+
+// writeGatewayResponse answers r on conn, a connection that the proxy
+// relays requests over, when it failed upstream with err. The connection
+// is closed after the response.
+func writeGatewayResponse(conn net.Conn, r *http.Request, target string, err error, pages bool) *GatewayError {
+	e := ClassifyError(err)
+	h, body := gatewayResponse(r, target, e, pages)
+	h.Set("Connection", "close")
+	resp := &http.Response{
+		StatusCode:    e.Status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       r,
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	resp.Write(conn)
+	return e
+}
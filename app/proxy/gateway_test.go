@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestClassifyError(t *testing.T) {
+	tests := []struct {
+		err     error
+		kind    ErrorKind
+		status  int
+		errType string
+	}{
+		{&net.DNSError{Err: "no such host", Name: "nope.invalid", IsNotFound: true}, ErrorDNS, 502, "dns_error"},
+		{&net.DNSError{Err: "i/o timeout", Name: "slow.example", IsTimeout: true}, ErrorDNS, 504, "dns_timeout"},
+		{context.DeadlineExceeded, ErrorTimeout, 504, "http_response_timeout"},
+		{&net.OpError{Op: "dial", Err: &timeoutError{}}, ErrorTimeout, 504, "connection_timeout"},
+		{&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED}, ErrorRefused, 502, "connection_refused"},
+		{&net.OpError{Op: "dial", Err: syscall.EHOSTUNREACH}, ErrorUnreachable, 502, "destination_ip_unroutable"},
+		{&net.OpError{Op: "read", Err: syscall.ECONNRESET}, ErrorReset, 502, "connection_terminated"},
+		{tls.RecordHeaderError{Msg: "bad record"}, ErrorTLS, 502, "tls_protocol_error"},
+		{fmt.Errorf("remote error: %w", tls.AlertError(40)), ErrorTLS, 502, "tls_alert_received"},
+		{&tls.CertificateVerificationError{Err: x509.UnknownAuthorityError{}}, ErrorTLS, 502, "tls_certificate_error"},
+		{errors.New(`net/http: HTTP/1.x transport connection broken: malformed HTTP response "nope"`), ErrorMalformed, 502, "http_protocol_error"},
+		{fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), ErrorEOF, 502, "http_response_incomplete"},
+		{errors.New("something else"), ErrorOther, 502, "destination_unavailable"},
+	}
+
+	for _, test := range tests {
+		got := ClassifyError(test.err)
+		if got.Kind != test.kind || got.Status != test.status || got.Type != test.errType {
+			t.Errorf("ClassifyError(%v) = %s %d %s, expected %s %d %s", test.err, got.Kind, got.Status, got.Type, test.kind, test.status, test.errType)
+		}
+		if !errors.Is(got, test.err) {
+			t.Errorf("ClassifyError(%v) doesn't wrap the error", test.err)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestProxyStatus(t *testing.T) {
+	got := proxyStatus("dns_error", `lookup "x" failed\ü`, `rcode="NXDOMAIN"`)
+	want := `nproxy; error=dns_error; rcode="NXDOMAIN"; details="lookup \"x\" failed\\?"`
+	if got != want {
+		t.Errorf("proxyStatus = %s, expected %s", got, want)
+	}
+}
+
+func TestGatewayResponse(t *testing.T) {
+	e := ClassifyError(&net.OpError{Op: "dial", Err: syscall.ECONNREFUSED})
+	withAccept := func(accept string) *http.Request {
+		r := httptest.NewRequest("GET", "http://backend.example/", nil)
+		r.Header.Set("Accept", accept)
+		return r
+	}
+
+	h, _ := gatewayResponse(withAccept("text/html"), "http://<b>/", e, false)
+	if ct := h.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Errorf("Expected a text body without error pages, got %s", ct)
+	}
+	if ps := h.Get("Proxy-Status"); !strings.HasPrefix(ps, "nproxy; error=connection_refused; details=") {
+		t.Errorf("Unexpected Proxy-Status %q", ps)
+	}
+
+	h, body := gatewayResponse(withAccept("application/json, */*"), "http://backend.example/", e, true)
+	var page struct {
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+		Kind   string `json:"kind"`
+		Target string `json:"target"`
+	}
+	if err := json.Unmarshal(body, &page); err != nil || h.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON body, got %s %q: %v", h.Get("Content-Type"), body, err)
+	}
+	if page.Status != 502 || page.Error != "connection_refused" || page.Kind != "refused" || page.Target != "http://backend.example/" {
+		t.Errorf("Unexpected JSON body %+v", page)
+	}
+
+	h, body = gatewayResponse(withAccept("text/html;q=0.9"), "http://<b>/", e, true)
+	if ct := h.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") || !strings.Contains(string(body), "&lt;b&gt;") {
+		t.Errorf("Expected an escaped HTML body, got %s %q", ct, body)
+	}
+}
+
+func TestMITMProxy_GatewayErrors(t *testing.T) {
+	// Reserve a port and close it so that connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	// A server that doesn't speak TLS or HTTP
+	garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		io.WriteString(conn, "nonsense\r\n\r\n")
+		conn.Close()
+	}))
+	defer garbage.Close()
+	plain := strings.TrimPrefix(garbage.URL, "http://")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Reload(Settings{ErrorPages: true})
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	tests := []struct {
+		name    string
+		url     string
+		errType string
+	}{
+		{"refused", "http://" + closed + "/", "connection_refused"},
+		{"malformed", garbage.URL + "/", "http_protocol_error"},
+		// The server's TLS fails after the client's tunnel is up
+		{"tls", "https://" + plain + "/", "tls_protocol_error"},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req.Header.Set("Accept", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway || !strings.Contains(resp.Header.Get("Proxy-Status"), "error="+tt.errType) {
+			t.Errorf("%s: expected 502 with error=%s, got %d %q", tt.name, tt.errType, resp.StatusCode, resp.Header.Get("Proxy-Status"))
+		}
+		if !strings.Contains(string(body), `"error":"`+tt.errType+`"`) {
+			t.Errorf("%s: expected a JSON error page, got %q", tt.name, body)
+		}
+	}
+
+	// CONNECT to a closed port is refused before the tunnel opens
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to dial proxy: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", closed, closed)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("Failed to read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(resp.Header.Get("Proxy-Status"), "error=connection_refused") {
+		t.Errorf("CONNECT: expected 502 with error=connection_refused, got %d %q", resp.StatusCode, resp.Header.Get("Proxy-Status"))
+	}
+}
+
+func TestMITMProxy_GatewayTimeout(t *testing.T) {
+	// The target answers after the request's deadline
+	release := make(chan struct{})
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer target.Close()
+	defer close(release)
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req := httptest.NewRequest("GET", target.URL, nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	p.handleHTTP(w, req, "")
+
+	if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Header().Get("Proxy-Status"), "error=http_response_timeout") {
+		t.Errorf("Expected 504 with error=http_response_timeout, got %d %q", w.Code, w.Header().Get("Proxy-Status"))
+	}
+}
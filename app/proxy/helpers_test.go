@@ -0,0 +1,32 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newProxiedClient returns a client that sends all traffic through proxyURL
+// and trusts the CA of the given MITM proxy
+func newProxiedClient(t *testing.T, proxy *MITMProxy, proxyURL string) *http.Client {
+	t.Helper()
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatalf("Failed to parse proxy URL: %v", err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(proxy.CA)
+
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(u),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	t.Cleanup(transport.CloseIdleConnections)
+
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
@@ -0,0 +1,108 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"nproxy/app/hop"
+)
+
+// copyRequestHeader gives req, the request that forwards in, the header of
+// in without its hop-by-hop headers, records the proxy in Via when via is
+// set, and has req send the trailers of in once its body has been read
+func copyRequestHeader(req, in *http.Request, via string) {
+	for key, values := range in.Header {
+		req.Header[key] = append([]string(nil), values...)
+	}
+	stripRequest(req, in, via)
+	// The server fills in the declared trailers when it reaches the end of
+	// the body, before the transport writes them
+	req.Trailer = in.Trailer
+}
+
+// stripRequest removes the hop-by-hop headers from req, the request that
+// forwards in, and records the proxy in Via when via is set
+func stripRequest(req, in *http.Request, via string) {
+	hop.StripRequest(req.Header)
+	if via != "" {
+		hop.AddVia(req.Header, in.ProtoMajor, in.ProtoMinor, via)
+	}
+}
+
+// stripResponse removes the hop-by-hop headers from resp, a response to
+// send on, and records the proxy in Via when via is set
+func stripResponse(resp *http.Response, via string) {
+	hop.StripResponse(resp.Header, resp.StatusCode)
+	if via != "" {
+		hop.AddVia(resp.Header, resp.ProtoMajor, resp.ProtoMinor, via)
+	}
+}
+
+// declareTrailers announces the trailers that resp declares in the header
+// of w, before it is written
+func declareTrailers(w http.ResponseWriter, resp *http.Response) {
+	for name := range resp.Trailer {
+		w.Header().Add("Trailer", name)
+	}
+}
+
+// copyTrailers sends the trailers of resp, whose body w has been given, as
+// the trailers of w. Those resp didn't declare are sent too.
+func copyTrailers(w http.ResponseWriter, resp *http.Response) {
+	for name, values := range resp.Trailer {
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+}
+
+// expectsContinue reports whether the client that sent req waits for a
+// 100 Continue response before sending its body
+func expectsContinue(req *http.Request) bool {
+	return req.ProtoAtLeast(1, 1) && req.Body != http.NoBody && strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+}
+
+// continueReader is the body of a relayed request whose client expects
+// 100 Continue: the first read, made once the server asks for the body,
+// answers the client with one. The reply is only sent until stop is
+// called, when the final response is about to be written.
+type continueReader struct {
+	io.ReadCloser
+
+	mu      sync.Mutex
+	w       io.Writer // nil once 100 Continue is sent or stopped
+	replied bool
+}
+
+func newContinueReader(body io.ReadCloser, w io.Writer) *continueReader {
+	return &continueReader{ReadCloser: body, w: w}
+}
+
+func (c *continueReader) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	if c.w != nil {
+		w := c.w
+		c.w = nil
+		if conn, ok := w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+			defer conn.SetWriteDeadline(time.Time{})
+		}
+		if _, err := io.WriteString(w, "HTTP/1.1 100 Continue\r\n\r\n"); err != nil {
+			c.mu.Unlock()
+			return 0, err
+		}
+		c.replied = true
+	}
+	c.mu.Unlock()
+	return c.ReadCloser.Read(p)
+}
+
+// stop keeps 100 Continue from being sent from now on and reports whether
+// it was sent. A client that didn't get one hasn't sent its body.
+func (c *continueReader) stop() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.w = nil
+	return c.replied
+}
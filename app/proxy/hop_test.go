@@ -0,0 +1,274 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nproxy/app/reverse"
+)
+
+// hopTarget is the server behind the proxy in the conformance tests. It
+// answers /headers with the request headers it got, /trailers with the
+// body and trailer it got, /expect with the body unless X-Reject is set,
+// and upgrades /upgrade to an echo protocol.
+func hopTarget(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/headers":
+		h := w.Header()
+		h.Set("Connection", "X-Resp-Hop")
+		h.Set("X-Resp-Hop", "1")
+		h.Set("Keep-Alive", "timeout=5")
+		h.Set("Proxy-Connection", "keep-alive")
+		h.Set("Upgrade", "h2c")
+		h.Set("X-Resp-End", "1")
+		json.NewEncoder(w).Encode(r.Header)
+	case "/trailers":
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Trailer", "X-Sum")
+		fmt.Fprintf(w, "%s %s", body, r.Trailer.Get("X-Checksum"))
+		w.Header().Set("X-Sum", "42")
+	case "/expect":
+		if r.Header.Get("X-Reject") != "" {
+			http.Error(w, "not that", http.StatusExpectationFailed)
+			return
+		}
+		io.Copy(w, r.Body)
+	case "/upgrade":
+		if r.Header.Get("Upgrade") != "echo" || !strings.EqualFold(r.Header.Get("Connection"), "upgrade") {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}
+}
+
+// hopPath is one way through the proxy: dial returns a connection that
+// requests can be written to, and target the request target for a path
+type hopPath struct {
+	name   string
+	host   string
+	dial   func(t *testing.T) net.Conn
+	target func(path string) string
+}
+
+// TestHopByHop checks the proxies' handling of hop-by-hop headers, Via and
+// Forwarded, trailers, Expect: 100-continue and upgrades (RFC 9110 and
+// 9112) on every path through them: requests forwarded by the MITM proxy
+// and the simple one, requests intercepted on a tunnel and reverse proxy
+// requests
+func TestHopByHop(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(hopTarget))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(http.HandlerFunc(hopTarget))
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	table, err := reverse.NewTable([]reverse.Route{{Upstream: plain.URL}}, nil)
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	p.Reload(Settings{Via: "nproxy", Forwarded: true, Reverse: table})
+	proxyURL, _ := startServing(t, ctx, p)
+	proxyAddr := strings.TrimPrefix(proxyURL, "http://")
+	reverseLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go p.ServeReverse(ctx, reverseLn)
+	simple := httptest.NewServer(NewServer(Options{Via: "nproxy", Forwarded: true}))
+	defer simple.Close()
+
+	dialTCP := func(t *testing.T, addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to connect: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return conn
+	}
+	plainHost := strings.TrimPrefix(plain.URL, "http://")
+	secureHost := strings.TrimPrefix(secure.URL, "https://")
+	paths := []hopPath{
+		{
+			name:   "forwarded",
+			host:   plainHost,
+			dial:   func(t *testing.T) net.Conn { return dialTCP(t, proxyAddr) },
+			target: func(path string) string { return plain.URL + path },
+		},
+		{
+			name:   "simple",
+			host:   plainHost,
+			dial:   func(t *testing.T) net.Conn { return dialTCP(t, strings.TrimPrefix(simple.URL, "http://")) },
+			target: func(path string) string { return plain.URL + path },
+		},
+		{
+			name: "intercepted",
+			host: secureHost,
+			dial: func(t *testing.T) net.Conn {
+				conn := dialTCP(t, proxyAddr)
+				fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", secureHost, secureHost)
+				resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+				if err != nil || resp.StatusCode != http.StatusOK {
+					t.Fatalf("CONNECT failed: %v %v", resp, err)
+				}
+				pool := x509.NewCertPool()
+				pool.AddCert(p.CA)
+				return tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+			},
+			target: func(path string) string { return path },
+		},
+		{
+			name:   "reverse",
+			host:   reverseLn.Addr().String(),
+			dial:   func(t *testing.T) net.Conn { return dialTCP(t, reverseLn.Addr().String()) },
+			target: func(path string) string { return path },
+		},
+	}
+
+	for _, hp := range paths {
+		t.Run(hp.name, func(t *testing.T) {
+			// send writes a request head with the given method, path and
+			// header lines, and returns the connection and its reader
+			send := func(method, path string, lines ...string) (net.Conn, *bufio.Reader) {
+				conn := hp.dial(t)
+				head := fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\n", method, hp.target(path), hp.host)
+				for _, l := range lines {
+					head += l + "\r\n"
+				}
+				io.WriteString(conn, head+"\r\n")
+				return conn, bufio.NewReader(conn)
+			}
+
+			t.Run("hop-by-hop headers", func(t *testing.T) {
+				_, br := send("GET", "/headers",
+					"Connection: keep-alive, X-Hop",
+					"X-Hop: 1",
+					"Keep-Alive: timeout=5",
+					"Proxy-Connection: keep-alive",
+					"Proxy-Authorization: Basic Ym9iOnNlY3JldA==",
+					"TE: trailers, deflate",
+					"Upgrade: h2c",
+					"X-End: 1")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("Failed to read response: %v", err)
+				}
+				defer resp.Body.Close()
+				var got http.Header
+				if err := json.NewDecoder(resp.Body).Decode(&got); err != nil {
+					t.Fatalf("Failed to decode the headers the target got: %v", err)
+				}
+				for _, name := range []string{"Connection", "X-Hop", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Upgrade"} {
+					if v, ok := got[name]; ok {
+						t.Errorf("Expected %s not to reach the target, got %q", name, v)
+					}
+				}
+				if got.Get("X-End") != "1" || got.Get("Te") != "trailers" {
+					t.Errorf("Expected X-End and TE: trailers to reach the target, got %v", got)
+				}
+				if via := got.Get("Via"); via != "1.1 nproxy" {
+					t.Errorf("Expected the request Via to be 1.1 nproxy, got %q", via)
+				}
+				if xff := got.Get("X-Forwarded-For"); xff != "127.0.0.1" {
+					t.Errorf("Expected X-Forwarded-For 127.0.0.1, got %q", xff)
+				}
+				if !strings.HasPrefix(got.Get("Forwarded"), "for=127.0.0.1;") {
+					t.Errorf("Expected a Forwarded element for the client, got %q", got.Get("Forwarded"))
+				}
+
+				for _, name := range []string{"X-Resp-Hop", "Keep-Alive", "Proxy-Connection", "Upgrade", "Connection"} {
+					if v, ok := resp.Header[name]; ok {
+						t.Errorf("Expected %s not to reach the client, got %q", name, v)
+					}
+				}
+				if resp.Header.Get("X-Resp-End") != "1" || resp.Header.Get("Via") != "1.1 nproxy" {
+					t.Errorf("Expected X-Resp-End and Via: 1.1 nproxy in the response, got %v", resp.Header)
+				}
+			})
+
+			t.Run("trailers", func(t *testing.T) {
+				conn, br := send("POST", "/trailers", "Transfer-Encoding: chunked", "Trailer: X-Checksum", "TE: trailers")
+				io.WriteString(conn, "5\r\nhello\r\n0\r\nX-Checksum: abc\r\n\r\n")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("Failed to read response: %v", err)
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || string(body) != "hello abc" {
+					t.Errorf("Expected the target to get the body and trailer, got %q %v", body, err)
+				}
+				if sum := resp.Trailer.Get("X-Sum"); sum != "42" {
+					t.Errorf("Expected the response trailer X-Sum: 42, got %q in %v", sum, resp.Trailer)
+				}
+			})
+
+			t.Run("100-continue", func(t *testing.T) {
+				conn, br := send("POST", "/expect", "Content-Length: 5", "Expect: 100-continue")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil || resp.StatusCode != http.StatusContinue {
+					t.Fatalf("Expected 100 Continue before sending the body, got %v %v", resp, err)
+				}
+				io.WriteString(conn, "hello")
+				resp, err = http.ReadResponse(br, nil)
+				if err != nil {
+					t.Fatalf("Failed to read response: %v", err)
+				}
+				body, _ := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK || string(body) != "hello" {
+					t.Errorf("Expected the body echoed, got %d %q", resp.StatusCode, body)
+				}
+			})
+
+			t.Run("100-continue refused", func(t *testing.T) {
+				_, br := send("POST", "/expect", "Content-Length: 5", "Expect: 100-continue", "X-Reject: 1")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil || resp.StatusCode != http.StatusExpectationFailed {
+					t.Fatalf("Expected the final 417 without 100 Continue, got %v %v", resp, err)
+				}
+				resp.Body.Close()
+			})
+
+			t.Run("upgrade", func(t *testing.T) {
+				conn, br := send("GET", "/upgrade", "Connection: Upgrade", "Upgrade: echo")
+				resp, err := http.ReadResponse(br, nil)
+				if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+					t.Fatalf("Expected 101, got %v %v", resp, err)
+				}
+				if resp.Header.Get("Upgrade") != "echo" || !strings.EqualFold(resp.Header.Get("Connection"), "upgrade") {
+					t.Errorf("Expected the 101 to keep its upgrade headers, got %v", resp.Header)
+				}
+				io.WriteString(conn, "ping")
+				buf := make([]byte, 4)
+				if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+					t.Errorf("Expected the upgraded connection to echo, got %q %v", buf, err)
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,372 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"os"
+	"sync"
+	"time"
+
+	"nproxy/app/limits"
+)
+
+// reportLimit logs and counts err if a limit caused it, reporting whether
+// one did. who names the client or request that ran into it.
+func reportLimit(mt *Metrics, err error, who string) bool {
+	var le *limits.Error
+	if !errors.As(err, &le) {
+		return false
+	}
+	log.Printf("Limit %s exceeded by %s", le.Limit, who)
+	mt.limitExceeded(le.Limit)
+	return true
+}
+
+// limitCause returns the *limits.Error that cancelled ctx, if one did, in
+// place of err, which is what the cancellation looked like to the caller
+func limitCause(ctx context.Context, err error) error {
+	var le *limits.Error
+	if err != nil && !errors.As(err, &le) && errors.As(context.Cause(ctx), &le) {
+		return le
+	}
+	return err
+}
+
+// clientLimit returns the limit on clients that err is about, or nil when
+// it isn't about one
+func clientLimit(err error) *limits.Error {
+	var le *limits.Error
+	if !errors.As(err, &le) {
+		return nil
+	}
+	switch le.Limit {
+	case limits.ClientHeader, limits.ClientRequest, limits.MaxHeaderBytes, limits.MaxRequestBody:
+		return le
+	}
+	return nil
+}
+
+// clientLimitStatus is the status that answers a client that ran into le
+func clientLimitStatus(le *limits.Error) int {
+	switch le.Limit {
+	case limits.MaxHeaderBytes:
+		return http.StatusRequestHeaderFieldsTooLarge
+	case limits.MaxRequestBody:
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusRequestTimeout
+}
+
+// writeClientLimit answers a request that ran into le, a limit on clients,
+// and returns the status
+func writeClientLimit(w http.ResponseWriter, le *limits.Error) int {
+	status := clientLimitStatus(le)
+	w.Header().Set("Connection", "close")
+	http.Error(w, http.StatusText(status)+": "+le.Error(), status)
+	return status
+}
+
+// writeClientLimitResponse answers on conn, a connection that the proxy
+// relays requests over, a client that ran into le, and returns the status.
+// req is nil when the request head couldn't be read. The connection is
+// closed after the response.
+func writeClientLimitResponse(conn net.Conn, req *http.Request, le *limits.Error) int {
+	status := clientLimitStatus(le)
+	body := []byte(http.StatusText(status) + ": " + le.Error() + "\n")
+	h := http.Header{}
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("Connection", "close")
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	resp.Write(conn)
+	return status
+}
+
+// exceeds reports whether a body of the given length, -1 when unknown, is
+// known to be bigger than max, which is unlimited when zero
+func exceeds(length, max int64) bool {
+	return max > 0 && length > max
+}
+
+// limitedBody reads a request or response body, failing with a
+// *limits.Error for sizeLimit once more than max bytes have arrived, and
+// with one for timeoutLimit when a read times out. A zero max or an empty
+// timeoutLimit turns that check off.
+type limitedBody struct {
+	io.ReadCloser
+	max          int64
+	n            int64
+	sizeLimit    string
+	timeoutLimit string
+}
+
+func limitBody(body io.ReadCloser, max int64, sizeLimit, timeoutLimit string) io.ReadCloser {
+	if max <= 0 && timeoutLimit == "" {
+		return body
+	}
+	return &limitedBody{ReadCloser: body, max: max, sizeLimit: sizeLimit, timeoutLimit: timeoutLimit}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.max > 0 && b.n > b.max {
+		return 0, &limits.Error{Limit: b.sizeLimit}
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	if b.max > 0 && b.n > b.max {
+		return max(n-int(b.n-b.max), 0), &limits.Error{Limit: b.sizeLimit}
+	}
+	if err != nil && b.timeoutLimit != "" && isTimeout(err) {
+		err = &limits.Error{Limit: b.timeoutLimit, Err: err}
+	}
+	return n, err
+}
+
+func isTimeout(err error) bool {
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// headReader sits between a relayed connection and its buffered reader and
+// lets at most limit bytes through while a request head is being read, as
+// net/http does for MaxHeaderBytes
+type headReader struct {
+	r         io.Reader
+	limit     int64
+	remaining int64 // -1 while no head is being read
+	exceeded  bool
+}
+
+// newHeadReader limits the heads read from r to maxBytes, or to net/http's
+// default when it is zero
+func newHeadReader(r io.Reader, maxBytes int) *headReader {
+	if maxBytes <= 0 {
+		maxBytes = http.DefaultMaxHeaderBytes
+	}
+	// Like net/http, allow for what the buffered reader reads ahead
+	return &headReader{r: r, limit: int64(maxBytes) + 4096, remaining: -1}
+}
+
+func (h *headReader) Read(p []byte) (int, error) {
+	if h.remaining < 0 {
+		return h.r.Read(p)
+	}
+	if h.remaining == 0 {
+		h.exceeded = true
+		return 0, io.EOF
+	}
+	if int64(len(p)) > h.remaining {
+		p = p[:h.remaining]
+	}
+	n, err := h.r.Read(p)
+	h.remaining -= int64(n)
+	return n, err
+}
+
+// startHead starts counting the bytes of a request head
+func (h *headReader) startHead() {
+	h.remaining, h.exceeded = h.limit, false
+}
+
+// endHead stops counting once the head has been read
+func (h *headReader) endHead() {
+	h.remaining = -1
+}
+
+// deadline is the time by which a phase of a relayed exchange must be
+// done, with the limit that sets it; the zero deadline is none
+type deadline struct {
+	at    time.Time
+	limit string
+}
+
+// deadlineAfter returns the deadline d from now set by limit, or none when
+// d is zero
+func deadlineAfter(d time.Duration, limit string) deadline {
+	if d <= 0 {
+		return deadline{}
+	}
+	return deadline{at: time.Now().Add(d), limit: limit}
+}
+
+// earliest returns whichever of a and b comes first
+func earliest(a, b deadline) deadline {
+	if a.at.IsZero() || (!b.at.IsZero() && b.at.Before(a.at)) {
+		return b
+	}
+	return a
+}
+
+// wrap turns err into a *limits.Error if the deadline caused it
+func (d deadline) wrap(err error) error {
+	var le *limits.Error
+	if err == nil || d.limit == "" || !isTimeout(err) || errors.As(err, &le) {
+		return err
+	}
+	return &limits.Error{Limit: d.limit, Err: err}
+}
+
+// dialWithin runs dial with ctx bounded by the upstream dial timeout d and
+// reports a timeout as a *limits.Error. Zero leaves the dial unbounded.
+func dialWithin(ctx context.Context, d time.Duration, dial func(context.Context) (net.Conn, error)) (net.Conn, error) {
+	if d <= 0 {
+		return dial(ctx)
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+	conn, err := dial(dialCtx)
+	if err != nil && errors.Is(dialCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, &limits.Error{Limit: limits.UpstreamDial, Err: err}
+	}
+	return conn, err
+}
+
+// upstreamTimeouts bounds a forwarded exchange by the upstream timeouts:
+// the returned context is cancelled with a *limits.Error as its cause when
+// the TLS handshake, the wait for the response head or the exchange as a
+// whole, response body included, takes too long. Dialing is bounded by the
+// transport. stop releases the timers once the exchange is over.
+func upstreamTimeouts(ctx context.Context, t limits.Timeouts) (_ context.Context, stop func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	var mu sync.Mutex
+	var timers [3]*time.Timer // request, TLS handshake, header
+	start := func(i int, d time.Duration, limit string) {
+		mu.Lock()
+		defer mu.Unlock()
+		if d > 0 {
+			timers[i] = time.AfterFunc(d, func() {
+				cancel(&limits.Error{Limit: limit, Err: context.DeadlineExceeded})
+			})
+		}
+	}
+	halt := func(i int) {
+		mu.Lock()
+		defer mu.Unlock()
+		if timers[i] != nil {
+			timers[i].Stop()
+		}
+	}
+
+	start(0, t.Request, limits.UpstreamRequest)
+	trace := &httptrace.ClientTrace{
+		TLSHandshakeStart:    func() { start(1, t.TLSHandshake, limits.UpstreamTLSHandshake) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { halt(1) },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { start(2, t.Header, limits.UpstreamHeader) },
+		GotFirstResponseByte: func() { halt(2) },
+	}
+	return httptrace.WithClientTrace(ctx, trace), func() {
+		for i := range timers {
+			halt(i)
+		}
+		cancel(context.Canceled)
+	}
+}
+
+// limitServer applies the limits on clients to srv, whose connections
+// conns tracks
+func limitServer(srv *http.Server, l limits.Limits, conns *clientConns) {
+	srv.ReadHeaderTimeout = l.Client.Header
+	srv.ReadTimeout = l.Client.Request
+	srv.IdleTimeout = l.Client.Idle
+	srv.MaxHeaderBytes = l.MaxHeaderBytes
+	srv.ConnState = conns.connState
+}
+
+// clientConns admits the connections to a proxy's listeners up to
+// max_conns_per_client per client address. Connections of an http.Server
+// are tracked through its ConnState hook; hijacked ones stay counted until
+// released by whoever took them over.
+type clientConns struct {
+	conns         *limits.Conns
+	headerTimeout time.Duration
+	metrics       *Metrics
+
+	mu   sync.Mutex
+	open map[net.Conn]connState
+}
+
+type connState struct {
+	admitted bool
+	state    http.ConnState
+	since    time.Time
+}
+
+func newClientConns(l limits.Limits, mt *Metrics) *clientConns {
+	return &clientConns{
+		conns:         limits.NewConns(l.MaxConnsPerClient),
+		headerTimeout: l.Client.Header,
+		metrics:       mt,
+		open:          make(map[net.Conn]connState),
+	}
+}
+
+// admit counts conn against its client's limit. When the client already
+// has the maximum open, the refusal is reported and admit returns false;
+// the caller closes conn.
+func (c *clientConns) admit(conn net.Conn) bool {
+	addr := conn.RemoteAddr().String()
+	admitted := c.conns.Acquire(addr)
+	c.mu.Lock()
+	c.open[conn] = connState{admitted: admitted, state: http.StateNew, since: time.Now()}
+	c.mu.Unlock()
+	if !admitted {
+		reportLimit(c.metrics, &limits.Error{Limit: limits.MaxConnsPerClient}, fmt.Sprintf("%s with %d connections open", addr, c.conns.Open(addr)))
+	}
+	return admitted
+}
+
+// release stops tracking conn
+func (c *clientConns) release(conn net.Conn) {
+	c.mu.Lock()
+	s, ok := c.open[conn]
+	delete(c.open, conn)
+	c.mu.Unlock()
+	if ok && s.admitted {
+		c.conns.Release(conn.RemoteAddr().String())
+	}
+}
+
+// connState is the ConnState hook of the proxy's http.Servers. A
+// connection that is closed before sending a request, after at least the
+// header timeout, timed out waiting for its request head.
+func (c *clientConns) connState(conn net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		if !c.admit(conn) {
+			conn.Close()
+		}
+	case http.StateClosed:
+		c.mu.Lock()
+		s := c.open[conn]
+		c.mu.Unlock()
+		if s.admitted && s.state == http.StateNew && c.headerTimeout > 0 && time.Since(s.since) >= c.headerTimeout {
+			reportLimit(c.metrics, &limits.Error{Limit: limits.ClientHeader}, conn.RemoteAddr().String())
+		}
+		c.release(conn)
+	case http.StateHijacked:
+		// Counted until the hijacker releases it
+	default:
+		c.mu.Lock()
+		if s, ok := c.open[conn]; ok {
+			s.state = state
+			c.open[conn] = s
+		}
+		c.mu.Unlock()
+	}
+}
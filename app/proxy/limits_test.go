@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"nproxy/app/limits"
+)
+
+func TestMITMProxy_BodyLimits(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		io.WriteString(w, strings.Repeat("x", 100))
+	}))
+	defer target.Close()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Limits.MaxRequestBody = 10
+	p.Limits.MaxResponseBody = 50
+
+	// A request body known to be too big is refused before it is forwarded
+	req := httptest.NewRequest("POST", target.URL, strings.NewReader(strings.Repeat("y", 20)))
+	w := httptest.NewRecorder()
+	p.handleHTTP(w, req, "")
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Request body: expected 413, got %d", w.Code)
+	}
+
+	// A response body known to be too big is answered with a gateway error
+	req = httptest.NewRequest("GET", target.URL, nil)
+	w = httptest.NewRecorder()
+	p.handleHTTP(w, req, "")
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Header().Get("Proxy-Status"), "error=http_response_body_size") {
+		t.Errorf("Response body: expected 502 with error=http_response_body_size, got %d %q", w.Code, w.Header().Get("Proxy-Status"))
+	}
+
+	for _, limit := range []string{limits.MaxRequestBody, limits.MaxResponseBody} {
+		if n := p.Metrics.limitsExceeded.Value(limit); n != 1 {
+			t.Errorf("Expected %s to be exceeded once, got %v", limit, n)
+		}
+	}
+}
+
+func TestMITMProxy_UpstreamHeaderTimeout(t *testing.T) {
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-release
+		}
+		io.WriteString(w, "ok")
+	})
+	target := httptest.NewTLSServer(handler)
+	defer target.Close()
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	defer close(release)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Limits.Upstream.Header = 50 * time.Millisecond
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	// Both forwarded and intercepted requests give up on a silent upstream
+	for _, url := range []string{plain.URL + "/slow", target.URL + "/slow"} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+		resp.Body.Close()
+		status := resp.Header.Get("Proxy-Status")
+		if resp.StatusCode != http.StatusGatewayTimeout || !strings.Contains(status, "error=http_response_timeout") ||
+			!strings.Contains(status, "upstream.header") {
+			t.Errorf("GET %s: expected 504 naming upstream.header, got %d %q", url, resp.StatusCode, status)
+		}
+	}
+	if n := p.Metrics.limitsExceeded.Value(limits.UpstreamHeader); n != 2 {
+		t.Errorf("Expected upstream.header to be exceeded twice, got %v", n)
+	}
+
+	// Upstreams that answer in time are unaffected
+	resp, err := client.Get(target.URL + "/")
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected 200, got %d", resp.StatusCode)
+	}
+}
+
+func TestMITMProxy_InterceptedHeaderLimit(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	defer target.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Limits.MaxHeaderBytes = 1024
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	req, _ := http.NewRequest("GET", target.URL, nil)
+	req.Header.Set("X-Big", strings.Repeat("z", 8192))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("GET: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Errorf("Expected 431, got %d", resp.StatusCode)
+	}
+	if n := p.Metrics.limitsExceeded.Value(limits.MaxHeaderBytes); n != 1 {
+		t.Errorf("Expected max_header_bytes to be exceeded once, got %v", n)
+	}
+}
+
+func TestMITMProxy_MaxConnsPerClient(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Limits.MaxConnsPerClient = 1
+	proxyURL, _ := startServing(t, ctx, p)
+	addr := strings.TrimPrefix(proxyURL, "http://")
+
+	first, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	waitFor(t, "the first connection to be counted", func() bool { return p.plumbing().conns.conns.Open(first.LocalAddr().String()) == 1 })
+
+	// A second connection from the same address is closed straight away
+	second, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer second.Close()
+	second.SetDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected the second connection to be closed, got %v", err)
+	}
+	if n := p.Metrics.limitsExceeded.Value(limits.MaxConnsPerClient); n != 1 {
+		t.Errorf("Expected max_conns_per_client to be exceeded once, got %v", n)
+	}
+
+	// Once the first is closed, the client may connect again
+	first.Close()
+	waitFor(t, "the first connection to be released", func() bool { return p.plumbing().conns.conns.Open(first.LocalAddr().String()) == 0 })
+	third, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer third.Close()
+	io.WriteString(third, "GET http://127.0.0.1:1/ HTTP/1.1\r\nHost: 127.0.0.1:1\r\n\r\n")
+	third.SetDeadline(time.Now().Add(5 * time.Second))
+	if resp, err := http.ReadResponse(bufio.NewReader(third), nil); err != nil {
+		t.Errorf("Expected the third connection to be served, got %v", err)
+	} else {
+		resp.Body.Close()
+	}
+}
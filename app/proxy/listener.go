@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+// sniffTimeout is how long a client has to send its first bytes on the
+// SOCKS and transparent listeners. Clients of protocols where the server
+// speaks first stay silent, so their connections are tunnelled once it has
+// passed.
+const sniffTimeout = 500 * time.Millisecond
+
+// serveListener accepts connections on ln and serves each with handle until
+// ctx is done or the proxy is shut down, when it returns nil. Connections
+// outlive ctx; Shutdown drains them along with the CONNECT tunnels. Clients
+// with max_conns_per_client connections open are turned away.
+func (m *MITMProxy) serveListener(ctx context.Context, ln net.Listener, handle func(context.Context, net.Conn)) error {
+	m.serverMu.Lock()
+	m.listeners = append(m.listeners, ln)
+	m.serverMu.Unlock()
+	stop := context.AfterFunc(ctx, func() { ln.Close() })
+	defer stop()
+
+	connCtx := context.WithoutCancel(ctx)
+	conns := m.plumbing().conns
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if !conns.admit(conn) {
+			conns.release(conn)
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer conns.release(conn)
+			handle(connCtx, conn)
+		}()
+	}
+}
+
+// peekedConn is a connection whose first bytes were read into r while
+// sniffing
+type peekedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newPeekedConn wraps conn with a buffer that holds the largest TLS record,
+// so that a whole ClientHello can be peeked
+func newPeekedConn(conn net.Conn) *peekedConn {
+	return &peekedConn{Conn: conn, r: bufio.NewReaderSize(conn, 5+16<<10)}
+}
+
+func (c *peekedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// httpMethods are the request methods that sniff recognizes
+var httpMethods = map[string]bool{
+	"GET": true, "HEAD": true, "POST": true, "PUT": true, "DELETE": true,
+	"OPTIONS": true, "PATCH": true, "TRACE": true, "CONNECT": true,
+}
+
+// sniff tells from the first bytes the client sends on conn which protocol
+// it speaks: "tls" for a TLS handshake record, "http" for an HTTP/1 request
+// line and "tunnel" for anything else, including silence for sniffTimeout
+func sniff(conn *peekedConn) string {
+	conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	first, err := conn.r.Peek(1)
+	if err != nil {
+		return "tunnel"
+	}
+	if first[0] == 0x16 { // handshake record
+		return "tls"
+	}
+	// The longest methods are 7 letters, followed by a space
+	head, _ := conn.r.Peek(8)
+	if method, _, ok := bytes.Cut(head, []byte(" ")); ok && httpMethods[string(method)] {
+		return "http"
+	}
+	return "tunnel"
+}
+
+// relaySniffed relays between a client and target, the address it is
+// connected to, according to the protocol sniff found: TLS is intercepted
+// with a certificate for the server name in the ClientHello, or host when
+// there is none, HTTP is relayed request by request, and anything else is
+// tunnelled over the connection that opened the tunnel
+func (m *MITMProxy) relaySniffed(ctx context.Context, clientConn *peekedConn, target *tunnelTarget, mode, host string, timings flow.Timings, user string) {
+	// The tunnel is tracked by the connection that the relays read from
+	if !m.tunnels.add(clientConn) {
+		return
+	}
+	defer m.tunnels.remove(clientConn)
+	m.Metrics.tunnelOpened()
+	defer m.Metrics.tunnelClosed()
+
+	switch mode {
+	case "tls":
+		m.interceptTLS(ctx, clientConn, target, host, timings, user)
+	case "http":
+		m.intercept(ctx, clientConn, target, timings, user)
+	default:
+		targetConn := target.take(target.addr)
+		defer targetConn.Close()
+		m.tunnels.attach(clientConn, targetConn)
+		splice(m.Metrics, clientConn, clientConn.r, targetConn, targetConn)
+	}
+}
@@ -0,0 +1,273 @@
+package proxy
+
+import (
+	"errors"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/flow"
+	"nproxy/app/metrics"
+	"nproxy/app/reverse"
+	"nproxy/app/trace"
+)
+
+// Metrics holds the Prometheus collectors exported by the proxy. All methods
+// are safe to call on a nil *Metrics, in which case nothing is recorded.
+type Metrics struct {
+	Registry *metrics.Registry
+
+	requests       *metrics.CounterVec
+	latency        *metrics.HistogramVec
+	tunnels        *metrics.GaugeVec
+	certs          *metrics.CounterVec
+	certDuration   *metrics.HistogramVec
+	upstreamErrors *metrics.CounterVec
+	bytes          *metrics.CounterVec
+	authFailures   *metrics.CounterVec
+	accessDenials  *metrics.CounterVec
+	socksSessions  *metrics.CounterVec
+	transparent    *metrics.CounterVec
+	poolHealth     *metrics.GaugeVec
+	poolActive     *metrics.GaugeVec
+	poolEjections  *metrics.CounterVec
+	retries        *metrics.CounterVec
+	circuitOpens   *metrics.CounterVec
+	limitsExceeded *metrics.CounterVec
+	exporter       atomic.Pointer[trace.Exporter] // whose span counts are exported; nil counts none
+}
+
+// NewMetrics creates the proxy collectors on a fresh registry
+func NewMetrics() *Metrics {
+	reg := metrics.NewRegistry()
+	mt := &Metrics{
+		Registry: reg,
+		requests: metrics.NewCounterVec(reg, "nproxy_requests_total",
+			"Requests handled by the proxy.", "method", "status", "host"),
+		latency: metrics.NewHistogramVec(reg, "nproxy_request_duration_seconds",
+			"Request latency split by phase (dns, connect, tls, ttfb, total).", nil, "phase"),
+		tunnels: metrics.NewGaugeVec(reg, "nproxy_active_tunnels",
+			"CONNECT tunnels currently open."),
+		certs: metrics.NewCounterVec(reg, "nproxy_certificates_generated_total",
+			"Leaf certificates generated for intercepted hosts.", "result"),
+		certDuration: metrics.NewHistogramVec(reg, "nproxy_certificate_generation_seconds",
+			"Time spent generating leaf certificates.", nil),
+		upstreamErrors: metrics.NewCounterVec(reg, "nproxy_upstream_errors_total",
+			"Errors talking to upstream servers by type.", "type"),
+		bytes: metrics.NewCounterVec(reg, "nproxy_bytes_transferred_total",
+			"Body bytes relayed by the proxy.", "direction"),
+		authFailures: metrics.NewCounterVec(reg, "nproxy_auth_failures_total",
+			"Requests refused for missing or invalid proxy credentials.", "reason"),
+		accessDenials: metrics.NewCounterVec(reg, "nproxy_access_denied_total",
+			"Requests refused by the client or destination ACL.", "acl"),
+		socksSessions: metrics.NewCounterVec(reg, "nproxy_socks_sessions_total",
+			"SOCKS sessions by how they were relayed (tls, http, tunnel, udp).", "mode"),
+		transparent: metrics.NewCounterVec(reg, "nproxy_transparent_connections_total",
+			"Redirected connections by how they were relayed (tls, http, tunnel).", "mode"),
+		poolHealth: metrics.NewGaugeVec(reg, "nproxy_upstream_healthy",
+			"Whether a pooled reverse proxy upstream passes its health checks.", "pool", "upstream"),
+		poolActive: metrics.NewGaugeVec(reg, "nproxy_upstream_active_requests",
+			"Requests in progress to a pooled reverse proxy upstream.", "pool", "upstream"),
+		poolEjections: metrics.NewCounterVec(reg, "nproxy_upstream_ejections_total",
+			"Pooled reverse proxy upstreams ejected for failing requests.", "pool", "upstream"),
+		retries: metrics.NewCounterVec(reg, "nproxy_upstream_retries_total",
+			"Upstream requests retried by reason (connect, status).", "reason"),
+		circuitOpens: metrics.NewCounterVec(reg, "nproxy_circuit_breaker_opened_total",
+			"Circuit breakers opened for upstream hosts.", "host"),
+		limitsExceeded: metrics.NewCounterVec(reg, "nproxy_limit_exceeded_total",
+			"Connections and requests stopped by a timeout, size or connection limit.", "limit"),
+	}
+	metrics.NewCounterFunc(reg, "nproxy_trace_spans_exported_total",
+		"Spans accepted by the trace collector.", mt.spanCount((*trace.Exporter).Exported))
+	metrics.NewCounterFunc(reg, "nproxy_trace_spans_dropped_total",
+		"Spans discarded because the export queue was full or the collector rejected them.", mt.spanCount((*trace.Exporter).Dropped))
+	return mt
+}
+
+// ObserveExporter exports the span counts of the trace exporter e
+func (mt *Metrics) ObserveExporter(e *trace.Exporter) {
+	if mt != nil {
+		mt.exporter.Store(e)
+	}
+}
+
+// spanCount returns a function reading a span count of the observed
+// exporter
+func (mt *Metrics) spanCount(count func(*trace.Exporter) uint64) func() float64 {
+	return func() float64 {
+		if e := mt.exporter.Load(); e != nil {
+			return float64(count(e))
+		}
+		return 0
+	}
+}
+
+// observeRequest records a completed request
+func (mt *Metrics) observeRequest(method string, status int, host string, total time.Duration) {
+	if mt == nil {
+		return
+	}
+	mt.requests.Inc(method, strconv.Itoa(status), extractHostname(host))
+	mt.latency.Observe(total.Seconds(), "total")
+}
+
+// observePhases records the non-zero upstream phases of a flow
+func (mt *Metrics) observePhases(t flow.Timings) {
+	if mt == nil {
+		return
+	}
+	for phase, d := range map[string]time.Duration{
+		"dns":     t.DNS,
+		"connect": t.Connect,
+		"tls":     t.TLS,
+		"ttfb":    t.TTFB,
+	} {
+		if d > 0 {
+			mt.latency.Observe(d.Seconds(), phase)
+		}
+	}
+}
+
+// tunnelOpened and tunnelClosed track active CONNECT tunnels
+func (mt *Metrics) tunnelOpened() {
+	if mt != nil {
+		mt.tunnels.Inc()
+	}
+}
+
+func (mt *Metrics) tunnelClosed() {
+	if mt != nil {
+		mt.tunnels.Dec()
+	}
+}
+
+// observeCert records a certificate generation attempt
+func (mt *Metrics) observeCert(d time.Duration, err error) {
+	if mt == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "error"
+	}
+	mt.certs.Inc(result)
+	mt.certDuration.Observe(d.Seconds())
+}
+
+// upstreamError records a failure talking to an upstream server
+func (mt *Metrics) upstreamError(err error) {
+	if mt == nil || err == nil {
+		return
+	}
+	mt.upstreamErrors.Inc(string(ClassifyError(err).Kind))
+}
+
+// addBytes records relayed body bytes; direction is "request" or "response"
+func (mt *Metrics) addBytes(direction string, n int64) {
+	if mt == nil || n <= 0 {
+		return
+	}
+	mt.bytes.Add(float64(n), direction)
+}
+
+// authFailure records a request refused by proxy authentication
+func (mt *Metrics) authFailure(err error) {
+	if mt == nil {
+		return
+	}
+	reason := "invalid"
+	if errors.Is(err, auth.ErrNoCredentials) {
+		reason = "missing"
+	}
+	mt.authFailures.Inc(reason)
+}
+
+// accessDenied records a request refused by an ACL
+func (mt *Metrics) accessDenied(err *acl.DeniedError) {
+	if mt == nil {
+		return
+	}
+	mt.accessDenials.Inc(err.Kind)
+}
+
+// socksSession records a SOCKS session and how it was relayed
+func (mt *Metrics) socksSession(mode string) {
+	if mt != nil {
+		mt.socksSessions.Inc(mode)
+	}
+}
+
+// transparentConnection records a redirected connection and how it was
+// relayed
+func (mt *Metrics) transparentConnection(mode string) {
+	if mt != nil {
+		mt.transparent.Inc(mode)
+	}
+}
+
+// upstreamHealth records whether a pooled upstream is healthy. Upstreams of
+// routes without a pool aren't tracked.
+func (mt *Metrics) upstreamHealth(b *reverse.Backend, healthy bool) {
+	if mt == nil || b.Pool() == "" {
+		return
+	}
+	v := 0.0
+	if healthy {
+		v = 1
+	}
+	mt.poolHealth.Set(v, b.Pool(), b.URL.String())
+}
+
+// upstreamPools records the health of every upstream in pools
+func (mt *Metrics) upstreamPools(pools []reverse.PoolStatus) {
+	if mt == nil {
+		return
+	}
+	for _, p := range pools {
+		for _, u := range p.Upstreams {
+			v := 0.0
+			if u.Healthy {
+				v = 1
+			}
+			mt.poolHealth.Set(v, p.Name, u.URL)
+		}
+	}
+}
+
+// upstreamRequest tracks requests in progress to a pooled upstream; delta
+// is 1 when one starts and -1 when it ends
+func (mt *Metrics) upstreamRequest(b *reverse.Backend, delta float64) {
+	if mt != nil && b.Pool() != "" {
+		mt.poolActive.Add(delta, b.Pool(), b.URL.String())
+	}
+}
+
+// upstreamEjected records the ejection of a pooled upstream
+func (mt *Metrics) upstreamEjected(b *reverse.Backend) {
+	if mt != nil && b.Pool() != "" {
+		mt.poolEjections.Inc(b.Pool(), b.URL.String())
+	}
+}
+
+// retried records a retried upstream request
+func (mt *Metrics) retried(reason string) {
+	if mt != nil {
+		mt.retries.Inc(reason)
+	}
+}
+
+// circuitOpened records the opening of a host's circuit breaker
+func (mt *Metrics) circuitOpened(addr string) {
+	if mt != nil {
+		mt.circuitOpens.Inc(extractHostname(addr))
+	}
+}
+
+// limitExceeded records a connection or request stopped by a limit
+func (mt *Metrics) limitExceeded(limit string) {
+	if mt != nil {
+		mt.limitsExceeded.Inc(limit)
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"nproxy/app/auth"
+	"nproxy/app/flow"
+	"nproxy/app/trace"
+)
+
+func TestMetrics_NilSafe(t *testing.T) {
+	var mt *Metrics
+
+	// None of these may panic on a nil receiver
+	mt.observeRequest("GET", 200, "example.com", 0)
+	mt.observePhases(flow.Timings{})
+	mt.tunnelOpened()
+	mt.tunnelClosed()
+	mt.observeCert(0, nil)
+	mt.upstreamError(errors.New("boom"))
+	mt.addBytes("response", 10)
+	mt.authFailure(auth.ErrNoCredentials)
+	mt.ObserveExporter(nil)
+}
+
+func TestMetrics_TraceSpans(t *testing.T) {
+	mt := NewMetrics()
+	var buf bytes.Buffer
+	mt.Registry.WriteTo(&buf)
+	if !strings.Contains(buf.String(), "nproxy_trace_spans_dropped_total 0\n") {
+		t.Errorf("Expected no dropped spans without an exporter, got:\n%s", buf.String())
+	}
+
+	// Spans exported after shutdown are dropped
+	e := trace.NewExporter("http://127.0.0.1:1/v1/traces", trace.ExporterOptions{})
+	e.Shutdown(context.Background())
+	e.Export(&trace.Span{Name: "late"})
+	mt.ObserveExporter(e)
+	buf.Reset()
+	mt.Registry.WriteTo(&buf)
+	for _, want := range []string{"nproxy_trace_spans_dropped_total 1\n", "nproxy_trace_spans_exported_total 0\n"} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestMITMProxy_HTTPMetrics(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("created"))
+	}))
+	defer targetServer.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("POST", targetServer.URL+"/items", strings.NewReader("payload"))
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, req, "")
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status 201, got %d", w.Code)
+	}
+
+	host := extractHostname(strings.TrimPrefix(targetServer.URL, "http://"))
+	if v := proxy.Metrics.requests.Value("POST", "201", host); v != 1 {
+		t.Errorf("Expected 1 request recorded, got %v", v)
+	}
+	if v := proxy.Metrics.bytes.Value("request"); v != float64(len("payload")) {
+		t.Errorf("Expected %d request bytes, got %v", len("payload"), v)
+	}
+	if v := proxy.Metrics.bytes.Value("response"); v != float64(len("created")) {
+		t.Errorf("Expected %d response bytes, got %v", len("created"), v)
+	}
+	if c := proxy.Metrics.latency.Count("total"); c != 1 {
+		t.Errorf("Expected 1 total latency observation, got %d", c)
+	}
+	if c := proxy.Metrics.latency.Count("connect"); c != 1 {
+		t.Errorf("Expected 1 connect latency observation, got %d", c)
+	}
+
+	var buf bytes.Buffer
+	proxy.Metrics.Registry.WriteTo(&buf)
+	for _, name := range []string{
+		"nproxy_requests_total",
+		"nproxy_request_duration_seconds",
+		"nproxy_active_tunnels",
+		"nproxy_certificates_generated_total",
+		"nproxy_certificate_generation_seconds",
+		"nproxy_upstream_errors_total",
+		"nproxy_bytes_transferred_total",
+		"nproxy_auth_failures_total",
+		"nproxy_access_denied_total",
+		"nproxy_socks_sessions_total",
+		"nproxy_transparent_connections_total",
+		"nproxy_upstream_healthy",
+		"nproxy_upstream_active_requests",
+		"nproxy_upstream_ejections_total",
+		"nproxy_upstream_retries_total",
+		"nproxy_circuit_breaker_opened_total",
+		"nproxy_limit_exceeded_total",
+	} {
+		if !strings.Contains(buf.String(), "# TYPE "+name+" ") {
+			t.Errorf("Metric %s missing from exposition", name)
+		}
+	}
+}
+
+func TestMITMProxy_UpstreamErrorMetrics(t *testing.T) {
+	// Reserve a port and close it so that connections are refused
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://"+addr+"/", nil)
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, req, "")
+
+	if v := proxy.Metrics.upstreamErrors.Value("refused"); v != 1 {
+		t.Errorf("Expected 1 refused error, got %v", v)
+	}
+}
+
+func TestMITMProxy_CertMetrics(t *testing.T) {
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+
+	if _, err := proxy.generateCert("example.com:443"); err != nil {
+		t.Fatalf("Failed to generate certificate: %v", err)
+	}
+
+	if v := proxy.Metrics.certs.Value("success"); v != 1 {
+		t.Errorf("Expected 1 successful certificate, got %v", v)
+	}
+	if c := proxy.Metrics.certDuration.Count(); c != 1 {
+		t.Errorf("Expected 1 duration observation, got %d", c)
+	}
+}
+
+func TestMITMProxy_TunnelMetrics(t *testing.T) {
+	targetServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("secure"))
+	}))
+	defer targetServer.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxy.handleRequest))
+	defer proxyServer.Close()
+
+	client := newProxiedClient(t, proxy, proxyServer.URL)
+	resp, err := client.Get(targetServer.URL + "/secret")
+	if err != nil {
+		t.Fatalf("Failed to send request through proxy: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != "secure" {
+		t.Errorf("Expected body 'secure', got '%s'", body)
+	}
+
+	host := extractHostname(strings.TrimPrefix(targetServer.URL, "https://"))
+	if v := proxy.Metrics.requests.Value("GET", "200", host); v != 1 {
+		t.Errorf("Expected 1 intercepted request recorded, got %v", v)
+	}
+	if c := proxy.Metrics.latency.Count("tls"); c != 1 {
+		t.Errorf("Expected 1 TLS latency observation, got %d", c)
+	}
+	if v := proxy.Metrics.tunnels.Value(); v != 1 {
+		t.Errorf("Expected 1 active tunnel while the client keeps it open, got %v", v)
+	}
+}
@@ -2,32 +2,127 @@ package proxy
 
 import (
 	"bufio"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/breaker"
+	"nproxy/app/cache"
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+	"nproxy/app/hop"
+	"nproxy/app/limits"
+	"nproxy/app/retry"
+	"nproxy/app/reverse"
+	"nproxy/app/trace"
+	"nproxy/app/transport"
+	"nproxy/app/upstream"
 )
 
-// MITMProxy is a structure that holds the configuration for MITM proxy server
+// MITMProxy is a structure that holds the configuration for MITM proxy server.
+// Once it is serving, the fields covered by Settings must only be changed
+// through Reload.
 type MITMProxy struct {
 	CA      *x509.Certificate
 	CAKey   *rsa.PrivateKey
 	CertDir string
 	Addr    string
 	Handler func(*http.Request, *http.Response) // Handler for request/response modification
+	Metrics *Metrics                            // Prometheus collectors; nil disables metrics
+
+	// Responder, when set, is offered every forwarded and intercepted
+	// request before it is sent upstream. The response it returns is relayed
+	// in place of the upstream's; nil sends the request on. With a Responder
+	// CONNECT tunnels are confirmed without dialing their target, which is
+	// dialed for the first request the Responder doesn't answer, so that
+	// hosts that don't exist can be answered too.
+	Responder func(*http.Request) *http.Response
+
+	ServerTiming     bool               // Inject a Server-Timing header with the timing breakdown into responses
+	OnFlow           func(*flow.Flow)   // Called with every completed flow
+	Tracer           *trace.Tracer      // Propagates W3C trace context and exports spans; nil disables tracing
+	Rules            *RuleSet           // Named handlers applied after Handler, toggleable at runtime
+	BodyCaptureLimit int                // Bytes of each request/response body kept on the flow; 0 disables capture
+	LogFilter        *filter.Filter     // Flows whose timing line is logged; nil logs every flow
+	Auth             *auth.Basic        // Credentials clients must present; nil accepts every client
+	Clients          *acl.Clients       // Client addresses allowed to use the proxy; nil allows all
+	Destinations     *acl.Destinations  // Upstream destinations clients may reach; nil allows all
+	Upstream         *upstream.Router   // Picks the upstream proxy for outbound connections; nil connects directly
+	Reverse          *reverse.Table     // Routes requests to ServeReverse listeners; nil routes none
+	Retry            *retry.Policy      // Retries failed upstream requests; nil never retries
+	Breakers         *breaker.Set       // Fails requests to failing upstream hosts fast; nil lets every request through
+	ErrorPages       bool               // Describe upstream failures in HTML or JSON bodies to clients that accept them
+	Via              string             // Pseudonym the proxy adds to the Via header of requests and responses; empty adds none
+	Forwarded        bool               // Describe clients in Forwarded and X-Forwarded-* headers of forwarded and intercepted requests
+	DrainTimeout     time.Duration      // How long Serve waits for in-flight requests and tunnels once its context is done
+	SOCKSUDP         bool               // Relay UDP ASSOCIATE datagrams for SOCKS clients
+	Limits           limits.Limits      // Timeouts and size and connection limits; set before the proxy serves
+	Transport        transport.Settings // Pooling, protocols and TLS of upstream connections; set before the proxy serves
+	Cache            *cache.Cache       // Answers forwarded and intercepted GET requests from stored responses; nil caches nothing
+
+	certMu sync.Mutex
+	certs  map[string]*tls.Certificate // leaf certificates by hostname
+
+	settingsMu sync.RWMutex // guards the reloadable fields against Reload
+
+	serverMu       sync.Mutex
+	server         *http.Server
+	listeners      []net.Listener // SOCKS and transparent listeners, closed by Shutdown
+	reverseServers []*http.Server
+	tunnels        tunnelSet
+
+	plumbOnce sync.Once
+	plumb     *plumbing
+
+	// originalDst stands in for the firewall's record of where redirected
+	// connections were sent in tests; nil asks the connection. Set before
+	// the proxy serves.
+	originalDst func(net.Conn) (netip.AddrPort, error)
 }
 
+// plumbing is what a proxy builds from its Limits and Transport settings
+// the first time it needs them: the pooled transports and the tracker of
+// client connections
+type plumbing struct {
+	forward *forwarder
+	reverse *http.Transport
+	conns   *clientConns
+}
+
+func (m *MITMProxy) plumbing() *plumbing {
+	m.plumbOnce.Do(func() {
+		m.plumb = &plumbing{
+			forward: newForwarder(m.Transport, m.Limits.Upstream),
+			reverse: newReverseTransport(m.Transport, m.Limits.Upstream),
+			conns:   newClientConns(m.Limits, m.Metrics),
+		}
+	})
+	return m.plumb
+}
+
+// DefaultBodyCaptureLimit is the body capture limit set by NewMITMProxy
+const DefaultBodyCaptureLimit = 128 << 10
+
 // NewMITMProxy creates a new MITM proxy
 func NewMITMProxy(addr string) (*MITMProxy, error) {
 	ca, caKey, err := generateCA()
@@ -40,11 +135,19 @@ func NewMITMProxy(addr string) (*MITMProxy, error) {
 		CAKey:   caKey,
 		CertDir: "./certs",
 		Addr:    addr,
+		Metrics: NewMetrics(),
+
+		Rules:            NewRuleSet(),
+		BodyCaptureLimit: DefaultBodyCaptureLimit,
+		DrainTimeout:     DefaultDrainTimeout,
+		Limits:           limits.Default(),
+		Transport:        transport.Default(),
 	}, nil
 }
 
-// Start starts the MITM proxy server
-func (m *MITMProxy) Start() error {
+// Start saves the CA certificate to CertDir and serves on Addr until ctx is
+// done or Shutdown is called. See Serve.
+func (m *MITMProxy) Start(ctx context.Context) error {
 	// Create certificate directory
 	if err := os.MkdirAll(m.CertDir, 0755); err != nil {
 		return fmt.Errorf("failed to create cert directory: %v", err)
@@ -55,30 +158,121 @@ func (m *MITMProxy) Start() error {
 		return fmt.Errorf("failed to save CA: %v", err)
 	}
 
-	server := &http.Server{
-		Addr:    m.Addr,
-		Handler: http.HandlerFunc(m.handleRequest),
+	ln, err := net.Listen("tcp", m.Addr)
+	if err != nil {
+		return err
 	}
 
 	log.Printf("MITM Proxy server starting on %s", m.Addr)
 	log.Printf("CA certificate saved to %s/ca.crt", m.CertDir)
 	log.Println("Install the CA certificate in your browser to avoid SSL warnings")
 
-	return server.ListenAndServe()
+	return m.Serve(ctx, ln)
+}
+
+// Serve accepts proxy connections on ln. When ctx is done the proxy shuts
+// down, giving in-flight requests and tunnels DrainTimeout to finish. Serve
+// returns nil after a shutdown, or context.DeadlineExceeded when the drain
+// exceeded DrainTimeout and the connections still open were closed; an
+// explicit Shutdown makes it return nil as soon as the listener is closed,
+// without waiting for the drain.
+func (m *MITMProxy) Serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: http.HandlerFunc(m.handleRequest)}
+	limitServer(srv, m.Limits, m.plumbing().conns)
+	m.serverMu.Lock()
+	m.server = srv
+	m.serverMu.Unlock()
+
+	return serveContext(ctx, srv, ln, m.DrainTimeout, m.Shutdown)
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests and
+// CONNECT tunnels to finish. Idle keep-alive connections and tunnels are
+// closed at once; whatever is still open when ctx expires is closed
+// forcibly. Then the pooled upstream connections are closed and the
+// tracer's queued spans are exported.
+func (m *MITMProxy) Shutdown(ctx context.Context) error {
+	m.serverMu.Lock()
+	srv, listeners, reverseServers := m.server, m.listeners, m.reverseServers
+	m.listeners = nil
+	m.serverMu.Unlock()
+
+	for _, ln := range listeners {
+		ln.Close()
+	}
+
+	log.Printf("MITM proxy shutting down with %d tunnels open", m.tunnels.len())
+
+	tunnelsErr := make(chan error, 1)
+	go func() { tunnelsErr <- m.tunnels.shutdown(ctx) }()
+	var errs []error
+	if srv != nil {
+		errs = append(errs, shutdownServer(ctx, srv))
+	}
+	for _, rs := range reverseServers {
+		errs = append(errs, shutdownServer(ctx, rs))
+	}
+	m.settingsMu.RLock()
+	m.Reverse.Stop()
+	m.settingsMu.RUnlock()
+	errs = append(errs, <-tunnelsErr)
+	m.plumbing().forward.CloseIdleConnections()
+	m.plumbing().reverse.CloseIdleConnections()
+	return errors.Join(append(errs, m.Tracer.Shutdown(ctx))...)
 }
 
 // handleRequest は HTTP/HTTPS リクエストを処理する
 func (m *MITMProxy) handleRequest(w http.ResponseWriter, r *http.Request) {
+	m.settingsMu.RLock()
+	a, clients, destinations, router := m.Auth, m.Clients, m.Destinations, m.Upstream
+	m.settingsMu.RUnlock()
+
+	if err := clients.CheckRemoteAddr(r.RemoteAddr); err != nil {
+		denyAccess(m.Metrics, w, r, err)
+		return
+	}
+	user, ok := authenticate(a, m.Metrics, w, r)
+	if !ok {
+		return
+	}
+	r = r.WithContext(withUpstream(withDestinations(r.Context(), destinations), router))
 	if r.Method == "CONNECT" {
-		m.handleConnect(w, r)
+		m.handleConnect(w, r, user)
 	} else {
-		m.handleHTTP(w, r)
+		m.handleHTTP(w, r, user)
 	}
 }
 
 // handleConnect は HTTPS CONNECT メソッドを処理する
-func (m *MITMProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
-	log.Printf("CONNECT request to %s", r.Host)
+func (m *MITMProxy) handleConnect(w http.ResponseWriter, r *http.Request, user string) {
+	if u := upstreamFrom(r.Context()).Proxy(r.Host); u != nil {
+		log.Printf("CONNECT request to %s via %s", r.Host, u.Redacted())
+	} else {
+		log.Printf("CONNECT request to %s", r.Host)
+	}
+
+	// ターゲットサーバーへの接続を確立
+	// The target is dialed before the tunnel is confirmed so that a denied
+	// destination gets a 403, unless the Responder may answer the tunnel's
+	// requests without it.
+	var timings flow.Timings
+	var targetConn net.Conn
+	var err error
+	if m.Responder == nil {
+		targetConn, err = m.dialTunnel(r.Context(), r.Host, &timings)
+	}
+	if err != nil {
+		if denyAccess(m.Metrics, w, r, err) {
+			return
+		}
+		log.Printf("Failed to connect to target %s: %v", r.Host, err)
+		reportLimit(m.Metrics, err, "CONNECT "+r.Host)
+		m.Metrics.upstreamError(err)
+		writeGatewayError(w, r, r.Host, err, m.snapshot().errorPages)
+		return
+	}
+	target := newTunnelTarget(r.Host, targetConn)
+	defer target.close()
 
 	// クライアントに接続確立を通知
 	w.WriteHeader(http.StatusOK)
@@ -94,91 +288,173 @@ func (m *MITMProxy) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer clientConn.Close()
+	defer m.plumbing().conns.release(clientConn)
+	// The server's request deadlines don't apply to the tunnel
+	clientConn.SetDeadline(time.Time{})
 
-	// ターゲットサーバーへの接続を確立
-	targetConn, err := net.Dial("tcp", r.Host)
-	if err != nil {
-		log.Printf("Failed to connect to target %s: %v", r.Host, err)
+	if !m.tunnels.add(clientConn) {
 		return
 	}
-	defer targetConn.Close()
+	defer m.tunnels.remove(clientConn)
+	m.Metrics.tunnelOpened()
+	defer m.Metrics.tunnelClosed()
 
-	// サーバー証明書を生成
-	cert, err := m.generateCert(r.Host)
-	if err != nil {
-		log.Printf("Failed to generate certificate for %s: %v", r.Host, err)
-		return
-	}
+	m.interceptTLS(r.Context(), clientConn, target, r.Host, timings, user)
+}
 
+// dialTunnel connects to addr for a tunnel within the upstream dial timeout
+func (m *MITMProxy) dialTunnel(ctx context.Context, addr string, t *flow.Timings) (net.Conn, error) {
+	return dialWithin(ctx, m.Limits.Upstream.Dial, func(ctx context.Context) (net.Conn, error) {
+		return dialTimed(ctx, addr, t)
+	})
+}
+
+// interceptTLS terminates the client's TLS with a certificate for the
+// server name it asks for, or host when it sends none, and intercepts the
+// HTTPS requests it sends to target. ctx carries the destination ACL and
+// upstream router that new connections to target are dialed with.
+func (m *MITMProxy) interceptTLS(ctx context.Context, clientConn net.Conn, target *tunnelTarget, host string, timings flow.Timings, user string) {
 	// クライアント側のTLS接続を確立
+	serverName := extractHostname(host)
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{*cert},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				serverName = hello.ServerName
+			}
+			// サーバー証明書を生成
+			cert, err := m.certFor(serverName)
+			if err != nil {
+				log.Printf("Failed to generate certificate for %s: %v", serverName, err)
+			}
+			return cert, err
+		},
 	}
 	clientTLSConn := tls.Server(clientConn, tlsConfig)
 	defer clientTLSConn.Close()
 
-	// サーバー側のTLS接続を確立
-	serverTLSConn := tls.Client(targetConn, &tls.Config{
-		ServerName:         extractHostname(r.Host),
-		InsecureSkipVerify: true,
-	})
-	defer serverTLSConn.Close()
-
 	// TLS ハンドシェイクを実行
-	if err := clientTLSConn.Handshake(); err != nil {
+	handshake := deadlineAfter(m.Limits.Client.TLSHandshake, limits.ClientTLSHandshake)
+	clientConn.SetDeadline(handshake.at)
+	if err := handshake.wrap(clientTLSConn.Handshake()); err != nil {
 		log.Printf("Client TLS handshake failed: %v", err)
+		reportLimit(m.Metrics, err, clientConn.RemoteAddr().String())
 		return
 	}
-
-	if err := serverTLSConn.Handshake(); err != nil {
-		log.Printf("Server TLS handshake failed: %v", err)
-		return
-	}
+	clientConn.SetDeadline(time.Time{})
 
 	// HTTPS トラフィックを傍受・転送
-	m.interceptHTTPS(clientTLSConn, serverTLSConn)
+	// The server is asked for the same name; the handshake with it happens
+	// when the first request needs a connection
+	target.serverName = serverName
+	m.intercept(ctx, clientTLSConn, target, timings, user)
 }
 
 // handleHTTP は HTTP リクエストを処理する
-func (m *MITMProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
+func (m *MITMProxy) handleHTTP(w http.ResponseWriter, r *http.Request, user string) {
 	log.Printf("HTTP request to %s", r.URL.String())
 
-	// リクエストを改ざんする機会を提供
-	if m.Handler != nil {
-		m.Handler(r, nil)
+	target := func(r *http.Request) string {
+		targetURL := r.URL.String()
+		if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
+			targetURL = "http://" + r.Host + r.RequestURI
+		}
+		return targetURL
 	}
+	m.settingsMu.RLock()
+	transport := m.Cache.Transport(&resilientTransport{base: m.plumbing().forward, policy: m.Retry, breakers: m.Breakers, metrics: m.Metrics})
+	forwarded := m.Forwarded
+	m.settingsMu.RUnlock()
+	var prepare func(*http.Request)
+	if forwarded {
+		prepare = func(req *http.Request) { hop.SetForwarded(req.Header, r) }
+	}
+	m.forward(w, r, user, transport, target, prepare)
+}
+
+// forward relays r to the URL that target returns for it once the handlers
+// have run, and its response back, recording the exchange as a flow.
+// Hop-by-hop headers stay behind, trailers are passed on both ways, and a
+// 101 Switching Protocols response turns the connection into a relay of
+// the upgraded one. prepare, if set, adjusts the request sent on.
+func (m *MITMProxy) forward(w http.ResponseWriter, r *http.Request, user string, transport http.RoundTripper, target func(*http.Request) string, prepare func(*http.Request)) {
+	s := m.snapshot()
+	ft := newFlowTimer()
+	f := flow.New(r.Method, r.URL.String(), r.Host)
+	f.User = user
+	defer func() { m.finishFlow(s, f, ft) }()
+
+	// リクエストを改ざんする機会を提供
+	m.runHandler(s, ft, f, r, nil)
 
 	// ターゲットサーバーにリクエストを転送
-	targetURL := r.URL.String()
-	if !strings.HasPrefix(targetURL, "http://") && !strings.HasPrefix(targetURL, "https://") {
-		targetURL = "http://" + r.Host + r.RequestURI
-	}
+	targetURL := target(r)
+	f.URL = targetURL
+	who := r.Method + " " + targetURL + " from " + r.RemoteAddr
 
-	req, err := http.NewRequest(r.Method, targetURL, r.Body)
+	if exceeds(r.ContentLength, m.Limits.MaxRequestBody) {
+		le := &limits.Error{Limit: limits.MaxRequestBody}
+		reportLimit(m.Metrics, le, who)
+		f.Status, f.Error = writeClientLimit(w, le), le.Error()
+		return
+	}
+	body := io.ReadCloser(http.NoBody)
+	if r.Body != nil {
+		body = limitBody(r.Body, m.Limits.MaxRequestBody, limits.MaxRequestBody, limits.ClientRequest)
+	}
+	reqBody := newCountingReader(body, s.bodyCaptureLimit)
+	ctx, stop := upstreamTimeouts(r.Context(), m.Limits.Upstream)
+	defer stop()
+	ctx = httptrace.WithClientTrace(ctx, ft.trace())
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, reqBody)
 	if err != nil {
+		f.Status, f.Error = http.StatusInternalServerError, err.Error()
 		http.Error(w, "Failed to create request", http.StatusInternalServerError)
 		return
 	}
+	req.ContentLength = r.ContentLength
 
 	// ヘッダーをコピー
-	for key, values := range r.Header {
-		for _, value := range values {
-			req.Header.Add(key, value)
-		}
+	copyRequestHeader(req, r, s.via)
+	if prepare != nil {
+		prepare(req)
 	}
+	m.Tracer.Inject(req.Header, f)
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := m.respond(transport).RoundTrip(req)
+	err = limitCause(ctx, err)
+	ft.add(clientRead, reqBody.duration())
+	m.Metrics.addBytes("request", reqBody.count())
+	captureRequest(f, req.Header, reqBody)
+	if denyAccess(m.Metrics, w, r, err) {
+		f.Status, f.Error = http.StatusForbidden, err.Error()
+		return
+	}
+	if circuitOpen(w, err) {
+		f.Status, f.Error = http.StatusServiceUnavailable, err.Error()
+		return
+	}
+	if le := clientLimit(err); le != nil {
+		reportLimit(m.Metrics, le, who)
+		f.Status, f.Error = writeClientLimit(w, le), le.Error()
+		return
+	}
+	if err == nil && exceeds(resp.ContentLength, m.Limits.MaxResponseBody) {
+		resp.Body.Close()
+		err = &limits.Error{Limit: limits.MaxResponseBody}
+	}
 	if err != nil {
-		http.Error(w, "Failed to forward request", http.StatusInternalServerError)
+		reportLimit(m.Metrics, err, who)
+		m.Metrics.upstreamError(err)
+		gerr := writeGatewayError(w, r, targetURL, err, s.errorPages)
+		f.Status, f.Error = gerr.Status, err.Error()
 		return
 	}
 	defer resp.Body.Close()
+	f.Status = resp.StatusCode
+	stripResponse(resp, s.via)
 
 	// レスポンスを改ざんする機会を提供
-	if m.Handler != nil {
-		m.Handler(r, resp)
-	}
+	m.runHandler(s, ft, f, r, resp)
 
 	// レスポンスヘッダーをコピー
 	for key, values := range resp.Header {
@@ -186,67 +462,404 @@ func (m *MITMProxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
 			w.Header().Add(key, value)
 		}
 	}
+	if s.serverTiming {
+		w.Header().Set("Server-Timing", ft.timings().ServerTiming())
+	}
 
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		captureResponse(f, w.Header(), newCountingReader(http.NoBody, 0))
+		if err := relayUpgrade(w, resp, m.plumbing().conns, &m.tunnels, m.Metrics); err != nil {
+			log.Printf("Failed to relay upgraded connection for %s: %v", who, err)
+			f.Error = err.Error()
+		}
+		return
+	}
+
+	declareTrailers(w, resp)
+	respBody := newCountingReader(limitBody(resp.Body, m.Limits.MaxResponseBody, limits.MaxResponseBody, ""), s.bodyCaptureLimit)
+	ft.measure(bodyTransfer, func() {
+		w.WriteHeader(resp.StatusCode)
+		_, err = io.Copy(w, respBody)
+	})
+	copyTrailers(w, resp)
+	m.Metrics.addBytes("response", respBody.count())
+	captureResponse(f, w.Header(), respBody)
+	if err = limitCause(ctx, err); reportLimit(m.Metrics, err, who) {
+		// The status is out, so the client learns of the cut by the
+		// connection closing
+		f.Error = err.Error()
+		panic(http.ErrAbortHandler)
+	}
 }
 
-// interceptHTTPS は HTTPS トラフィックを傍受する
-func (m *MITMProxy) interceptHTTPS(clientConn, serverConn *tls.Conn) {
-	// クライアントからサーバーへの転送（リクエスト）
-	go func() {
-		defer clientConn.Close()
-		defer serverConn.Close()
+// relayUpgrade answers w with resp, a 101 Switching Protocols response
+// whose header w already has, and relays the upgraded connection until
+// either side closes it. The client connection, which conns counts, is
+// tracked in tunnels meanwhile.
+func relayUpgrade(w http.ResponseWriter, resp *http.Response, conns *clientConns, tunnels *tunnelSet, mt *Metrics) error {
+	upgraded, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		w.Header().Del("Connection")
+		w.Header().Del("Upgrade")
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return errors.New("upgraded connection is not writable")
+	}
+	clientConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		upgraded.Close()
+		return err
+	}
+	defer clientConn.Close()
+	defer conns.release(clientConn)
+	// The server's request deadlines don't apply to the upgraded connection
+	clientConn.SetDeadline(time.Time{})
 
-		reader := bufio.NewReader(clientConn)
-		for {
-			req, err := http.ReadRequest(reader)
-			if err != nil {
-				if err != io.EOF {
-					log.Printf("Error reading HTTPS request: %v", err)
-				}
-				break
-			}
+	head := &http.Response{StatusCode: resp.StatusCode, ProtoMajor: 1, ProtoMinor: 1, Header: w.Header()}
+	if err = head.Write(brw); err == nil {
+		err = brw.Flush()
+	}
+	if err != nil || !tunnels.add(clientConn) {
+		upgraded.Close()
+		return err
+	}
+	defer tunnels.remove(clientConn)
+	tunnels.attach(clientConn, upgraded)
+	splice(mt, clientConn, brw.Reader, upgraded, upgraded)
+	return nil
+}
+
+// intercept relays the HTTP requests on a tunnel to target through the
+// proxy's transport and records each exchange as a flow. clientConn is a
+// *tls.Conn for HTTPS and the plain connection for HTTP. ctx carries the
+// destination ACL and upstream router that new connections to target are
+// dialed with.
+//
+// Requests are relayed one at a time so that every response can be paired
+// with the request that produced it. A 101 Switching Protocols response turns
+// the connection into an opaque bidirectional stream. The tunnel's connection
+// timings are attributed to the first flow only, as with a reused connection.
+// Every flow belongs to the user who authenticated the CONNECT request.
+//
+// The client timeouts bound the wait for each request, the reading of its
+// head and of the whole request; its head and body sizes are limited too.
+// Hop-by-hop headers stay behind in both directions, and a client that
+// expects 100 Continue gets one once the server asks for the body.
+func (m *MITMProxy) intercept(ctx context.Context, clientConn net.Conn, target *tunnelTarget, tunnel flow.Timings, user string) {
+	// The tunnel is tracked by the connection under the TLS layer
+	scheme, tracked := "http", clientConn
+	if tlsConn, ok := clientConn.(*tls.Conn); ok {
+		scheme, tracked = "https", tlsConn.NetConn()
+	}
+	label := strings.ToUpper(scheme)
+	l := m.Limits
+	head := newHeadReader(clientConn, l.MaxHeaderBytes)
+	clientReader := bufio.NewReader(head)
+	who := clientConn.RemoteAddr().String()
 
-			log.Printf("HTTPS request: %s %s", req.Method, req.URL.Path)
+	// Cancelling the requests in flight is how a drain that runs out of
+	// time closes the upstream side of the tunnel
+	ctx, cancel := context.WithCancel(withTunnel(ctx, target))
+	defer cancel()
+	m.tunnels.attach(tracked, closerFunc(cancel))
 
-			// リクエストを改ざんする機会を提供
-			if m.Handler != nil {
-				m.Handler(req, nil)
+	for {
+		// Wait for the next request before starting its clock so that idle
+		// keep-alive time is not counted. Shutdown closes the tunnel while
+		// it is idle, and so does the idle timeout, quietly.
+		if !m.tunnels.idle(tracked) {
+			return
+		}
+		clientConn.SetReadDeadline(deadlineAfter(l.Client.Idle, limits.ClientIdle).at)
+		head.startHead()
+		if _, err := clientReader.Peek(1); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) && !isTimeout(err) {
+				log.Printf("Error reading %s request: %v", label, err)
 			}
+			return
+		}
+		if !m.tunnels.busy(tracked) {
+			return
+		}
 
-			// サーバーにリクエストを転送
-			if err := req.Write(serverConn); err != nil {
-				log.Printf("Error writing HTTPS request: %v", err)
-				break
+		ft := newFlowTimer()
+		ft.t.DNS, ft.t.Connect = tunnel.DNS, tunnel.Connect
+		tunnel = flow.Timings{}
+
+		whole := deadlineAfter(l.Client.Request, limits.ClientRequest)
+		headEnd := earliest(deadlineAfter(l.Client.Header, limits.ClientHeader), whole)
+		clientConn.SetReadDeadline(headEnd.at)
+		var req *http.Request
+		var err error
+		ft.measure(clientRead, func() { req, err = http.ReadRequest(clientReader) })
+		head.endHead()
+		if err != nil {
+			if head.exceeded {
+				err = &limits.Error{Limit: limits.MaxHeaderBytes, Err: err}
+			}
+			err = headEnd.wrap(err)
+			log.Printf("Error reading %s request: %v", label, err)
+			if le := clientLimit(err); le != nil {
+				reportLimit(m.Metrics, le, who)
+				writeClientLimitResponse(clientConn, nil, le)
 			}
+			return
+		}
+		clientConn.SetReadDeadline(whole.at)
+		if exceeds(req.ContentLength, l.MaxRequestBody) {
+			le := &limits.Error{Limit: limits.MaxRequestBody}
+			reportLimit(m.Metrics, le, who)
+			writeClientLimitResponse(clientConn, req, le)
+			return
+		}
+		if req.Body != http.NoBody {
+			req.Body = limitBody(req.Body, l.MaxRequestBody, limits.MaxRequestBody, whole.limit)
+			if expectsContinue(req) {
+				req.Body = newContinueReader(req.Body, clientConn)
+			}
+		}
+		req.RemoteAddr = who
+		if tlsConn, ok := clientConn.(*tls.Conn); ok {
+			state := tlsConn.ConnectionState()
+			req.TLS = &state
 		}
-	}()
 
-	// サーバーからクライアントへの転送（レスポンス）
-	reader := bufio.NewReader(serverConn)
-	for {
-		resp, err := http.ReadResponse(reader, nil)
+		log.Printf("%s request: %s %s", label, req.Method, req.URL.Path)
+		f := flow.New(req.Method, scheme+"://"+req.Host+req.URL.RequestURI(), req.Host)
+		f.Start = ft.start
+		f.User = user
+
+		s := m.snapshot()
+		resp, err := m.exchange(ctx, s, ft, f, req, scheme, target, clientConn)
+		m.finishFlow(s, f, ft)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("Error reading HTTPS response: %v", err)
+			log.Printf("Error relaying %s exchange: %v", label, err)
+			return
+		}
+		clientConn.SetReadDeadline(time.Time{})
+
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			if upgraded, ok := resp.Body.(io.ReadWriteCloser); ok {
+				splice(m.Metrics, clientConn, clientReader, upgraded, upgraded)
+			} else {
+				resp.Body.Close()
 			}
-			break
+			return
+		}
+		if c, ok := req.Body.(*continueReader); ok && !c.stop() {
+			// The client still holds the body that the server didn't ask for
+			return
+		}
+		if req.Close {
+			return
+		}
+	}
+}
+
+// closerFunc adapts a function to io.Closer
+type closerFunc func()
+
+func (f closerFunc) Close() error {
+	f()
+	return nil
+}
+
+// upstreamFailed records a failure to relay req upstream and answers the
+// client on clientConn with a gateway error in its place. A failure caused
+// by the client running into a limit is answered with a client error.
+func (m *MITMProxy) upstreamFailed(s *flowSettings, f *flow.Flow, req *http.Request, clientConn net.Conn, err error) error {
+	reportLimit(m.Metrics, err, req.Method+" "+f.URL+" from "+clientConn.RemoteAddr().String())
+	if le := clientLimit(err); le != nil {
+		f.Status, f.Error = writeClientLimitResponse(clientConn, req, le), err.Error()
+		return err
+	}
+	if open := openCircuit(err); open != nil {
+		f.Status, f.Error = writeCircuitOpenResponse(clientConn, req, open), err.Error()
+		return err
+	}
+	m.Metrics.upstreamError(err)
+	gerr := writeGatewayResponse(clientConn, req, f.URL, err, s.errorPages)
+	f.Status, f.Error = gerr.Status, err.Error()
+	return err
+}
+
+// exchange relays one request intercepted on a tunnel to target with the
+// given scheme through the proxy's transport, and its response back to the
+// client, filling in f and ft as it goes. The upstream timeouts bound the
+// wait for the response head and the exchange as a whole. The body of a
+// 101 Switching Protocols response is left open for the caller to splice.
+func (m *MITMProxy) exchange(ctx context.Context, s *flowSettings, ft *flowTimer, f *flow.Flow, req *http.Request, scheme string, target *tunnelTarget, clientConn net.Conn) (*http.Response, error) {
+	// リクエストを改ざんする機会を提供
+	m.runHandler(s, ft, f, req, nil)
+	m.Tracer.Inject(req.Header, f)
+
+	// サーバーにリクエストを転送
+	// The request goes to the tunnel's address whatever its Host header says
+	ctx, stop := upstreamTimeouts(ctx, m.Limits.Upstream)
+	defer stop()
+	reqBody := newCountingReader(req.Body, s.bodyCaptureLimit)
+	out := req.WithContext(httptrace.WithClientTrace(ctx, ft.trace()))
+	out.RequestURI = ""
+	out.URL.Scheme, out.URL.Host = scheme, target.addr
+	// Whether the client keeps its connection open is no concern of the
+	// pooled upstream one
+	out.Close = false
+	stripRequest(out, req, s.via)
+	if s.forwarded {
+		hop.SetForwarded(out.Header, req)
+	}
+	if req.Body != http.NoBody {
+		out.Body = reqBody
+	}
+	var transport http.RoundTripper = &resilientTransport{base: m.plumbing().forward, policy: s.retry, breakers: s.breakers, metrics: m.Metrics}
+	if target.names(req.Host, scheme) {
+		// Cached under its Host header, which could otherwise name a server
+		// other than the one that answered
+		transport = m.Cache.Transport(transport)
+	}
+	resp, err := m.respond(transport).RoundTrip(out)
+	if c, ok := req.Body.(*continueReader); ok {
+		// Whatever is written to the client from now on is the response
+		c.stop()
+	}
+	err = limitCause(ctx, err)
+	ft.add(clientRead, reqBody.duration())
+	m.Metrics.addBytes("request", reqBody.count())
+	captureRequest(f, req.Header, reqBody)
+	if err == nil && exceeds(resp.ContentLength, m.Limits.MaxResponseBody) {
+		resp.Body.Close()
+		err = &limits.Error{Limit: limits.MaxResponseBody}
+	}
+	if err != nil {
+		return nil, m.upstreamFailed(s, f, req, clientConn, err)
+	}
+	f.Status = resp.StatusCode
+	stripResponse(resp, s.via)
+	// The client's connection stays open unless the client closes it
+	resp.Close = req.Close
+	asHTTP1(resp)
+
+	log.Printf("Response from %s: %d", f.Host, resp.StatusCode)
+
+	// レスポンスを改ざんする機会を提供
+	m.runHandler(s, ft, f, nil, resp)
+
+	if s.serverTiming {
+		resp.Header.Set("Server-Timing", ft.timings().ServerTiming())
+	}
+
+	// クライアントにレスポンスを転送
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if _, ok := resp.Body.(io.ReadWriteCloser); !ok {
+			// Made up by a Responder or handler rather than switched to by
+			// the server
+			resp.Body.Close()
+			return nil, m.upstreamFailed(s, f, req, clientConn, errors.New("upgraded connection is not writable"))
 		}
+		head := *resp
+		head.Body = nil
+		err = head.Write(clientConn)
+		captureResponse(f, resp.Header, newCountingReader(http.NoBody, 0))
+		if err != nil {
+			resp.Body.Close()
+			f.Error = err.Error()
+			return nil, err
+		}
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	respBody := newCountingReader(limitBody(resp.Body, m.Limits.MaxResponseBody, limits.MaxResponseBody, ""), s.bodyCaptureLimit)
+	resp.Body = respBody
+	ft.measure(bodyTransfer, func() { err = resp.Write(clientConn) })
+	m.Metrics.addBytes("response", respBody.count())
+	captureResponse(f, resp.Header, respBody)
+	if err = limitCause(ctx, err); err != nil {
+		reportLimit(m.Metrics, err, req.Method+" "+f.URL)
+		f.Error = err.Error()
+		return nil, err
+	}
+	return resp, nil
+}
 
-		log.Printf("HTTPS response: %d", resp.StatusCode)
+// asHTTP1 makes resp, which may have come over HTTP/2, fit to be written to
+// an HTTP/1.1 client: a body of unknown length is sent chunked rather than
+// by closing the connection
+func asHTTP1(resp *http.Response) {
+	if resp.ProtoMajor == 1 {
+		return
+	}
+	resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+}
 
-		// レスポンスを改ざんする機会を提供
+// runHandler invokes the modification handler and the enabled rules whose
+// filters match f, and records the time spent as handler time. The headers
+// seen so far are put on f first so that rule filters can test them.
+func (m *MITMProxy) runHandler(s *flowSettings, ft *flowTimer, f *flow.Flow, req *http.Request, resp *http.Response) {
+	if resp != nil {
+		f.ResponseHeader = resp.Header
+	} else if req != nil {
+		f.RequestHeader = req.Header
+	}
+	ft.measure(handlerTime, func() {
 		if m.Handler != nil {
-			m.Handler(nil, resp)
+			m.Handler(req, resp)
 		}
+		applyRules(s.rules, f, req, resp)
+	})
+}
+
+// captureRequest records the request as sent upstream on f
+func captureRequest(f *flow.Flow, h http.Header, body *countingReader) {
+	f.RequestHeader = h.Clone()
+	f.RequestSize = body.count()
+	f.RequestBody, f.RequestTruncated = body.captured()
+}
+
+// captureResponse records the response as returned to the client on f
+func captureResponse(f *flow.Flow, h http.Header, body *countingReader) {
+	f.ResponseHeader = h.Clone()
+	f.ResponseSize = body.count()
+	f.ResponseBody, f.ResponseTruncated = body.captured()
+}
 
-		// クライアントにレスポンスを転送
-		if err := resp.Write(clientConn); err != nil {
-			log.Printf("Error writing HTTPS response: %v", err)
-			break
+// finishFlow stamps the final timings on f, then logs, records and publishes it
+func (m *MITMProxy) finishFlow(s *flowSettings, f *flow.Flow, ft *flowTimer) {
+	f.Timings = ft.timings()
+	if s.logFilter.Match(f) {
+		if f.User != "" {
+			log.Printf("Timing %s %s %d (user %s): %s", f.Method, f.URL, f.Status, f.User, f.Timings)
+		} else {
+			log.Printf("Timing %s %s %d: %s", f.Method, f.URL, f.Status, f.Timings)
 		}
 	}
+
+	m.Metrics.observePhases(f.Timings)
+	m.Metrics.observeRequest(f.Method, f.Status, f.Host, f.Timings.Total)
+	m.Tracer.Finish(f)
+
+	if m.OnFlow != nil {
+		m.OnFlow(f)
+	}
+}
+
+// splice copies bytes in both directions until either side closes. Data
+// already buffered by the readers is forwarded first. The bytes relayed are
+// counted in mt.
+func splice(mt *Metrics, clientConn net.Conn, clientReader io.Reader, serverConn io.WriteCloser, serverReader io.Reader) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst io.WriteCloser, src io.Reader, direction string) {
+		n, _ := io.Copy(dst, src)
+		mt.addBytes(direction, n)
+		dst.Close()
+		done <- struct{}{}
+	}
+
+	go pipe(serverConn, clientReader, "request")
+	go pipe(clientConn, serverReader, "response")
+	<-done
+	<-done
 }
 
 // generateCA は CA証明書と秘密鍵を生成する
@@ -291,8 +904,64 @@ func generateCA() (*x509.Certificate, *rsa.PrivateKey, error) {
 	return cert, key, nil
 }
 
+// certFor returns the cached leaf certificate for host, generating it on
+// first use
+func (m *MITMProxy) certFor(host string) (*tls.Certificate, error) {
+	hostname := extractHostname(host)
+
+	m.certMu.Lock()
+	cert, ok := m.certs[hostname]
+	m.certMu.Unlock()
+	if ok {
+		return cert, nil
+	}
+
+	// Generate without holding the lock so that tunnels to other hosts are
+	// not serialised behind key generation
+	cert, err := m.generateCert(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	m.certMu.Lock()
+	defer m.certMu.Unlock()
+	if existing, ok := m.certs[hostname]; ok {
+		return existing, nil
+	}
+	if m.certs == nil {
+		m.certs = make(map[string]*tls.Certificate)
+	}
+	m.certs[hostname] = cert
+	return cert, nil
+}
+
+// ClearCertCache drops every cached leaf certificate and returns how many
+// there were
+func (m *MITMProxy) ClearCertCache() int {
+	m.certMu.Lock()
+	defer m.certMu.Unlock()
+	n := len(m.certs)
+	m.certs = nil
+	return n
+}
+
+// CachedCerts returns the number of cached leaf certificates
+func (m *MITMProxy) CachedCerts() int {
+	m.certMu.Lock()
+	defer m.certMu.Unlock()
+	return len(m.certs)
+}
+
 // generateCert は指定されたホスト名用のサーバー証明書を生成する
 func (m *MITMProxy) generateCert(host string) (*tls.Certificate, error) {
+	start := time.Now()
+	cert, err := m.signCert(host)
+	m.Metrics.observeCert(time.Since(start), err)
+	return cert, err
+}
+
+// signCert creates a leaf certificate for host signed by the proxy CA
+func (m *MITMProxy) signCert(host string) (*tls.Certificate, error) {
 	// RSA秘密鍵を生成
 	key, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
@@ -344,18 +1013,102 @@ func (m *MITMProxy) generateCert(host string) (*tls.Certificate, error) {
 // saveCA は CA証明書をファイルに保存する
 func (m *MITMProxy) saveCA() error {
 	// CA証明書をPEM形式で保存
-	certFile, err := os.Create(fmt.Sprintf("%s/ca.crt", m.CertDir))
+	return os.WriteFile(fmt.Sprintf("%s/ca.crt", m.CertDir), m.CAPEM(), 0644)
+}
+
+// UseCAFiles loads the CA certificate and key from certFile and keyFile.
+// When neither file exists the proxy's current CA is written there instead,
+// so clients that trust it keep working across restarts.
+func (m *MITMProxy) UseCAFiles(certFile, keyFile string) error {
+	certPEM, certErr := os.ReadFile(certFile)
+	keyPEM, keyErr := os.ReadFile(keyFile)
+	if errors.Is(certErr, os.ErrNotExist) && errors.Is(keyErr, os.ErrNotExist) {
+		return m.writeCAFiles(certFile, keyFile)
+	}
+	if certErr != nil {
+		return fmt.Errorf("failed to read CA certificate: %v", certErr)
+	}
+	if keyErr != nil {
+		return fmt.Errorf("failed to read CA key: %v", keyErr)
+	}
+
+	ca, caKey, err := parseCA(certPEM, keyPEM)
 	if err != nil {
 		return err
 	}
-	defer certFile.Close()
+	m.CA, m.CAKey = ca, caKey
+	m.ClearCertCache()
+	return nil
+}
+
+func (m *MITMProxy) writeCAFiles(certFile, keyFile string) error {
+	keyDER, err := x509.MarshalPKCS8PrivateKey(m.CAKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode CA key: %v", err)
+	}
+	for _, dir := range []string{filepath.Dir(certFile), filepath.Dir(keyFile)} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create CA directory: %v", err)
+		}
+	}
+	if err := os.WriteFile(certFile, m.CAPEM(), 0644); err != nil {
+		return fmt.Errorf("failed to write CA certificate: %v", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(keyFile, keyPEM, 0600); err != nil {
+		return fmt.Errorf("failed to write CA key: %v", err)
+	}
+	return nil
+}
+
+// parseCA decodes a PEM CA certificate and its RSA key in PKCS #1 or
+// PKCS #8 form
+func parseCA(certPEM, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil || certBlock.Type != "CERTIFICATE" {
+		return nil, nil, errors.New("CA certificate file contains no PEM certificate")
+	}
+	ca, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA certificate: %v", err)
+	}
+
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, errors.New("CA key file contains no PEM key")
+	}
+	var key any
+	if keyBlock.Type == "RSA PRIVATE KEY" {
+		key, err = x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	} else {
+		key, err = x509.ParsePKCS8PrivateKey(keyBlock.Bytes)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse CA key: %v", err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("CA key is not an RSA key")
+	}
+	if !rsaKey.PublicKey.Equal(ca.PublicKey) {
+		return nil, nil, errors.New("CA key does not match the CA certificate")
+	}
+	return ca, rsaKey, nil
+}
 
-	return pem.Encode(certFile, &pem.Block{
+// CAPEM returns the CA certificate in PEM format
+func (m *MITMProxy) CAPEM() []byte {
+	return pem.EncodeToMemory(&pem.Block{
 		Type:  "CERTIFICATE",
 		Bytes: m.CA.Raw,
 	})
 }
 
+// ActiveTunnels returns the number of CONNECT tunnels currently open
+func (m *MITMProxy) ActiveTunnels() int64 {
+	return int64(m.tunnels.len())
+}
+
 // extractHostname はホスト:ポート形式からホスト名を抽出する
 func extractHostname(host string) string {
 	hostname, _, err := net.SplitHostPort(host)
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
 	"io"
 	"net/http"
@@ -8,8 +9,14 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"nproxy/app/cache"
+	"nproxy/app/flow"
+	"nproxy/app/trace"
 )
 
 func TestNewMITMProxy(t *testing.T) {
@@ -105,7 +112,7 @@ func TestMITMProxy_HandleHTTP(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	// Process HTTP request
-	proxy.handleHTTP(w, req)
+	proxy.handleHTTP(w, req, "")
 
 	// Verify response
 	if w.Code != http.StatusOK {
@@ -153,7 +160,7 @@ func TestMITMProxy_HandleConnect(t *testing.T) {
 	w := httptest.NewRecorder()
 
 	// Process CONNECT method
-	proxy.handleConnect(w, req)
+	proxy.handleConnect(w, req, "")
 
 	// Verify response status (status until connection is established)
 	if w.Code != http.StatusOK {
@@ -416,7 +423,7 @@ func BenchmarkMITMProxy_HandleHTTP(b *testing.B) {
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		w := httptest.NewRecorder()
-		proxy.handleHTTP(w, req)
+		proxy.handleHTTP(w, req, "")
 	}
 }
 
@@ -463,10 +470,10 @@ func TestMITMProxy_ErrorHandling(t *testing.T) {
 	req := httptest.NewRequest("GET", "http://nonexistent-host.local/test", nil)
 	w := httptest.NewRecorder()
 
-	proxy.handleHTTP(w, req)
+	proxy.handleHTTP(w, req, "")
 
-	if w.Code != http.StatusInternalServerError {
-		t.Logf("Error handling test: got status %d", w.Code)
+	if w.Code != http.StatusBadGateway || !strings.Contains(w.Header().Get("Proxy-Status"), "error=dns_error") {
+		t.Errorf("Expected 502 with a dns_error Proxy-Status, got %d %q", w.Code, w.Header().Get("Proxy-Status"))
 	}
 
 	// Test CONNECT request with invalid host
@@ -474,7 +481,352 @@ func TestMITMProxy_ErrorHandling(t *testing.T) {
 	connectReq.Host = "nonexistent-host.local:443"
 	connectW := httptest.NewRecorder()
 
-	proxy.handleConnect(connectW, connectReq)
+	proxy.handleConnect(connectW, connectReq, "")
 
 	t.Log("Error handling tests completed")
 }
+
+func TestMITMProxy_TracePropagation(t *testing.T) {
+	var upstreamTraceParent string
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamTraceParent = r.Header.Get("traceparent")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer targetServer.Close()
+
+	var exported int
+	var mu sync.Mutex
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		exported++
+	}))
+	defer collector.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	exporter := trace.NewExporter(collector.URL+"/v1/traces", trace.ExporterOptions{})
+	proxy.Tracer = trace.NewTracer(exporter)
+
+	req := httptest.NewRequest("GET", targetServer.URL, nil)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, req, "")
+
+	sc, err := trace.ParseTraceParent(upstreamTraceParent)
+	if err != nil {
+		t.Fatalf("Upstream received invalid traceparent %q: %v", upstreamTraceParent, err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected trace to be continued, got trace ID %s", sc.TraceID)
+	}
+	if sc.SpanID.String() == "00f067aa0ba902b7" {
+		t.Error("Expected the proxy to insert its own span")
+	}
+
+	if err := exporter.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Failed to shut down exporter: %v", err)
+	}
+	if exporter.Exported() != 1 {
+		t.Errorf("Expected 1 exported span, got %d", exporter.Exported())
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if exported != 1 {
+		t.Errorf("Expected 1 export request at the collector, got %d", exported)
+	}
+}
+
+func TestMITMProxy_CertCache(t *testing.T) {
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+
+	first, err := proxy.certFor("example.com:443")
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+	second, err := proxy.certFor("example.com:8443")
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+
+	if first != second {
+		t.Error("Expected the certificate to be reused for the same hostname")
+	}
+	if proxy.CachedCerts() != 1 {
+		t.Errorf("Expected 1 cached certificate, got %d", proxy.CachedCerts())
+	}
+	if v := proxy.Metrics.certs.Value("success"); v != 1 {
+		t.Errorf("Expected 1 generated certificate, got %v", v)
+	}
+
+	if n := proxy.ClearCertCache(); n != 1 {
+		t.Errorf("Expected ClearCertCache to report 1, got %d", n)
+	}
+	third, err := proxy.certFor("example.com:443")
+	if err != nil {
+		t.Fatalf("Failed to get certificate: %v", err)
+	}
+	if third == first {
+		t.Error("Expected a fresh certificate after clearing the cache")
+	}
+}
+
+func TestMITMProxy_UseCAFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := dir+"/ca/ca.crt", dir+"/ca/ca.key"
+
+	first, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	if err := first.UseCAFiles(certFile, keyFile); err != nil {
+		t.Fatalf("Failed to create CA files: %v", err)
+	}
+	if info, err := os.Stat(keyFile); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("Expected a private key file with mode 0600, got %v", info.Mode())
+	}
+
+	second, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	if err := second.UseCAFiles(certFile, keyFile); err != nil {
+		t.Fatalf("Failed to load CA files: %v", err)
+	}
+	if !second.CA.Equal(first.CA) || !second.CAKey.Equal(first.CAKey) {
+		t.Error("Expected the second proxy to load the first proxy's CA")
+	}
+
+	// A key that doesn't belong to the certificate is rejected
+	other, _ := NewMITMProxy(":0")
+	otherKey := dir + "/other.key"
+	other.UseCAFiles(dir+"/other.crt", otherKey)
+	if err := second.UseCAFiles(certFile, otherKey); err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("Expected a key mismatch error, got %v", err)
+	}
+
+	os.Remove(keyFile)
+	if err := second.UseCAFiles(certFile, keyFile); err == nil {
+		t.Error("Expected an error when only the certificate exists")
+	}
+}
+
+func TestMITMProxy_FlowCapture(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("response body"))
+	}))
+	defer targetServer.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	proxy.BodyCaptureLimit = 8
+	proxy.Rules.Add("tag", func(req *http.Request, resp *http.Response) {
+		if req != nil {
+			req.Header.Set("X-Rule", "applied")
+		}
+	})
+
+	var captured *flow.Flow
+	proxy.OnFlow = func(f *flow.Flow) { captured = f }
+
+	req := httptest.NewRequest("POST", targetServer.URL, strings.NewReader("request"))
+	proxy.handleHTTP(httptest.NewRecorder(), req, "")
+
+	if captured == nil {
+		t.Fatal("Expected a flow to be published")
+	}
+	if captured.RequestHeader.Get("X-Rule") != "applied" {
+		t.Error("Expected rule modifications in the captured request headers")
+	}
+	if string(captured.RequestBody) != "request" || captured.RequestTruncated || captured.RequestSize != 7 {
+		t.Errorf("Unexpected request capture: %q truncated=%v size=%d",
+			captured.RequestBody, captured.RequestTruncated, captured.RequestSize)
+	}
+	if string(captured.ResponseBody) != "response" || !captured.ResponseTruncated || captured.ResponseSize != 13 {
+		t.Errorf("Unexpected response capture: %q truncated=%v size=%d",
+			captured.ResponseBody, captured.ResponseTruncated, captured.ResponseSize)
+	}
+	if captured.ContentType() != "text/plain" {
+		t.Errorf("Expected captured content type text/plain, got %q", captured.ContentType())
+	}
+}
+
+func TestMITMProxy_Responder(t *testing.T) {
+	targetServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	defer targetServer.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	var flows []*flow.Flow
+	var mu sync.Mutex
+	proxy.OnFlow = func(f *flow.Flow) {
+		mu.Lock()
+		flows = append(flows, f)
+		mu.Unlock()
+	}
+	proxy.Responder = func(req *http.Request) *http.Response {
+		if req.URL.Hostname() != "stub.invalid" {
+			return nil
+		}
+		body, _ := io.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Header:     http.Header{"X-Stub": {"1"}},
+			Body:       io.NopCloser(strings.NewReader("stub " + string(body))),
+		}
+	}
+	proxyURL, _ := startServing(t, ctx, proxy)
+	client := newProxiedClient(t, proxy, proxyURL)
+
+	// A host that doesn't exist is answered, intercepted or not
+	for _, u := range []string{"https://stub.invalid/a", "http://stub.invalid/b"} {
+		resp, err := client.Post(u, "text/plain", strings.NewReader("hi"))
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", u, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusCreated || resp.Header.Get("X-Stub") != "1" || string(body) != "stub hi" {
+			t.Errorf("Expected the responder's answer for %s, got %d %v %q", u, resp.StatusCode, resp.Header, body)
+		}
+	}
+
+	// Requests it doesn't answer go upstream
+	resp, err := client.Get(targetServer.URL)
+	if err != nil {
+		t.Fatalf("Request upstream failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "upstream" {
+		t.Errorf("Expected the upstream's answer, got %q", body)
+	}
+
+	waitFor(t, "the flows", func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(flows) == 3
+	})
+	if f := flows[0]; f.URL != "https://stub.invalid/a" || f.Status != http.StatusCreated || string(f.RequestBody) != "hi" || string(f.ResponseBody) != "stub hi" {
+		t.Errorf("Expected the answered request to be recorded as a flow, got %+v", f)
+	}
+}
+
+func TestMITMProxy_Cache(t *testing.T) {
+	var requests atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("cached"))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	if proxy.Cache, err = cache.New(cache.Default()); err != nil {
+		t.Fatalf("Failed to create cache: %v", err)
+	}
+	proxyURL, _ := startServing(t, ctx, proxy)
+	client := newProxiedClient(t, proxy, proxyURL)
+
+	// Forwarded and intercepted requests are both answered from the cache
+	for _, u := range []string{plain.URL + "/a", secure.URL + "/a"} {
+		for i, want := range []string{cache.Miss, cache.Hit} {
+			resp, err := client.Get(u)
+			if err != nil {
+				t.Fatalf("Request to %s failed: %v", u, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if got := resp.Header.Get("X-Cache"); got != want || string(body) != "cached" {
+				t.Errorf("Expected request %d to %s to be a %s, got %s %q", i, u, want, got, body)
+			}
+		}
+	}
+	if n := requests.Load(); n != 2 {
+		t.Errorf("Expected 2 requests to reach the servers, got %d", n)
+	}
+
+	// A request sent over a tunnel to another server with the Host header
+	// of secure must not be stored for secure
+	other := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("poisoned"))
+	}))
+	defer other.Close()
+	req, _ := http.NewRequest("GET", other.URL+"/b", nil)
+	req.Host = secure.Listener.Addr().String()
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Request to %s failed: %v", other.URL, err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Cache"); got != "" {
+		t.Errorf("Expected a request naming another server to bypass the cache, got X-Cache %s", got)
+	}
+	resp, err = client.Get(secure.URL + "/b")
+	if err != nil {
+		t.Fatalf("Request to %s failed: %v", secure.URL, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got := resp.Header.Get("X-Cache"); got != cache.Miss || string(body) != "cached" {
+		t.Errorf("Expected a miss answered by the server, got %s %q", got, body)
+	}
+}
+
+func TestMITMProxy_ResponderUpgrade(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	// A made-up 101 has no connection to switch to
+	proxy.Responder = func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusSwitchingProtocols,
+			Header:     http.Header{"Connection": {"Upgrade"}, "Upgrade": {"websocket"}},
+			Body:       io.NopCloser(strings.NewReader("")),
+		}
+	}
+	proxyURL, _ := startServing(t, ctx, proxy)
+	client := newProxiedClient(t, proxy, proxyURL)
+
+	for _, u := range []string{"https://stub.invalid/ws", "http://stub.invalid/ws"} {
+		req, _ := http.NewRequest("GET", u, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("Request to %s failed: %v", u, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("Expected 502 for %s, got %d", u, resp.StatusCode)
+		}
+	}
+}
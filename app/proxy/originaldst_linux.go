@@ -0,0 +1,57 @@
+//go:build linux
+
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"syscall"
+)
+
+// soOriginalDst is SO_ORIGINAL_DST, and IP6T_SO_ORIGINAL_DST at the IPv6
+// level, from linux/netfilter_ipv4.h
+const soOriginalDst = 80
+
+// natDestination returns the address a connection redirected with
+// iptables REDIRECT or DNAT was sent to, as recorded by connection tracking
+func natDestination(conn net.Conn) (netip.AddrPort, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return netip.AddrPort{}, errors.New("not a socket")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+
+	var dst netip.AddrPort
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.Addr().Is4() || local.Addr().Is4In6() {
+			// sockaddr_in fits in the 20 bytes of an ipv6_mreq
+			var mreq *syscall.IPv6Mreq
+			if mreq, sockErr = syscall.GetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IP, soOriginalDst); sockErr == nil {
+				sa := mreq.Multiaddr
+				dst = netip.AddrPortFrom(netip.AddrFrom4([4]byte(sa[4:8])), binary.BigEndian.Uint16(sa[2:4]))
+			}
+			return
+		}
+		// sockaddr_in6 is the first member of an ip6_mtuinfo
+		var info *syscall.IPv6MTUInfo
+		if info, sockErr = syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.IPPROTO_IPV6, soOriginalDst); sockErr == nil {
+			var port [2]byte
+			binary.NativeEndian.PutUint16(port[:], info.Addr.Port)
+			dst = netip.AddrPortFrom(netip.AddrFrom16(info.Addr.Addr), binary.BigEndian.Uint16(port[:]))
+		}
+	})
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	if sockErr != nil {
+		return netip.AddrPort{}, sockErr
+	}
+	return dst, nil
+}
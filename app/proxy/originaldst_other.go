@@ -0,0 +1,15 @@
+//go:build !linux
+
+package proxy
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+)
+
+// natDestination is only supported on Linux; elsewhere the original
+// destination must be kept as the local address, as TPROXY does
+func natDestination(conn net.Conn) (netip.AddrPort, error) {
+	return netip.AddrPort{}, errors.ErrUnsupported
+}
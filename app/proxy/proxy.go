@@ -1,72 +1,304 @@
 package proxy
 
 import (
+	"context"
+	"errors"
 	"io"
 	"log"
+	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/breaker"
+	"nproxy/app/cache"
+	"nproxy/app/flow"
+	"nproxy/app/hop"
+	"nproxy/app/limits"
+	"nproxy/app/retry"
+	"nproxy/app/transport"
+	"nproxy/app/upstream"
 )
 
-func Start(addr string) error {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		log.Println("addr: ", addr)
-		log.Println("Request from client: ", r)
-
-		// For proxy requests, use the original request URL
-		var targetURL string
-		if r.URL.IsAbs() {
-			// This is a proper proxy request with absolute URL
-			targetURL = r.URL.String()
-		} else {
-			// This is a direct request, construct the target URL
-			scheme := "http"
-			if r.TLS != nil {
-				scheme = "https"
-			}
-			targetURL = scheme + "://" + r.Host + r.URL.Path
-			if r.URL.RawQuery != "" {
-				targetURL += "?" + r.URL.RawQuery
-			}
-		}
+// Options configure a Server
+type Options struct {
+	DrainTimeout time.Duration                       // How long in-flight requests and tunnels get to finish once the context is done
+	Auth         *auth.Basic                         // Credentials clients must present; nil accepts every client
+	Clients      *acl.Clients                        // Client addresses allowed to use the proxy; nil allows all
+	Destinations *acl.Destinations                   // Upstream destinations clients may reach; nil allows all
+	Upstream     *upstream.Router                    // Picks the upstream proxy for outbound connections; nil connects directly
+	Retry        *retry.Policy                       // Retries failed upstream requests; nil never retries
+	Breakers     *breaker.Set                        // Fails requests to failing upstream hosts fast; nil lets every request through
+	ErrorPages   bool                                // Describe upstream failures in HTML or JSON bodies to clients that accept them
+	Limits       limits.Limits                       // Timeouts and size and connection limits; the zero value has none
+	Transport    transport.Settings                  // Pooling, protocols and TLS of upstream connections
+	Via          string                              // Pseudonym the proxy adds to the Via header of requests and responses; empty adds none
+	Forwarded    bool                                // Describe clients in Forwarded and X-Forwarded-* headers of forwarded requests
+	RoundTripper http.RoundTripper                   // Sends forwarded requests instead of the pooled transport built from Transport; nil uses that one
+	Logger       *log.Logger                         // Receives the server's log lines; nil logs to the standard logger
+	Handler      func(*http.Request, *http.Response) // Called with each request before it is forwarded and again with its response, either of which it may modify
+	Cache        *cache.Cache                        // Answers forwarded GET requests from stored responses; nil caches nothing
+}
+
+// Server is the simple forward proxy. It relays requests in absolute form
+// and tunnels CONNECT requests to their destination as they are, without
+// intercepting TLS or recording flows. Server is an http.Handler, so it can
+// be mounted on any http.Server, or serve on its own with Start or Serve.
+//
+// The destination ACL and upstream router apply to every connection the
+// server dials; an Options.RoundTripper dials its own connections, for
+// which they don't.
+type Server struct {
+	opts    Options
+	forward *forwarder // nil when Options.RoundTripper replaces it
+	rt      http.RoundTripper
+	conns   *clientConns
+	tunnels tunnelSet
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// NewServer creates a Server with opts. Its pooled upstream connections are
+// shared by all the listeners it serves.
+func NewServer(opts Options) *Server {
+	s := &Server{opts: opts, conns: newClientConns(opts.Limits, nil)}
+	base := opts.RoundTripper
+	if base == nil {
+		s.forward = newForwarder(opts.Transport, opts.Limits.Upstream)
+		base = s.forward
+	}
+	s.rt = opts.Cache.Transport(&resilientTransport{base: base, policy: opts.Retry, breakers: opts.Breakers})
+	return s
+}
+
+// Start runs a Server with opts on addr until ctx is done. See Server.Start.
+func Start(ctx context.Context, addr string, opts Options) error {
+	return NewServer(opts).Start(ctx, addr)
+}
+
+// Start serves on addr until ctx is done or Shutdown is called. See Serve.
+func (s *Server) Start(ctx context.Context, addr string) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.logf("Proxy server starting on %s", ln.Addr())
+	return s.Serve(ctx, ln)
+}
+
+// Serve accepts proxy connections on ln. When ctx is done the server shuts
+// down, giving in-flight requests and tunnels DrainTimeout to finish. Serve
+// returns nil after a shutdown, or context.DeadlineExceeded when the drain
+// exceeded DrainTimeout and the connections still open were closed; an
+// explicit Shutdown makes it return nil as soon as the listener is closed,
+// without waiting for the drain.
+func (s *Server) Serve(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: s, ErrorLog: s.opts.Logger}
+	limitServer(srv, s.opts.Limits, s.conns)
+	s.mu.Lock()
+	s.server = srv
+	s.mu.Unlock()
+
+	return serveContext(ctx, srv, ln, s.opts.DrainTimeout, s.Shutdown)
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests and
+// tunnels to finish, closing whatever is still open when ctx expires. Then
+// the pooled upstream connections are closed. Tunnels of a Server mounted
+// on another http.Server are closed by Shutdown too.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	srv := s.server
+	s.mu.Unlock()
 
-		log.Printf("Forwarding request to: %s", targetURL)
+	s.logf("Proxy shutting down with %d tunnels open", s.tunnels.len())
 
-		// Create new request
-		req, err := http.NewRequest(r.Method, targetURL, r.Body)
-		if err != nil {
-			log.Printf("Failed to create request: %v", err)
-			http.Error(w, "Failed to create request", http.StatusInternalServerError)
+	tunnelsErr := make(chan error, 1)
+	go func() { tunnelsErr <- s.tunnels.shutdown(ctx) }()
+	var errs []error
+	if srv != nil {
+		errs = append(errs, shutdownServer(ctx, srv))
+	}
+	errs = append(errs, <-tunnelsErr)
+	if s.forward != nil {
+		s.forward.CloseIdleConnections()
+	}
+	return errors.Join(errs...)
+}
+
+// ServeHTTP checks the client's address and credentials, then tunnels a
+// CONNECT request or forwards any other
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := s.opts.Clients.CheckRemoteAddr(r.RemoteAddr); err != nil {
+		denyAccess(nil, w, r, err)
+		return
+	}
+	user, ok := authenticate(s.opts.Auth, nil, w, r)
+	if !ok {
+		return
+	}
+	r = r.WithContext(withUpstream(withDestinations(r.Context(), s.opts.Destinations), s.opts.Upstream))
+	if r.Method == http.MethodConnect {
+		s.tunnel(w, r, user)
+	} else {
+		s.forwardRequest(w, r, user)
+	}
+}
+
+// tunnel connects the client of a CONNECT request to the host it names and
+// relays bytes both ways until either side closes
+func (s *Server) tunnel(w http.ResponseWriter, r *http.Request, user string) {
+	who := "CONNECT " + r.Host + " from " + r.RemoteAddr
+	// The target is dialed before the tunnel is confirmed so that a denied
+	// destination gets a 403
+	var t flow.Timings
+	targetConn, err := dialWithin(r.Context(), s.opts.Limits.Upstream.Dial, func(ctx context.Context) (net.Conn, error) {
+		return dialTimed(ctx, r.Host, &t)
+	})
+	if err != nil {
+		if denyAccess(nil, w, r, err) {
 			return
 		}
+		s.logf("Failed to connect to target %s: %v", r.Host, err)
+		reportLimit(nil, err, who)
+		writeGatewayError(w, r, r.Host, err, s.opts.ErrorPages)
+		return
+	}
+	defer targetConn.Close()
 
-		// Copy headers from original request
-		for key, values := range r.Header {
-			for _, value := range values {
-				req.Header.Add(key, value)
-			}
-		}
-		log.Println("Request to target: ", req)
-
-		// Send request using client
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			log.Printf("Failed to forward request: %v", err)
-			http.Error(w, "Failed to forward request", http.StatusInternalServerError)
-			return
+	w.WriteHeader(http.StatusOK)
+	clientConn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		s.logf("Failed to take over the connection for %s: %v", who, err)
+		return
+	}
+	defer clientConn.Close()
+	defer s.conns.release(clientConn)
+	// The server's request deadlines don't apply to the tunnel
+	clientConn.SetDeadline(time.Time{})
+
+	if !s.tunnels.add(clientConn) {
+		return
+	}
+	defer s.tunnels.remove(clientConn)
+	s.tunnels.attach(clientConn, targetConn)
+	start := time.Now()
+	splice(nil, clientConn, brw.Reader, targetConn, targetConn)
+	if user != "" {
+		s.logf("Tunnel %s (user %s) closed after %s, connect %s", who, user, time.Since(start).Round(time.Millisecond), t.Connect)
+	} else {
+		s.logf("Tunnel %s closed after %s, connect %s", who, time.Since(start).Round(time.Millisecond), t.Connect)
+	}
+}
+
+// forwardRequest relays r to the URL it names and its response back.
+// Hop-by-hop headers stay behind, trailers are passed on both ways, and a
+// 101 Switching Protocols response turns the connection into a relay of
+// the upgraded one.
+func (s *Server) forwardRequest(w http.ResponseWriter, r *http.Request, user string) {
+	// Requests addressed to the proxy itself would be forwarded back to
+	// it; routing those to servers is what the reverse proxy is for
+	if !r.URL.IsAbs() {
+		http.Error(w, "Not a proxy request; nproxy mitm serves reverse proxy routes", http.StatusBadRequest)
+		return
+	}
+	if s.opts.Handler != nil {
+		s.opts.Handler(r, nil)
+	}
+	l := s.opts.Limits
+	targetURL := r.URL.String()
+	who := r.Method + " " + targetURL + " from " + r.RemoteAddr
+
+	if exceeds(r.ContentLength, l.MaxRequestBody) {
+		le := &limits.Error{Limit: limits.MaxRequestBody}
+		reportLimit(nil, le, who)
+		writeClientLimit(w, le)
+		return
+	}
+
+	// Create new request, tracing the upstream phases
+	ft := newFlowTimer()
+	ctx, stop := upstreamTimeouts(r.Context(), l.Upstream)
+	defer stop()
+	ctx = httptrace.WithClientTrace(ctx, ft.trace())
+	body := limitBody(r.Body, l.MaxRequestBody, limits.MaxRequestBody, limits.ClientRequest)
+	req, err := http.NewRequestWithContext(ctx, r.Method, targetURL, body)
+	if err != nil {
+		s.logf("Failed to create request: %v", err)
+		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		return
+	}
+
+	// Copy headers from original request, but for the hop-by-hop ones
+	req.ContentLength = r.ContentLength
+	copyRequestHeader(req, r, s.opts.Via)
+	if s.opts.Forwarded {
+		hop.SetForwarded(req.Header, r)
+	}
+
+	resp, err := s.rt.RoundTrip(req)
+	err = limitCause(ctx, err)
+	if denyAccess(nil, w, r, err) || circuitOpen(w, err) {
+		return
+	}
+	if le := clientLimit(err); le != nil {
+		reportLimit(nil, le, who)
+		writeClientLimit(w, le)
+		return
+	}
+	if err == nil && exceeds(resp.ContentLength, l.MaxResponseBody) {
+		resp.Body.Close()
+		err = &limits.Error{Limit: limits.MaxResponseBody}
+	}
+	if err != nil {
+		s.logf("Failed to forward request: %v", err)
+		reportLimit(nil, err, who)
+		writeGatewayError(w, r, targetURL, err, s.opts.ErrorPages)
+		return
+	}
+	defer resp.Body.Close()
+	stripResponse(resp, s.opts.Via)
+	if s.opts.Handler != nil {
+		s.opts.Handler(r, resp)
+	}
+
+	// Return target response to client
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
 		}
-		log.Println("Response from target: ", resp)
-		defer resp.Body.Close()
-
-		// Return target response to client
-		for key, values := range resp.Header {
-			for _, value := range values {
-				w.Header().Add(key, value)
-			}
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		if err := relayUpgrade(w, resp, s.conns, &s.tunnels, nil); err != nil {
+			s.logf("Failed to relay upgraded connection for %s: %v", who, err)
 		}
-		log.Println("Response to client: ", w)
+		return
+	}
+	declareTrailers(w, resp)
+	ft.measure(bodyTransfer, func() {
 		w.WriteHeader(resp.StatusCode)
-		io.Copy(w, resp.Body)
+		_, err = io.Copy(w, limitBody(resp.Body, l.MaxResponseBody, limits.MaxResponseBody, ""))
 	})
+	copyTrailers(w, resp)
+	if user != "" {
+		s.logf("Timing %s %s %d (user %s): %s", r.Method, targetURL, resp.StatusCode, user, ft.timings())
+	} else {
+		s.logf("Timing %s %s %d: %s", r.Method, targetURL, resp.StatusCode, ft.timings())
+	}
+	if err = limitCause(ctx, err); reportLimit(nil, err, who) {
+		panic(http.ErrAbortHandler)
+	}
+}
 
-	return http.ListenAndServe(addr, nil)
+// logf logs to Options.Logger, or the standard logger when it is nil
+func (s *Server) logf(format string, args ...any) {
+	if s.opts.Logger != nil {
+		s.opts.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
 }
@@ -1,36 +1,255 @@
 package proxy
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
-func TestProxy(t *testing.T) {
-	// Create mock server
-	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
+// serverClient returns a client that sends all traffic through the proxy at
+// proxyURL and trusts the certificate of target
+func serverClient(t *testing.T, proxyURL string, target *httptest.Server) *http.Client {
+	t.Helper()
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		t.Fatalf("Failed to parse proxy URL: %v", err)
+	}
+	tr := &http.Transport{Proxy: http.ProxyURL(u)}
+	if target != nil && target.TLS != nil {
+		pool := x509.NewCertPool()
+		pool.AddCert(target.Certificate())
+		tr.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr, Timeout: 5 * time.Second}
+}
+
+// syncBuffer is a log destination that tests can read while servers write
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestServer(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen", r.Header.Get("X-Debug"))
+		fmt.Fprint(w, "hello")
 	}))
-	defer targetServer.Close()
+	defer target.Close()
+
+	// Two servers with their own options run side by side, mounted on
+	// servers of the test's own
+	var logs [2]syncBuffer
+	var proxies [2]*httptest.Server
+	for i := range proxies {
+		s := NewServer(Options{
+			Logger: log.New(&logs[i], "", 0),
+			Handler: func(req *http.Request, resp *http.Response) {
+				if resp == nil {
+					req.Header.Set("X-Debug", fmt.Sprint(i))
+				} else {
+					resp.Header.Set("X-Proxy", fmt.Sprint(i))
+				}
+			},
+		})
+		proxies[i] = httptest.NewServer(s)
+		defer proxies[i].Close()
+		defer s.Shutdown(context.Background())
+	}
+
+	for i, p := range proxies {
+		resp, err := serverClient(t, p.URL, nil).Get(target.URL + "/path")
+		if err != nil {
+			t.Fatalf("Request through proxy %d failed: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "hello" {
+			t.Errorf("Expected the target's body through proxy %d, got %q", i, body)
+		}
+		if got := resp.Header.Get("X-Seen"); got != fmt.Sprint(i) {
+			t.Errorf("Expected the request handler of proxy %d to set X-Debug, the target saw %q", i, got)
+		}
+		if got := resp.Header.Get("X-Proxy"); got != fmt.Sprint(i) {
+			t.Errorf("Expected the response handler of proxy %d to set X-Proxy, got %q", i, got)
+		}
+		if !strings.Contains(logs[i].String(), "Timing GET "+target.URL+"/path 200") {
+			t.Errorf("Expected proxy %d to log the request to its logger, got %q", i, logs[i].String())
+		}
+	}
+
+	// A request addressed to the proxy itself isn't forwarded
+	resp, err := http.Get(proxies[0].URL + "/")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a request that isn't a proxy request, got %d", resp.StatusCode)
+	}
+}
 
-	// Create proxy server
-	proxyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		r.URL.Scheme = "http"
-		r.URL.Host = strings.TrimPrefix(targetServer.URL, "http://")
-		Start(r.URL.String())
+func TestServer_Connect(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "secure")
 	}))
-	defer proxyServer.Close()
+	defer target.Close()
+	var logs syncBuffer
+	s := NewServer(Options{Logger: log.New(&logs, "", 0)})
+	p := httptest.NewServer(s)
+	defer p.Close()
+
+	// The client's TLS reaches the target untouched, so it verifies the
+	// target's own certificate
+	resp, err := serverClient(t, p.URL, target).Get(target.URL)
+	if err != nil {
+		t.Fatalf("Request through the tunnel failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "secure" {
+		t.Errorf("Expected the target's body, got %q", body)
+	}
 
-	// Send request to proxy server
-	resp, err := http.Get(proxyServer.URL)
+	// A destination that can't be reached is a gateway error
+	ln, _ := net.Listen("tcp", "127.0.0.1:0")
+	closed := ln.Addr().String()
+	ln.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(p.URL, "http://"))
 	if err != nil {
-		t.Fatalf("Failed to send request to proxy server: %v", err)
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", closed, closed)
+	resp, err = http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("Expected 502 for an unreachable destination, got %v %v", resp, err)
+	}
+	if !strings.Contains(logs.String(), "Failed to connect to target "+closed) {
+		t.Errorf("Expected the failure to be logged, got %q", logs.String())
+	}
+}
+
+func TestServer_RoundTripper(t *testing.T) {
+	var sent *http.Request
+	s := NewServer(Options{
+		Via: "nproxy",
+		RoundTripper: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			sent = req
+			return &http.Response{
+				StatusCode: http.StatusTeapot,
+				ProtoMajor: 1,
+				ProtoMinor: 1,
+				Header:     http.Header{"Connection": {"close"}},
+				Body:       io.NopCloser(strings.NewReader("stub")),
+				Request:    req,
+			}, nil
+		}),
+	})
+	p := httptest.NewServer(s)
+	defer p.Close()
+
+	resp, err := serverClient(t, p.URL, nil).Get("http://example.invalid/tea")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot || string(body) != "stub" {
+		t.Errorf("Expected the round tripper's response, got %d %q", resp.StatusCode, body)
+	}
+	if resp.Header.Get("Via") != "1.1 nproxy" {
+		t.Errorf("Expected the response to be relayed like any other, got %v", resp.Header)
+	}
+	if sent == nil || sent.URL.String() != "http://example.invalid/tea" || sent.Header.Get("Via") != "1.1 nproxy" {
+		t.Errorf("Expected the round tripper to get the request sent on, got %v", sent)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer target.Close()
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(conn, conn)
+		}
+	}()
+
+	s := NewServer(Options{DrainTimeout: 50 * time.Millisecond})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- s.Serve(ctx, ln) }()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	addr := target.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+	io.WriteString(conn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("Expected the tunnel to relay bytes, got %q %v", buf, err)
 	}
-	defer resp.Body.Close()
 
-	// Verify response
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("Expected status code 200, got %d", resp.StatusCode)
+	// The tunnel stays busy, so it is closed once the drain timeout expires
+	cancel()
+	select {
+	case err := <-served:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected Serve to report the drain timing out, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return after its context was done")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Errorf("Expected the tunnel to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", ln.Addr().String()); err == nil {
+		t.Error("Expected the listener to be closed")
 	}
 }
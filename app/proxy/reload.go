@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/breaker"
+	"nproxy/app/filter"
+	"nproxy/app/retry"
+	"nproxy/app/reverse"
+	"nproxy/app/upstream"
+)
+
+// Settings are the MITMProxy options that can be changed while it runs.
+// They mirror the fields of the same names.
+type Settings struct {
+	ServerTiming     bool
+	BodyCaptureLimit int
+	LogFilter        *filter.Filter
+	Rules            []Rule
+	Auth             *auth.Basic
+	Clients          *acl.Clients
+	Destinations     *acl.Destinations
+	Upstream         *upstream.Router
+	Reverse          *reverse.Table
+	Retry            *retry.Policy
+	Breakers         *breaker.Set
+	ErrorPages       bool
+	Via              string
+	Forwarded        bool
+}
+
+// Settings returns the current reloadable settings
+func (m *MITMProxy) Settings() Settings {
+	m.settingsMu.RLock()
+	defer m.settingsMu.RUnlock()
+	return Settings{
+		ServerTiming:     m.ServerTiming,
+		BodyCaptureLimit: m.BodyCaptureLimit,
+		LogFilter:        m.LogFilter,
+		Rules:            m.Rules.List(),
+		Auth:             m.Auth,
+		Clients:          m.Clients,
+		Destinations:     m.Destinations,
+		Upstream:         m.Upstream,
+		Reverse:          m.Reverse,
+		Retry:            m.Retry,
+		Breakers:         m.Breakers,
+		ErrorPages:       m.ErrorPages,
+		Via:              m.Via,
+		Forwarded:        m.Forwarded,
+	}
+}
+
+// Reload replaces the reloadable settings in one step. Flows that have
+// already started finish with the settings they started with; only new
+// flows, including new requests on open tunnels, see s. A new Reverse
+// table starts its health checks and the old one's stop.
+func (m *MITMProxy) Reload(s Settings) {
+	m.settingsMu.Lock()
+	defer m.settingsMu.Unlock()
+
+	m.ServerTiming = s.ServerTiming
+	m.BodyCaptureLimit = s.BodyCaptureLimit
+	m.LogFilter = s.LogFilter
+	m.Auth = s.Auth
+	m.Clients = s.Clients
+	if m.Destinations != s.Destinations || m.Upstream != s.Upstream {
+		// Pooled connections were checked against the old destinations
+		// or lead through the old upstream proxies
+		m.plumbing().forward.CloseIdleConnections()
+	}
+	m.Destinations = s.Destinations
+	m.Upstream = s.Upstream
+	if m.Reverse != s.Reverse {
+		m.Reverse.Stop()
+		m.startReverse(s.Reverse)
+	}
+	m.Reverse = s.Reverse
+	m.Retry = s.Retry
+	m.Breakers = s.Breakers
+	m.ErrorPages = s.ErrorPages
+	m.Via = s.Via
+	m.Forwarded = s.Forwarded
+	if m.Rules == nil {
+		m.Rules = NewRuleSet()
+	}
+	m.Rules.Replace(s.Rules)
+}
+
+// flowSettings is the snapshot of the reloadable settings that one flow
+// uses from start to finish
+type flowSettings struct {
+	serverTiming     bool
+	bodyCaptureLimit int
+	logFilter        *filter.Filter
+	rules            []Rule
+	retry            *retry.Policy
+	breakers         *breaker.Set
+	errorPages       bool
+	via              string
+	forwarded        bool
+}
+
+func (m *MITMProxy) snapshot() *flowSettings {
+	m.settingsMu.RLock()
+	defer m.settingsMu.RUnlock()
+	return &flowSettings{
+		serverTiming:     m.ServerTiming,
+		bodyCaptureLimit: m.BodyCaptureLimit,
+		logFilter:        m.LogFilter,
+		rules:            m.Rules.List(),
+		retry:            m.Retry,
+		breakers:         m.Breakers,
+		errorPages:       m.ErrorPages,
+		via:              m.Via,
+		forwarded:        m.Forwarded,
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"nproxy/app/filter"
+)
+
+// tagRule sets X-Rule on the request and the response
+func tagRule(name string) Rule {
+	return Rule{Name: name, Enabled: true, Handler: func(req *http.Request, resp *http.Response) {
+		if req != nil {
+			req.Header.Set("X-Rule", name)
+		}
+		if resp != nil {
+			resp.Header.Set("X-Rule", name)
+		}
+	}}
+}
+
+func TestMITMProxy_ReloadKeepsFlowsInProgress(t *testing.T) {
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Reload(Settings{Rules: []Rule{tagRule("old")}, BodyCaptureLimit: DefaultBodyCaptureLimit})
+
+	// The upstream reloads the proxy while the flow is halfway through
+	var upstreamRule string
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRule = r.Header.Get("X-Rule")
+		p.Reload(Settings{
+			ServerTiming: true,
+			LogFilter:    filter.MustParse("status >= 500"),
+			Rules:        []Rule{tagRule("new")},
+		})
+	}))
+	defer target.Close()
+
+	w := httptest.NewRecorder()
+	p.handleHTTP(w, httptest.NewRequest("GET", target.URL, nil), "")
+	if upstreamRule != "old" || w.Header().Get("X-Rule") != "old" {
+		t.Errorf("Expected the whole flow to use the old rule, got %q upstream and %q downstream", upstreamRule, w.Header().Get("X-Rule"))
+	}
+	if w.Header().Get("Server-Timing") != "" {
+		t.Error("Expected the flow in progress to keep Server-Timing off")
+	}
+
+	w = httptest.NewRecorder()
+	p.handleHTTP(w, httptest.NewRequest("GET", target.URL, nil), "")
+	if upstreamRule != "new" || w.Header().Get("X-Rule") != "new" || w.Header().Get("Server-Timing") == "" {
+		t.Errorf("Expected the next flow to use the new settings, got %q upstream and headers %v", upstreamRule, w.Header())
+	}
+
+	s := p.Settings()
+	if !s.ServerTiming || s.BodyCaptureLimit != 0 || s.LogFilter.String() != "status >= 500" || len(s.Rules) != 1 || s.Rules[0].Name != "new" {
+		t.Errorf("Unexpected settings after reload: %+v", s)
+	}
+}
@@ -0,0 +1,55 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+)
+
+// responder is a transport that offers requests to respond first and sends
+// those it doesn't answer on with base
+type responder struct {
+	respond func(*http.Request) *http.Response
+	base    http.RoundTripper
+}
+
+// respond returns base, answering requests with the Responder first when
+// one is set
+func (m *MITMProxy) respond(base http.RoundTripper) http.RoundTripper {
+	if m.Responder == nil {
+		return base
+	}
+	return &responder{respond: m.Responder, base: base}
+}
+
+// RoundTrip returns the response of respond to req, completed to look like
+// one read from a server, or else that of base. The request body is read to
+// the end either way, so that it is captured on the flow.
+func (r *responder) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp := r.respond(req)
+	if resp == nil {
+		return r.base.RoundTrip(req)
+	}
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+	if resp.ProtoMajor == 0 {
+		resp.Proto, resp.ProtoMajor, resp.ProtoMinor = "HTTP/1.1", 1, 1
+	}
+	if resp.Header == nil {
+		resp.Header = make(http.Header)
+	}
+	if resp.Body == nil {
+		resp.Body = http.NoBody
+	}
+	if resp.ContentLength == 0 && resp.Body != http.NoBody {
+		// An unknown length, sent chunked rather than by closing the
+		// client's connection
+		resp.ContentLength = -1
+	}
+	if resp.ContentLength < 0 && len(resp.TransferEncoding) == 0 {
+		resp.TransferEncoding = []string{"chunked"}
+	}
+	resp.Request = req
+	return resp, nil
+}
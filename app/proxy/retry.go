@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/breaker"
+	"nproxy/app/retry"
+)
+
+// resilientTransport sends requests with base, retrying them as policy
+// allows and refusing them at once for hosts whose circuit breaker is
+// open. Retried request bodies are replayed from a buffer, so requests
+// whose client waits for 100 Continue are sent once: reading their body
+// ahead would ask the client for it before the server does.
+type resilientTransport struct {
+	base     http.RoundTripper
+	policy   *retry.Policy
+	breakers *breaker.Set
+	metrics  *Metrics
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	retries := t.policy.Allows(req.Method) && !expectsContinue(req)
+	var body []byte
+	if retries && req.Body != nil && req.Body != http.NoBody {
+		limit := t.policy.BodyLimit()
+		buf, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+		if err != nil {
+			req.Body.Close()
+			return nil, err
+		}
+		if int64(len(buf)) > limit {
+			// Too big to keep: send it once, as it comes
+			retries = false
+			req = req.Clone(req.Context())
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(buf), req.Body), req.Body}
+		} else {
+			req.Body.Close()
+			body = buf
+		}
+	}
+
+	host := canonicalAddr(req.URL)
+	for attempt := 1; ; attempt++ {
+		done, err := t.breakers.Allow(host)
+		if err != nil {
+			if req.Body != nil && body == nil {
+				req.Body.Close()
+			}
+			return nil, err
+		}
+		try := req
+		if body != nil {
+			try = req.Clone(req.Context())
+			try.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		resp, err := t.base.RoundTrip(try)
+		if done(breakerFailure(resp, err)) {
+			log.Printf("Circuit breaker for %s opened", host)
+			t.metrics.circuitOpened(host)
+		}
+
+		// The destination ACL refuses addresses while dialing, but a refusal
+		// is final
+		var denied *acl.DeniedError
+		reason := t.policy.Reason(resp, err)
+		if !retries || attempt >= t.policy.Attempts || reason == "" || errors.As(err, &denied) {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+		delay := t.policy.Delay(attempt)
+		log.Printf("Retrying %s %s in %s after a %s failure", req.Method, req.URL, delay.Round(time.Millisecond), reason)
+		t.metrics.retried(reason)
+		if err := sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// breakerFailure reports whether the outcome of a request counts against
+// the upstream's circuit breaker: requests refused by the ACL or abandoned
+// by the client don't
+func breakerFailure(resp *http.Response, err error) bool {
+	var denied *acl.DeniedError
+	switch {
+	case err == nil:
+		return resp.StatusCode >= 500
+	case errors.As(err, &denied), errors.Is(err, context.Canceled):
+		return false
+	}
+	return true
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// circuitOpen answers 503 Service Unavailable and reports true if err is a
+// refusal by an open circuit breaker
+func circuitOpen(w http.ResponseWriter, err error) bool {
+	open := openCircuit(err)
+	if open == nil {
+		return false
+	}
+	for name, values := range circuitOpenHeader(open) {
+		w.Header()[name] = values
+	}
+	http.Error(w, "Service unavailable: "+open.Error(), http.StatusServiceUnavailable)
+	return true
+}
+
+// writeCircuitOpenResponse answers req, intercepted on conn, like
+// circuitOpen, closing the connection after it, and returns the status
+func writeCircuitOpenResponse(conn net.Conn, req *http.Request, open *breaker.OpenError) int {
+	body := []byte("Service unavailable: " + open.Error() + "\n")
+	h := circuitOpenHeader(open)
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Connection", "close")
+	resp := &http.Response{
+		StatusCode:    http.StatusServiceUnavailable,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        h,
+		Body:          io.NopCloser(bytes.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+		Request:       req,
+	}
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	resp.Write(conn)
+	return http.StatusServiceUnavailable
+}
+
+// openCircuit returns the refusal by an open circuit breaker in err, or nil
+// when it isn't one, logging it
+func openCircuit(err error) *breaker.OpenError {
+	var open *breaker.OpenError
+	if !errors.As(err, &open) {
+		return nil
+	}
+	log.Printf("Refused request to %s: %v", open.Host, open)
+	return open
+}
+
+// circuitOpenHeader returns the headers of the 503 answering a request
+// refused by open, which tell the client when to try again
+func circuitOpenHeader(open *breaker.OpenError) http.Header {
+	h := http.Header{}
+	h.Set("Proxy-Status", proxyStatus("destination_unavailable", open.Error()))
+	h.Set("Retry-After", strconv.Itoa(int(math.Ceil(max(open.RetryAfter, time.Second).Seconds()))))
+	return h
+}
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/breaker"
+	"nproxy/app/retry"
+)
+
+func TestMITMProxy_Retry(t *testing.T) {
+	// The targets fail the first two tries of every request
+	var tries atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if tries.Add(1)%3 != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		io.WriteString(w, r.Method+" "+string(body))
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Metrics = NewMetrics()
+	p.Reload(Settings{Retry: &retry.Policy{Attempts: 3, Statuses: []int{503}, Backoff: time.Millisecond}})
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	tests := []struct {
+		method string
+		status int
+		body   string
+	}{
+		// The body is replayed on every try
+		{"PUT", http.StatusOK, "PUT payload"},
+		// Only idempotent methods are retried
+		{"POST", http.StatusServiceUnavailable, ""},
+	}
+	// Forwarded and intercepted requests alike
+	for _, target := range []*httptest.Server{plain, secure} {
+		for _, tt := range tests {
+			tries.Store(0)
+			req, _ := http.NewRequest(tt.method, target.URL, strings.NewReader("payload"))
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatalf("%s %s: %v", tt.method, target.URL, err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != tt.status || tt.body != "" && string(body) != tt.body {
+				t.Errorf("%s %s: expected %d %q, got %d %q", tt.method, target.URL, tt.status, tt.body, resp.StatusCode, body)
+			}
+		}
+	}
+	if n := p.Metrics.retries.Value("status"); n != 4 {
+		t.Errorf("Expected 4 retries, got %v", n)
+	}
+}
+
+func TestResilientTransport_ConnectError(t *testing.T) {
+	// The first two tries can't connect
+	var calls atomic.Int32
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		if calls.Add(1) < 3 {
+			return nil, &net.OpError{Op: "dial", Net: "tcp", Err: io.ErrUnexpectedEOF}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})
+	rt := &resilientTransport{base: base, policy: &retry.Policy{Attempts: 3, Backoff: time.Millisecond}}
+	req := httptest.NewRequest("POST", "http://backend.example/", strings.NewReader("x"))
+	req.RequestURI = ""
+	if _, err := rt.RoundTrip(req); err == nil || calls.Load() != 1 {
+		t.Errorf("Expected a POST not to be retried, got %d calls", calls.Load())
+	}
+	req = httptest.NewRequest("GET", "http://backend.example/", nil)
+	req.RequestURI = ""
+	if resp, err := rt.RoundTrip(req); err != nil || resp.StatusCode != http.StatusOK || calls.Load() != 3 {
+		t.Errorf("Expected the GET to succeed on its second try, got %v after %d calls", err, calls.Load())
+	}
+}
+
+func TestResilientTransport_Denied(t *testing.T) {
+	var calls atomic.Int32
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: &acl.DeniedError{Kind: "destination", Target: "10.0.0.1:80", Reason: "private address"}}
+	})
+	rt := &resilientTransport{base: base, policy: &retry.Policy{Attempts: 3, Backoff: time.Millisecond}}
+	req := httptest.NewRequest("GET", "http://backend.example/", nil)
+	req.RequestURI = ""
+	if _, err := rt.RoundTrip(req); err == nil || calls.Load() != 1 {
+		t.Errorf("Expected a refused destination not to be retried, got %d calls", calls.Load())
+	}
+}
+
+func TestResilientTransport_ExpectContinue(t *testing.T) {
+	var calls atomic.Int32
+	body := &readCounter{Reader: strings.NewReader("payload")}
+	base := roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		if body.reads != 0 {
+			t.Error("Expected the body not to be read before the request is sent")
+		}
+		return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: http.NoBody, Request: req}, nil
+	})
+	rt := &resilientTransport{base: base, policy: &retry.Policy{Attempts: 3, Statuses: []int{503}, Backoff: time.Millisecond}}
+	req := httptest.NewRequest("PUT", "http://backend.example/", io.NopCloser(body))
+	req.RequestURI = ""
+	req.Header.Set("Expect", "100-continue")
+	if resp, err := rt.RoundTrip(req); err != nil || resp.StatusCode != http.StatusServiceUnavailable || calls.Load() != 1 {
+		t.Errorf("Expected a request waiting for 100 Continue to be sent once, got %v after %d calls", err, calls.Load())
+	}
+}
+
+// readCounter counts the reads of its Reader
+type readCounter struct {
+	io.Reader
+	reads int
+}
+
+func (r *readCounter) Read(p []byte) (int, error) {
+	r.reads++
+	return r.Reader.Read(p)
+}
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
+func TestMITMProxy_CircuitBreaker(t *testing.T) {
+	var failing atomic.Bool
+	var reached atomic.Int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached.Add(1)
+		if failing.Load() {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Metrics = NewMetrics()
+	breakers := breaker.New(breaker.Settings{Failures: 2, OpenTime: 50 * time.Millisecond})
+	p.Reload(Settings{Breakers: breakers})
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	// Forwarded and intercepted requests alike
+	for i, target := range []*httptest.Server{plain, secure} {
+		failing.Store(true)
+		reached.Store(0)
+		get := func() *http.Response {
+			resp, err := client.Get(target.URL)
+			if err != nil {
+				t.Fatalf("GET %s: %v", target.URL, err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			return resp
+		}
+
+		get()
+		get()
+		resp := get()
+		if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" || reached.Load() != 2 {
+			t.Errorf("Expected the open circuit to fail fast with 503 for %s, got %d (Retry-After %q) after %d requests reached the target",
+				target.URL, resp.StatusCode, resp.Header.Get("Retry-After"), reached.Load())
+		}
+		if n := p.Metrics.circuitOpens.Value("127.0.0.1"); n != float64(i+1) {
+			t.Errorf("Expected the circuit for %s to open once, got %v", target.URL, n)
+		}
+
+		// After the open time a successful trial closes the circuit
+		failing.Store(false)
+		time.Sleep(60 * time.Millisecond)
+		if resp := get(); resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected the trial request to reach %s, got %d", target.URL, resp.StatusCode)
+		}
+		if st := breakers.State(target.Listener.Addr().String()); st != breaker.Closed {
+			t.Errorf("Expected the circuit for %s to close, got %s", target.URL, st)
+		}
+	}
+}
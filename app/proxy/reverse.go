@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+
+	"nproxy/app/hop"
+	"nproxy/app/limits"
+	"nproxy/app/reverse"
+	"nproxy/app/transport"
+)
+
+// newReverseTransport creates the transport that sends requests to reverse
+// proxy upstreams from the settings s. These are set up by the operator, so
+// neither the destination ACL nor upstream proxies apply, and the pool is
+// kept apart from the forwarder's so that connections to them are never
+// reused for proxied requests. Dials and idle connections are bounded by
+// the upstream timeouts t.
+func newReverseTransport(s transport.Settings, t limits.Timeouts) *http.Transport {
+	tr := transport.New(s, t.Idle)
+	dialer := s.Dialer()
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialWithin(ctx, t.Dial, func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		})
+	}
+	return tr
+}
+
+// ServeReverse serves ln as a reverse proxy: each request is routed by its
+// host and path to an upstream with the Reverse table, and passes through
+// the same handlers, rules, recording and logging as proxied requests.
+// Requests that no route matches get 404. The client ACL applies, but
+// clients don't authenticate. Wrap ln with ReverseTLSConfig to terminate
+// TLS.
+//
+// When ctx is done the listener drains for DrainTimeout; Shutdown drains it
+// too. ServeReverse returns nil after either.
+func (m *MITMProxy) ServeReverse(ctx context.Context, ln net.Listener) error {
+	srv := &http.Server{Handler: http.HandlerFunc(m.handleReverse)}
+	limitServer(srv, m.Limits, m.plumbing().conns)
+	m.serverMu.Lock()
+	m.reverseServers = append(m.reverseServers, srv)
+	m.serverMu.Unlock()
+
+	return serveContext(ctx, srv, ln, m.DrainTimeout, func(ctx context.Context) error {
+		return shutdownServer(ctx, srv)
+	})
+}
+
+// ReverseTLSConfig returns the TLS configuration that terminates TLS for
+// ServeReverse with certificates issued by the proxy's CA for the server
+// name each client asks for, or for the address it connected to
+func (m *MITMProxy) ReverseTLSConfig() *tls.Config {
+	return &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+			}
+			cert, err := m.certFor(name)
+			if err != nil {
+				log.Printf("Failed to generate certificate for %s: %v", name, err)
+			}
+			return cert, err
+		},
+	}
+}
+
+// handleReverse routes a request received by a ServeReverse listener
+func (m *MITMProxy) handleReverse(w http.ResponseWriter, r *http.Request) {
+	m.settingsMu.RLock()
+	clients, table, policy, breakers := m.Clients, m.Reverse, m.Retry, m.Breakers
+	m.settingsMu.RUnlock()
+
+	if err := clients.CheckRemoteAddr(r.RemoteAddr); err != nil {
+		denyAccess(m.Metrics, w, r, err)
+		return
+	}
+	route := table.Lookup(r.Host, r.URL.Path)
+	if route == nil {
+		log.Printf("No reverse proxy route for %s%s", r.Host, r.URL.Path)
+		w.Header().Set("Proxy-Status", proxyStatus("destination_not_found", "no route for "+r.Host+r.URL.Path))
+		http.NotFound(w, r)
+		return
+	}
+	backend, err := route.Pick(r)
+	if err != nil {
+		log.Printf("No upstream for %s%s in pool %s: %v", r.Host, r.URL.Path, route.Pool, err)
+		w.Header().Set("Proxy-Status", proxyStatus("destination_unavailable", err.Error()))
+		http.Error(w, "No healthy upstream", http.StatusServiceUnavailable)
+		return
+	}
+	log.Printf("Reverse proxy request for %s%s to %s", r.Host, r.URL.Path, backend.URL)
+
+	target := func(r *http.Request) string {
+		return route.Target(backend, r.URL).String()
+	}
+	if route.Retry != nil {
+		policy = route.Retry
+	}
+	transport := &resilientTransport{
+		base:     &backendTransport{base: m.plumbing().reverse, backend: backend, metrics: m.Metrics},
+		policy:   policy,
+		breakers: breakers,
+		metrics:  m.Metrics,
+	}
+	m.forward(w, r, "", transport, target, func(req *http.Request) {
+		hop.SetForwarded(req.Header, r)
+		if route.PreserveHost {
+			req.Host = r.Host
+		}
+	})
+}
+
+// backendTransport sends requests to a reverse proxy upstream with the
+// proxy's reverse transport and reports each one to the upstream's pool when
+// its response body is closed. Requests that get no response or a 5xx one
+// count as failures for outlier ejection.
+type backendTransport struct {
+	base    *http.Transport
+	backend *reverse.Backend
+	metrics *Metrics
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := t.backend
+	b.Begin()
+	t.metrics.upstreamRequest(b, 1)
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		t.done(true)
+		return nil, err
+	}
+	failed := resp.StatusCode >= 500
+	done := &doneBody{ReadCloser: resp.Body, done: func() { t.done(failed) }}
+	if rw, ok := resp.Body.(io.ReadWriteCloser); ok {
+		// The body of a 101 response is the upgraded connection
+		resp.Body = &doneConn{doneBody: done, w: rw}
+	} else {
+		resp.Body = done
+	}
+	return resp, nil
+}
+
+func (t *backendTransport) done(failed bool) {
+	t.metrics.upstreamRequest(t.backend, -1)
+	if t.backend.Done(failed) {
+		log.Printf("Ejected upstream %s from pool %s", t.backend.URL, t.backend.Pool())
+		t.metrics.upstreamEjected(t.backend)
+	}
+}
+
+// doneBody calls done once when the body is closed
+type doneBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *doneBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// doneConn is a doneBody that can be written to, as upgraded connections
+// are
+type doneConn struct {
+	*doneBody
+	w io.Writer
+}
+
+func (c *doneConn) Write(p []byte) (int, error) { return c.w.Write(p) }
+
+// startReverse begins the health checks of a new reverse proxy table and
+// publishes the state of its upstreams
+func (m *MITMProxy) startReverse(table *reverse.Table) {
+	table.Start(m.plumbing().reverse, m.Metrics.upstreamHealth)
+	m.Metrics.upstreamPools(table.Status())
+}
@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nproxy/app/flow"
+	"nproxy/app/reverse"
+)
+
+func TestMITMProxy_Reverse(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, strings.Join([]string{
+			r.Host, r.URL.RequestURI(), r.Header.Get("X-Forwarded-Host"), r.Header.Get("X-Forwarded-Proto"), r.Header.Get("X-Rule"),
+		}, " "))
+	}))
+	defer backend.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	flows := make(chan *flow.Flow, 10)
+	p.OnFlow = func(f *flow.Flow) { flows <- f }
+	p.Handler = func(req *http.Request, resp *http.Response) {
+		if resp == nil {
+			req.Header.Set("X-Rule", "applied")
+		}
+	}
+	table, err := reverse.NewTable([]reverse.Route{
+		{Host: "app.example", Path: "/api/", Upstream: backend.URL + "/v1", StripPrefix: true},
+		{Host: "*.example", Upstream: backend.URL, PreserveHost: true},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	p.Reload(Settings{Reverse: table})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.ServeReverse(ctx, tls.NewListener(ln, p.ReverseTLSConfig())) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("ServeReverse: %v", err)
+		}
+	}()
+
+	// Clients reach the proxy under the routed names and trust its CA
+	pool := x509.NewCertPool()
+	pool.AddCert(p.CA)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ln.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+
+	backendHost := strings.TrimPrefix(backend.URL, "http://")
+	tests := []struct {
+		url        string
+		status     int
+		body, flow string
+	}{
+		{"https://app.example/api/users?page=2", http.StatusOK,
+			backendHost + " /v1/users?page=2 app.example https applied", backend.URL + "/v1/users?page=2"},
+		{"https://www.example/index.html", http.StatusOK,
+			"www.example /index.html www.example https applied", backend.URL + "/index.html"},
+		{"https://app.other/", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(tt.url)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.url, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s: expected %d, got %d", tt.url, tt.status, resp.StatusCode)
+		}
+		if tt.body != "" && string(body) != tt.body {
+			t.Errorf("GET %s: expected the backend to see %q, got %q", tt.url, tt.body, body)
+		}
+		if tt.flow == "" {
+			continue
+		}
+		select {
+		case f := <-flows:
+			if f.URL != tt.flow {
+				t.Errorf("GET %s: expected a flow for %s, got %s", tt.url, tt.flow, f.URL)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("GET %s: expected a flow", tt.url)
+		}
+	}
+}
+
+func TestMITMProxy_ReversePool(t *testing.T) {
+	var goodStatus atomic.Int32
+	goodStatus.Store(http.StatusOK)
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(goodStatus.Load()))
+		io.WriteString(w, "good")
+	}))
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		io.WriteString(w, "bad")
+	}))
+	defer bad.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Metrics = NewMetrics()
+	table, err := reverse.NewTable([]reverse.Route{{Pool: "web"}}, []reverse.Pool{{
+		Name: "web", Upstreams: []string{good.URL, bad.URL},
+		Outlier: reverse.Outlier{ConsecutiveErrors: 2, EjectionTime: time.Minute},
+	}})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	p.Reload(Settings{Reverse: table})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go p.ServeReverse(ctx, ln)
+	get := func() (int, string) {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/")
+		if err != nil {
+			t.Fatalf("GET: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	// Round robin reaches both upstreams until the failing one is ejected
+	var bodies []string
+	for range 6 {
+		_, body := get()
+		bodies = append(bodies, body)
+	}
+	if got := strings.Join(bodies, " "); got != "good bad good bad good good" {
+		t.Errorf("Expected the failing upstream to be ejected after two errors, got %s", got)
+	}
+	if n := p.Metrics.poolEjections.Value("web", bad.URL); n != 1 {
+		t.Errorf("Expected 1 ejection, got %v", n)
+	}
+	for _, u := range []string{good.URL, bad.URL} {
+		if n := p.Metrics.poolActive.Value("web", u); n != 0 {
+			t.Errorf("Expected no active requests to %s, got %v", u, n)
+		}
+		if h := p.Metrics.poolHealth.Value("web", u); h != 1 {
+			t.Errorf("Expected %s to be reported healthy, got %v", u, h)
+		}
+	}
+
+	// With every upstream ejected there is nowhere to send requests
+	goodStatus.Store(http.StatusInternalServerError)
+	get()
+	get()
+	if status, _ := get(); status != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with no healthy upstream, got %d", status)
+	}
+}
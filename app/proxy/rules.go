@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+)
+
+// Rule is a named request/response handler that can be switched on and off
+// while the proxy is running. Handler has the same contract as
+// MITMProxy.Handler. When Filter is set the handler only runs for flows
+// that match it, evaluated against what is known at each call: a filter on
+// status, for example, can only match when the response is handled.
+type Rule struct {
+	Name    string
+	Handler func(*http.Request, *http.Response)
+	Filter  *filter.Filter
+	Enabled bool
+}
+
+// RuleSet is an ordered, concurrency-safe collection of rules
+type RuleSet struct {
+	mu    sync.RWMutex
+	rules []*Rule
+}
+
+// NewRuleSet creates an empty rule set
+func NewRuleSet() *RuleSet {
+	return &RuleSet{}
+}
+
+// Add appends an enabled rule, replacing any existing rule with the same name
+func (rs *RuleSet) Add(name string, handler func(*http.Request, *http.Response)) {
+	rs.AddFiltered(name, nil, handler)
+}
+
+// AddFiltered is like Add, but the rule only applies to flows matching f
+func (rs *RuleSet) AddFiltered(name string, f *filter.Filter, handler func(*http.Request, *http.Response)) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rule := &Rule{Name: name, Handler: handler, Filter: f, Enabled: true}
+	for i, r := range rs.rules {
+		if r.Name == name {
+			rs.rules[i] = rule
+			return
+		}
+	}
+	rs.rules = append(rs.rules, rule)
+}
+
+// SetEnabled switches the named rule on or off
+func (rs *RuleSet) SetEnabled(name string, enabled bool) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for _, r := range rs.rules {
+		if r.Name == name {
+			r.Enabled = enabled
+			return nil
+		}
+	}
+	return fmt.Errorf("rule %q not found", name)
+}
+
+// List returns a snapshot of the rules in evaluation order
+func (rs *RuleSet) List() []Rule {
+	if rs == nil {
+		return nil
+	}
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	rules := make([]Rule, 0, len(rs.rules))
+	for _, r := range rs.rules {
+		rules = append(rules, *r)
+	}
+	return rules
+}
+
+// Replace swaps in a new list of rules in one step
+func (rs *RuleSet) Replace(rules []Rule) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.rules = make([]*Rule, len(rules))
+	for i := range rules {
+		r := rules[i]
+		rs.rules[i] = &r
+	}
+}
+
+// Apply runs every enabled rule matching f in order. It is safe to call on
+// a nil set.
+func (rs *RuleSet) Apply(f *flow.Flow, req *http.Request, resp *http.Response) {
+	applyRules(rs.List(), f, req, resp)
+}
+
+// applyRules runs the enabled rules matching f in order
+func applyRules(rules []Rule, f *flow.Flow, req *http.Request, resp *http.Response) {
+	for _, r := range rules {
+		if r.Enabled && r.Handler != nil && r.Filter.Match(f) {
+			r.Handler(req, resp)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+)
+
+var testFlow = flow.New("GET", "http://example.com/", "example.com")
+
+func TestRuleSet(t *testing.T) {
+	rs := NewRuleSet()
+
+	var calls []string
+	rs.Add("first", func(req *http.Request, resp *http.Response) { calls = append(calls, "first") })
+	rs.Add("second", func(req *http.Request, resp *http.Response) { calls = append(calls, "second") })
+
+	rs.Apply(testFlow, nil, nil)
+	if len(calls) != 2 || calls[0] != "first" || calls[1] != "second" {
+		t.Errorf("Expected rules to run in order, got %v", calls)
+	}
+
+	if err := rs.SetEnabled("first", false); err != nil {
+		t.Fatalf("Failed to disable rule: %v", err)
+	}
+	calls = nil
+	rs.Apply(testFlow, nil, nil)
+	if len(calls) != 1 || calls[0] != "second" {
+		t.Errorf("Expected only the enabled rule to run, got %v", calls)
+	}
+
+	rules := rs.List()
+	if len(rules) != 2 || rules[0].Enabled || !rules[1].Enabled {
+		t.Errorf("Unexpected rule list: %+v", rules)
+	}
+
+	if err := rs.SetEnabled("missing", true); err == nil {
+		t.Error("Expected an error for an unknown rule")
+	}
+}
+
+func TestRuleSetReplace(t *testing.T) {
+	rs := NewRuleSet()
+
+	var called string
+	rs.Add("rule", func(req *http.Request, resp *http.Response) { called = "old" })
+	rs.Add("rule", func(req *http.Request, resp *http.Response) { called = "new" })
+
+	if n := len(rs.List()); n != 1 {
+		t.Errorf("Expected 1 rule after replacing, got %d", n)
+	}
+	rs.Apply(testFlow, nil, nil)
+	if called != "new" {
+		t.Errorf("Expected replacement rule to run, got %q", called)
+	}
+}
+
+func TestRuleSetNil(t *testing.T) {
+	var rs *RuleSet
+	rs.Apply(testFlow, nil, nil)
+	if rules := rs.List(); rules != nil {
+		t.Errorf("Expected no rules, got %v", rules)
+	}
+}
+
+func TestRuleSetFilter(t *testing.T) {
+	rs := NewRuleSet()
+
+	var calls int
+	rs.AddFiltered("errors", filter.MustParse(`host ~ "example" && status >= 500`), func(req *http.Request, resp *http.Response) {
+		calls++
+	})
+
+	f := flow.New("GET", "http://example.com/", "example.com")
+	rs.Apply(f, &http.Request{}, nil)
+	if calls != 0 {
+		t.Error("Expected the rule not to run before the status is known")
+	}
+
+	f.Status = http.StatusBadGateway
+	rs.Apply(f, nil, &http.Response{})
+	if calls != 1 {
+		t.Errorf("Expected the rule to run once for a matching flow, got %d", calls)
+	}
+
+	if rules := rs.List(); rules[0].Filter.String() != `host ~ "example" && status >= 500` {
+		t.Errorf("Expected the rule to keep its filter, got %q", rules[0].Filter)
+	}
+}
@@ -0,0 +1,169 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// DefaultDrainTimeout is how long a server waits for in-flight requests and
+// tunnels once its context is done
+const DefaultDrainTimeout = 30 * time.Second
+
+// serveContext runs srv on ln until ctx is done, then calls shutdown with a
+// context that expires after drain. It returns nil when the server was shut
+// down, either this way or by an explicit Shutdown, and
+// context.DeadlineExceeded when requests or tunnels were still in progress
+// after drain and had to be closed.
+func serveContext(ctx context.Context, srv *http.Server, ln net.Listener, drain time.Duration, shutdown func(context.Context) error) error {
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(ln) }()
+
+	select {
+	case err := <-served:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+		drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), drain)
+		defer cancel()
+		return shutdown(drainCtx)
+	}
+}
+
+// shutdownServer gracefully shuts srv down, closing the connections that are
+// still active when ctx expires
+func shutdownServer(ctx context.Context, srv *http.Server) error {
+	if err := srv.Shutdown(ctx); err != nil {
+		srv.Close()
+		return err
+	}
+	return nil
+}
+
+// tunnelSet tracks hijacked CONNECT connections, which http.Server.Shutdown
+// doesn't see. A tunnel is idle while it waits for the client's next
+// request. On shutdown idle tunnels are closed at once and busy ones as soon
+// as their current exchange completes; whatever is left when the drain
+// context expires is closed forcibly.
+type tunnelSet struct {
+	mu      sync.Mutex
+	conns   map[net.Conn]*tunnel // by client connection
+	closing bool
+	drained chan struct{} // closed when the last tunnel is removed while closing
+}
+
+type tunnel struct {
+	idle     bool
+	upstream io.Closer // closed along with the client connection when draining times out
+}
+
+// add starts tracking c as a busy tunnel. It returns false once shutdown
+// has started, in which case the tunnel must not be served.
+func (s *tunnelSet) add(c net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*tunnel)
+	}
+	s.conns[c] = &tunnel{}
+	return true
+}
+
+// attach records the upstream side of the tunnel from client c
+func (s *tunnelSet) attach(c net.Conn, upstream io.Closer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.conns[c]; ok {
+		t.upstream = upstream
+	}
+}
+
+// remove stops tracking c
+func (s *tunnelSet) remove(c net.Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, c)
+	if s.closing && len(s.conns) == 0 && s.drained != nil {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// idle marks c as waiting for a request. It returns false once shutdown has
+// started, in which case the tunnel should be closed instead.
+func (s *tunnelSet) idle(c net.Conn) bool {
+	return s.setIdle(c, true)
+}
+
+// busy marks c as relaying a request. It returns false if shutdown closed
+// the tunnel while it was idle.
+func (s *tunnelSet) busy(c net.Conn) bool {
+	return s.setIdle(c, false)
+}
+
+func (s *tunnelSet) setIdle(c net.Conn, idle bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	if t, ok := s.conns[c]; ok {
+		t.idle = idle
+	}
+	return true
+}
+
+// len returns the number of open tunnels
+func (s *tunnelSet) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// shutdown closes idle tunnels and waits for the busy ones to finish until
+// ctx expires, then closes those too
+func (s *tunnelSet) shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for c, t := range s.conns {
+		if t.idle {
+			c.Close()
+		}
+	}
+	if len(s.conns) == 0 {
+		s.mu.Unlock()
+		return nil
+	}
+	drained := make(chan struct{})
+	s.drained = drained
+	s.mu.Unlock()
+
+	select {
+	case <-drained:
+		return nil
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.conns) > 0 {
+		log.Printf("Closing %d tunnels that did not finish in time", len(s.conns))
+	}
+	for c, t := range s.conns {
+		c.Close()
+		if t.upstream != nil {
+			t.upstream.Close()
+		}
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// startServing runs p on a random local port and returns its URL and the
+// channel receiving Serve's result
+func startServing(t *testing.T, ctx context.Context, p *MITMProxy) (string, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.Serve(ctx, ln) }()
+	return "http://" + ln.Addr().String(), served
+}
+
+// waitFor polls cond until it holds or a second has passed
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// slowTarget is an HTTPS server whose /slow endpoint blocks until release
+// is closed
+func slowTarget(t *testing.T) (server *httptest.Server, entered <-chan struct{}, release chan struct{}) {
+	in := make(chan struct{}, 1)
+	release = make(chan struct{})
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			in <- struct{}{}
+			<-release
+		}
+		io.WriteString(w, "done")
+	}))
+	t.Cleanup(server.Close)
+	return server, in, release
+}
+
+func TestMITMProxy_ShutdownDrainsTunnels(t *testing.T) {
+	target, entered, release := slowTarget(t)
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	proxyURL, served := startServing(t, context.Background(), p)
+
+	// An idle keep-alive tunnel and a tunnel with a request in flight
+	idleClient := newProxiedClient(t, p, proxyURL)
+	resp, err := idleClient.Get(target.URL + "/fast")
+	if err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	busyClient := newProxiedClient(t, p, proxyURL)
+	result := make(chan error, 1)
+	go func() {
+		resp, err := busyClient.Get(target.URL + "/slow")
+		if err == nil {
+			_, err = io.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-entered
+	if p.ActiveTunnels() != 2 {
+		t.Fatalf("Expected 2 open tunnels, got %d", p.ActiveTunnels())
+	}
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- p.Shutdown(context.Background()) }()
+
+	// The idle tunnel is closed at once, the busy one stays open
+	waitFor(t, "the idle tunnel to close", func() bool { return p.ActiveTunnels() == 1 })
+	if err := <-served; err != nil {
+		t.Errorf("Expected Serve to return nil after Shutdown, got %v", err)
+	}
+	if _, err := net.Dial("tcp", proxyURL[len("http://"):]); err == nil {
+		t.Error("Expected the listener to be closed")
+	}
+
+	close(release)
+	if err := <-result; err != nil {
+		t.Errorf("Expected the in-flight request to complete, got %v", err)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Expected a clean shutdown, got %v", err)
+	}
+	if p.ActiveTunnels() != 0 {
+		t.Errorf("Expected no open tunnels, got %d", p.ActiveTunnels())
+	}
+}
+
+func TestMITMProxy_ShutdownDeadlineClosesTunnels(t *testing.T) {
+	target, entered, release := slowTarget(t)
+	defer close(release)
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.DrainTimeout = 50 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	proxyURL, served := startServing(t, ctx, p)
+
+	client := newProxiedClient(t, p, proxyURL)
+	result := make(chan error, 1)
+	go func() {
+		resp, err := client.Get(target.URL + "/slow")
+		if err == nil {
+			resp.Body.Close()
+		}
+		result <- err
+	}()
+	<-entered
+
+	// Cancelling the context drains for DrainTimeout, then cuts the tunnel
+	cancel()
+	if err := <-served; !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the drain to time out, got %v", err)
+	}
+	if err := <-result; err == nil {
+		t.Error("Expected the in-flight request to fail")
+	}
+	waitFor(t, "the tunnel to close", func() bool { return p.ActiveTunnels() == 0 })
+}
+
+func TestTunnelSetRefusesAfterShutdown(t *testing.T) {
+	var s tunnelSet
+	a, b := net.Pipe()
+	defer b.Close()
+
+	if !s.add(a) {
+		t.Fatal("Expected add to succeed before shutdown")
+	}
+	s.idle(a)
+	done := make(chan error, 1)
+	go func() { done <- s.shutdown(context.Background()) }()
+
+	// Shutdown closes the idle tunnel, whose goroutine then removes it
+	if _, err := a.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the idle tunnel to be closed")
+	}
+	s.remove(a)
+	if err := <-done; err != nil {
+		t.Fatalf("Expected shutdown to finish, got %v", err)
+	}
+
+	c, d := net.Pipe()
+	defer c.Close()
+	defer d.Close()
+	if s.add(c) {
+		t.Error("Expected add to fail after shutdown")
+	}
+}
@@ -0,0 +1,330 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/auth"
+	"nproxy/app/flow"
+	"nproxy/app/socks5"
+)
+
+// socksHandshakeTimeout bounds the SOCKS negotiation, so that clients can't
+// hold connections open without making a request
+const socksHandshakeTimeout = 30 * time.Second
+
+const (
+	// maxSOCKSPeers is how many destinations a UDP association relays
+	// replies from at once
+	maxSOCKSPeers = 256
+	// socksPeerIdle is how long replies are relayed from a destination after
+	// the client last sent to it
+	socksPeerIdle = 2 * time.Minute
+)
+
+// ServeSOCKS accepts SOCKS5 connections on ln and feeds them into the same
+// pipeline as CONNECT tunnels: TLS is intercepted with a certificate for
+// the server name the client asks for, plain HTTP is relayed request by
+// request, and any other protocol is tunnelled untouched. Clients
+// authenticate with a username and password when Auth is set, and the
+// ACLs and upstream proxies apply as for HTTP clients. UDP ASSOCIATE is
+// served when SOCKSUDP is set.
+//
+// ServeSOCKS returns nil once ctx is done or the proxy is shut down. Its
+// sessions are drained by Shutdown along with the CONNECT tunnels.
+func (m *MITMProxy) ServeSOCKS(ctx context.Context, ln net.Listener) error {
+	return m.serveListener(ctx, ln, m.handleSOCKS)
+}
+
+// handleSOCKS serves one SOCKS connection
+func (m *MITMProxy) handleSOCKS(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	m.settingsMu.RLock()
+	a, clients, destinations, router := m.Auth, m.Clients, m.Destinations, m.Upstream
+	m.settingsMu.RUnlock()
+
+	if err := clients.CheckRemoteAddr(conn.RemoteAddr().String()); err != nil {
+		m.socksDenied(conn, "connection", err)
+		return
+	}
+
+	conn.SetDeadline(time.Now().Add(socksHandshakeTimeout))
+	var verify func(user, password string) bool
+	if a != nil {
+		verify = a.Users.Verify
+	}
+	req, err := socks5.Accept(conn, verify)
+	switch {
+	case errors.Is(err, socks5.ErrAuthRequired):
+		m.Metrics.authFailure(auth.ErrNoCredentials)
+		return
+	case errors.Is(err, socks5.ErrAuthFailed):
+		log.Printf("SOCKS authentication failed from %s: %v", conn.RemoteAddr(), err)
+		m.Metrics.authFailure(auth.ErrInvalidCredentials)
+		return
+	case err != nil:
+		if err != io.EOF {
+			log.Printf("SOCKS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		}
+		return
+	}
+
+	ctx = withUpstream(withDestinations(ctx, destinations), router)
+	switch {
+	case req.Command == socks5.CommandConnect:
+		m.socksConnect(ctx, conn, req)
+	case req.Command == socks5.CommandUDPAssociate && m.SOCKSUDP:
+		m.socksAssociate(ctx, conn, req)
+	default:
+		log.Printf("Unsupported SOCKS %v from %s", req.Command, conn.RemoteAddr())
+		socks5.WriteReply(conn, socks5.CommandNotSupported, nil)
+	}
+}
+
+// socksConnect connects the client to the requested address and decides
+// from the client's first bytes how to relay the connection
+func (m *MITMProxy) socksConnect(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	if u := upstreamFrom(ctx).Proxy(req.Addr); u != nil {
+		log.Printf("SOCKS CONNECT to %s via %s", req.Addr, u.Redacted())
+	} else {
+		log.Printf("SOCKS CONNECT to %s", req.Addr)
+	}
+
+	var timings flow.Timings
+	targetConn, err := m.dialTunnel(ctx, req.Addr, &timings)
+	if err != nil {
+		if m.socksDenied(conn, req.Addr, err) {
+			socks5.WriteReply(conn, socks5.NotAllowed, nil)
+			return
+		}
+		log.Printf("Failed to connect to target %s: %v", req.Addr, err)
+		reportLimit(m.Metrics, err, "SOCKS CONNECT "+req.Addr)
+		m.Metrics.upstreamError(err)
+		socks5.WriteReply(conn, socksReply(err), nil)
+		return
+	}
+	target := newTunnelTarget(req.Addr, targetConn)
+	defer target.close()
+	if err := socks5.WriteReply(conn, socks5.Succeeded, targetConn.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	clientConn := newPeekedConn(conn)
+	mode := sniff(clientConn)
+	m.Metrics.socksSession(mode)
+	m.relaySniffed(ctx, clientConn, target, mode, req.Addr, timings, req.Username)
+}
+
+// socksReply maps a dial error to the closest SOCKS reply
+func socksReply(err error) socks5.Reply {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr), errors.Is(err, syscall.EHOSTUNREACH):
+		return socks5.HostUnreachable
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socks5.NetworkUnreachable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socks5.ConnectionRefused
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return socks5.TTLExpired
+	}
+	return socks5.GeneralFailure
+}
+
+// socksDenied logs and counts err if it is an ACL refusal, reporting
+// whether it was
+func (m *MITMProxy) socksDenied(conn net.Conn, target string, err error) bool {
+	var denied *acl.DeniedError
+	if !errors.As(err, &denied) {
+		return false
+	}
+	log.Printf("Access denied for SOCKS %s from %s: %v", target, conn.RemoteAddr(), denied)
+	m.Metrics.accessDenied(denied)
+	return true
+}
+
+// socksAssociate relays UDP datagrams between the client and the
+// destinations it addresses until the client closes conn. Only datagrams
+// from the address and port the client first sent from are relayed out,
+// and only replies from destinations it has recently sent to are relayed
+// back. Destinations routed through an upstream proxy can't be reached over
+// UDP, so their datagrams are dropped.
+func (m *MITMProxy) socksAssociate(ctx context.Context, conn net.Conn, req *socks5.Request) {
+	localIP, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	clientIP, _ := netip.ParseAddrPort(conn.RemoteAddr().String())
+
+	relay, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(netip.AddrPortFrom(localIP.Addr(), 0)))
+	if err != nil {
+		log.Printf("Failed to open SOCKS UDP relay: %v", err)
+		socks5.WriteReply(conn, socks5.GeneralFailure, nil)
+		return
+	}
+	defer relay.Close()
+	outbound, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		log.Printf("Failed to open SOCKS UDP relay: %v", err)
+		socks5.WriteReply(conn, socks5.GeneralFailure, nil)
+		return
+	}
+	defer outbound.Close()
+
+	if err := socks5.WriteReply(conn, socks5.Succeeded, relay.LocalAddr()); err != nil {
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	log.Printf("SOCKS UDP ASSOCIATE from %s on %s", conn.RemoteAddr(), relay.LocalAddr())
+
+	// The association is always idle: shutdown ends it at once
+	if !m.tunnels.add(conn) {
+		return
+	}
+	defer m.tunnels.remove(conn)
+	m.tunnels.attach(conn, relay)
+	m.tunnels.idle(conn)
+	m.Metrics.socksSession("udp")
+
+	var (
+		mu     sync.Mutex
+		client netip.AddrPort // where the client sends from; set by its first datagram
+		peers  socksPeers
+	)
+	// Replies from the destinations are wrapped and sent to the client
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := outbound.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			from = netip.AddrPortFrom(from.Addr().Unmap(), from.Port())
+			mu.Lock()
+			to, known := client, peers.known(from, time.Now())
+			mu.Unlock()
+			if !known {
+				continue
+			}
+			msg, err := socks5.AppendDatagram(nil, from.String(), buf[:n])
+			if err == nil {
+				relay.WriteToUDPAddrPort(msg, to)
+				m.Metrics.addBytes("response", int64(n))
+			}
+		}
+	}()
+	// Datagrams from the client are unwrapped and sent on
+	go func() {
+		buf := make([]byte, 64<<10)
+		for {
+			n, from, err := relay.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if from.Addr().Unmap() != clientIP.Addr().Unmap() {
+				continue
+			}
+			mu.Lock()
+			if !client.IsValid() {
+				client = from
+			}
+			fromClient := from == client
+			mu.Unlock()
+			if !fromClient {
+				continue
+			}
+			addr, payload, err := socks5.ParseDatagram(buf[:n])
+			if err != nil {
+				continue
+			}
+			dest, err := m.resolveDatagram(ctx, conn, addr)
+			if err != nil {
+				continue
+			}
+			mu.Lock()
+			added := peers.add(dest, time.Now())
+			mu.Unlock()
+			if !added {
+				continue
+			}
+			outbound.WriteToUDPAddrPort(payload, dest)
+			m.Metrics.addBytes("request", int64(len(payload)))
+		}
+	}()
+
+	// The association lasts as long as the control connection
+	io.Copy(io.Discard, conn)
+}
+
+// socksPeers are the destinations a UDP association's client has sent to,
+// with when it last did
+type socksPeers map[netip.AddrPort]time.Time
+
+// add records that the client sends to dest at now. It reports false,
+// leaving the peers as they are, when dest is new and maxSOCKSPeers others
+// are still active.
+func (p *socksPeers) add(dest netip.AddrPort, now time.Time) bool {
+	if *p == nil {
+		*p = make(socksPeers)
+	}
+	if _, ok := (*p)[dest]; !ok && len(*p) >= maxSOCKSPeers {
+		for peer, sent := range *p {
+			if now.Sub(sent) >= socksPeerIdle {
+				delete(*p, peer)
+			}
+		}
+		if len(*p) >= maxSOCKSPeers {
+			return false
+		}
+	}
+	(*p)[dest] = now
+	return true
+}
+
+// known reports whether replies from peer are relayed at now
+func (p socksPeers) known(peer netip.AddrPort, now time.Time) bool {
+	sent, ok := p[peer]
+	return ok && now.Sub(sent) < socksPeerIdle
+}
+
+// resolveDatagram resolves the destination of a client datagram and checks
+// it against the destination ACL in ctx
+func (m *MITMProxy) resolveDatagram(ctx context.Context, conn net.Conn, addr string) (netip.AddrPort, error) {
+	if upstreamFrom(ctx).Proxy(addr) != nil {
+		return netip.AddrPort{}, errors.New("routed through an upstream proxy")
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	port, _ := strconv.Atoi(portStr)
+	d := destinationsFrom(ctx)
+	named, err := d.CheckName(host, port)
+	if err != nil {
+		m.socksDenied(conn, addr, err)
+		return netip.AddrPort{}, err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil || len(ips) == 0 {
+			return netip.AddrPort{}, errors.New("no address for " + host)
+		}
+		ip = ips[0]
+	}
+	ip = ip.Unmap()
+	if err := d.CheckAddr(ip, port, named); err != nil {
+		m.socksDenied(conn, addr, err)
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(ip, uint16(port)), nil
+}
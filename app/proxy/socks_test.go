@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/flow"
+	"nproxy/app/socks5"
+)
+
+// startSOCKS serves p's SOCKS listener on a loopback port until ctx is done
+// and returns its address
+func startSOCKS(t *testing.T, ctx context.Context, p *MITMProxy) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.ServeSOCKS(ctx, ln) }()
+	t.Cleanup(func() {
+		if err := <-served; err != nil {
+			t.Errorf("ServeSOCKS: %v", err)
+		}
+	})
+	return ln.Addr().String()
+}
+
+// newSOCKSClient returns a client that connects through the SOCKS listener
+// at addr and trusts the CA of p
+func newSOCKSClient(p *MITMProxy, addr string, user *url.Userinfo) *http.Client {
+	pool := x509.NewCertPool()
+	pool.AddCert(p.CA)
+	transport := &http.Transport{
+		Proxy:           http.ProxyURL(&url.URL{Scheme: "socks5", Host: addr, User: user}),
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	return &http.Client{Transport: transport, Timeout: 5 * time.Second}
+}
+
+func TestMITMProxy_SOCKS(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "reached")
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	flows := make(chan *flow.Flow, 10)
+	p.OnFlow = func(f *flow.Flow) { flows <- f }
+	addr := startSOCKS(t, ctx, p)
+	client := newSOCKSClient(p, addr, nil)
+	defer client.CloseIdleConnections()
+
+	// TLS and plain HTTP are both intercepted and recorded as flows
+	for _, target := range []string{secure.URL, plain.URL} {
+		resp, err := client.Get(target + "/path")
+		if err != nil {
+			t.Fatalf("GET %s through SOCKS: %v", target, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "reached" {
+			t.Errorf("Expected the target's body, got %q", body)
+		}
+		select {
+		case f := <-flows:
+			if f.URL != target+"/path" {
+				t.Errorf("Expected a flow for %s/path, got %s", target, f.URL)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a flow for %s", target)
+		}
+	}
+
+	// Other protocols are tunnelled untouched
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		c, err := echo.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "banner\n") // the server speaks first
+		io.Copy(c, c)
+	}()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial the SOCKS listener: %v", err)
+	}
+	defer conn.Close()
+	if err := socks5.Connect(conn, echo.Addr().String(), nil); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len("banner\nping"))
+	if _, err := io.ReadFull(conn, buf[:len("banner\n")]); err != nil {
+		t.Fatalf("Failed to read the banner: %v", err)
+	}
+	io.WriteString(conn, "ping")
+	if _, err := io.ReadFull(conn, buf[len("banner\n"):]); err != nil || string(buf) != "banner\nping" {
+		t.Errorf("Expected the tunnel to relay the exchange, got %q %v", buf, err)
+	}
+}
+
+func TestMITMProxy_SOCKSAccessControl(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	addr := startSOCKS(t, ctx, p)
+	dial := func(auth *socks5.Auth) error {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Failed to dial the SOCKS listener: %v", err)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		return socks5.Connect(conn, target.Listener.Addr().String(), auth)
+	}
+
+	p.Reload(Settings{Auth: bobAuth(t)})
+	if err := dial(nil); !errors.Is(err, socks5.ErrAuthFailed) {
+		t.Errorf("Expected a client without credentials to be refused, got %v", err)
+	}
+	if err := dial(&socks5.Auth{Username: "bob", Password: "wrong"}); !errors.Is(err, socks5.ErrAuthFailed) {
+		t.Errorf("Expected wrong credentials to be refused, got %v", err)
+	}
+	if err := dial(&socks5.Auth{Username: "bob", Password: "secret"}); err != nil {
+		t.Errorf("Expected bob to connect, got %v", err)
+	}
+
+	denied, _ := acl.NewDestinations(nil, nil, true)
+	p.Reload(Settings{Destinations: denied})
+	if err := dial(nil); err == nil || !strings.Contains(err.Error(), socks5.NotAllowed.String()) {
+		t.Errorf("Expected the loopback target to be refused, got %v", err)
+	}
+}
+
+func TestMITMProxy_SOCKSUDP(t *testing.T) {
+	echo, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := echo.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			echo.WriteTo(buf[:n], from)
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.SOCKSUDP = true
+	addr := startSOCKS(t, ctx, p)
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to dial the SOCKS listener: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// The client's greeting and request, then the reply with the relay address
+	conn.Write([]byte{5, 1, 0})
+	conn.Write([]byte{5, byte(socks5.CommandUDPAssociate), 0, 1, 0, 0, 0, 0, 0, 0})
+	reply := make([]byte, 2+10)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatalf("Failed to read the UDP ASSOCIATE reply: %v", err)
+	}
+	if reply[3] != byte(socks5.Succeeded) {
+		t.Fatalf("Expected UDP ASSOCIATE to succeed, got %v", socks5.Reply(reply[3]))
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[6:10]), Port: int(reply[10])<<8 | int(reply[11])}
+
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer udp.Close()
+	msg, _ := socks5.AppendDatagram(nil, echo.LocalAddr().String(), []byte("ping"))
+	udp.WriteTo(msg, relay)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := udp.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("Expected the echo through the relay: %v", err)
+	}
+	from, payload, err := socks5.ParseDatagram(buf[:n])
+	if err != nil || from != echo.LocalAddr().String() || string(payload) != "ping" {
+		t.Errorf("Expected ping from %s, got %q from %s (%v)", echo.LocalAddr(), payload, from, err)
+	}
+
+	// The client is where the first datagram came from; other ports on the
+	// same host aren't relayed for
+	other, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer other.Close()
+	other.WriteTo(msg, relay)
+	other.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := other.ReadFrom(buf); err == nil {
+		t.Error("Expected no reply to a datagram from another port")
+	}
+}
+
+func TestSOCKSPeers(t *testing.T) {
+	var peers socksPeers
+	now := time.Now()
+	for i := 0; i < maxSOCKSPeers; i++ {
+		if !peers.add(netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 53), now) {
+			t.Fatalf("Expected peer %d to be added", i)
+		}
+	}
+	first := netip.MustParseAddrPort("10.0.0.0:53")
+	extra := netip.MustParseAddrPort("192.0.2.1:53")
+	if peers.add(extra, now) || peers.known(extra, now) {
+		t.Error("Expected a new peer to be refused while the others are active")
+	}
+	if !peers.add(first, now) {
+		t.Error("Expected a known peer to be refreshed when full")
+	}
+
+	later := now.Add(socksPeerIdle)
+	if peers.known(first, later) {
+		t.Error("Expected replies from an idle peer to be dropped")
+	}
+	if !peers.add(extra, later) || !peers.known(extra, later) || len(peers) != 1 {
+		t.Errorf("Expected idle peers to make room, got %d peers", len(peers))
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http/httptrace"
+	"net/netip"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nproxy/app/flow"
+	"nproxy/app/upstream"
+)
+
+// flowTimer collects the timing breakdown of a single flow. Upstream phases
+// are filled in by httptrace callbacks, which may run on transport
+// goroutines, so all access goes through the mutex.
+type flowTimer struct {
+	start time.Time
+
+	mu                                                      sync.Mutex
+	t                                                       flow.Timings
+	dnsStart, connectStart, tlsStart, gotConn, wroteRequest time.Time
+}
+
+func newFlowTimer() *flowTimer {
+	return &flowTimer{start: time.Now()}
+}
+
+// Field selectors for flowTimer.add and flowTimer.measure
+var (
+	clientRead   = func(t *flow.Timings) *time.Duration { return &t.ClientRead }
+	requestWrite = func(t *flow.Timings) *time.Duration { return &t.RequestWrite }
+	ttfb         = func(t *flow.Timings) *time.Duration { return &t.TTFB }
+	bodyTransfer = func(t *flow.Timings) *time.Duration { return &t.BodyTransfer }
+	handlerTime  = func(t *flow.Timings) *time.Duration { return &t.Handler }
+)
+
+// add accumulates d into the phase selected by field
+func (ft *flowTimer) add(field func(*flow.Timings) *time.Duration, d time.Duration) {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	*field(&ft.t) += d
+}
+
+// measure runs f and adds its duration to the selected phase
+func (ft *flowTimer) measure(field func(*flow.Timings) *time.Duration, f func()) {
+	start := time.Now()
+	f()
+	ft.add(field, time.Since(start))
+}
+
+// timings returns a snapshot of the breakdown with Total set to the time
+// elapsed so far
+func (ft *flowTimer) timings() flow.Timings {
+	ft.mu.Lock()
+	defer ft.mu.Unlock()
+	t := ft.t
+	t.Total = time.Since(ft.start)
+	return t
+}
+
+// trace returns an httptrace hook that fills in the upstream phases
+func (ft *flowTimer) trace() *httptrace.ClientTrace {
+	locked := func(f func()) {
+		ft.mu.Lock()
+		defer ft.mu.Unlock()
+		f()
+	}
+	since := func(start time.Time, d *time.Duration) {
+		if !start.IsZero() {
+			*d = time.Since(start)
+		}
+	}
+
+	return &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) { locked(func() { ft.dnsStart = time.Now() }) },
+		DNSDone:  func(httptrace.DNSDoneInfo) { locked(func() { since(ft.dnsStart, &ft.t.DNS) }) },
+		ConnectStart: func(string, string) {
+			locked(func() { ft.connectStart = time.Now() })
+		},
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil {
+				locked(func() { since(ft.connectStart, &ft.t.Connect) })
+			}
+		},
+		TLSHandshakeStart: func() { locked(func() { ft.tlsStart = time.Now() }) },
+		TLSHandshakeDone: func(_ tls.ConnectionState, err error) {
+			if err == nil {
+				locked(func() { since(ft.tlsStart, &ft.t.TLS) })
+			}
+		},
+		GotConn: func(httptrace.GotConnInfo) { locked(func() { ft.gotConn = time.Now() }) },
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			locked(func() {
+				ft.wroteRequest = time.Now()
+				since(ft.gotConn, &ft.t.RequestWrite)
+			})
+		},
+		GotFirstResponseByte: func() { locked(func() { since(ft.wroteRequest, &ft.t.TTFB) }) },
+	}
+}
+
+// dialTimed connects to addr, recording DNS resolution and TCP connect times
+// separately in t. Every resolved address is tried in order until one
+// succeeds. The destination ACL in ctx is checked before resolving and for
+// every address before it is tried.
+//
+// When the router in ctx picks an upstream proxy, the connection is made
+// through it instead. The proxy resolves addr, so the ACL is only checked
+// by name and the connect time includes the proxy handshake.
+func dialTimed(ctx context.Context, addr string, t *flow.Timings) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := destinationsFrom(ctx)
+	portNum, _ := strconv.Atoi(port)
+	if u := upstreamFrom(ctx).Proxy(addr); u != nil {
+		if err := d.CheckUnresolved(host, portNum); err != nil {
+			return nil, err
+		}
+		var dialer net.Dialer
+		start := time.Now()
+		conn, err := upstream.Dial(ctx, u, addr, dialer.DialContext)
+		if err != nil {
+			return nil, err
+		}
+		t.Connect = time.Since(start)
+		return conn, nil
+	}
+	named, err := d.CheckName(host, portNum)
+	if err != nil {
+		return nil, err
+	}
+
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		start := time.Now()
+		ips, err = net.DefaultResolver.LookupHost(ctx, host)
+		t.DNS = time.Since(start)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var dialer net.Dialer
+	start := time.Now()
+	for _, ip := range ips {
+		if addr, parseErr := netip.ParseAddr(ip); parseErr == nil {
+			if err := d.CheckAddr(addr, portNum, named); err != nil {
+				return nil, err
+			}
+		}
+		var conn net.Conn
+		conn, err = dialer.DialContext(ctx, "tcp", net.JoinHostPort(ip, port))
+		if err == nil {
+			t.Connect = time.Since(start)
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// countingReader counts the bytes read through it and the time spent
+// waiting in Read, optionally keeping a copy of the first bytes. It may be
+// read by a transport goroutine while the handler inspects it, so the
+// counters are atomic.
+type countingReader struct {
+	r       io.ReadCloser
+	n       atomic.Int64
+	elapsed atomic.Int64
+	capture *bodyCapture
+}
+
+// newCountingReader wraps r, capturing up to captureLimit bytes of it
+func newCountingReader(r io.ReadCloser, captureLimit int) *countingReader {
+	c := &countingReader{r: r}
+	if captureLimit > 0 {
+		c.capture = &bodyCapture{limit: captureLimit}
+	}
+	return c
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := c.r.Read(p)
+	c.elapsed.Add(int64(time.Since(start)))
+	c.n.Add(int64(n))
+	if c.capture != nil {
+		c.capture.Write(p[:n])
+	}
+	return n, err
+}
+
+func (c *countingReader) Close() error {
+	return c.r.Close()
+}
+
+// count returns the number of bytes read so far
+func (c *countingReader) count() int64 {
+	return c.n.Load()
+}
+
+// duration returns the time spent inside Read so far
+func (c *countingReader) duration() time.Duration {
+	return time.Duration(c.elapsed.Load())
+}
+
+// captured returns the bytes kept so far and whether more were read
+func (c *countingReader) captured() ([]byte, bool) {
+	if c.capture == nil {
+		return nil, c.count() > 0
+	}
+	return c.capture.bytes()
+}
+
+// bodyCapture keeps the first limit bytes written to it
+type bodyCapture struct {
+	mu        sync.Mutex
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *bodyCapture) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if room := b.limit - len(b.buf); len(p) > room {
+		b.buf = append(b.buf, p[:room]...)
+		b.truncated = true
+	} else {
+		b.buf = append(b.buf, p...)
+	}
+	return len(p), nil
+}
+
+func (b *bodyCapture) bytes() ([]byte, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf...), b.truncated
+}
@@ -0,0 +1,191 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+func TestFlowTimer_Measure(t *testing.T) {
+	ft := newFlowTimer()
+	ft.measure(handlerTime, func() { time.Sleep(5 * time.Millisecond) })
+	ft.add(handlerTime, time.Millisecond)
+
+	timings := ft.timings()
+	if timings.Handler < 6*time.Millisecond {
+		t.Errorf("Expected handler time of at least 6ms, got %v", timings.Handler)
+	}
+	if timings.Total < timings.Handler-time.Millisecond {
+		t.Errorf("Expected total %v to cover handler time %v", timings.Total, timings.Handler)
+	}
+}
+
+func TestCountingReader(t *testing.T) {
+	r := newCountingReader(io.NopCloser(strings.NewReader("hello world")), 0)
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Failed to read: %v", err)
+	}
+
+	if string(data) != "hello world" {
+		t.Errorf("Expected 'hello world', got '%s'", data)
+	}
+	if r.count() != int64(len(data)) {
+		t.Errorf("Expected count %d, got %d", len(data), r.count())
+	}
+	if body, truncated := r.captured(); body != nil || !truncated {
+		t.Errorf("Expected nothing captured without a limit, got %q (truncated=%v)", body, truncated)
+	}
+}
+
+func TestCountingReader_Capture(t *testing.T) {
+	tests := []struct {
+		limit     int
+		expected  string
+		truncated bool
+	}{
+		{5, "hello", true},
+		{11, "hello world", false},
+		{100, "hello world", false},
+	}
+
+	for _, test := range tests {
+		r := newCountingReader(io.NopCloser(strings.NewReader("hello world")), test.limit)
+		io.Copy(io.Discard, r)
+
+		body, truncated := r.captured()
+		if string(body) != test.expected || truncated != test.truncated {
+			t.Errorf("limit %d: expected %q (truncated=%v), got %q (truncated=%v)",
+				test.limit, test.expected, test.truncated, body, truncated)
+		}
+	}
+}
+
+func TestMITMProxy_FlowTimings(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("slow"))
+	}))
+	defer targetServer.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	proxy.ServerTiming = true
+	proxy.SetHandler(func(req *http.Request, resp *http.Response) {})
+
+	var flows []*flow.Flow
+	proxy.OnFlow = func(f *flow.Flow) { flows = append(flows, f) }
+
+	req := httptest.NewRequest("GET", targetServer.URL+"/slow", nil)
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, req, "")
+
+	if len(flows) != 1 {
+		t.Fatalf("Expected 1 flow, got %d", len(flows))
+	}
+	f := flows[0]
+
+	if f.Status != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", f.Status)
+	}
+	if f.URL != targetServer.URL+"/slow" {
+		t.Errorf("Expected URL %s, got %s", targetServer.URL+"/slow", f.URL)
+	}
+	if f.Timings.Connect <= 0 {
+		t.Error("Expected a connect time")
+	}
+	if f.Timings.TTFB < 10*time.Millisecond {
+		t.Errorf("Expected TTFB of at least 10ms, got %v", f.Timings.TTFB)
+	}
+	if f.Timings.Handler <= 0 {
+		t.Error("Expected handler time to be recorded")
+	}
+	if f.Timings.Total < f.Timings.TTFB {
+		t.Errorf("Expected total %v to cover TTFB %v", f.Timings.Total, f.Timings.TTFB)
+	}
+
+	serverTiming := w.Header().Get("Server-Timing")
+	if !strings.Contains(serverTiming, "ttfb;dur=") || !strings.Contains(serverTiming, "connect;dur=") {
+		t.Errorf("Unexpected Server-Timing header: %q", serverTiming)
+	}
+}
+
+func TestMITMProxy_ServerTimingDisabled(t *testing.T) {
+	targetServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer targetServer.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	proxy.handleHTTP(w, httptest.NewRequest("GET", targetServer.URL, nil), "")
+
+	if v := w.Header().Get("Server-Timing"); v != "" {
+		t.Errorf("Expected no Server-Timing header, got %q", v)
+	}
+}
+
+func TestMITMProxy_TunnelFlowTimings(t *testing.T) {
+	targetServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer targetServer.Close()
+
+	proxy, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	proxy.ServerTiming = true
+
+	var mu sync.Mutex
+	var flows []*flow.Flow
+	proxy.OnFlow = func(f *flow.Flow) {
+		mu.Lock()
+		defer mu.Unlock()
+		flows = append(flows, f)
+	}
+
+	proxyServer := httptest.NewServer(http.HandlerFunc(proxy.handleRequest))
+	defer proxyServer.Close()
+
+	client := newProxiedClient(t, proxy, proxyServer.URL)
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(targetServer.URL + "/")
+		if err != nil {
+			t.Fatalf("Failed to send request through proxy: %v", err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+
+		if !strings.Contains(resp.Header.Get("Server-Timing"), "ttfb;dur=") {
+			t.Errorf("Unexpected Server-Timing header: %q", resp.Header.Get("Server-Timing"))
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(flows) != 2 {
+		t.Fatalf("Expected 2 flows, got %d", len(flows))
+	}
+
+	// Both requests share one tunnel, so only the first pays for the handshake
+	if flows[0].Timings.TLS <= 0 || flows[0].Timings.Connect <= 0 {
+		t.Errorf("Expected first flow to carry connection timings, got %+v", flows[0].Timings)
+	}
+	if flows[1].Timings.TLS != 0 || flows[1].Timings.Connect != 0 {
+		t.Errorf("Expected second flow to have no connection timings, got %+v", flows[1].Timings)
+	}
+	if !strings.HasPrefix(flows[0].URL, "https://") {
+		t.Errorf("Expected an https URL, got %s", flows[0].URL)
+	}
+}
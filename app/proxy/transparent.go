@@ -0,0 +1,189 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/flow"
+)
+
+// transparentHandshakeTimeout bounds how long a redirected client may take
+// to send its ClientHello or request head
+const transparentHandshakeTimeout = 30 * time.Second
+
+// ServeTransparent accepts connections redirected to ln by the firewall,
+// e.g. with iptables REDIRECT or TPROXY, from clients that aren't configured
+// to use a proxy. Each connection goes to the address it was originally
+// sent to, through the same pipeline as CONNECT tunnels: TLS is intercepted
+// with a certificate for the server name in the ClientHello, plain HTTP is
+// relayed request by request, and any other protocol is tunnelled
+// untouched.
+//
+// Redirected clients can't authenticate, so Auth doesn't apply; the client
+// ACL does, and so do the destination ACL and upstream proxies, which see
+// the original address. ServeTransparent returns nil once ctx is done or
+// the proxy is shut down.
+func (m *MITMProxy) ServeTransparent(ctx context.Context, ln net.Listener) error {
+	return m.serveListener(ctx, ln, func(ctx context.Context, conn net.Conn) {
+		m.handleTransparent(ctx, conn, ln.Addr())
+	})
+}
+
+// originalDst recovers the address a redirected connection was sent to
+func originalDst(conn net.Conn) (netip.AddrPort, error) {
+	if dst, err := natDestination(conn); err == nil {
+		return dst, nil
+	}
+	// TPROXY keeps the original address as the local one
+	local, err := netip.ParseAddrPort(conn.LocalAddr().String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return netip.AddrPortFrom(local.Addr().Unmap(), local.Port()), nil
+}
+
+// handleTransparent serves one redirected connection accepted on the
+// listener at listenAddr
+func (m *MITMProxy) handleTransparent(ctx context.Context, conn net.Conn, listenAddr net.Addr) {
+	defer conn.Close()
+
+	m.settingsMu.RLock()
+	clients, destinations, router := m.Clients, m.Destinations, m.Upstream
+	m.settingsMu.RUnlock()
+
+	if err := clients.CheckRemoteAddr(conn.RemoteAddr().String()); err != nil {
+		m.transparentDenied(conn, "connection", err)
+		return
+	}
+	lookup := m.originalDst
+	if lookup == nil {
+		lookup = originalDst
+	}
+	dst, err := lookup(conn)
+	if err != nil {
+		log.Printf("No original destination for %s: %v", conn.RemoteAddr(), err)
+		return
+	}
+	// A connection that wasn't redirected would loop back to the listener
+	local, _ := netip.ParseAddrPort(conn.LocalAddr().String())
+	if listen, err := netip.ParseAddrPort(listenAddr.String()); err == nil && dst.Port() == listen.Port() && dst.Addr() == local.Addr().Unmap() {
+		log.Printf("Refusing connection from %s made to the transparent listener itself", conn.RemoteAddr())
+		return
+	}
+
+	clientConn := newPeekedConn(conn)
+	mode := sniff(clientConn)
+	conn.SetReadDeadline(time.Now().Add(transparentHandshakeTimeout))
+	var name string
+	switch mode {
+	case "tls":
+		name = clientHelloServerName(clientConn.r)
+	case "http":
+		name = requestHost(clientConn.r)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	// The name comes from the client and needn't belong to the address it
+	// connected to, so it can only get the connection refused: allow
+	// entries for it don't lift checks on the address.
+	host := dst.String()
+	if name != "" {
+		host = net.JoinHostPort(name, strconv.Itoa(int(dst.Port())))
+		if _, err := destinations.CheckName(name, int(dst.Port())); err != nil {
+			m.transparentDenied(conn, host, err)
+			return
+		}
+		log.Printf("Transparent %s connection to %s (%s)", mode, dst, name)
+	} else {
+		log.Printf("Transparent %s connection to %s", mode, dst)
+	}
+
+	ctx = withUpstream(withDestinations(ctx, destinations), router)
+	var timings flow.Timings
+	targetConn, err := m.dialTunnel(ctx, dst.String(), &timings)
+	if err != nil {
+		if !m.transparentDenied(conn, dst.String(), err) {
+			log.Printf("Failed to connect to target %s: %v", dst, err)
+			reportLimit(m.Metrics, err, "transparent connection to "+dst.String())
+			m.Metrics.upstreamError(err)
+		}
+		return
+	}
+	target := newTunnelTarget(dst.String(), targetConn)
+	defer target.close()
+
+	m.Metrics.transparentConnection(mode)
+	m.relaySniffed(ctx, clientConn, target, mode, host, timings, "")
+}
+
+// transparentDenied logs and counts err if it is an ACL refusal, reporting
+// whether it was
+func (m *MITMProxy) transparentDenied(conn net.Conn, target string, err error) bool {
+	var denied *acl.DeniedError
+	if !errors.As(err, &denied) {
+		return false
+	}
+	log.Printf("Access denied for transparent %s from %s: %v", target, conn.RemoteAddr(), denied)
+	m.Metrics.accessDenied(denied)
+	return true
+}
+
+// errHelloRead stops the handshake in clientHelloServerName once the
+// ClientHello is parsed
+var errHelloRead = errors.New("ClientHello read")
+
+// clientHelloServerName returns the server name in the TLS ClientHello
+// record at the start of r, without consuming it. It returns "" when the
+// client sent no server name or the record isn't a ClientHello.
+func clientHelloServerName(r *bufio.Reader) string {
+	head, err := r.Peek(5)
+	if err != nil {
+		return ""
+	}
+	record, err := r.Peek(5 + int(binary.BigEndian.Uint16(head[3:5])))
+	if err != nil {
+		return ""
+	}
+	var name string
+	tls.Server(helloConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	return name
+}
+
+// helloConn feeds a peeked ClientHello to tls.Server and discards what it
+// writes back
+type helloConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c helloConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c helloConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// requestHost returns the host named by the HTTP request whose head is
+// buffered in r, without consuming it. It returns "" when the head hasn't
+// arrived in full or names no host.
+func requestHost(r *bufio.Reader) string {
+	buffered, _ := r.Peek(r.Buffered())
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buffered)))
+	if err != nil {
+		return ""
+	}
+	return extractHostname(req.Host)
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/flow"
+)
+
+// redirector stands in for the firewall, making every connection to a
+// proxy's transparent listener look as if it had been redirected from the
+// current target
+type redirector struct {
+	target atomic.Pointer[netip.AddrPort]
+}
+
+// redirect installs a redirector in p, which must not be serving yet
+func redirect(p *MITMProxy) *redirector {
+	r := &redirector{}
+	p.originalDst = func(net.Conn) (netip.AddrPort, error) { return *r.target.Load(), nil }
+	return r
+}
+
+// to redirects the connections made from now on from target
+func (r *redirector) to(target string) {
+	dst := netip.MustParseAddrPort(target)
+	r.target.Store(&dst)
+}
+
+func TestMITMProxy_Transparent(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "reached "+r.Host)
+	})
+	plain := httptest.NewServer(handler)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(handler)
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	flows := make(chan *flow.Flow, 10)
+	p.OnFlow = func(f *flow.Flow) { flows <- f }
+	redirected := redirect(p)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	served := make(chan error, 1)
+	go func() { served <- p.ServeTransparent(ctx, ln) }()
+	defer func() {
+		cancel()
+		if err := <-served; err != nil {
+			t.Errorf("ServeTransparent: %v", err)
+		}
+	}()
+
+	// The client resolves every name to the transparent listener, as a
+	// redirecting firewall would make it appear
+	pool := x509.NewCertPool()
+	pool.AddCert(p.CA)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, ln.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{RootCAs: pool},
+	}
+	defer transport.CloseIdleConnections()
+	client := &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	get := func(target string) (string, error) {
+		resp, err := client.Get(target)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	for _, server := range []*httptest.Server{secure, plain} {
+		redirected.to(server.Listener.Addr().String())
+		_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		scheme := strings.SplitN(server.URL, ":", 2)[0]
+		target := scheme + "://app.example:" + port + "/path"
+
+		// The certificate is made for the ClientHello's server name, which
+		// the client verifies
+		body, err := get(target)
+		if err != nil {
+			t.Fatalf("GET %s: %v", target, err)
+		}
+		if body != "reached app.example:"+port {
+			t.Errorf("Expected the original destination to be reached, got %q", body)
+		}
+		select {
+		case f := <-flows:
+			if f.URL != target {
+				t.Errorf("Expected a flow for %s, got %s", target, f.URL)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected a flow for %s", target)
+		}
+		transport.CloseIdleConnections()
+	}
+
+	// Names are checked by the destination ACL
+	denied, _ := acl.NewDestinations(nil, []string{"blocked.example"}, false)
+	p.Reload(Settings{Destinations: denied})
+	_, port, _ := net.SplitHostPort(plain.Listener.Addr().String())
+	if _, err := get("http://blocked.example:" + port + "/"); err == nil {
+		t.Error("Expected a denied name to be refused")
+	}
+	if _, err := get("http://allowed.example:" + port + "/"); err != nil {
+		t.Errorf("Expected other names to be allowed, got %v", err)
+	}
+}
+
+func TestMITMProxy_TransparentLoop(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	go p.ServeTransparent(ctx, ln)
+
+	// A connection that wasn't redirected has the listener as its original
+	// destination and must not be relayed back to it
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if _, err := http.ReadResponse(bufio.NewReader(conn), nil); err == nil {
+		t.Error("Expected the connection to be closed")
+	}
+	if n := p.ActiveTunnels(); n != 0 {
+		t.Errorf("Expected no tunnels, got %d", n)
+	}
+}
+
+func TestClientHelloServerName(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		tls.Client(client, &tls.Config{ServerName: "app.example"}).Handshake()
+		client.Close()
+	}()
+	r := bufio.NewReaderSize(server, 5+16<<10)
+	if name := clientHelloServerName(r); name != "app.example" {
+		t.Errorf("Expected app.example, got %q", name)
+	}
+	// The ClientHello is still there for the real handshake
+	if b, _ := r.Peek(1); len(b) != 1 || b[0] != 0x16 {
+		t.Errorf("Expected the ClientHello to be left unread, got %v", b)
+	}
+}
@@ -0,0 +1,299 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"nproxy/app/flow"
+	"nproxy/app/limits"
+	"nproxy/app/transport"
+	"nproxy/app/upstream"
+)
+
+type upstreamKey struct{}
+
+// withUpstream returns ctx carrying the router that picks the upstream
+// proxy for dials made with it
+func withUpstream(ctx context.Context, r *upstream.Router) context.Context {
+	if r == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, upstreamKey{}, r)
+}
+
+func upstreamFrom(ctx context.Context) *upstream.Router {
+	r, _ := ctx.Value(upstreamKey{}).(*upstream.Router)
+	return r
+}
+
+// forwarder is a proxy's transport, which pools upstream connections
+// across its flows. It sends plain HTTP requests on, either directly or
+// through the upstream proxy picked by the router in the request context.
+// Requests through a proxy are checked against the destination ACL by name,
+// since the proxy resolves the host; direct ones are checked address by
+// address as they are dialed.
+//
+// Requests intercepted on a tunnel, whose context carries the tunnel's
+// target, are sent to the address the tunnel was opened to over
+// connections dialed the way the tunnel was, with TLS to the server name
+// the client asked for. They are pooled apart from forwarded requests,
+// whose upstream certificates are always verified, and requests to
+// upgrade the connection are sent over HTTP/1. Pools are keyed by address,
+// so a tunnel whose server name isn't the host it was opened to keeps its
+// connections to itself.
+type forwarder struct {
+	direct, proxied      *http.Transport
+	tunneled, tunneledH1 *http.Transport
+
+	settings transport.Settings
+	timeouts limits.Timeouts
+}
+
+// newForwarder creates the transport of a proxy from the settings s. Dials
+// and idle connections are bounded by the upstream timeouts t; the other
+// upstream timeouts apply per request.
+func newForwarder(s transport.Settings, t limits.Timeouts) *forwarder {
+	dialer := s.Dialer()
+	direct := transport.New(s, t.Idle)
+	direct.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialWithin(ctx, t.Dial, func(ctx context.Context) (net.Conn, error) {
+			return dialForward(ctx, dialer, network, addr)
+		})
+	}
+
+	proxied := transport.New(s, t.Idle)
+	proxied.Proxy = func(req *http.Request) (*url.URL, error) {
+		return upstreamFrom(req.Context()).Proxy(canonicalAddr(req.URL)), nil
+	}
+	proxied.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialWithin(ctx, t.Dial, func(ctx context.Context) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, addr)
+		})
+	}
+
+	return &forwarder{
+		direct:     direct,
+		proxied:    proxied,
+		tunneled:   newTunnelTransport(s, t, true),
+		tunneledH1: newTunnelTransport(s, t, false),
+		settings:   s,
+		timeouts:   t,
+	}
+}
+
+// newTunnelTransport creates the transport for intercepted requests,
+// offering HTTP/2 when s allows it and h2 is true. Handshakes are bounded
+// here rather than per request, since net/http leaves them to custom TLS
+// dials, and reported to the request's trace like its own.
+func newTunnelTransport(s transport.Settings, t limits.Timeouts, h2 bool) *http.Transport {
+	tr := transport.New(s, t.Idle)
+	if !h2 {
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return dialTunneled(ctx, t.Dial, addr)
+	}
+	tr.DialTLSContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialTunneled(ctx, t.Dial, addr)
+		if err != nil {
+			return nil, err
+		}
+		serverName := tunnelFrom(ctx).serverName
+		if serverName == "" {
+			serverName = extractHostname(addr)
+		}
+		return handshakeWithin(ctx, t.TLSHandshake, tls.Client(conn, s.InterceptConfig(serverName, h2)))
+	}
+	return tr
+}
+
+func (f *forwarder) RoundTrip(req *http.Request) (*http.Response, error) {
+	if tunnel := tunnelFrom(req.Context()); tunnel != nil {
+		h2 := req.Header.Get("Upgrade") == ""
+		if !tunnel.shared() {
+			return tunnel.transport(h2, func() *http.Transport {
+				return newTunnelTransport(f.settings, f.timeouts, h2)
+			}).RoundTrip(req)
+		}
+		if !h2 {
+			return f.tunneledH1.RoundTrip(req)
+		}
+		return f.tunneled.RoundTrip(req)
+	}
+	addr := canonicalAddr(req.URL)
+	if upstreamFrom(req.Context()).Proxy(addr) == nil {
+		return f.direct.RoundTrip(req)
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	portNum, _ := strconv.Atoi(port)
+	if err := destinationsFrom(req.Context()).CheckUnresolved(host, portNum); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return f.proxied.RoundTrip(req)
+}
+
+// CloseIdleConnections closes the pooled connections to targets and
+// upstream proxies
+func (f *forwarder) CloseIdleConnections() {
+	for _, tr := range []*http.Transport{f.direct, f.proxied, f.tunneled, f.tunneledH1} {
+		tr.CloseIdleConnections()
+	}
+}
+
+type tunnelKey struct{}
+
+// tunnelTarget is where the requests intercepted on a tunnel go: the
+// address the tunnel was opened to and, for TLS, the server name the
+// client asked for. The connection dialed to open the tunnel is handed to
+// the transport for the first request that needs a new one.
+type tunnelTarget struct {
+	addr       string
+	serverName string
+
+	mu        sync.Mutex
+	conn      net.Conn        // nil once taken
+	own, own1 *http.Transport // when not shared: with HTTP/2 allowed and HTTP/1 only
+}
+
+func newTunnelTarget(addr string, conn net.Conn) *tunnelTarget {
+	return &tunnelTarget{addr: addr, conn: conn}
+}
+
+// take returns the tunnel's own connection the first time it is asked for
+// one to addr, and nil after that
+func (t *tunnelTarget) take(addr string) net.Conn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if addr != t.addr {
+		return nil
+	}
+	conn := t.conn
+	t.conn = nil
+	return conn
+}
+
+// shared reports whether the tunnel's requests may share pooled
+// connections with other tunnels to the same address, which they may when
+// they aren't sent over TLS or the server name is the address's host
+func (t *tunnelTarget) shared() bool {
+	return t.serverName == "" || t.serverName == extractHostname(t.addr)
+}
+
+// names reports whether host, the Host header of a request sent over the
+// tunnel with scheme, is the address the tunnel goes to and the server name
+// it was opened for. Only then is the response known to come from the
+// server host names, so that it may be cached under it.
+func (t *tunnelTarget) names(host, scheme string) bool {
+	u := &url.URL{Scheme: scheme, Host: host}
+	return strings.EqualFold(canonicalAddr(u), canonicalAddr(&url.URL{Scheme: scheme, Host: t.addr})) &&
+		(t.serverName == "" || strings.EqualFold(t.serverName, u.Hostname()))
+}
+
+// transport returns the tunnel's own transport for requests that allow
+// HTTP/2 or, when h2 is false, for HTTP/1 only, creating it with newTransport
+// the first time
+func (t *tunnelTarget) transport(h2 bool, newTransport func() *http.Transport) *http.Transport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr := &t.own
+	if !h2 {
+		tr = &t.own1
+	}
+	if *tr == nil {
+		*tr = newTransport()
+	}
+	return *tr
+}
+
+// close closes the tunnel's own connection if no request took it, and the
+// idle connections of its own transports
+func (t *tunnelTarget) close() {
+	if conn := t.take(t.addr); conn != nil {
+		conn.Close()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range []*http.Transport{t.own, t.own1} {
+		if tr != nil {
+			tr.CloseIdleConnections()
+		}
+	}
+}
+
+// withTunnel returns ctx carrying the target of the tunnel that requests
+// made with it were intercepted on
+func withTunnel(ctx context.Context, t *tunnelTarget) context.Context {
+	return context.WithValue(ctx, tunnelKey{}, t)
+}
+
+func tunnelFrom(ctx context.Context) *tunnelTarget {
+	t, _ := ctx.Value(tunnelKey{}).(*tunnelTarget)
+	return t
+}
+
+// dialTunneled connects to addr for a request intercepted on the tunnel in
+// ctx: over the tunnel's own connection if it is still to be taken, or
+// else as the tunnel was dialed, within the upstream dial timeout d
+func dialTunneled(ctx context.Context, d time.Duration, addr string) (net.Conn, error) {
+	if conn := tunnelFrom(ctx).take(addr); conn != nil {
+		return conn, nil
+	}
+	return dialWithin(ctx, d, func(ctx context.Context) (net.Conn, error) {
+		var t flow.Timings // the request's trace sees the phases
+		return dialTimed(ctx, addr, &t)
+	})
+}
+
+// handshakeWithin runs the client handshake of conn within the upstream
+// TLS handshake timeout d, reporting a timeout as a *limits.Error and the
+// handshake to the trace in ctx. Zero leaves it unbounded.
+func handshakeWithin(ctx context.Context, d time.Duration, conn *tls.Conn) (net.Conn, error) {
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.TLSHandshakeStart != nil {
+		trace.TLSHandshakeStart()
+	}
+	hsCtx := ctx
+	if d > 0 {
+		var cancel context.CancelFunc
+		hsCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	err := conn.HandshakeContext(hsCtx)
+	if trace != nil && trace.TLSHandshakeDone != nil {
+		trace.TLSHandshakeDone(conn.ConnectionState(), err)
+	}
+	if err != nil {
+		conn.Close()
+		if errors.Is(hsCtx.Err(), context.DeadlineExceeded) && ctx.Err() == nil {
+			return nil, &limits.Error{Limit: limits.UpstreamTLSHandshake, Err: err}
+		}
+		return nil, err
+	}
+	return conn, nil
+}
+
+// canonicalAddr returns the host:port of u, with the scheme's default port
+// if it has none
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
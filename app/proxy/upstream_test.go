@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nproxy/app/acl"
+	"nproxy/app/flow"
+	"nproxy/app/upstream"
+)
+
+func TestMITMProxy_Upstream(t *testing.T) {
+	plain := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "reached")
+	}))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(plain.Config.Handler)
+	defer secure.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Another MITM proxy serves as the upstream and records what it relays
+	next, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create upstream proxy: %v", err)
+	}
+	relayed := make(chan string, 10)
+	next.OnFlow = func(f *flow.Flow) { relayed <- f.URL }
+	nextURL, _ := startServing(t, ctx, next)
+
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	proxyURL, _ := startServing(t, ctx, p)
+	client := newProxiedClient(t, p, proxyURL)
+
+	get := func(target string) (int, string, error) {
+		resp, err := client.Get(target)
+		if err != nil {
+			return 0, "", err
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body), nil
+	}
+	expectRelayed := func(target string, want bool) {
+		t.Helper()
+		if !want {
+			select {
+			case got := <-relayed:
+				t.Errorf("Expected %s to bypass the upstream, but it relayed %s", target, got)
+			default:
+			}
+			return
+		}
+		// The upstream finishes its flow after the response is sent
+		select {
+		case got := <-relayed:
+			if !strings.HasPrefix(got, target) {
+				t.Errorf("Expected the upstream to relay %s, got %s", target, got)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("Expected %s to go through the upstream", target)
+		}
+	}
+	// reload applies s to p and makes the client open new tunnels
+	reload := func(s Settings) {
+		p.Reload(s)
+		client.CloseIdleConnections()
+	}
+
+	router, err := upstream.NewRouter(map[string]string{"next": nextURL}, nil, "next", "")
+	if err != nil {
+		t.Fatalf("NewRouter: %v", err)
+	}
+	reload(Settings{Upstream: router})
+	for _, target := range []string{plain.URL, secure.URL} {
+		if status, body, err := get(target); err != nil || status != http.StatusOK || body != "reached" {
+			t.Fatalf("Expected %s through the upstream, got %d %q %v", target, status, body, err)
+		}
+		expectRelayed(target, true)
+	}
+
+	// Excluded hosts are reached directly
+	router, _ = upstream.NewRouter(map[string]string{"next": nextURL}, nil, "next", "127.0.0.1")
+	reload(Settings{Upstream: router})
+	for _, target := range []string{plain.URL, secure.URL} {
+		if status, _, err := get(target); err != nil || status != http.StatusOK {
+			t.Fatalf("Expected %s directly, got %d %v", target, status, err)
+		}
+		expectRelayed(target, false)
+	}
+
+	// Destinations reached through the upstream are checked by name
+	router, _ = upstream.NewRouter(map[string]string{"next": nextURL}, nil, "next", "")
+	denied, _ := acl.NewDestinations(nil, []string{"localhost"}, false)
+	reload(Settings{Upstream: router, Destinations: denied})
+	for _, target := range []string{plain.URL, secure.URL} {
+		target = strings.Replace(target, "127.0.0.1", "localhost", 1)
+		status, _, err := get(target)
+		if status != http.StatusForbidden && (err == nil || !strings.Contains(err.Error(), "Forbidden")) {
+			t.Errorf("Expected %s to be forbidden, got %d %v", target, status, err)
+		}
+		expectRelayed(target, false)
+	}
+
+	// An unreachable upstream is a gateway error
+	router, _ = upstream.NewRouter(map[string]string{"gone": "http://127.0.0.1:1"}, nil, "gone", "")
+	reload(Settings{Upstream: router})
+	if _, _, err := get(secure.URL); err == nil || !strings.Contains(err.Error(), "Bad Gateway") {
+		t.Errorf("Expected CONNECT through an unreachable upstream to fail with 502, got %v", err)
+	}
+}
+
+func TestMITMProxy_PooledTunnels(t *testing.T) {
+	var mu sync.Mutex
+	conns := make(map[string]bool)
+	target := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		conns[r.RemoteAddr] = true
+		mu.Unlock()
+		io.WriteString(w, r.Proto)
+	}))
+	target.EnableHTTP2 = true
+	target.StartTLS()
+	defer target.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	proxyURL, _ := startServing(t, ctx, p)
+
+	// Every client opens a tunnel of its own, yet the requests intercepted
+	// on them share one upstream connection, which speaks HTTP/2
+	for i := 0; i < 3; i++ {
+		resp, err := newProxiedClient(t, p, proxyURL).Get(target.URL)
+		if err != nil {
+			t.Fatalf("Request %d failed: %v", i, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "HTTP/2.0" || resp.Proto != "HTTP/1.1" {
+			t.Errorf("Expected an HTTP/2 upstream answered over HTTP/1.1, got %q over %s", body, resp.Proto)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(conns) != 1 {
+		t.Errorf("Expected the tunnels to share 1 upstream connection, got %d", len(conns))
+	}
+}
+
+func TestMITMProxy_TunnelUpgrade(t *testing.T) {
+	target := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.WriteString(rw, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		rw.Flush()
+		io.Copy(conn, rw)
+	}))
+	defer target.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	p, err := NewMITMProxy(":0")
+	if err != nil {
+		t.Fatalf("Failed to create MITM proxy: %v", err)
+	}
+	p.Limits.Upstream.Request = 100 * time.Millisecond
+	proxyURL, _ := startServing(t, ctx, p)
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxyURL, "http://"))
+	if err != nil {
+		t.Fatalf("Failed to connect to the proxy: %v", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	addr := target.Listener.Addr().String()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", addr, addr)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT failed: %v %v", resp, err)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(p.CA)
+	tlsConn := tls.Client(conn, &tls.Config{RootCAs: pool, ServerName: "127.0.0.1"})
+	fmt.Fprintf(tlsConn, "GET /ws HTTP/1.1\r\nHost: %s\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n", addr)
+	tbr := bufio.NewReader(tlsConn)
+	resp, err = http.ReadResponse(tbr, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v %v", resp, err)
+	}
+
+	// The upgraded connection outlives the upstream request timeout
+	time.Sleep(200 * time.Millisecond)
+	io.WriteString(tlsConn, "ping")
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(tbr, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the upgraded connection to echo, got %q %v", buf, err)
+	}
+}
+
+func TestTunnelTarget_Names(t *testing.T) {
+	tests := []struct {
+		addr, serverName string
+		host, scheme     string
+		want             bool
+	}{
+		{"example.com:443", "example.com", "example.com", "https", true},
+		{"example.com:443", "example.com", "EXAMPLE.com:443", "https", true},
+		{"example.com:80", "", "example.com", "http", true},
+		{"example.com:8443", "example.com", "example.com", "https", false},
+		{"example.com:443", "example.com", "victim.example", "https", false},
+		{"203.0.113.7:443", "victim.example", "victim.example", "https", false},
+		{"203.0.113.7:443", "", "203.0.113.7", "https", true},
+		{"[2001:db8::1]:80", "", "[2001:db8::1]", "http", true},
+	}
+	for _, tt := range tests {
+		target := &tunnelTarget{addr: tt.addr, serverName: tt.serverName}
+		if got := target.names(tt.host, tt.scheme); got != tt.want {
+			t.Errorf("names(%q, %q) for %s (%q) = %v, want %v", tt.host, tt.scheme, tt.addr, tt.serverName, got, tt.want)
+		}
+	}
+}
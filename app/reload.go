@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"nproxy/app/config"
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+	"nproxy/app/proxy"
+)
+
+// liveSettings are the settings, by path prefix, that a reload applies to
+// the running proxy. Changes to any other setting are reported but only
+// take effect after a restart.
+var liveSettings = []string{
+	"auth",
+	"acl",
+	"upstream",
+	"reverse.routes",
+	"reverse.pools",
+	"retry",
+	"circuit_breaker",
+	"error_pages",
+	"headers",
+	"mitm.server_timing",
+	"mitm.body_capture_limit",
+	"rules",
+	"recording.enabled",
+	"recording.filter",
+	"logging.verbose",
+	"logging.filter",
+}
+
+// reloader re-reads the mitm command's configuration on SIGHUP or an admin
+// API call and applies it to the running proxy
+type reloader struct {
+	args         []string
+	proxy        *proxy.MITMProxy
+	flows        *flow.Store // nil when nothing records flows
+	recordFilter atomic.Pointer[filter.Filter]
+
+	mu      sync.Mutex // serializes reloads
+	current *config.Config
+}
+
+// watchSignal reloads on every SIGHUP until ctx is done
+func (r *reloader) watchSignal(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-hup:
+				log.Printf("Received SIGHUP")
+				r.reload()
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// reload loads and validates the configuration again and, only if it has
+// no problems, swaps it in. Flows in progress finish under the old
+// settings. Every change is logged and returned.
+func (r *reloader) reload() ([]config.Change, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, opts, err := loadMITMConfig(r.args)
+	if err != nil {
+		log.Printf("Configuration reload failed, keeping the running configuration:\n%v", err)
+		return nil, err
+	}
+
+	changes := config.Diff(r.current, c)
+	for i, ch := range changes {
+		if !isLive(ch.Path) {
+			changes[i].Message += " (takes effect after a restart)"
+		}
+	}
+
+	settings, err := mitmSettings(c, opts)
+	if err != nil {
+		log.Printf("Configuration reload failed, keeping the running configuration:\n%v", err)
+		return nil, err
+	}
+	keepRuleStates(settings.Rules, r.proxy.Rules.List(), r.current, c)
+	r.proxy.Reload(settings)
+	r.recordFilter.Store(filter.MustParse(c.Recording.Filter))
+	if r.flows != nil && c.Recording.Enabled != r.current.Recording.Enabled {
+		r.flows.SetRecording(c.Recording.Enabled)
+	}
+	r.current = c
+
+	if len(changes) == 0 {
+		log.Printf("Configuration reloaded: no changes")
+	} else {
+		lines := make([]string, len(changes))
+		for i, ch := range changes {
+			lines[i] = "  " + ch.String()
+		}
+		log.Printf("Configuration reloaded:\n%s", strings.Join(lines, "\n"))
+	}
+	return changes, nil
+}
+
+// keepRuleStates carries over the enabled state of running rules, which
+// the admin API may have toggled, to the reloaded rules whose definitions
+// haven't changed. Rules that are new or changed start as configured.
+func keepRuleStates(rules, running []proxy.Rule, old, new *config.Config) {
+	enabled := make(map[string]bool, len(running))
+	for _, r := range running {
+		enabled[r.Name] = r.Enabled
+	}
+	oldRules := make(map[string]config.RuleConfig, len(old.Rules))
+	for _, r := range old.Rules {
+		oldRules[r.Name] = r
+	}
+	newRules := make(map[string]config.RuleConfig, len(new.Rules))
+	for _, r := range new.Rules {
+		newRules[r.Name] = r
+	}
+
+	for i, r := range rules {
+		state, ok := enabled[r.Name]
+		if !ok {
+			continue
+		}
+		cfg, fromFile := newRules[r.Name]
+		if !fromFile || reflect.DeepEqual(cfg, oldRules[r.Name]) {
+			rules[i].Enabled = state
+		}
+	}
+}
+
+func isLive(path string) bool {
+	for _, p := range liveSettings {
+		if path == p || strings.HasPrefix(path, p+".") || strings.HasPrefix(path, p+"[") {
+			return true
+		}
+	}
+	return false
+}
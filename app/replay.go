@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+)
+
+// replayDropHeaders are recorded request headers that must not be re-sent:
+// connection-specific ones, the length (set from the body) and the trace
+// context of the original request
+var replayDropHeaders = []string{
+	"Connection", "Proxy-Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade",
+	"Content-Length", "Proxy-Authorization", "Traceparent", "Tracestate",
+}
+
+// runReplay re-sends the requests of flows exported from the terminal UI
+// or the admin API and compares the response status with the recording
+func runReplay(args []string) error {
+	fs := flag.NewFlagSet("nproxy replay", flag.ExitOnError)
+	proxyAddr := fs.String("proxy", "", "send requests through this proxy, e.g. http://localhost:8080")
+	expr := fs.String("filter", "", "filter expression selecting the flows to replay")
+	insecure := fs.Bool("insecure", false, "skip TLS certificate verification")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for each request")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: nproxy replay [flags] flows.json...\n\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("no flow files given")
+	}
+
+	match, err := filter.Parse(*expr)
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: *insecure}
+	if *proxyAddr != "" {
+		u, err := url.Parse(*proxyAddr)
+		if err != nil {
+			return fmt.Errorf("invalid -proxy: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(u)
+	}
+	client := &http.Client{
+		Transport: transport,
+		Timeout:   *timeout,
+		// Replay exactly the recorded request, not the redirects it caused
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	var replayed, changed, failed int
+	for _, name := range fs.Args() {
+		flows, err := readFlows(name)
+		if err != nil {
+			return err
+		}
+		for _, f := range flows {
+			if !match.Match(f) {
+				continue
+			}
+			if f.RequestTruncated {
+				fmt.Printf("#%d %s %s: skipped, the request body was truncated when recorded\n", f.ID, f.Method, f.URL)
+				continue
+			}
+
+			start := time.Now()
+			status, err := replay(client, f)
+			replayed++
+			switch {
+			case err != nil:
+				failed++
+				fmt.Printf("#%d %s %s: %v\n", f.ID, f.Method, f.URL, err)
+			case status != f.Status:
+				changed++
+				fmt.Printf("#%d %s %s: %d, recorded %d (%s)\n", f.ID, f.Method, f.URL, status, f.Status, time.Since(start).Round(time.Millisecond))
+			default:
+				fmt.Printf("#%d %s %s: %d (%s)\n", f.ID, f.Method, f.URL, status, time.Since(start).Round(time.Millisecond))
+			}
+		}
+	}
+
+	fmt.Printf("Replayed %d flows: %d with a different status, %d failed\n", replayed, changed, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d requests failed", failed)
+	}
+	return nil
+}
+
+// readFlows reads a JSON array of flows as written by the terminal UI's
+// export
+func readFlows(name string) ([]*flow.Flow, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var flows []*flow.Flow
+	if err := json.Unmarshal(data, &flows); err != nil {
+		return nil, fmt.Errorf("%s: not an exported flow list: %v", name, err)
+	}
+	return flows, nil
+}
+
+// replay sends the recorded request of f and returns the response status
+func replay(client *http.Client, f *flow.Flow) (int, error) {
+	req, err := http.NewRequest(f.Method, f.URL, bytes.NewReader(f.RequestBody))
+	if err != nil {
+		return 0, err
+	}
+	req.Header = f.RequestHeader.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, name := range replayDropHeaders {
+		req.Header.Del(name)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+		req.Header.Del("Host")
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	return resp.StatusCode, nil
+}
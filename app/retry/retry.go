@@ -0,0 +1,142 @@
+// Package retry decides when a failed upstream request is sent again and
+// how long to wait before doing so.
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Defaults used for zero Policy fields
+const (
+	DefaultBackoff    = 100 * time.Millisecond
+	DefaultMaxBackoff = 2 * time.Second
+	DefaultMaxBody    = 64 << 10
+)
+
+// idempotent are the methods retried when a policy names none (RFC 9110
+// section 9.2.2)
+var idempotent = []string{"GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE"}
+
+// Reasons returned by Policy.Reason
+const (
+	ReasonConnect = "connect"
+	ReasonStatus  = "status"
+)
+
+// Policy says which requests are retried and when. Requests are retried
+// when the connection to the upstream couldn't be made, so the request was
+// never sent, or when the response status is one of Statuses. A nil
+// *Policy never retries.
+type Policy struct {
+	Attempts   int           // tries in all, the first included; 1 or less never retries
+	Methods    []string      // methods that are retried; the idempotent ones when empty
+	Statuses   []int         // response statuses that are retried
+	Backoff    time.Duration // delay before the first retry, doubled for each one after
+	MaxBackoff time.Duration // longest delay between tries
+	MaxBody    int64         // largest request body kept for replay; requests with bigger bodies aren't retried
+}
+
+// Check checks a policy's settings
+func Check(p Policy) error {
+	switch {
+	case p.Attempts < 0:
+		return errors.New("attempts must not be negative")
+	case p.Backoff < 0, p.MaxBackoff < 0:
+		return errors.New("durations must not be negative")
+	case p.MaxBackoff != 0 && p.MaxBackoff < p.Backoff:
+		return errors.New("max_backoff must not be shorter than backoff")
+	case p.MaxBody < 0:
+		return errors.New("max_body must not be negative")
+	}
+	for _, m := range p.Methods {
+		if m == "" || m == "CONNECT" || !isToken(m) {
+			return fmt.Errorf("%q is not a method that can be retried", m)
+		}
+	}
+	for _, s := range p.Statuses {
+		if s < 100 || s > 599 {
+			return fmt.Errorf("status %d must be from 100 to 599", s)
+		}
+	}
+	return nil
+}
+
+func isToken(s string) bool {
+	for _, c := range s {
+		if c <= ' ' || c >= 0x7f || c == '(' || c == ')' || c == ',' || c == '/' || c == ':' || c == ';' || c == '"' {
+			return false
+		}
+	}
+	return true
+}
+
+// Allows reports whether requests with method may be retried at all
+func (p *Policy) Allows(method string) bool {
+	if p == nil || p.Attempts <= 1 {
+		return false
+	}
+	if len(p.Methods) == 0 {
+		return slices.Contains(idempotent, method)
+	}
+	return slices.Contains(p.Methods, method)
+}
+
+// Reason returns why the outcome of a try calls for another, ReasonConnect
+// or ReasonStatus, or "" when it doesn't
+func (p *Policy) Reason(resp *http.Response, err error) string {
+	switch {
+	case p == nil:
+		return ""
+	case err != nil:
+		if IsConnectError(err) {
+			return ReasonConnect
+		}
+	case slices.Contains(p.Statuses, resp.StatusCode):
+		return ReasonStatus
+	}
+	return ""
+}
+
+// Delay returns how long to wait before retry n, counting from 1: the
+// backoff doubled n-1 times and capped at MaxBackoff, less a random part of
+// up to half so that clients retrying together spread out
+func (p *Policy) Delay(n int) time.Duration {
+	base, ceiling := DefaultBackoff, DefaultMaxBackoff
+	if p != nil && p.Backoff > 0 {
+		base = p.Backoff
+	}
+	if p != nil && p.MaxBackoff > 0 {
+		ceiling = p.MaxBackoff
+	}
+	d := base
+	for i := 1; i < n && d < ceiling; i++ {
+		d *= 2
+	}
+	d = min(d, ceiling)
+	return d - rand.N(d/2+1)
+}
+
+// BodyLimit returns the largest request body kept for replay
+func (p *Policy) BodyLimit() int64 {
+	if p == nil || p.MaxBody == 0 {
+		return DefaultMaxBody
+	}
+	return p.MaxBody
+}
+
+// IsConnectError reports whether err means that no connection was made to
+// the upstream, or to the proxy leading to it, so the request wasn't sent
+func IsConnectError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && (opErr.Op == "dial" || opErr.Op == "proxyconnect") {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
@@ -0,0 +1,89 @@
+package retry
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPolicyAllows(t *testing.T) {
+	p := &Policy{Attempts: 3}
+	for method, want := range map[string]bool{"GET": true, "PUT": true, "DELETE": true, "POST": false, "PATCH": false} {
+		if got := p.Allows(method); got != want {
+			t.Errorf("Allows(%s) = %v, want %v", method, got, want)
+		}
+	}
+	p.Methods = []string{"POST"}
+	if !p.Allows("POST") || p.Allows("GET") {
+		t.Error("Expected Methods to replace the idempotent methods")
+	}
+	if (&Policy{Attempts: 1}).Allows("GET") || (*Policy)(nil).Allows("GET") {
+		t.Error("Expected a single attempt or a nil policy never to retry")
+	}
+}
+
+func TestPolicyReason(t *testing.T) {
+	p := &Policy{Attempts: 2, Statuses: []int{502, 503}}
+	dial := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	tests := []struct {
+		status int
+		err    error
+		want   string
+	}{
+		{0, fmt.Errorf("Get: %w", dial), ReasonConnect},
+		{0, &net.DNSError{Err: "server misbehaving", IsTemporary: true}, ReasonConnect},
+		{0, &net.DNSError{Err: "no such host", IsNotFound: true}, ""},
+		{0, &net.OpError{Op: "read", Err: errors.New("connection reset")}, ""},
+		{503, nil, ReasonStatus},
+		{500, nil, ""},
+		{200, nil, ""},
+	}
+	for _, tt := range tests {
+		var resp *http.Response
+		if tt.err == nil {
+			resp = &http.Response{StatusCode: tt.status}
+		}
+		if got := p.Reason(resp, tt.err); got != tt.want {
+			t.Errorf("Reason(%d, %v) = %q, want %q", tt.status, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestPolicyDelay(t *testing.T) {
+	p := &Policy{Backoff: 100 * time.Millisecond, MaxBackoff: 500 * time.Millisecond}
+	for n, max := range map[int]time.Duration{1: 100, 2: 200, 3: 400, 4: 500, 10: 500} {
+		max *= time.Millisecond
+		for range 20 {
+			if d := p.Delay(n); d < max/2 || d > max {
+				t.Errorf("Delay(%d) = %s, want between %s and %s", n, d, max/2, max)
+			}
+		}
+	}
+	if d := (*Policy)(nil).Delay(1); d < DefaultBackoff/2 || d > DefaultBackoff {
+		t.Errorf("Expected the default backoff, got %s", d)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		p       Policy
+		wantErr string
+	}{
+		{Policy{Attempts: 3, Methods: []string{"GET", "POST"}, Statuses: []int{503}}, ""},
+		{Policy{Attempts: -1}, "must not be negative"},
+		{Policy{Backoff: time.Second, MaxBackoff: time.Millisecond}, "must not be shorter"},
+		{Policy{Methods: []string{"CONNECT"}}, "can be retried"},
+		{Policy{Methods: []string{"GE T"}}, "can be retried"},
+		{Policy{Statuses: []int{99}}, "from 100 to 599"},
+	}
+	for _, tt := range tests {
+		err := Check(tt.p)
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("Check(%+v): expected error containing %q, got %v", tt.p, tt.wantErr, err)
+		}
+	}
+}
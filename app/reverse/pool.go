@@ -0,0 +1,381 @@
+package reverse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Balancing algorithms for Pool.Balance
+const (
+	RoundRobin = "round_robin"
+	LeastConn  = "least_conn"
+	Hash       = "hash"
+)
+
+// Health check and ejection defaults, used for zero values
+const (
+	DefaultCheckInterval      = 10 * time.Second
+	DefaultCheckTimeout       = 2 * time.Second
+	DefaultHealthyThreshold   = 2
+	DefaultUnhealthyThreshold = 3
+	DefaultEjectionTime       = 30 * time.Second
+)
+
+// ErrNoUpstream is returned by Pick when every upstream of the route is
+// unhealthy or ejected
+var ErrNoUpstream = errors.New("no healthy upstream")
+
+// Pool is a named group of upstreams that routes share
+type Pool struct {
+	Name        string
+	Upstreams   []string // upstream URLs, as for Route.Upstream
+	Balance     string   // RoundRobin (the default), LeastConn or Hash
+	HashHeader  string   // with Hash, the request header whose value picks the upstream
+	HashCookie  string   // with Hash, the cookie used when HashHeader is unset or absent
+	HealthCheck HealthCheck
+	Outlier     Outlier
+}
+
+// HealthCheck configures active health checks: each upstream is sent GET
+// Path every Interval and answers 2xx or 3xx within Timeout to pass.
+// Upstreams start healthy.
+type HealthCheck struct {
+	Path               string // empty disables active checks
+	Interval           time.Duration
+	Timeout            time.Duration
+	HealthyThreshold   int // passes in a row that make an unhealthy upstream healthy
+	UnhealthyThreshold int // failures in a row that make a healthy upstream unhealthy
+}
+
+// Outlier configures passive ejection: an upstream whose requests fail
+// ConsecutiveErrors times in a row, with no response or a 5xx one, gets no
+// requests for EjectionTime
+type Outlier struct {
+	ConsecutiveErrors int // zero disables ejection
+	EjectionTime      time.Duration
+}
+
+// CheckPool checks a pool's settings other than its upstream URLs
+func CheckPool(p Pool) error {
+	switch {
+	case p.Balance != "" && p.Balance != RoundRobin && p.Balance != LeastConn && p.Balance != Hash:
+		return fmt.Errorf("balance %q must be %s, %s or %s", p.Balance, RoundRobin, LeastConn, Hash)
+	case p.Balance == Hash && p.HashHeader == "" && p.HashCookie == "":
+		return errors.New("hash balancing needs hash_header or hash_cookie")
+	case p.HealthCheck.Path != "" && p.HealthCheck.Path[0] != '/':
+		return fmt.Errorf("health check path %q must start with /", p.HealthCheck.Path)
+	case p.HealthCheck.Interval < 0, p.HealthCheck.Timeout < 0, p.Outlier.EjectionTime < 0:
+		return errors.New("durations must not be negative")
+	case p.HealthCheck.HealthyThreshold < 0, p.HealthCheck.UnhealthyThreshold < 0, p.Outlier.ConsecutiveErrors < 0:
+		return errors.New("thresholds must not be negative")
+	}
+	return nil
+}
+
+// pool holds the upstreams of a Pool, or of a route with a single upstream
+type pool struct {
+	Pool
+	backends []*Backend
+	next     atomic.Uint64
+}
+
+func newPool(p Pool) (*pool, error) {
+	if len(p.Upstreams) == 0 {
+		return nil, fmt.Errorf("pool %q has no upstreams", p.Name)
+	}
+	if err := CheckPool(p); err != nil {
+		return nil, fmt.Errorf("pool %q: %w", p.Name, err)
+	}
+	pl := &pool{Pool: p}
+	for _, s := range p.Upstreams {
+		u, err := ParseUpstream(s)
+		if err != nil {
+			return nil, err
+		}
+		pl.backends = append(pl.backends, &Backend{URL: u, pool: pl, healthy: true})
+	}
+	return pl, nil
+}
+
+// pick chooses an available backend for req, or returns nil
+func (p *pool) pick(req *http.Request) *Backend {
+	now := time.Now()
+	up := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.available(now) {
+			up = append(up, b)
+		}
+	}
+	if len(up) == 0 {
+		return nil
+	}
+	start := int((p.next.Add(1) - 1) % uint64(len(up)))
+	switch p.Balance {
+	case Hash:
+		if key := p.hashKey(req); key != "" {
+			return rendezvous(up, key)
+		}
+	case LeastConn:
+		// Ties go round robin
+		best := up[start]
+		for i := 1; i < len(up); i++ {
+			if b := up[(start+i)%len(up)]; b.active.Load() < best.active.Load() {
+				best = b
+			}
+		}
+		return best
+	}
+	return up[start]
+}
+
+// hashKey returns the value that Hash balancing picks by, or "" when the
+// request carries none
+func (p *pool) hashKey(req *http.Request) string {
+	if p.HashHeader != "" {
+		if v := req.Header.Get(p.HashHeader); v != "" {
+			return v
+		}
+	}
+	if p.HashCookie != "" {
+		if c, err := req.Cookie(p.HashCookie); err == nil && c.Value != "" {
+			return c.Value
+		}
+	}
+	return ""
+}
+
+// rendezvous picks the backend with the highest hash of key and its URL,
+// so that a backend going away only moves the keys it had
+func rendezvous(backends []*Backend, key string) *Backend {
+	var best *Backend
+	var bestScore uint64
+	for _, b := range backends {
+		h := fnv.New64a()
+		io.WriteString(h, key)
+		h.Write([]byte{0})
+		io.WriteString(h, b.URL.String())
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+// Backend is one upstream of a pool
+type Backend struct {
+	URL *url.URL
+
+	pool   *pool
+	active atomic.Int64
+
+	mu           sync.Mutex
+	healthy      bool
+	passes       int // health checks passed in a row
+	failures     int // health checks failed in a row
+	errors       int // requests failed in a row
+	ejectedUntil time.Time
+}
+
+// Pool returns the name of b's pool, which is empty for a route's single
+// upstream
+func (b *Backend) Pool() string {
+	return b.pool.Name
+}
+
+// Begin records the start of a request to b
+func (b *Backend) Begin() {
+	b.active.Add(1)
+}
+
+// Done records the end of a request started with Begin. A failed request
+// counts toward outlier ejection and a successful one resets the count.
+// Done reports whether b was ejected.
+func (b *Backend) Done(failed bool) bool {
+	b.active.Add(-1)
+	o := b.pool.Outlier
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.errors = 0
+		return false
+	}
+	b.errors++
+	if o.ConsecutiveErrors == 0 || b.errors < o.ConsecutiveErrors {
+		return false
+	}
+	b.errors = 0
+	b.ejectedUntil = time.Now().Add(or(o.EjectionTime, DefaultEjectionTime))
+	return true
+}
+
+// Active returns the number of requests to b in progress
+func (b *Backend) Active() int64 {
+	return b.active.Load()
+}
+
+func (b *Backend) available(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && !now.Before(b.ejectedUntil)
+}
+
+// check runs b's active health checks until ctx is done
+func (b *Backend) check(ctx context.Context, rt http.RoundTripper, onHealth func(*Backend, bool)) {
+	hc := b.pool.HealthCheck
+	target := *b.URL
+	target.Path = joinPath(b.URL.Path, hc.Path)
+	ticker := time.NewTicker(or(hc.Interval, DefaultCheckInterval))
+	defer ticker.Stop()
+	for {
+		passed := probe(ctx, rt, target.String(), or(hc.Timeout, DefaultCheckTimeout))
+		if ctx.Err() != nil {
+			return
+		}
+		if changed, healthy := b.record(passed); changed {
+			onHealth(b, healthy)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probe sends one health check request and reports whether it passed
+func probe(ctx context.Context, rt http.RoundTripper, target string, timeout time.Duration) bool {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp.StatusCode < 400
+}
+
+// record counts a health check result, reporting whether it changed b's
+// health and what it is now
+func (b *Backend) record(passed bool) (changed, healthy bool) {
+	hc := b.pool.HealthCheck
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if passed {
+		b.passes, b.failures = b.passes+1, 0
+		changed = !b.healthy && b.passes >= or(hc.HealthyThreshold, DefaultHealthyThreshold)
+	} else {
+		b.passes, b.failures = 0, b.failures+1
+		changed = b.healthy && b.failures >= or(hc.UnhealthyThreshold, DefaultUnhealthyThreshold)
+	}
+	if changed {
+		b.healthy = !b.healthy
+	}
+	return changed, b.healthy
+}
+
+// or returns v, or def when v is zero
+func or[T comparable](v, def T) T {
+	var zero T
+	if v == zero {
+		return def
+	}
+	return v
+}
+
+// PoolStatus is the state of a pool's upstreams
+type PoolStatus struct {
+	Name      string
+	Balance   string
+	Upstreams []UpstreamStatus
+}
+
+// UpstreamStatus is the state of one upstream
+type UpstreamStatus struct {
+	URL            string
+	Healthy        bool // passing active health checks
+	Ejected        bool // ejected for failing requests
+	ActiveRequests int64
+}
+
+// Status returns the state of the table's pools in the order they were
+// given. A nil *Table has no pools.
+func (t *Table) Status() []PoolStatus {
+	if t == nil {
+		return nil
+	}
+	now := time.Now()
+	var status []PoolStatus
+	for _, p := range t.pools {
+		ps := PoolStatus{Name: p.Name, Balance: or(p.Balance, RoundRobin)}
+		for _, b := range p.backends {
+			b.mu.Lock()
+			ps.Upstreams = append(ps.Upstreams, UpstreamStatus{
+				URL:            b.URL.String(),
+				Healthy:        b.healthy,
+				Ejected:        now.Before(b.ejectedUntil),
+				ActiveRequests: b.active.Load(),
+			})
+			b.mu.Unlock()
+		}
+		status = append(status, ps)
+	}
+	return status
+}
+
+// Start begins the active health checks of the table's pools, sending them
+// with rt and calling onHealth from their goroutines whenever an upstream
+// becomes healthy or unhealthy. Start does nothing on a nil *Table or one
+// that was started before.
+func (t *Table) Start(rt http.RoundTripper, onHealth func(b *Backend, healthy bool)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.cancel != nil {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	t.cancel = cancel
+	for _, p := range t.pools {
+		if p.HealthCheck.Path == "" {
+			continue
+		}
+		for _, b := range p.backends {
+			t.checks.Add(1)
+			go func() {
+				defer t.checks.Done()
+				b.check(ctx, rt, onHealth)
+			}()
+		}
+	}
+}
+
+// Stop ends the health checks begun by Start and waits for them to finish.
+// Routes keep working with the upstreams' last known health.
+func (t *Table) Stop() {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	cancel := t.cancel
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	t.checks.Wait()
+}
@@ -0,0 +1,218 @@
+package reverse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newPoolRoute returns the route of a table with a single route to p
+func newPoolRoute(t *testing.T, p Pool) *Route {
+	t.Helper()
+	table, err := NewTable([]Route{{Pool: p.Name}}, []Pool{p})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	return table.Lookup("example.com", "/")
+}
+
+func pick(t *testing.T, r *Route, req *http.Request) string {
+	t.Helper()
+	b, err := r.Pick(req)
+	if err != nil {
+		t.Fatalf("Pick: %v", err)
+	}
+	return b.URL.Host
+}
+
+func TestPoolRoundRobin(t *testing.T) {
+	r := newPoolRoute(t, Pool{Name: "web", Upstreams: []string{"http://a", "http://b", "http://c"}})
+	req := httptest.NewRequest("GET", "/", nil)
+	var got []string
+	for range 6 {
+		got = append(got, pick(t, r, req))
+	}
+	if s := strings.Join(got, ""); s != "abcabc" {
+		t.Errorf("Expected upstreams in turn, got %s", s)
+	}
+}
+
+func TestPoolLeastConn(t *testing.T) {
+	r := newPoolRoute(t, Pool{Name: "web", Balance: LeastConn, Upstreams: []string{"http://a", "http://b", "http://c"}})
+	req := httptest.NewRequest("GET", "/", nil)
+	busy := r.pool.backends[0]
+	busy.Begin()
+	busy.Begin()
+	r.pool.backends[1].Begin()
+	for range 3 {
+		if got := pick(t, r, req); got != "c" {
+			t.Errorf("Expected the idle upstream, got %s", got)
+		}
+	}
+	busy.Done(false)
+	busy.Done(false)
+	// a and c are tied and take turns
+	seen := map[string]bool{}
+	for range 4 {
+		seen[pick(t, r, req)] = true
+	}
+	if !seen["a"] || !seen["c"] || seen["b"] {
+		t.Errorf("Expected ties to go round robin, got %v", seen)
+	}
+}
+
+func TestPoolHash(t *testing.T) {
+	r := newPoolRoute(t, Pool{
+		Name: "web", Balance: Hash, HashHeader: "X-User", HashCookie: "session",
+		Upstreams: []string{"http://a", "http://b", "http://c", "http://d"},
+	})
+	withHeader := func(v string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-User", v)
+		return req
+	}
+
+	// The same key always goes to the same upstream, and keys spread
+	spread := map[string]bool{}
+	for _, user := range []string{"alice", "bob", "carol", "dave", "erin", "frank", "grace", "heidi"} {
+		first := pick(t, r, withHeader(user))
+		for range 3 {
+			if got := pick(t, r, withHeader(user)); got != first {
+				t.Errorf("Expected %s to stick to %s, got %s", user, first, got)
+			}
+		}
+		spread[first] = true
+	}
+	if len(spread) < 2 {
+		t.Errorf("Expected keys to spread over upstreams, got %v", spread)
+	}
+
+	// The cookie is used without the header
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: "alice"})
+	if got, want := pick(t, r, req), pick(t, r, withHeader("alice")); got != want {
+		t.Errorf("Expected the cookie to pick %s, got %s", want, got)
+	}
+
+	// Ejecting an upstream only moves its own keys
+	owner := pick(t, r, withHeader("alice"))
+	var other string
+	for _, user := range []string{"bob", "carol", "dave", "erin", "frank", "grace", "heidi"} {
+		if pick(t, r, withHeader(user)) != owner {
+			other = user
+			break
+		}
+	}
+	before := pick(t, r, withHeader(other))
+	for _, b := range r.pool.backends {
+		if b.URL.Host == owner {
+			b.ejectedUntil = time.Now().Add(time.Minute)
+		}
+	}
+	if got := pick(t, r, withHeader("alice")); got == owner {
+		t.Errorf("Expected alice to move off the ejected %s", owner)
+	}
+	if got := pick(t, r, withHeader(other)); got != before {
+		t.Errorf("Expected %s to stay on %s, got %s", other, before, got)
+	}
+}
+
+func TestPoolOutlierEjection(t *testing.T) {
+	r := newPoolRoute(t, Pool{
+		Name: "web", Upstreams: []string{"http://a", "http://b"},
+		Outlier: Outlier{ConsecutiveErrors: 2, EjectionTime: time.Minute},
+	})
+	a := r.pool.backends[0]
+
+	// A success resets the count
+	for _, failed := range []bool{true, false, true} {
+		a.Begin()
+		if a.Done(failed) {
+			t.Fatal("Expected no ejection before two errors in a row")
+		}
+	}
+	a.Begin()
+	if !a.Done(true) {
+		t.Fatal("Expected the second error in a row to eject the upstream")
+	}
+	req := httptest.NewRequest("GET", "/", nil)
+	for range 4 {
+		if got := pick(t, r, req); got != "b" {
+			t.Errorf("Expected the ejected upstream to be skipped, got %s", got)
+		}
+	}
+	if s := (&Table{pools: []*pool{r.pool}}).Status(); !s[0].Upstreams[0].Ejected || s[0].Upstreams[0].ActiveRequests != 0 {
+		t.Errorf("Expected a to be reported ejected and idle, got %+v", s)
+	}
+
+	r.pool.backends[1].ejectedUntil = time.Now().Add(time.Minute)
+	if _, err := r.Pick(req); err != ErrNoUpstream {
+		t.Errorf("Expected ErrNoUpstream with every upstream ejected, got %v", err)
+	}
+}
+
+func TestPoolHealthCheck(t *testing.T) {
+	var failing atomic.Bool
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/base/healthz" || failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer backend.Close()
+
+	table, err := NewTable([]Route{{Pool: "web"}}, []Pool{{
+		Name: "web", Upstreams: []string{backend.URL + "/base"},
+		HealthCheck: HealthCheck{Path: "/healthz", Interval: 10 * time.Millisecond, HealthyThreshold: 2, UnhealthyThreshold: 2},
+	}})
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	changes := make(chan bool, 10)
+	table.Start(http.DefaultTransport, func(b *Backend, healthy bool) { changes <- healthy })
+	defer table.Stop()
+
+	route := table.Lookup("example.com", "/")
+	u, _ := url.Parse("/")
+	failing.Store(true)
+	if healthy := <-changes; healthy {
+		t.Fatal("Expected the upstream to become unhealthy")
+	}
+	if _, err := route.Pick(&http.Request{URL: u}); err != ErrNoUpstream {
+		t.Errorf("Expected no upstream while unhealthy, got %v", err)
+	}
+	failing.Store(false)
+	if healthy := <-changes; !healthy {
+		t.Fatal("Expected the upstream to become healthy again")
+	}
+	if _, err := route.Pick(&http.Request{URL: u}); err != nil {
+		t.Errorf("Expected the upstream back, got %v", err)
+	}
+}
+
+func TestNewTablePoolErrors(t *testing.T) {
+	tests := []struct {
+		pool    Pool
+		wantErr string
+	}{
+		{Pool{Upstreams: []string{"http://a"}}, "empty or not unique"},
+		{Pool{Name: "web"}, "has no upstreams"},
+		{Pool{Name: "web", Upstreams: []string{"a:80"}}, "is not an upstream URL"},
+		{Pool{Name: "web", Upstreams: []string{"http://a"}, Balance: "random"}, "must be round_robin"},
+		{Pool{Name: "web", Upstreams: []string{"http://a"}, Balance: Hash}, "needs hash_header or hash_cookie"},
+		{Pool{Name: "web", Upstreams: []string{"http://a"}, HealthCheck: HealthCheck{Path: "health"}}, "must start with /"},
+		{Pool{Name: "web", Upstreams: []string{"http://a"}, Outlier: Outlier{ConsecutiveErrors: -1}}, "must not be negative"},
+	}
+	for _, tt := range tests {
+		if _, err := NewTable(nil, []Pool{tt.pool}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("NewTable(%+v): expected error containing %q, got %v", tt.pool, tt.wantErr, err)
+		}
+	}
+	web := Pool{Name: "web", Upstreams: []string{"http://a"}}
+	if _, err := NewTable(nil, []Pool{web, web}); err == nil {
+		t.Error("Expected duplicate pool names to be refused")
+	}
+}
@@ -0,0 +1,219 @@
+// Package reverse routes the requests nproxy serves as a reverse proxy: it
+// maps incoming hosts and path prefixes to upstream URLs or balanced pools
+// of them and tracks the health of pooled upstreams.
+package reverse
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"nproxy/app/retry"
+)
+
+// Route sends requests for Host whose path starts with Path to Upstream,
+// or to one of the upstreams of the named Pool
+type Route struct {
+	Host         string        // example.com, *.example.com for its subdomains, or empty for any host
+	Path         string        // path prefix; empty or / for every path
+	Upstream     string        // http:// or https:// URL whose path is prepended to the request path
+	Pool         string        // name of a pool, instead of Upstream
+	StripPrefix  bool          // remove Path from the request path first
+	PreserveHost bool          // send the incoming Host header instead of the upstream's
+	Retry        *retry.Policy // nil uses the proxy's policy
+
+	pool *pool
+}
+
+// ParseUpstream parses an upstream URL: http:// or https://, optionally
+// with a path, but without a query or fragment
+func ParseUpstream(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%q is not an upstream URL such as http://10.0.0.5:8080", s)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("%q: scheme must be http or https", s)
+	}
+	if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+		return nil, fmt.Errorf("%q: an upstream URL has no credentials, query or fragment", s)
+	}
+	return u, nil
+}
+
+// CheckHost checks a route's host pattern
+func CheckHost(host string) error {
+	name := strings.TrimPrefix(host, "*.")
+	if strings.ContainsAny(name, "*/:") || (name == "" && host != "") {
+		return fmt.Errorf("%q is not a host name or *.domain", host)
+	}
+	return nil
+}
+
+// CheckPath checks a route's path prefix
+func CheckPath(path string) error {
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return fmt.Errorf("%q must start with /", path)
+	}
+	return nil
+}
+
+// Table picks the route for each request. Routes are tried in order and
+// the first whose host and path match is used.
+type Table struct {
+	routes []Route
+	pools  []*pool
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	checks sync.WaitGroup
+}
+
+// NewTable checks and parses routes and the pools they refer to
+func NewTable(routes []Route, pools []Pool) (*Table, error) {
+	t := &Table{routes: make([]Route, len(routes))}
+	byName := make(map[string]*pool)
+	for _, p := range pools {
+		if _, dup := byName[p.Name]; dup || p.Name == "" {
+			return nil, fmt.Errorf("pool name %q is empty or not unique", p.Name)
+		}
+		pl, err := newPool(p)
+		if err != nil {
+			return nil, err
+		}
+		byName[p.Name] = pl
+		t.pools = append(t.pools, pl)
+	}
+	for i, r := range routes {
+		if err := CheckHost(r.Host); err != nil {
+			return nil, err
+		}
+		if err := CheckPath(r.Path); err != nil {
+			return nil, err
+		}
+		switch {
+		case (r.Upstream == "") == (r.Pool == ""):
+			return nil, errors.New("a route needs either an upstream or a pool")
+		case r.Pool != "":
+			if r.pool = byName[r.Pool]; r.pool == nil {
+				return nil, fmt.Errorf("no pool named %q", r.Pool)
+			}
+		default:
+			pl, err := newPool(Pool{Upstreams: []string{r.Upstream}})
+			if err != nil {
+				return nil, err
+			}
+			r.pool = pl
+		}
+		r.Host = normalizeHost(r.Host)
+		if r.Path == "" {
+			r.Path = "/"
+		}
+		t.routes[i] = r
+	}
+	return t, nil
+}
+
+// Lookup returns the route for a request to host, which may include a
+// port, and path, or nil when none matches. A nil *Table has no routes.
+func (t *Table) Lookup(host, path string) *Route {
+	if t == nil {
+		return nil
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = normalizeHost(host)
+	for i := range t.routes {
+		r := &t.routes[i]
+		if r.matchHost(host) && r.matchPath(path) {
+			return r
+		}
+	}
+	return nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (r *Route) matchHost(host string) bool {
+	switch {
+	case r.Host == "":
+		return true
+	case strings.HasPrefix(r.Host, "*."):
+		return strings.HasSuffix(host, r.Host[1:])
+	default:
+		return host == r.Host
+	}
+}
+
+// matchPath matches the prefix at path segment boundaries: /api matches
+// /api and /api/users but not /apis
+func (r *Route) matchPath(path string) bool {
+	prefix := strings.TrimSuffix(r.Path, "/")
+	return prefix == "" || path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// Pick chooses the upstream for req among the route's available ones, or
+// returns ErrNoUpstream when there are none
+func (r *Route) Pick(req *http.Request) (*Backend, error) {
+	if b := r.pool.pick(req); b != nil {
+		return b, nil
+	}
+	return nil, ErrNoUpstream
+}
+
+// Target returns the URL on upstream b for a request for u on this route.
+// The path is joined and stripped in its escaped form, so that escaped
+// characters such as %2F reach the upstream as the client sent them.
+func (r *Route) Target(b *Backend, u *url.URL) *url.URL {
+	path := u.EscapedPath()
+	if r.StripPrefix {
+		path = stripPrefix(path, strings.TrimSuffix(r.Path, "/"))
+	}
+	target := *b.URL
+	target.RawPath = joinPath(b.URL.EscapedPath(), path)
+	target.Path, _ = url.PathUnescape(target.RawPath)
+	target.RawQuery = u.RawQuery
+	return &target
+}
+
+// stripPrefix removes the segments of the escaped path that spell prefix,
+// however the client escaped them, keeping the rest as it was escaped
+func stripPrefix(path, prefix string) string {
+	n := strings.Count(prefix, "/") + 1
+	segments := strings.SplitN(path, "/", n+1)
+	if len(segments) < n {
+		return path
+	}
+	if head, err := url.PathUnescape(strings.Join(segments[:n], "/")); err != nil || head != prefix {
+		return path
+	}
+	if len(segments) == n {
+		return ""
+	}
+	return "/" + segments[n]
+}
+
+// joinPath joins two paths with exactly one slash between them
+func joinPath(a, b string) string {
+	switch {
+	case b == "":
+	case strings.HasSuffix(a, "/") && strings.HasPrefix(b, "/"):
+		a += b[1:]
+	case !strings.HasSuffix(a, "/") && !strings.HasPrefix(b, "/"):
+		a += "/" + b
+	default:
+		a += b
+	}
+	if a == "" {
+		return "/"
+	}
+	return a
+}
@@ -0,0 +1,80 @@
+package reverse
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	table, err := NewTable([]Route{
+		{Host: "api.example.com", Path: "/v1/", Upstream: "http://10.0.0.5:8080/internal", StripPrefix: true},
+		{Host: "api.example.com", Path: "/static", Upstream: "http://10.0.0.6"},
+		{Host: "*.apps.example.com", Upstream: "https://apps.internal/"},
+		{Path: "/health", Upstream: "http://127.0.0.1:9000"},
+	}, nil)
+	if err != nil {
+		t.Fatalf("NewTable: %v", err)
+	}
+	tests := []struct {
+		host, url string
+		want      string // empty when no route matches
+	}{
+		{"api.example.com", "/v1/users?page=2", "http://10.0.0.5:8080/internal/users?page=2"},
+		{"API.example.com:443", "/v1", "http://10.0.0.5:8080/internal"},
+		{"api.example.com", "/v1/a%2Fb?x=%2F", "http://10.0.0.5:8080/internal/a%2Fb?x=%2F"},
+		{"api.example.com", "/%761/a%2Fb", "http://10.0.0.5:8080/internal/a%2Fb"},
+		{"api.example.com", "/static/a%2Fb%20c", "http://10.0.0.6/static/a%2Fb%20c"},
+		{"api.example.com", "/static/app.js", "http://10.0.0.6/static/app.js"},
+		{"api.example.com", "/statics", ""},
+		{"api.example.com", "/health", "http://127.0.0.1:9000/health"},
+		{"web.apps.example.com", "/", "https://apps.internal/"},
+		{"apps.example.com", "/", ""},
+		{"other.example", "/health", "http://127.0.0.1:9000/health"},
+		{"other.example", "/", ""},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		r := table.Lookup(tt.host, u.Path)
+		got := ""
+		if r != nil {
+			b, err := r.Pick(&http.Request{URL: u})
+			if err != nil {
+				t.Fatalf("Pick: %v", err)
+			}
+			got = r.Target(b, u).String()
+		}
+		if got != tt.want {
+			t.Errorf("%s%s routed to %q, want %q", tt.host, tt.url, got, tt.want)
+		}
+	}
+
+	var none *Table
+	if r := none.Lookup("example.com", "/"); r != nil {
+		t.Errorf("Expected a nil *Table to have no routes, got %+v", r)
+	}
+}
+
+func TestNewTableErrors(t *testing.T) {
+	tests := []struct {
+		route   Route
+		wantErr string
+	}{
+		{Route{Upstream: "10.0.0.5:8080"}, "is not an upstream URL"},
+		{Route{Upstream: "ftp://files"}, "scheme must be http or https"},
+		{Route{Upstream: "http://backend?x=1"}, "no credentials, query or fragment"},
+		{Route{Host: "a*.example.com", Upstream: "http://backend"}, "is not a host name"},
+		{Route{Host: "example.com:443", Upstream: "http://backend"}, "is not a host name"},
+		{Route{Path: "api", Upstream: "http://backend"}, "must start with /"},
+		{Route{}, "either an upstream or a pool"},
+		{Route{Upstream: "http://backend", Pool: "web"}, "either an upstream or a pool"},
+		{Route{Pool: "api"}, `no pool named "api"`},
+	}
+	pools := []Pool{{Name: "web", Upstreams: []string{"http://10.0.0.5", "http://10.0.0.6"}}}
+	for _, tt := range tests {
+		if _, err := NewTable([]Route{tt.route}, pools); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("NewTable(%+v): expected error containing %q, got %v", tt.route, tt.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+)
+
+// Request is what a client asks of the server, as read by Accept
+type Request struct {
+	Command  Command
+	Addr     string // host:port; the host is a name or an address
+	Username string // set when the client authenticated
+}
+
+// Accept runs the server side of the handshake on conn and returns the
+// client's request, which the caller must answer with WriteReply. When
+// verify is non-nil the client must authenticate with a username and
+// password it accepts; otherwise no authentication is asked for. Failures
+// up to and including an unsupported address type are answered before
+// Accept returns.
+func Accept(conn net.Conn, verify func(username, password string) bool) (*Request, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(conn, head[:]); err != nil {
+		return nil, err
+	}
+	if head[0] != version {
+		return nil, fmt.Errorf("socks5: client speaks version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+
+	want := byte(methodNoAuth)
+	if verify != nil {
+		want = methodUserPassword
+	}
+	if bytes.IndexByte(methods, want) < 0 {
+		conn.Write([]byte{version, methodNoAcceptable})
+		if verify != nil {
+			return nil, ErrAuthRequired
+		}
+		return nil, errors.New("socks5: client requires authentication")
+	}
+	if _, err := conn.Write([]byte{version, want}); err != nil {
+		return nil, err
+	}
+
+	req := &Request{}
+	if verify != nil {
+		username, password, err := readCredentials(conn)
+		if err != nil {
+			return nil, err
+		}
+		if !verify(username, password) {
+			conn.Write([]byte{userPasswordVersion, 1})
+			return nil, fmt.Errorf("%w for %q", ErrAuthFailed, username)
+		}
+		if _, err := conn.Write([]byte{userPasswordVersion, 0}); err != nil {
+			return nil, err
+		}
+		req.Username = username
+	}
+
+	var reqHead [3]byte
+	if _, err := io.ReadFull(conn, reqHead[:]); err != nil {
+		return nil, err
+	}
+	if reqHead[0] != version {
+		return nil, fmt.Errorf("socks5: client speaks version %d", reqHead[0])
+	}
+	req.Command = Command(reqHead[1])
+	addr, err := readAddr(conn)
+	if err != nil {
+		WriteReply(conn, AddressNotSupported, nil)
+		return nil, err
+	}
+	req.Addr = addr
+	return req, nil
+}
+
+func readCredentials(r io.Reader) (username, password string, err error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return "", "", err
+	}
+	if head[0] != userPasswordVersion {
+		return "", "", fmt.Errorf("socks5: unknown authentication version %d", head[0])
+	}
+	user := make([]byte, head[1])
+	if _, err := io.ReadFull(r, user); err != nil {
+		return "", "", err
+	}
+	var n [1]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return "", "", err
+	}
+	pass := make([]byte, n[0])
+	if _, err := io.ReadFull(r, pass); err != nil {
+		return "", "", err
+	}
+	return string(user), string(pass), nil
+}
+
+// WriteReply answers a request. bound is the address the server uses for
+// the client's connection, or for its datagrams after UDP ASSOCIATE; nil
+// sends 0.0.0.0:0.
+func WriteReply(w io.Writer, r Reply, bound net.Addr) error {
+	addr := "0.0.0.0:0"
+	if bound != nil {
+		addr = bound.String()
+	}
+	msg, err := appendAddr([]byte{version, byte(r), 0}, addr)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	return err
+}
+
+// ParseDatagram splits a datagram relayed with UDP ASSOCIATE into its
+// destination, a host:port address, and payload. Fragments are not
+// supported.
+func ParseDatagram(b []byte) (addr string, payload []byte, err error) {
+	if len(b) < 4 {
+		return "", nil, errors.New("socks5: short datagram")
+	}
+	if b[2] != 0 {
+		return "", nil, errors.New("socks5: fragmented datagrams are not supported")
+	}
+	r := bytes.NewReader(b[3:])
+	if addr, err = readAddr(r); err != nil {
+		return "", nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// AppendDatagram appends a datagram carrying payload from addr, a host:port
+// address, to b
+func AppendDatagram(b []byte, addr string, payload []byte) ([]byte, error) {
+	b, err := appendAddr(append(b, 0, 0, 0), addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, payload...), nil
+}
@@ -0,0 +1,249 @@
+// Package socks5 speaks SOCKS version 5 (RFC 1928) with username/password
+// authentication (RFC 1929).
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+const (
+	version = 5
+
+	methodNoAuth       = 0x00
+	methodUserPassword = 0x02
+	methodNoAcceptable = 0xff
+
+	// userPasswordVersion is the version of the RFC 1929 subnegotiation
+	userPasswordVersion = 1
+
+	atypIPv4   = 1
+	atypDomain = 3
+	atypIPv6   = 4
+)
+
+// Command is the operation a client requests
+type Command byte
+
+// Commands defined by RFC 1928
+const (
+	CommandConnect      Command = 1
+	CommandBind         Command = 2
+	CommandUDPAssociate Command = 3
+)
+
+func (c Command) String() string {
+	switch c {
+	case CommandConnect:
+		return "CONNECT"
+	case CommandBind:
+		return "BIND"
+	case CommandUDPAssociate:
+		return "UDP ASSOCIATE"
+	}
+	return "command " + strconv.Itoa(int(c))
+}
+
+// Reply is the status a server sends in answer to a request
+type Reply byte
+
+// Replies defined by RFC 1928
+const (
+	Succeeded Reply = iota
+	GeneralFailure
+	NotAllowed
+	NetworkUnreachable
+	HostUnreachable
+	ConnectionRefused
+	TTLExpired
+	CommandNotSupported
+	AddressNotSupported
+)
+
+func (r Reply) String() string {
+	switch r {
+	case Succeeded:
+		return "succeeded"
+	case GeneralFailure:
+		return "general SOCKS server failure"
+	case NotAllowed:
+		return "connection not allowed by ruleset"
+	case NetworkUnreachable:
+		return "network unreachable"
+	case HostUnreachable:
+		return "host unreachable"
+	case ConnectionRefused:
+		return "connection refused"
+	case TTLExpired:
+		return "TTL expired"
+	case CommandNotSupported:
+		return "command not supported"
+	case AddressNotSupported:
+		return "address type not supported"
+	}
+	return "reply " + strconv.Itoa(int(r))
+}
+
+// Auth holds the credentials for username/password authentication
+type Auth struct {
+	Username string
+	Password string
+}
+
+var (
+	// ErrAuthFailed is returned when the server rejects the credentials or
+	// requires credentials the client doesn't have, and by Accept when the
+	// client's credentials are wrong
+	ErrAuthFailed = errors.New("socks5: authentication failed")
+
+	// ErrAuthRequired is returned by Accept when the server requires
+	// credentials and the client offers none
+	ErrAuthRequired = errors.New("socks5: client offered no username/password authentication")
+)
+
+// Connect asks the SOCKS server at the other end of conn to connect to
+// addr, a host:port address, authenticating with auth unless it is nil.
+// Host names are resolved by the server. On success conn carries the
+// connection to addr.
+func Connect(conn net.Conn, addr string, auth *Auth) error {
+	req, err := appendAddr([]byte{version, byte(CommandConnect), 0}, addr)
+	if err != nil {
+		return err
+	}
+
+	methods := []byte{methodNoAuth}
+	if auth != nil {
+		methods = []byte{methodUserPassword, methodNoAuth}
+	}
+	if _, err := conn.Write(append([]byte{version, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return err
+	}
+	if choice[0] != version {
+		return fmt.Errorf("socks5: server replied with version %d", choice[0])
+	}
+	switch choice[1] {
+	case methodNoAuth:
+	case methodUserPassword:
+		if auth == nil {
+			return ErrAuthFailed
+		}
+		if err := sendCredentials(conn, auth); err != nil {
+			return err
+		}
+	case methodNoAcceptable:
+		return ErrAuthFailed
+	default:
+		return fmt.Errorf("socks5: server chose unknown method %d", choice[1])
+	}
+
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != version {
+		return fmt.Errorf("socks5: server replied with version %d", reply[0])
+	}
+	// The bound address is of no use to a CONNECT client
+	if _, err := readAddr(conn); err != nil {
+		return err
+	}
+	if Reply(reply[1]) != Succeeded {
+		return fmt.Errorf("socks5: connect to %s: %v", addr, Reply(reply[1]))
+	}
+	return nil
+}
+
+func sendCredentials(conn net.Conn, auth *Auth) error {
+	if len(auth.Username) == 0 || len(auth.Username) > 255 || len(auth.Password) > 255 {
+		return errors.New("socks5: username must be 1 to 255 bytes and password at most 255")
+	}
+	msg := []byte{userPasswordVersion, byte(len(auth.Username))}
+	msg = append(msg, auth.Username...)
+	msg = append(msg, byte(len(auth.Password)))
+	msg = append(msg, auth.Password...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+	var status [2]byte
+	if _, err := io.ReadFull(conn, status[:]); err != nil {
+		return err
+	}
+	if status[1] != 0 {
+		return ErrAuthFailed
+	}
+	return nil
+}
+
+// appendAddr appends the address type, address and port of addr
+func appendAddr(b []byte, addr string) ([]byte, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("socks5: invalid port in %q", addr)
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if ip.Is4() || ip.Is4In6() {
+			ip4 := ip.Unmap().As4()
+			b = append(append(b, atypIPv4), ip4[:]...)
+		} else {
+			ip16 := ip.As16()
+			b = append(append(b, atypIPv6), ip16[:]...)
+		}
+	} else {
+		if len(host) == 0 || len(host) > 255 {
+			return nil, fmt.Errorf("socks5: host name %q must be 1 to 255 bytes", host)
+		}
+		b = append(append(b, atypDomain, byte(len(host))), host...)
+	}
+	return append(b, byte(port>>8), byte(port)), nil
+}
+
+// readAddr reads an address type, address and port as host:port
+func readAddr(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+	var host []byte
+	switch atyp[0] {
+	case atypIPv4:
+		host = make([]byte, 4)
+	case atypIPv6:
+		host = make([]byte, 16)
+	case atypDomain:
+		var n [1]byte
+		if _, err := io.ReadFull(r, n[:]); err != nil {
+			return "", err
+		}
+		host = make([]byte, n[0])
+	default:
+		return "", fmt.Errorf("socks5: unknown address type %d", atyp[0])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(r, host); err != nil {
+		return "", err
+	}
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+	hostStr := string(host)
+	if atyp[0] != atypDomain {
+		ip, _ := netip.AddrFromSlice(host)
+		hostStr = ip.String()
+	}
+	return net.JoinHostPort(hostStr, strconv.Itoa(int(port[0])<<8|int(port[1]))), nil
+}
@@ -0,0 +1,216 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+// fakeServer answers one handshake on conn: it checks that the client sends
+// each of expect in turn and replies with the matching entry of replies
+func fakeServer(t *testing.T, conn net.Conn, expect, replies [][]byte) {
+	t.Helper()
+	go func() {
+		defer conn.Close()
+		for i, want := range expect {
+			got := make([]byte, len(want))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("Message %d: expected %v, got %v", i, want, got)
+				return
+			}
+			if _, err := conn.Write(replies[i]); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+func TestConnect(t *testing.T) {
+	success := []byte{version, 0, 0, atypIPv4, 10, 0, 0, 1, 0x1f, 0x90}
+	tests := []struct {
+		name    string
+		addr    string
+		auth    *Auth
+		expect  [][]byte
+		replies [][]byte
+		wantErr string
+	}{
+		{
+			name:    "domain without auth",
+			addr:    "example.com:443",
+			expect:  [][]byte{{version, 1, methodNoAuth}, append([]byte{version, byte(CommandConnect), 0, atypDomain, 11}, "example.com\x01\xbb"...)},
+			replies: [][]byte{{version, methodNoAuth}, success},
+		},
+		{
+			name:    "IPv6 with credentials",
+			addr:    "[2001:db8::1]:80",
+			auth:    &Auth{Username: "alice", Password: "pw"},
+			expect:  [][]byte{{version, 2, methodUserPassword, methodNoAuth}, []byte("\x01\x05alice\x02pw"), append([]byte{version, byte(CommandConnect), 0, atypIPv6, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, 0, 80)},
+			replies: [][]byte{{version, methodUserPassword}, {userPasswordVersion, 0}, success},
+		},
+		{
+			name:    "credentials rejected",
+			addr:    "10.0.0.1:22",
+			auth:    &Auth{Username: "alice", Password: "wrong"},
+			expect:  [][]byte{{version, 2, methodUserPassword, methodNoAuth}, []byte("\x01\x05alice\x05wrong")},
+			replies: [][]byte{{version, methodUserPassword}, {userPasswordVersion, 1}},
+			wantErr: ErrAuthFailed.Error(),
+		},
+		{
+			name:    "credentials required",
+			addr:    "10.0.0.1:22",
+			expect:  [][]byte{{version, 1, methodNoAuth}},
+			replies: [][]byte{{version, methodNoAcceptable}},
+			wantErr: ErrAuthFailed.Error(),
+		},
+		{
+			name:    "connection refused",
+			addr:    "10.0.0.1:22",
+			expect:  [][]byte{{version, 1, methodNoAuth}, {version, byte(CommandConnect), 0, atypIPv4, 10, 0, 0, 1, 0, 22}},
+			replies: [][]byte{{version, methodNoAuth}, {version, byte(ConnectionRefused), 0, atypIPv4, 0, 0, 0, 0, 0, 0}},
+			wantErr: "socks5: connect to 10.0.0.1:22: connection refused",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			fakeServer(t, server, tt.expect, tt.replies)
+
+			err := Connect(client, tt.addr, tt.auth)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("Connect: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+				t.Fatalf("Expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestConnectCarriesData(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		greeting := make([]byte, 3)
+		io.ReadFull(server, greeting)
+		server.Write([]byte{version, methodNoAuth})
+		request := make([]byte, 5+len("example.com")+2)
+		io.ReadFull(server, request)
+		server.Write([]byte{version, 0, 0, atypDomain, 1, 'x', 0, 1})
+		io.WriteString(server, "hello")
+	}()
+	if err := Connect(client, "example.com:80", nil); err != nil {
+		t.Fatalf("Connect: %v", err)
+	}
+	data, _ := io.ReadAll(client)
+	if string(data) != "hello" {
+		t.Errorf("Expected the tunnelled data after the reply, got %q", data)
+	}
+}
+
+func TestConnectRejectsBadInput(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go io.Copy(io.Discard, server)
+	defer server.Close()
+
+	if err := Connect(client, "example.com", nil); err == nil {
+		t.Error("Expected an address without a port to be rejected")
+	}
+	if err := Connect(client, strings.Repeat("a", 256)+":80", nil); err == nil || errors.Is(err, ErrAuthFailed) {
+		t.Errorf("Expected an overlong host name to be rejected, got %v", err)
+	}
+}
+
+func TestAccept(t *testing.T) {
+	verify := func(user, pass string) bool { return user == "alice" && pass == "secret" }
+	tests := []struct {
+		name      string
+		verify    func(string, string) bool
+		auth      *Auth
+		addr      string
+		wantUser  string
+		serverErr error
+	}{
+		{name: "no auth", addr: "example.com:443"},
+		{name: "IPv4", addr: "192.0.2.1:80"},
+		{name: "IPv6", addr: "[2001:db8::1]:8080"},
+		{name: "credentials", verify: verify, auth: &Auth{"alice", "secret"}, addr: "example.com:443", wantUser: "alice"},
+		{name: "wrong credentials", verify: verify, auth: &Auth{"alice", "nope"}, addr: "example.com:443", serverErr: ErrAuthFailed},
+		{name: "missing credentials", verify: verify, addr: "example.com:443", serverErr: ErrAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer client.Close()
+			clientErr := make(chan error, 1)
+			go func() { clientErr <- Connect(client, tt.addr, tt.auth) }()
+
+			req, err := Accept(server, tt.verify)
+			if tt.serverErr != nil {
+				server.Close()
+				if !errors.Is(err, tt.serverErr) {
+					t.Fatalf("Expected %v, got %v", tt.serverErr, err)
+				}
+				if err := <-clientErr; !errors.Is(err, ErrAuthFailed) {
+					t.Errorf("Expected the client to see the refusal, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Accept: %v", err)
+			}
+			if req.Command != CommandConnect || req.Addr != tt.addr || req.Username != tt.wantUser {
+				t.Errorf("Unexpected request %+v", req)
+			}
+			bound := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4321}
+			if err := WriteReply(server, Succeeded, bound); err != nil {
+				t.Fatalf("WriteReply: %v", err)
+			}
+			if err := <-clientErr; err != nil {
+				t.Errorf("Connect: %v", err)
+			}
+		})
+	}
+}
+
+func TestAcceptRefusedReply(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	clientErr := make(chan error, 1)
+	go func() { clientErr <- Connect(client, "example.com:25", nil) }()
+	if _, err := Accept(server, nil); err != nil {
+		t.Fatalf("Accept: %v", err)
+	}
+	WriteReply(server, NotAllowed, nil)
+	if err := <-clientErr; err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("Expected the client to see the refusal, got %v", err)
+	}
+}
+
+func TestDatagram(t *testing.T) {
+	for _, addr := range []string{"example.com:53", "192.0.2.1:53", "[2001:db8::1]:53"} {
+		b, err := AppendDatagram(nil, addr, []byte("query"))
+		if err != nil {
+			t.Fatalf("AppendDatagram(%s): %v", addr, err)
+		}
+		got, payload, err := ParseDatagram(b)
+		if err != nil || got != addr || string(payload) != "query" {
+			t.Errorf("ParseDatagram = %s %q %v, want %s \"query\"", got, payload, err, addr)
+		}
+	}
+	if _, _, err := ParseDatagram([]byte{0, 0, 1, atypIPv4, 1, 2, 3, 4, 0, 53}); err == nil {
+		t.Error("Expected fragments to be rejected")
+	}
+	if _, _, err := ParseDatagram([]byte{0, 0}); err == nil {
+		t.Error("Expected a short datagram to be rejected")
+	}
+}
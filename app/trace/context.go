@@ -0,0 +1,133 @@
+// Package trace implements W3C Trace Context propagation and exports spans
+// for proxied flows to an OpenTelemetry collector using OTLP/HTTP JSON.
+package trace
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Header names defined by the W3C Trace Context specification
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+// FlagSampled is the trace-flags bit indicating the caller records the trace
+const FlagSampled byte = 0x01
+
+// TraceID is a 16 byte trace identifier
+type TraceID [16]byte
+
+// SpanID is an 8 byte span identifier
+type SpanID [8]byte
+
+// String returns the lowercase hex encoding used on the wire
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+
+// String returns the lowercase hex encoding used on the wire
+func (id SpanID) String() string { return hex.EncodeToString(id[:]) }
+
+// IsValid reports whether the ID is not all zeroes
+func (id TraceID) IsValid() bool { return id != TraceID{} }
+
+// IsValid reports whether the ID is not all zeroes
+func (id SpanID) IsValid() bool { return id != SpanID{} }
+
+// SpanContext identifies a span within a trace
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Flags   byte
+}
+
+// Sampled reports whether the sampled flag is set
+func (sc SpanContext) Sampled() bool {
+	return sc.Flags&FlagSampled != 0
+}
+
+// TraceParent formats the span context as a version 00 traceparent value
+func (sc SpanContext) TraceParent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// ParseTraceParent parses a traceparent header value. Versions other than 00
+// are accepted as long as their first four fields are well formed, as the
+// specification requires.
+func ParseTraceParent(value string) (SpanContext, error) {
+	var sc SpanContext
+
+	value = strings.TrimSpace(value)
+	parts := strings.Split(value, "-")
+	if len(parts) < 4 {
+		return sc, errors.New("traceparent: expected 4 dash-separated fields")
+	}
+
+	version, err := decodeHex(parts[0], 1)
+	if err != nil {
+		return sc, fmt.Errorf("traceparent: invalid version: %v", err)
+	}
+	switch {
+	case version[0] == 0xff:
+		return sc, errors.New("traceparent: version ff is forbidden")
+	case version[0] == 0 && len(parts) != 4:
+		return sc, errors.New("traceparent: version 00 must have exactly 4 fields")
+	}
+
+	traceID, err := decodeHex(parts[1], len(sc.TraceID))
+	if err != nil {
+		return sc, fmt.Errorf("traceparent: invalid trace-id: %v", err)
+	}
+	spanID, err := decodeHex(parts[2], len(sc.SpanID))
+	if err != nil {
+		return sc, fmt.Errorf("traceparent: invalid parent-id: %v", err)
+	}
+	flags, err := decodeHex(parts[3], 1)
+	if err != nil {
+		return sc, fmt.Errorf("traceparent: invalid trace-flags: %v", err)
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+
+	if !sc.TraceID.IsValid() {
+		return sc, errors.New("traceparent: trace-id must not be all zeroes")
+	}
+	if !sc.SpanID.IsValid() {
+		return sc, errors.New("traceparent: parent-id must not be all zeroes")
+	}
+	return sc, nil
+}
+
+// decodeHex decodes a lowercase hex field of exactly n bytes
+func decodeHex(s string, n int) ([]byte, error) {
+	if len(s) != n*2 {
+		return nil, fmt.Errorf("expected %d hex digits, got %d", n*2, len(s))
+	}
+	if strings.ToLower(s) != s {
+		return nil, errors.New("hex digits must be lowercase")
+	}
+	return hex.DecodeString(s)
+}
+
+// newTraceID returns a random, valid trace ID
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// newSpanID returns a random, valid span ID
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
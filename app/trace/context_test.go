@@ -0,0 +1,73 @@
+package trace
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	sc, err := ParseTraceParent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if err != nil {
+		t.Fatalf("Failed to parse valid traceparent: %v", err)
+	}
+
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Unexpected trace ID: %s", sc.TraceID)
+	}
+	if sc.SpanID.String() != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected span ID: %s", sc.SpanID)
+	}
+	if !sc.Sampled() {
+		t.Error("Expected sampled flag to be set")
+	}
+	if sc.TraceParent() != "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01" {
+		t.Errorf("Round trip mismatch: %s", sc.TraceParent())
+	}
+}
+
+func TestParseTraceParentFutureVersion(t *testing.T) {
+	sc, err := ParseTraceParent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-extra")
+	if err != nil {
+		t.Fatalf("Expected future version to be accepted: %v", err)
+	}
+	if sc.Sampled() {
+		t.Error("Expected sampled flag to be clear")
+	}
+}
+
+func TestParseTraceParentInvalid(t *testing.T) {
+	tests := []struct {
+		value    string
+		contains string
+	}{
+		{"", "4 dash-separated"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7", "4 dash-separated"},
+		{"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", "forbidden"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra", "exactly 4"},
+		{"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", "lowercase"},
+		{"00-4bf92f3577b34da6-00f067aa0ba902b7-01", "trace-id"},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", "all zeroes"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", "all zeroes"},
+		{"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902zz-01", "parent-id"},
+	}
+
+	for _, test := range tests {
+		_, err := ParseTraceParent(test.value)
+		if err == nil {
+			t.Errorf("Expected error for %q", test.value)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.contains) {
+			t.Errorf("Error for %q = %v, expected it to mention %q", test.value, err, test.contains)
+		}
+	}
+}
+
+func TestNewIDs(t *testing.T) {
+	if a, b := newTraceID(), newTraceID(); !a.IsValid() || a == b {
+		t.Errorf("Expected distinct valid trace IDs, got %s and %s", a, b)
+	}
+	if a, b := newSpanID(), newSpanID(); !a.IsValid() || a == b {
+		t.Errorf("Expected distinct valid span IDs, got %s and %s", a, b)
+	}
+}
@@ -0,0 +1,402 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Span is a finished span ready for export
+type Span struct {
+	Context    SpanContext
+	Parent     SpanID // zero for root spans
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Error      bool   // marks the span status as error
+	Message    string // status message, only exported for errors
+}
+
+// Attribute is a span attribute. Value must be a string, bool, int, int64
+// or float64.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// DropPolicy decides which span is discarded when the export queue is full
+type DropPolicy int
+
+const (
+	// DropNewest discards the span being exported
+	DropNewest DropPolicy = iota
+	// DropOldest discards the oldest queued span to make room
+	DropOldest
+)
+
+// ParseDropPolicy parses a drop policy by name: newest, the default when
+// empty, or oldest
+func ParseDropPolicy(name string) (DropPolicy, error) {
+	switch strings.ToLower(name) {
+	case "", "newest":
+		return DropNewest, nil
+	case "oldest":
+		return DropOldest, nil
+	}
+	return DropNewest, fmt.Errorf("unknown drop policy %q; expected newest or oldest", name)
+}
+
+func (p DropPolicy) String() string {
+	if p == DropOldest {
+		return "oldest"
+	}
+	return "newest"
+}
+
+// ExporterOptions configures an Exporter. Zero values select the defaults.
+type ExporterOptions struct {
+	ServiceName   string        // resource service.name, default "nproxy"
+	BatchSize     int           // spans per request, default 128
+	QueueSize     int           // spans buffered before dropping, default 2048
+	FlushInterval time.Duration // maximum time a span waits in the queue, default 5s
+	DropPolicy    DropPolicy    // what to discard when the queue is full
+	Client        *http.Client  // default has a 10s timeout
+}
+
+// Exporter batches spans and posts them to an OTLP/HTTP collector using the
+// JSON encoding. Export never blocks: spans that do not fit in the queue, or
+// whose batch the collector rejects, are dropped and counted.
+type Exporter struct {
+	endpoint string
+	opts     ExporterOptions
+
+	queue   chan *Span
+	flushes chan chan struct{}
+	done    chan struct{}
+	stopped chan struct{}
+	once    sync.Once
+
+	exported atomic.Uint64
+	dropped  atomic.Uint64
+}
+
+// CheckOptions checks the sizes and interval of opts
+func CheckOptions(opts ExporterOptions) error {
+	switch {
+	case opts.BatchSize < 0:
+		return errors.New("batch_size must not be negative; use 0 for the default")
+	case opts.QueueSize < 0:
+		return errors.New("queue_size must not be negative; use 0 for the default")
+	case opts.FlushInterval < 0:
+		return errors.New("flush_interval must not be negative; use 0 for the default")
+	case opts.BatchSize > 0 && opts.QueueSize > 0 && opts.BatchSize > opts.QueueSize:
+		return errors.New("batch_size must not be more than queue_size")
+	}
+	return nil
+}
+
+// NewExporter creates an exporter posting to endpoint, typically
+// http://collector:4318/v1/traces, and starts its background worker
+func NewExporter(endpoint string, opts ExporterOptions) *Exporter {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "nproxy"
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 128
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 2048
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	e := &Exporter{
+		endpoint: endpoint,
+		opts:     opts,
+		queue:    make(chan *Span, opts.QueueSize),
+		flushes:  make(chan chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Export queues a span and reports whether it was accepted
+func (e *Exporter) Export(s *Span) bool {
+	select {
+	case <-e.done:
+		e.dropped.Add(1)
+		return false
+	default:
+	}
+
+	for {
+		select {
+		case e.queue <- s:
+			return true
+		default:
+		}
+
+		if e.opts.DropPolicy != DropOldest {
+			e.dropped.Add(1)
+			return false
+		}
+		select {
+		case <-e.queue:
+			e.dropped.Add(1)
+		default:
+		}
+	}
+}
+
+// Flush sends every queued span and waits for the requests to finish
+func (e *Exporter) Flush(ctx context.Context) error {
+	ack := make(chan struct{})
+	select {
+	case e.flushes <- ack:
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-ack:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting spans, sends the queued ones and waits for the
+// worker to exit or ctx to expire
+func (e *Exporter) Shutdown(ctx context.Context) error {
+	e.once.Do(func() { close(e.done) })
+	select {
+	case <-e.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Exported returns the number of spans accepted by the collector
+func (e *Exporter) Exported() uint64 {
+	return e.exported.Load()
+}
+
+// Dropped returns the number of spans discarded by the drop policy, after
+// shutdown, or because the collector rejected them
+func (e *Exporter) Dropped() uint64 {
+	return e.dropped.Load()
+}
+
+func (e *Exporter) run() {
+	defer close(e.stopped)
+
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, e.opts.BatchSize)
+	send := func() {
+		if len(batch) > 0 {
+			e.send(batch)
+			batch = batch[:0]
+		}
+	}
+	drain := func() {
+		for {
+			select {
+			case s := <-e.queue:
+				batch = append(batch, s)
+				if len(batch) >= e.opts.BatchSize {
+					send()
+				}
+			default:
+				send()
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case s := <-e.queue:
+			batch = append(batch, s)
+			if len(batch) >= e.opts.BatchSize {
+				send()
+			}
+		case <-ticker.C:
+			send()
+		case ack := <-e.flushes:
+			drain()
+			close(ack)
+		case <-e.done:
+			drain()
+			return
+		}
+	}
+}
+
+// send posts one batch, counting it as dropped on any failure
+func (e *Exporter) send(batch []*Span) {
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		log.Printf("Failed to encode %d spans: %v", len(batch), err)
+		e.dropped.Add(uint64(len(batch)))
+		return
+	}
+
+	resp, err := e.opts.Client.Post(e.endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Failed to export %d spans: %v", len(batch), err)
+		e.dropped.Add(uint64(len(batch)))
+		return
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode/100 != 2 {
+		log.Printf("Collector rejected %d spans: %s", len(batch), resp.Status)
+		e.dropped.Add(uint64(len(batch)))
+		return
+	}
+	e.exported.Add(uint64(len(batch)))
+}
+
+// OTLP/HTTP JSON request structures. 64-bit integers are encoded as strings
+// and IDs as hex, as the OTLP JSON mapping requires.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Flags             uint32         `json:"flags"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+// OTLP enum values
+const (
+	spanKindClient  = 3
+	statusCodeOK    = 1
+	statusCodeError = 2
+)
+
+func (e *Exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		span := otlpSpan{
+			TraceID:           s.Context.TraceID.String(),
+			SpanID:            s.Context.SpanID.String(),
+			Flags:             uint32(s.Context.Flags),
+			Name:              s.Name,
+			Kind:              spanKindClient,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+			Attributes:        encodeAttributes(s.Attributes),
+			Status:            otlpStatus{Code: statusCodeOK},
+		}
+		if s.Parent.IsValid() {
+			span.ParentSpanID = s.Parent.String()
+		}
+		if s.Error {
+			span.Status = otlpStatus{Code: statusCodeError, Message: s.Message}
+		}
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: encodeAttributes([]Attribute{
+			{Key: "service.name", Value: e.opts.ServiceName},
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "nproxy"},
+			Spans: spans,
+		}},
+	}}}
+}
+
+func encodeAttributes(attrs []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, 0, len(attrs))
+	for _, a := range attrs {
+		var v otlpAnyValue
+		switch val := a.Value.(type) {
+		case string:
+			v.StringValue = &val
+		case bool:
+			v.BoolValue = &val
+		case int:
+			s := strconv.Itoa(val)
+			v.IntValue = &s
+		case int64:
+			s := strconv.FormatInt(val, 10)
+			v.IntValue = &s
+		case float64:
+			v.DoubleValue = &val
+		default:
+			s := fmt.Sprint(val)
+			v.StringValue = &s
+		}
+		kvs = append(kvs, otlpKeyValue{Key: a.Key, Value: v})
+	}
+	return kvs
+}
@@ -0,0 +1,257 @@
+package trace
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collector is a stand-in OTLP/HTTP endpoint that records every request
+type collector struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+	status   int
+	server   *httptest.Server
+}
+
+func newCollector(t *testing.T) *collector {
+	c := &collector{status: http.StatusOK}
+	c.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("Unexpected export request: %s %s", r.URL.Path, r.Header.Get("Content-Type"))
+		}
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("Collector received invalid JSON: %v", err)
+		}
+
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.requests = append(c.requests, req)
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.server.Close)
+	return c
+}
+
+func (c *collector) url() string {
+	return c.server.URL + "/v1/traces"
+}
+
+func (c *collector) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []otlpSpan
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func (c *collector) batches() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.requests)
+}
+
+func testSpan(name string) *Span {
+	return &Span{
+		Context: SpanContext{TraceID: newTraceID(), SpanID: newSpanID(), Flags: FlagSampled},
+		Name:    name,
+		Start:   time.Unix(100, 0),
+		End:     time.Unix(101, 0),
+	}
+}
+
+func TestExporterBatching(t *testing.T) {
+	c := newCollector(t)
+	e := NewExporter(c.url(), ExporterOptions{BatchSize: 2, FlushInterval: time.Hour})
+
+	for i := 0; i < 5; i++ {
+		if !e.Export(testSpan("span")) {
+			t.Fatalf("Span %d was dropped", i)
+		}
+	}
+	if err := e.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	if n := len(c.spans()); n != 5 {
+		t.Errorf("Expected 5 spans at the collector, got %d", n)
+	}
+	if b := c.batches(); b != 3 {
+		t.Errorf("Expected 3 batches of at most 2 spans, got %d", b)
+	}
+	if e.Exported() != 5 || e.Dropped() != 0 {
+		t.Errorf("Expected 5 exported and 0 dropped, got %d and %d", e.Exported(), e.Dropped())
+	}
+}
+
+func TestExporterFlushInterval(t *testing.T) {
+	c := newCollector(t)
+	e := NewExporter(c.url(), ExporterOptions{FlushInterval: 10 * time.Millisecond})
+	defer e.Shutdown(context.Background())
+
+	e.Export(testSpan("span"))
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(c.spans()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := len(c.spans()); n != 1 {
+		t.Errorf("Expected the interval to flush 1 span, got %d", n)
+	}
+}
+
+func TestExporterFlush(t *testing.T) {
+	c := newCollector(t)
+	e := NewExporter(c.url(), ExporterOptions{FlushInterval: time.Hour})
+	defer e.Shutdown(context.Background())
+
+	e.Export(testSpan("span"))
+	if err := e.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush failed: %v", err)
+	}
+	if n := len(c.spans()); n != 1 {
+		t.Errorf("Expected 1 span after Flush, got %d", n)
+	}
+}
+
+func TestExporterEncoding(t *testing.T) {
+	c := newCollector(t)
+	e := NewExporter(c.url(), ExporterOptions{ServiceName: "test-proxy"})
+
+	s := testSpan("GET example.com")
+	s.Parent = newSpanID()
+	s.Error = true
+	s.Message = "connection refused"
+	s.Attributes = []Attribute{
+		{Key: "str", Value: "v"},
+		{Key: "int", Value: 42},
+		{Key: "float", Value: 1.5},
+		{Key: "bool", Value: true},
+	}
+	e.Export(s)
+	e.Shutdown(context.Background())
+
+	c.mu.Lock()
+	resource := c.requests[0].ResourceSpans[0].Resource
+	c.mu.Unlock()
+	if len(resource.Attributes) != 1 || *resource.Attributes[0].Value.StringValue != "test-proxy" {
+		t.Errorf("Unexpected resource attributes: %+v", resource.Attributes)
+	}
+
+	spans := c.spans()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if span.TraceID != s.Context.TraceID.String() || span.SpanID != s.Context.SpanID.String() {
+		t.Errorf("IDs not hex encoded: %s %s", span.TraceID, span.SpanID)
+	}
+	if span.ParentSpanID != s.Parent.String() {
+		t.Errorf("Expected parent %s, got %s", s.Parent, span.ParentSpanID)
+	}
+	if span.StartTimeUnixNano != "100000000000" || span.EndTimeUnixNano != "101000000000" {
+		t.Errorf("Unexpected timestamps: %s %s", span.StartTimeUnixNano, span.EndTimeUnixNano)
+	}
+	if span.Status.Code != statusCodeError || span.Status.Message != "connection refused" {
+		t.Errorf("Unexpected status: %+v", span.Status)
+	}
+	if *span.Attributes[1].Value.IntValue != "42" {
+		t.Errorf("Expected int attribute encoded as string, got %+v", span.Attributes[1].Value)
+	}
+	if *span.Attributes[2].Value.DoubleValue != 1.5 || !*span.Attributes[3].Value.BoolValue {
+		t.Errorf("Unexpected attribute values: %+v", span.Attributes)
+	}
+}
+
+func TestExporterDropNewest(t *testing.T) {
+	// Without a worker draining the queue it fills up deterministically
+	e := &Exporter{
+		queue: make(chan *Span, 2),
+		done:  make(chan struct{}),
+	}
+
+	var accepted []string
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if e.Export(testSpan(name)) {
+			accepted = append(accepted, name)
+		}
+	}
+
+	if len(accepted) != 2 || accepted[0] != "a" || accepted[1] != "b" {
+		t.Errorf("Expected only the first 2 spans to be accepted, got %v", accepted)
+	}
+	if e.Dropped() != 2 {
+		t.Errorf("Expected 2 dropped spans, got %d", e.Dropped())
+	}
+}
+
+func TestExporterDropOldest(t *testing.T) {
+	e := &Exporter{
+		opts:  ExporterOptions{DropPolicy: DropOldest},
+		queue: make(chan *Span, 2),
+		done:  make(chan struct{}),
+	}
+
+	for _, name := range []string{"a", "b", "c"} {
+		if !e.Export(testSpan(name)) {
+			t.Errorf("Span %s was rejected with DropOldest", name)
+		}
+	}
+
+	if e.Dropped() != 1 {
+		t.Errorf("Expected 1 dropped span, got %d", e.Dropped())
+	}
+	if first := <-e.queue; first.Name != "b" {
+		t.Errorf("Expected oldest span to be discarded, queue starts with %s", first.Name)
+	}
+}
+
+func TestExporterCollectorRejects(t *testing.T) {
+	c := newCollector(t)
+	c.status = http.StatusServiceUnavailable
+	e := NewExporter(c.url(), ExporterOptions{})
+
+	e.Export(testSpan("span"))
+	e.Shutdown(context.Background())
+
+	if e.Dropped() != 1 || e.Exported() != 0 {
+		t.Errorf("Expected rejected span to be dropped, got exported=%d dropped=%d", e.Exported(), e.Dropped())
+	}
+}
+
+func TestExporterAfterShutdown(t *testing.T) {
+	c := newCollector(t)
+	e := NewExporter(c.url(), ExporterOptions{})
+	e.Shutdown(context.Background())
+
+	if e.Export(testSpan("late")) {
+		t.Error("Expected span to be rejected after shutdown")
+	}
+	if err := e.Flush(context.Background()); err != nil {
+		t.Errorf("Flush after shutdown should be a no-op, got %v", err)
+	}
+}
+
+func TestParseDropPolicy(t *testing.T) {
+	for name, want := range map[string]DropPolicy{"": DropNewest, "newest": DropNewest, "Oldest": DropOldest} {
+		if p, err := ParseDropPolicy(name); err != nil || p != want {
+			t.Errorf("ParseDropPolicy(%q) = %v, %v; want %v", name, p, err, want)
+		}
+	}
+	if _, err := ParseDropPolicy("random"); err == nil {
+		t.Error("Expected an unknown policy to be rejected")
+	}
+}
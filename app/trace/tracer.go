@@ -0,0 +1,123 @@
+package trace
+
+import (
+	"context"
+	"encoding/hex"
+	"net/http"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+// Tracer creates a span for every proxied flow and hands finished spans to
+// an Exporter. All methods are safe to call on a nil *Tracer, in which case
+// headers are left untouched and nothing is exported.
+type Tracer struct {
+	Exporter *Exporter
+}
+
+// NewTracer creates a tracer exporting through e
+func NewTracer(e *Exporter) *Tracer {
+	return &Tracer{Exporter: e}
+}
+
+// Inject starts the span for f. If h carries a valid traceparent the span
+// joins that trace as a child, otherwise a new sampled trace is started.
+// The span's own traceparent is then written to h so that the upstream
+// server sees the proxy as its parent; tracestate is forwarded unchanged.
+func (t *Tracer) Inject(h http.Header, f *flow.Flow) {
+	if t == nil {
+		return
+	}
+
+	sc := SpanContext{TraceID: newTraceID(), Flags: FlagSampled}
+	var parent SpanID
+	if incoming, err := ParseTraceParent(h.Get(TraceParentHeader)); err == nil {
+		sc.TraceID, sc.Flags, parent = incoming.TraceID, incoming.Flags, incoming.SpanID
+	} else {
+		// tracestate belongs to the trace being replaced
+		h.Del(TraceStateHeader)
+	}
+	sc.SpanID = newSpanID()
+
+	h.Set(TraceParentHeader, sc.TraceParent())
+
+	// Only sampled spans are recorded on the flow and later exported
+	if sc.Sampled() {
+		f.TraceID = sc.TraceID.String()
+		f.SpanID = sc.SpanID.String()
+		if parent.IsValid() {
+			f.ParentSpanID = parent.String()
+		}
+	}
+}
+
+// Finish exports the span started by Inject, annotated with the flow's
+// outcome and timing breakdown
+func (t *Tracer) Finish(f *flow.Flow) {
+	if t == nil || t.Exporter == nil || f.TraceID == "" {
+		return
+	}
+
+	span := &Span{
+		Name:    f.Method + " " + f.Host,
+		Start:   f.Start,
+		End:     f.Start.Add(f.Timings.Total),
+		Error:   f.Error != "" || f.Status >= 400,
+		Message: f.Error,
+		Attributes: []Attribute{
+			{Key: "http.request.method", Value: f.Method},
+			{Key: "url.full", Value: f.URL},
+			{Key: "server.address", Value: f.Host},
+			{Key: "nproxy.flow.id", Value: int64(f.ID)},
+		},
+	}
+	span.Context.Flags = FlagSampled
+	decodeID(span.Context.TraceID[:], f.TraceID)
+	decodeID(span.Context.SpanID[:], f.SpanID)
+	decodeID(span.Parent[:], f.ParentSpanID)
+
+	if f.Status != 0 {
+		span.Attributes = append(span.Attributes, Attribute{Key: "http.response.status_code", Value: f.Status})
+	}
+	if f.Error != "" {
+		span.Attributes = append(span.Attributes, Attribute{Key: "error.type", Value: "upstream"})
+	}
+	for _, p := range []struct {
+		name string
+		d    time.Duration
+	}{
+		{"client_read", f.Timings.ClientRead},
+		{"dns", f.Timings.DNS},
+		{"connect", f.Timings.Connect},
+		{"tls", f.Timings.TLS},
+		{"request_write", f.Timings.RequestWrite},
+		{"ttfb", f.Timings.TTFB},
+		{"body_transfer", f.Timings.BodyTransfer},
+		{"handler", f.Timings.Handler},
+	} {
+		if p.d > 0 {
+			ms := float64(p.d) / float64(time.Millisecond)
+			span.Attributes = append(span.Attributes, Attribute{Key: "nproxy.timing." + p.name + "_ms", Value: ms})
+		}
+	}
+
+	t.Exporter.Export(span)
+}
+
+// Shutdown exports the spans still queued and stops the exporter. Spans
+// finished afterwards are dropped.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	if t == nil || t.Exporter == nil {
+		return nil
+	}
+	return t.Exporter.Shutdown(ctx)
+}
+
+// decodeID fills dst from a hex ID recorded on a flow, leaving it zero when
+// the ID is empty or malformed
+func decodeID(dst []byte, s string) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == len(dst) {
+		copy(dst, b)
+	}
+}
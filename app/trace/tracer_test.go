@@ -0,0 +1,141 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"nproxy/app/flow"
+)
+
+func TestTracerInjectNewTrace(t *testing.T) {
+	tracer := NewTracer(nil)
+	f := flow.New("GET", "http://example.com/", "example.com")
+	h := http.Header{}
+	h.Set(TraceStateHeader, "vendor=orphan")
+
+	tracer.Inject(h, f)
+
+	sc, err := ParseTraceParent(h.Get(TraceParentHeader))
+	if err != nil {
+		t.Fatalf("Injected traceparent is invalid: %v", err)
+	}
+	if !sc.Sampled() {
+		t.Error("Expected new traces to be sampled")
+	}
+	if f.TraceID != sc.TraceID.String() || f.SpanID != sc.SpanID.String() {
+		t.Errorf("Flow IDs %s/%s do not match header %s", f.TraceID, f.SpanID, h.Get(TraceParentHeader))
+	}
+	if f.ParentSpanID != "" {
+		t.Errorf("Expected a root span, got parent %s", f.ParentSpanID)
+	}
+	if h.Get(TraceStateHeader) != "" {
+		t.Error("Expected tracestate without a traceparent to be dropped")
+	}
+}
+
+func TestTracerInjectChildSpan(t *testing.T) {
+	tracer := NewTracer(nil)
+	f := flow.New("GET", "http://example.com/", "example.com")
+	h := http.Header{}
+	h.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	h.Set(TraceStateHeader, "vendor=value")
+
+	tracer.Inject(h, f)
+
+	sc, err := ParseTraceParent(h.Get(TraceParentHeader))
+	if err != nil {
+		t.Fatalf("Injected traceparent is invalid: %v", err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" {
+		t.Errorf("Expected trace ID to be kept, got %s", sc.TraceID)
+	}
+	if sc.SpanID.String() == "00f067aa0ba902b7" {
+		t.Error("Expected a new span ID for the proxy span")
+	}
+	if f.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Expected parent span 00f067aa0ba902b7, got %s", f.ParentSpanID)
+	}
+	if h.Get(TraceStateHeader) != "vendor=value" {
+		t.Errorf("Expected tracestate to be forwarded, got %q", h.Get(TraceStateHeader))
+	}
+}
+
+func TestTracerInjectUnsampled(t *testing.T) {
+	tracer := NewTracer(nil)
+	f := flow.New("GET", "http://example.com/", "example.com")
+	h := http.Header{}
+	h.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	tracer.Inject(h, f)
+
+	if sc, _ := ParseTraceParent(h.Get(TraceParentHeader)); sc.Sampled() {
+		t.Error("Expected the sampling decision to be propagated")
+	}
+	if f.TraceID != "" {
+		t.Error("Expected unsampled flows not to be recorded")
+	}
+}
+
+func TestTracerFinish(t *testing.T) {
+	c := newCollector(t)
+	e := NewExporter(c.url(), ExporterOptions{})
+	tracer := NewTracer(e)
+
+	f := flow.New("POST", "https://example.com/api", "example.com")
+	h := http.Header{}
+	h.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	tracer.Inject(h, f)
+
+	f.Status = http.StatusBadGateway
+	f.Error = errors.New("connection refused").Error()
+	f.Timings.TTFB = 20 * time.Millisecond
+	f.Timings.Total = 25 * time.Millisecond
+	tracer.Finish(f)
+	e.Shutdown(context.Background())
+
+	spans := c.spans()
+	if len(spans) != 1 {
+		t.Fatalf("Expected 1 span, got %d", len(spans))
+	}
+	span := spans[0]
+
+	if span.Name != "POST example.com" {
+		t.Errorf("Unexpected span name %q", span.Name)
+	}
+	if span.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || span.ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("Unexpected span lineage: trace=%s parent=%s", span.TraceID, span.ParentSpanID)
+	}
+	if span.Status.Code != statusCodeError {
+		t.Errorf("Expected error status, got %+v", span.Status)
+	}
+
+	attrs := map[string]otlpAnyValue{}
+	for _, kv := range span.Attributes {
+		attrs[kv.Key] = kv.Value
+	}
+	if v := attrs["url.full"].StringValue; v == nil || *v != "https://example.com/api" {
+		t.Errorf("Unexpected url.full attribute: %+v", attrs["url.full"])
+	}
+	if v := attrs["http.response.status_code"].IntValue; v == nil || *v != "502" {
+		t.Errorf("Unexpected status code attribute: %+v", attrs["http.response.status_code"])
+	}
+	if v := attrs["nproxy.timing.ttfb_ms"].DoubleValue; v == nil || *v != 20 {
+		t.Errorf("Unexpected TTFB attribute: %+v", attrs["nproxy.timing.ttfb_ms"])
+	}
+}
+
+func TestTracerNil(t *testing.T) {
+	var tracer *Tracer
+	f := flow.New("GET", "http://example.com/", "example.com")
+	h := http.Header{}
+
+	tracer.Inject(h, f)
+	tracer.Finish(f)
+
+	if h.Get(TraceParentHeader) != "" {
+		t.Error("Expected a nil tracer to leave headers untouched")
+	}
+}
@@ -0,0 +1,137 @@
+// Package transport configures the HTTP transport that a proxy shares
+// across its flows: how many connections it keeps to upstream servers,
+// whether it speaks HTTP/2 to them and how it sets up TCP and TLS.
+package transport
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Settings configure the pooling, protocols, dialing and TLS of a proxy's
+// transport. Timeouts are set apart, by the limits package.
+type Settings struct {
+	MaxIdleConns        int           // idle connections kept in all; 0 for no limit
+	MaxIdleConnsPerHost int           // idle connections kept per upstream host; net/http's 2 when zero
+	MaxConnsPerHost     int           // connections per upstream host, busy or idle; 0 for no limit
+	KeepAlive           time.Duration // interval of TCP keep-alive probes; negative turns them off
+	HTTP2               bool          // negotiate HTTP/2 with upstream servers over TLS
+	TLS                 TLS
+}
+
+// TLS configures the TLS connections to upstream servers
+type TLS struct {
+	// VerifyIntercepted checks the certificates of the servers behind
+	// intercepted tunnels. Servers reached by forwarded and reverse proxy
+	// requests are always checked.
+	VerifyIntercepted bool
+	RootCAs           *x509.CertPool // trusted roots; the system's when nil
+	MinVersion        uint16         // lowest TLS version offered; crypto/tls's default when zero
+}
+
+// Default returns the settings of a proxy that isn't configured otherwise
+func Default() Settings {
+	return Settings{
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 8,
+		KeepAlive:           30 * time.Second,
+		HTTP2:               true,
+	}
+}
+
+// Check checks the settings
+func Check(s Settings) error {
+	switch {
+	case s.MaxIdleConns < 0, s.MaxIdleConnsPerHost < 0, s.MaxConnsPerHost < 0:
+		return errors.New("connection counts must not be negative; use 0 for no limit")
+	case s.MaxIdleConns != 0 && s.MaxIdleConnsPerHost > s.MaxIdleConns:
+		return errors.New("max_idle_conns_per_host must not be more than max_idle_conns")
+	case s.TLS.MinVersion != 0 && s.TLS.MinVersion < tls.VersionTLS10:
+		return errors.New("min_version must be 1.0 or later")
+	}
+	return nil
+}
+
+// ParseVersion parses a TLS version as written in the config file, e.g.
+// "1.2"; "" is crypto/tls's default, zero
+func ParseVersion(s string) (uint16, error) {
+	switch s {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, errors.New("unknown TLS version " + s + "; expected 1.0, 1.1, 1.2 or 1.3")
+}
+
+// LoadRoots reads the PEM certificates in file as a pool of trusted roots
+func LoadRoots(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%s contains no PEM certificates", file)
+	}
+	return pool, nil
+}
+
+// New returns a transport with the pooling and protocols of s whose idle
+// connections are closed after idle. It sends requests as they are, without
+// asking for compressed responses, and neither dials nor picks proxies:
+// callers set DialContext and Proxy.
+func New(s Settings, idle time.Duration) *http.Transport {
+	tr := &http.Transport{
+		MaxIdleConns:          s.MaxIdleConns,
+		MaxIdleConnsPerHost:   s.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       s.MaxConnsPerHost,
+		IdleConnTimeout:       idle,
+		ExpectContinueTimeout: time.Second,
+		DisableCompression:    true,
+		TLSClientConfig:       s.ClientConfig(),
+		ForceAttemptHTTP2:     s.HTTP2,
+	}
+	if !s.HTTP2 {
+		// A non-nil empty map keeps net/http from setting up HTTP/2
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return tr
+}
+
+// Dialer returns a dialer with the keep-alive interval of s
+func (s Settings) Dialer() *net.Dialer {
+	return &net.Dialer{KeepAlive: s.KeepAlive}
+}
+
+// ClientConfig returns the TLS configuration for connections to upstream
+// servers that are verified
+func (s Settings) ClientConfig() *tls.Config {
+	return &tls.Config{RootCAs: s.TLS.RootCAs, MinVersion: s.TLS.MinVersion}
+}
+
+// InterceptConfig returns the TLS configuration for a connection to
+// serverName, the server behind an intercepted tunnel. It offers HTTP/2
+// when s allows it and h2 is true.
+func (s Settings) InterceptConfig(serverName string, h2 bool) *tls.Config {
+	c := s.ClientConfig()
+	c.ServerName = serverName
+	c.InsecureSkipVerify = !s.TLS.VerifyIntercepted
+	c.NextProtos = []string{"http/1.1"}
+	if s.HTTP2 && h2 {
+		c.NextProtos = []string{"h2", "http/1.1"}
+	}
+	return c
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheck(t *testing.T) {
+	if err := Check(Default()); err != nil {
+		t.Errorf("Expected the defaults to be valid, got %v", err)
+	}
+	if err := Check(Settings{}); err != nil {
+		t.Errorf("Expected no limits to be valid, got %v", err)
+	}
+	for _, s := range []Settings{
+		{MaxConnsPerHost: -1},
+		{MaxIdleConns: 2, MaxIdleConnsPerHost: 4},
+		{TLS: TLS{MinVersion: 0x0300}},
+	} {
+		if err := Check(s); err == nil {
+			t.Errorf("Expected %+v to be invalid", s)
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	for s, want := range map[string]uint16{"": 0, "1.0": tls.VersionTLS10, "1.2": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		if v, err := ParseVersion(s); err != nil || v != want {
+			t.Errorf("ParseVersion(%q) = %#x, %v; want %#x", s, v, err, want)
+		}
+	}
+	if _, err := ParseVersion("TLS1.2"); err == nil {
+		t.Error("Expected an unknown version to be refused")
+	}
+}
+
+func TestLoadRoots(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	defer srv.Close()
+	dir := t.TempDir()
+	file := filepath.Join(dir, "ca.pem")
+	os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0o600)
+	if _, err := LoadRoots(file); err != nil {
+		t.Errorf("Expected the certificate to load, got %v", err)
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	os.WriteFile(empty, []byte("not a certificate"), 0o600)
+	if _, err := LoadRoots(empty); err == nil || !strings.Contains(err.Error(), "no PEM certificates") {
+		t.Errorf("Expected a file without certificates to be refused, got %v", err)
+	}
+}
+
+func TestNew(t *testing.T) {
+	s := Default()
+	tr := New(s, time.Minute)
+	if tr.MaxIdleConnsPerHost != 8 || tr.IdleConnTimeout != time.Minute || !tr.ForceAttemptHTTP2 || tr.TLSNextProto != nil {
+		t.Errorf("Unexpected transport %+v", tr)
+	}
+	if !tr.DisableCompression {
+		t.Error("Expected the transport to leave Accept-Encoding to clients")
+	}
+
+	s.HTTP2 = false
+	if tr := New(s, 0); tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Error("Expected HTTP/2 to be turned off")
+	}
+}
+
+func TestInterceptConfig(t *testing.T) {
+	s := Default()
+	c := s.InterceptConfig("example.com", true)
+	if c.ServerName != "example.com" || !c.InsecureSkipVerify || !reflect.DeepEqual(c.NextProtos, []string{"h2", "http/1.1"}) {
+		t.Errorf("Unexpected config for an intercepted server: %+v", c)
+	}
+	if c := s.InterceptConfig("example.com", false); !reflect.DeepEqual(c.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("Expected only HTTP/1.1 when h2 is false, got %v", c.NextProtos)
+	}
+
+	s.HTTP2 = false
+	s.TLS.VerifyIntercepted = true
+	c = s.InterceptConfig("example.com", true)
+	if c.InsecureSkipVerify || !reflect.DeepEqual(c.NextProtos, []string{"http/1.1"}) {
+		t.Errorf("Unexpected config with verification on and HTTP/2 off: %+v", c)
+	}
+	if s.ClientConfig().InsecureSkipVerify {
+		t.Error("Expected forwarded requests to be verified")
+	}
+}
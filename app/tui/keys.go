@@ -0,0 +1,110 @@
+package tui
+
+import "unicode/utf8"
+
+// keyCode identifies a key press; printable characters use keyRune
+type keyCode int
+
+const (
+	keyRune keyCode = iota
+	keyUp
+	keyDown
+	keyPageUp
+	keyPageDown
+	keyHome
+	keyEnd
+	keyEnter
+	keyEscape
+	keyBackspace
+	keyTab
+	keyCtrlC
+	keyCtrlU
+)
+
+type key struct {
+	code keyCode
+	r    rune
+}
+
+// escapes maps the terminal escape sequences we understand to keys. Both
+// the CSI and SS3 forms of the cursor keys are listed since terminals
+// switch between them depending on the keypad mode.
+var escapes = map[string]keyCode{
+	"\x1b[A":  keyUp,
+	"\x1bOA":  keyUp,
+	"\x1b[B":  keyDown,
+	"\x1bOB":  keyDown,
+	"\x1b[5~": keyPageUp,
+	"\x1b[6~": keyPageDown,
+	"\x1b[H":  keyHome,
+	"\x1bOH":  keyHome,
+	"\x1b[1~": keyHome,
+	"\x1b[7~": keyHome,
+	"\x1b[F":  keyEnd,
+	"\x1bOF":  keyEnd,
+	"\x1b[4~": keyEnd,
+	"\x1b[8~": keyEnd,
+}
+
+// parseKeys decodes the bytes of one read from a raw-mode terminal.
+// Unknown escape sequences are skipped.
+func parseKeys(b []byte) []key {
+	var keys []key
+	for len(b) > 0 {
+		switch c := b[0]; {
+		case c == 0x1b:
+			n := escapeLen(b)
+			if n == 1 {
+				keys = append(keys, key{code: keyEscape})
+			} else if code, ok := escapes[string(b[:n])]; ok {
+				keys = append(keys, key{code: code})
+			}
+			b = b[n:]
+			continue
+		case c == '\r' || c == '\n':
+			keys = append(keys, key{code: keyEnter})
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, key{code: keyBackspace})
+		case c == '\t':
+			keys = append(keys, key{code: keyTab})
+		case c == 0x03:
+			keys = append(keys, key{code: keyCtrlC})
+		case c == 0x15:
+			keys = append(keys, key{code: keyCtrlU})
+		case c < 0x20:
+			// Other control characters have no binding
+		default:
+			r, size := utf8.DecodeRune(b)
+			keys = append(keys, key{code: keyRune, r: r})
+			b = b[size:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys
+}
+
+// escapeLen returns the length of the escape sequence at the start of b,
+// which is 1 for a lone Escape key
+func escapeLen(b []byte) int {
+	if len(b) < 2 {
+		return 1
+	}
+	switch b[1] {
+	case '[':
+		// CSI: parameters and intermediates, then a final byte in 0x40-0x7e
+		for i := 2; i < len(b); i++ {
+			if b[i] >= 0x40 && b[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(b)
+	case 'O':
+		if len(b) >= 3 {
+			return 3
+		}
+		return len(b)
+	default:
+		return 1
+	}
+}
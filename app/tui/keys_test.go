@@ -0,0 +1,30 @@
+package tui
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []key
+	}{
+		{"runes", "jé/", []key{{code: keyRune, r: 'j'}, {code: keyRune, r: 'é'}, {code: keyRune, r: '/'}}},
+		{"arrows", "\x1b[A\x1b[B\x1bOA", []key{{code: keyUp}, {code: keyDown}, {code: keyUp}}},
+		{"paging", "\x1b[5~\x1b[6~\x1b[H\x1b[4~", []key{{code: keyPageUp}, {code: keyPageDown}, {code: keyHome}, {code: keyEnd}}},
+		{"lone escape", "\x1b", []key{{code: keyEscape}}},
+		{"escape then rune", "\x1bq", []key{{code: keyEscape}, {code: keyRune, r: 'q'}}},
+		{"controls", "\r\x7f\t\x03\x15", []key{{code: keyEnter}, {code: keyBackspace}, {code: keyTab}, {code: keyCtrlC}, {code: keyCtrlU}}},
+		{"unknown sequence skipped", "\x1b[1;5Cx", []key{{code: keyRune, r: 'x'}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseKeys([]byte(tt.input)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseKeys(%q) = %v, want %v", tt.input, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,624 @@
+package tui
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"nproxy/app/filter"
+	"nproxy/app/flow"
+)
+
+type mode int
+
+const (
+	modeList mode = iota
+	modeFilter
+	modeDetail
+)
+
+// action is what the terminal loop must do after a key press
+type action int
+
+const (
+	actionNone action = iota
+	actionQuit
+	actionExport
+)
+
+// model is the terminal UI state. It is independent of the terminal so
+// that key handling and rendering can be tested directly.
+type model struct {
+	flows   []*flow.Flow // received flows, oldest first
+	visible []*flow.Flow // flows matching the filter
+	limit   int
+
+	filter    string
+	expr      *filter.Filter // filter parsed as an expression, nil for a text search
+	filterErr error          // why filter is not an expression
+	cursor    int            // index into visible
+	offset    int            // index of the first row on screen
+	follow    bool           // keep the cursor on the newest flow
+
+	marked  map[uint64]bool
+	paused  bool
+	pending []*flow.Flow // flows received while paused
+
+	mode   mode
+	detail *flow.Flow
+	scroll int
+
+	status string
+	width  int
+	height int
+}
+
+func newModel(limit int) *model {
+	return &model{
+		limit:  limit,
+		follow: true,
+		marked: make(map[uint64]bool),
+		width:  80,
+		height: 24,
+	}
+}
+
+// add appends a flow, or queues it while the stream is paused
+func (m *model) add(f *flow.Flow) {
+	if m.paused {
+		m.pending = append(m.pending, f)
+		return
+	}
+	m.flows = append(m.flows, f)
+	if len(m.flows) > m.limit {
+		evicted := m.flows[0]
+		m.flows[0] = nil
+		m.flows = m.flows[1:]
+		delete(m.marked, evicted.ID)
+		if len(m.visible) > 0 && m.visible[0] == evicted {
+			m.visible = m.visible[1:]
+			if m.cursor > 0 {
+				m.cursor--
+			}
+		}
+	}
+	if m.matches(f) {
+		m.visible = append(m.visible, f)
+	}
+	if m.follow {
+		m.cursor = len(m.visible) - 1
+	}
+	m.clamp()
+}
+
+// matches reports whether f passes the filter. A filter that parses as a
+// filter expression is evaluated as one; otherwise every space-separated
+// term must appear in the method, URL or status code.
+func (m *model) matches(f *flow.Flow) bool {
+	if m.filter == "" || m.expr != nil {
+		return m.expr.Match(f)
+	}
+	text := strings.ToLower(f.Method + " " + f.URL + " " + strconv.Itoa(f.Status))
+	for _, term := range strings.Fields(strings.ToLower(m.filter)) {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+	return true
+}
+
+// refilter rebuilds the visible list, keeping the cursor on the same flow
+// when it still matches
+func (m *model) refilter() {
+	m.expr, m.filterErr = nil, nil
+	if m.filter != "" {
+		m.expr, m.filterErr = filter.Parse(m.filter)
+	}
+
+	var current uint64
+	if f := m.selected(); f != nil {
+		current = f.ID
+	}
+
+	m.visible = m.visible[:0]
+	m.cursor = -1
+	for _, f := range m.flows {
+		if m.matches(f) {
+			if f.ID == current {
+				m.cursor = len(m.visible)
+			}
+			m.visible = append(m.visible, f)
+		}
+	}
+	if m.cursor < 0 || m.follow {
+		m.cursor = len(m.visible) - 1
+	}
+	m.clamp()
+}
+
+func (m *model) selected() *flow.Flow {
+	if m.cursor < 0 || m.cursor >= len(m.visible) {
+		return nil
+	}
+	return m.visible[m.cursor]
+}
+
+// rows is the number of flow rows that fit on screen
+func (m *model) rows() int {
+	return max(m.height-3, 1)
+}
+
+// clamp keeps the cursor in range and on screen
+func (m *model) clamp() {
+	m.cursor = min(max(m.cursor, 0), max(len(m.visible)-1, 0))
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	}
+	if m.cursor >= m.offset+m.rows() {
+		m.offset = m.cursor - m.rows() + 1
+	}
+	m.offset = min(max(m.offset, 0), max(len(m.visible)-m.rows(), 0))
+}
+
+func (m *model) move(delta int) {
+	m.cursor += delta
+	m.clamp()
+	m.follow = m.cursor == len(m.visible)-1
+}
+
+// markedFlows returns the marked flows in order, or the flow under the
+// cursor when nothing is marked
+func (m *model) markedFlows() []*flow.Flow {
+	var out []*flow.Flow
+	for _, f := range m.flows {
+		if m.marked[f.ID] {
+			out = append(out, f)
+		}
+	}
+	if len(out) == 0 {
+		if f := m.selected(); f != nil {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func (m *model) togglePause() {
+	m.paused = !m.paused
+	if m.paused {
+		return
+	}
+	pending := m.pending
+	m.pending = nil
+	for _, f := range pending {
+		m.add(f)
+	}
+}
+
+// handleKey applies a key press and reports what the caller must do next
+func (m *model) handleKey(k key) action {
+	if k.code == keyCtrlC {
+		return actionQuit
+	}
+	switch m.mode {
+	case modeFilter:
+		m.filterKey(k)
+	case modeDetail:
+		return m.detailKey(k)
+	default:
+		return m.listKey(k)
+	}
+	return actionNone
+}
+
+func (m *model) listKey(k key) action {
+	m.status = ""
+	switch k.code {
+	case keyUp:
+		m.move(-1)
+	case keyDown:
+		m.move(1)
+	case keyPageUp:
+		m.move(-m.rows())
+	case keyPageDown:
+		m.move(m.rows())
+	case keyHome:
+		m.move(-len(m.visible))
+	case keyEnd:
+		m.move(len(m.visible))
+	case keyEnter:
+		m.openDetail()
+	case keyEscape:
+		if m.filter != "" {
+			m.filter = ""
+			m.refilter()
+		}
+	case keyRune:
+		switch k.r {
+		case 'q':
+			return actionQuit
+		case 'k':
+			m.move(-1)
+		case 'j':
+			m.move(1)
+		case 'g':
+			m.move(-len(m.visible))
+		case 'G':
+			m.move(len(m.visible))
+		case '/':
+			m.mode = modeFilter
+		case ' ', 'm':
+			if f := m.selected(); f != nil {
+				if m.marked[f.ID] {
+					delete(m.marked, f.ID)
+				} else {
+					m.marked[f.ID] = true
+				}
+				m.move(1)
+			}
+		case 'a':
+			for _, f := range m.visible {
+				m.marked[f.ID] = true
+			}
+		case 'u':
+			clear(m.marked)
+		case 'p':
+			m.togglePause()
+		case 'c':
+			m.flows, m.visible, m.pending = nil, nil, nil
+			clear(m.marked)
+			m.cursor, m.offset, m.follow = 0, 0, true
+		case 'e':
+			return actionExport
+		}
+	}
+	return actionNone
+}
+
+// filterKey edits the filter; the list updates as the user types
+func (m *model) filterKey(k key) {
+	switch k.code {
+	case keyEnter:
+		m.mode = modeList
+		return
+	case keyEscape:
+		m.mode = modeList
+		m.filter = ""
+	case keyBackspace:
+		if m.filter != "" {
+			_, size := utf8.DecodeLastRuneInString(m.filter)
+			m.filter = m.filter[:len(m.filter)-size]
+		}
+	case keyCtrlU:
+		m.filter = ""
+	case keyRune:
+		m.filter += string(k.r)
+	default:
+		return
+	}
+	m.refilter()
+}
+
+func (m *model) openDetail() {
+	if f := m.selected(); f != nil {
+		m.detail = f
+		m.scroll = 0
+		m.mode = modeDetail
+	}
+}
+
+func (m *model) detailKey(k key) action {
+	lines := len(m.detailLines())
+	page := max(m.height-2, 1)
+	switch k.code {
+	case keyEscape, keyBackspace:
+		m.mode = modeList
+	case keyUp:
+		m.scroll--
+	case keyDown:
+		m.scroll++
+	case keyPageUp:
+		m.scroll -= page
+	case keyPageDown, keyTab:
+		m.scroll += page
+	case keyHome:
+		m.scroll = 0
+	case keyEnd:
+		m.scroll = lines
+	case keyRune:
+		switch k.r {
+		case 'q':
+			m.mode = modeList
+		case 'k':
+			m.scroll--
+		case 'j':
+			m.scroll++
+		case ' ':
+			m.scroll += page
+		case 'g':
+			m.scroll = 0
+		case 'G':
+			m.scroll = lines
+		case 'e':
+			return actionExport
+		}
+	}
+	m.scroll = min(max(m.scroll, 0), max(lines-page, 0))
+	return actionNone
+}
+
+// render draws the screen as exactly m.height lines of at most m.width
+// columns. Highlighted lines are wrapped in reverse video.
+func (m *model) render() []string {
+	var lines []string
+	if m.mode == modeDetail {
+		lines = m.renderDetail()
+	} else {
+		lines = m.renderList()
+	}
+	for len(lines) < m.height {
+		lines = append(lines, "")
+	}
+	return lines[:m.height]
+}
+
+const (
+	reverse = "\x1b[7m"
+	bold    = "\x1b[1m"
+	reset   = "\x1b[0m"
+)
+
+func (m *model) renderList() []string {
+	title := fmt.Sprintf("nproxy  %d/%d flows", len(m.visible), len(m.flows))
+	if n := len(m.marked); n > 0 {
+		title += fmt.Sprintf("  %d marked", n)
+	}
+	if m.paused {
+		title += fmt.Sprintf("  PAUSED (%d waiting)", len(m.pending))
+	}
+	if m.filter != "" && m.mode != modeFilter {
+		if m.expr != nil {
+			title += "  filter: " + m.filter
+		} else {
+			title += "  search: " + m.filter
+		}
+	}
+
+	lines := []string{
+		reverse + fit(title, m.width) + reset,
+		bold + fit(m.row(" ", "ID", "METHOD", "CODE", "HOST", "PATH", "SIZE", "TIME"), m.width) + reset,
+	}
+	end := min(m.offset+m.rows(), len(m.visible))
+	for i := m.offset; i < end; i++ {
+		f := m.visible[i]
+		mark := " "
+		if m.marked[f.ID] {
+			mark = "*"
+		}
+		status := "-"
+		if f.Status != 0 {
+			status = strconv.Itoa(f.Status)
+		}
+		line := fit(m.row(mark, strconv.FormatUint(f.ID, 10), f.Method, status, f.Host, path(f.URL),
+			formatSize(f.ResponseSize), formatDuration(f.Timings.Total)), m.width)
+		if i == m.cursor {
+			line = reverse + line + reset
+		}
+		lines = append(lines, line)
+	}
+	for len(lines) < m.height-1 {
+		lines = append(lines, "")
+	}
+
+	footer := m.status
+	switch {
+	case m.mode == modeFilter:
+		footer = "/" + m.filter + "█"
+		if m.filterErr != nil {
+			footer += "  (text search; as an expression: " + strings.TrimPrefix(m.filterErr.Error(), "filter: ") + ")"
+		}
+	case footer == "":
+		footer = "↑↓ move  enter details  / filter  space mark  a all  u unmark  p pause  e export  c clear  q quit"
+	}
+	return append(lines, fit(footer, m.width))
+}
+
+// row lays out the list columns, giving the path whatever width is left
+func (m *model) row(mark, id, method, status, host, p, size, dur string) string {
+	// Fixed columns and their separators take 65 cells
+	pathWidth := max(m.width-65, 10)
+	return fmt.Sprintf("%s%6s %-7s %-4s %-24s %-*s %9s %8s",
+		mark, id, fit(method, 7), status, fit(host, 24), pathWidth, fit(p, pathWidth), size, dur)
+}
+
+func (m *model) renderDetail() []string {
+	f := m.detail
+	lines := []string{reverse + fit(fmt.Sprintf("#%d %s %s", f.ID, f.Method, f.URL), m.width) + reset}
+	body := m.detailLines()
+	page := max(m.height-2, 1)
+	end := min(m.scroll+page, len(body))
+	for _, l := range body[m.scroll:end] {
+		lines = append(lines, fit(l, m.width))
+	}
+	for len(lines) < m.height-1 {
+		lines = append(lines, "")
+	}
+	footer := m.status
+	if footer == "" {
+		footer = fmt.Sprintf("↑↓ scroll  space page  e export  esc back   %d-%d of %d", m.scroll+1, end, len(body))
+	}
+	return append(lines, fit(footer, m.width))
+}
+
+// detailLines formats the selected flow, wrapped to the screen width
+func (m *model) detailLines() []string {
+	f := m.detail
+	if f == nil {
+		return nil
+	}
+
+	var text []string
+	text = append(text, fmt.Sprintf("Status: %d", f.Status))
+	if f.Error != "" {
+		text = append(text, "Error: "+f.Error)
+	}
+	text = append(text, "Started: "+f.Start.Format(time.RFC3339Nano))
+	if f.TraceID != "" {
+		text = append(text, "Trace: "+f.TraceID+" span "+f.SpanID)
+	}
+	if t := f.Timings.String(); t != "" {
+		text = append(text, "Timing: "+t)
+	}
+
+	text = append(text, "", "── Request ──")
+	text = append(text, headerLines(f.RequestHeader)...)
+	text = append(text, "")
+	text = append(text, bodyLines(f.RequestBody, f.RequestHeader, f.RequestSize, f.RequestTruncated)...)
+
+	text = append(text, "", "── Response ──")
+	text = append(text, headerLines(f.ResponseHeader)...)
+	text = append(text, "")
+	text = append(text, bodyLines(f.ResponseBody, f.ResponseHeader, f.ResponseSize, f.ResponseTruncated)...)
+
+	var wrapped []string
+	for _, l := range text {
+		wrapped = append(wrapped, wrap(l, m.width)...)
+	}
+	return wrapped
+}
+
+func headerLines(h http.Header) []string {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		for _, v := range h[name] {
+			lines = append(lines, name+": "+v)
+		}
+	}
+	return lines
+}
+
+// bodyLines shows a captured body as text, indenting JSON. Binary bodies
+// are summarised rather than written to the terminal.
+func bodyLines(body []byte, h http.Header, size int64, truncated bool) []string {
+	if len(body) == 0 {
+		if size > 0 {
+			return []string{fmt.Sprintf("(%s body not captured)", formatSize(size))}
+		}
+		return []string{"(no body)"}
+	}
+	if !printable(body) {
+		return []string{fmt.Sprintf("(%s binary body, %s)", formatSize(size), h.Get("Content-Type"))}
+	}
+
+	if strings.Contains(h.Get("Content-Type"), "json") {
+		var buf bytes.Buffer
+		if json.Indent(&buf, body, "", "  ") == nil {
+			body = buf.Bytes()
+		}
+	}
+	lines := strings.Split(strings.TrimRight(string(body), "\n"), "\n")
+	if truncated {
+		lines = append(lines, fmt.Sprintf("(truncated: showing %s of %s)", formatSize(int64(len(body))), formatSize(size)))
+	}
+	return lines
+}
+
+// printable reports whether b is UTF-8 text without control characters
+// other than whitespace, so it is safe to write to the terminal
+func printable(b []byte) bool {
+	if !utf8.Valid(b) {
+		return false
+	}
+	for _, r := range string(b) {
+		if unicode.IsControl(r) && r != '\n' && r != '\r' && r != '\t' {
+			return false
+		}
+	}
+	return true
+}
+
+// fit truncates or pads s to exactly width columns, replacing tabs and
+// control characters so they can't move the cursor
+func fit(s string, width int) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range s {
+		if n == width {
+			break
+		}
+		if r == '\t' {
+			r = ' '
+		} else if unicode.IsControl(r) {
+			r = '?'
+		}
+		if n == width-1 && utf8.RuneCountInString(s) > width {
+			r = '…'
+		}
+		b.WriteRune(r)
+		n++
+	}
+	for ; n < width; n++ {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// wrap splits s into lines of at most width runes
+func wrap(s string, width int) []string {
+	runes := []rune(s)
+	if len(runes) <= width || width <= 0 {
+		return []string{s}
+	}
+	var lines []string
+	for len(runes) > width {
+		lines = append(lines, string(runes[:width]))
+		runes = runes[width:]
+	}
+	return append(lines, string(runes))
+}
+
+func path(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return u.RequestURI()
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fM", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fK", float64(n)/(1<<10))
+	default:
+		return fmt.Sprintf("%dB", n)
+	}
+}
+
+func formatDuration(d time.Duration) string {
+	switch {
+	case d == 0:
+		return "-"
+	case d < time.Millisecond:
+		return fmt.Sprintf("%dµs", d.Microseconds())
+	case d < time.Second:
+		return fmt.Sprintf("%dms", d.Milliseconds())
+	default:
+		return fmt.Sprintf("%.2fs", d.Seconds())
+	}
+}
@@ -0,0 +1,247 @@
+package tui
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"nproxy/app/flow"
+)
+
+func testFlow(method, url, host string, status int) *flow.Flow {
+	f := flow.New(method, url, host)
+	f.Status = status
+	return f
+}
+
+func press(m *model, input string) action {
+	var last action
+	for _, k := range parseKeys([]byte(input)) {
+		last = m.handleKey(k)
+	}
+	return last
+}
+
+func TestModelFollowsNewFlows(t *testing.T) {
+	m := newModel(100)
+	m.height = 6 // three rows of flows
+
+	for i := 0; i < 5; i++ {
+		m.add(testFlow("GET", "http://a.example/", "a.example", 200))
+	}
+	if m.cursor != 4 || m.offset != 2 {
+		t.Errorf("Expected cursor on newest flow, got cursor %d offset %d", m.cursor, m.offset)
+	}
+
+	// Moving up stops following; new flows no longer move the cursor
+	press(m, "k")
+	m.add(testFlow("GET", "http://a.example/", "a.example", 200))
+	if m.cursor != 3 {
+		t.Errorf("Expected cursor to stay at 3, got %d", m.cursor)
+	}
+
+	press(m, "G")
+	m.add(testFlow("GET", "http://a.example/", "a.example", 200))
+	if m.cursor != 6 {
+		t.Errorf("Expected cursor to follow to 6, got %d", m.cursor)
+	}
+
+	press(m, "g")
+	if m.cursor != 0 || m.offset != 0 {
+		t.Errorf("Expected cursor at top, got cursor %d offset %d", m.cursor, m.offset)
+	}
+}
+
+func TestModelEvictsOldestFlow(t *testing.T) {
+	m := newModel(2)
+	first := testFlow("GET", "http://a.example/", "a.example", 200)
+	m.add(first)
+	press(m, " ")
+	m.add(testFlow("GET", "http://b.example/", "b.example", 200))
+	m.add(testFlow("GET", "http://c.example/", "c.example", 200))
+
+	if len(m.flows) != 2 || len(m.visible) != 2 || m.flows[0].Host != "b.example" {
+		t.Errorf("Expected the oldest flow to be evicted, got %d flows", len(m.flows))
+	}
+	if m.marked[first.ID] {
+		t.Error("Expected the evicted flow to be unmarked")
+	}
+}
+
+func TestModelFilterAsYouType(t *testing.T) {
+	m := newModel(100)
+	m.add(testFlow("GET", "http://api.example/users", "api.example", 200))
+	m.add(testFlow("POST", "http://api.example/users", "api.example", 500))
+	m.add(testFlow("GET", "http://cdn.example/logo.png", "cdn.example", 200))
+
+	press(m, "/api")
+	if m.mode != modeFilter || len(m.visible) != 2 {
+		t.Fatalf("Expected 2 flows matching api while typing, got %d", len(m.visible))
+	}
+	press(m, " 500")
+	if len(m.visible) != 1 || m.visible[0].Method != "POST" {
+		t.Fatalf("Expected only the POST to match, got %d", len(m.visible))
+	}
+	press(m, "\x7f\x7f\x7f\x7f")
+	if len(m.visible) != 2 {
+		t.Errorf("Expected backspace to widen the filter, got %d", len(m.visible))
+	}
+
+	press(m, "\r")
+	if m.mode != modeList || m.filter != "api" {
+		t.Errorf("Expected enter to keep the filter, got mode %d filter %q", m.mode, m.filter)
+	}
+	if !strings.Contains(strings.Join(m.render(), "\n"), "search: api") {
+		t.Error("Expected the title to show the active text search")
+	}
+
+	press(m, "\x1b")
+	if m.filter != "" || len(m.visible) != 3 {
+		t.Errorf("Expected escape to clear the filter, got %q with %d flows", m.filter, len(m.visible))
+	}
+}
+
+func TestModelFilterExpression(t *testing.T) {
+	m := newModel(100)
+	m.width = 200
+	m.add(testFlow("GET", "http://api.example/users", "api.example", 200))
+	m.add(testFlow("POST", "http://api.example/users", "api.example", 500))
+	m.add(testFlow("GET", "http://cdn.example/logo.png", "cdn.example", 503))
+
+	// Incomplete expressions fall back to a text search and say why
+	press(m, "/status >")
+	if m.expr != nil || !strings.Contains(m.render()[m.height-1], "text search; as an expression: column 9") {
+		t.Errorf("Expected a text search hint, got %q", m.render()[m.height-1])
+	}
+
+	press(m, `= 500 && host ~ "^api"`)
+	if m.expr == nil || len(m.visible) != 1 || m.visible[0].Method != "POST" {
+		t.Fatalf("Expected the expression to select the POST, got %d flows (%v)", len(m.visible), m.filterErr)
+	}
+
+	// New flows are filtered by the expression too
+	m.add(testFlow("GET", "http://api.example/a", "api.example", 502))
+	m.add(testFlow("GET", "http://api.example/b", "api.example", 204))
+	if len(m.visible) != 2 {
+		t.Errorf("Expected the matching new flow to be shown, got %d flows", len(m.visible))
+	}
+
+	press(m, "\r")
+	if !strings.Contains(m.render()[0], `filter: status >= 500 && host ~ "^api"`) {
+		t.Errorf("Expected the title to show the expression, got %q", m.render()[0])
+	}
+}
+
+func TestModelPauseResume(t *testing.T) {
+	m := newModel(100)
+	m.add(testFlow("GET", "http://a.example/", "a.example", 200))
+
+	press(m, "p")
+	m.add(testFlow("GET", "http://a.example/", "a.example", 200))
+	m.add(testFlow("GET", "http://a.example/", "a.example", 200))
+	if len(m.flows) != 1 || len(m.pending) != 2 {
+		t.Fatalf("Expected flows to wait while paused, got %d shown %d pending", len(m.flows), len(m.pending))
+	}
+	if !strings.Contains(m.render()[0], "PAUSED (2 waiting)") {
+		t.Errorf("Expected the title to show the pause, got %q", m.render()[0])
+	}
+
+	press(m, "p")
+	if len(m.flows) != 3 || len(m.pending) != 0 {
+		t.Errorf("Expected waiting flows on resume, got %d shown %d pending", len(m.flows), len(m.pending))
+	}
+}
+
+func TestModelMarkAndExport(t *testing.T) {
+	m := newModel(100)
+	a := testFlow("GET", "http://a.example/", "a.example", 200)
+	b := testFlow("GET", "http://b.example/", "b.example", 404)
+	c := testFlow("GET", "http://c.example/", "c.example", 200)
+	for _, f := range []*flow.Flow{a, b, c} {
+		m.add(f)
+	}
+
+	// Without marks the flow under the cursor is exported
+	if got := m.markedFlows(); len(got) != 1 || got[0] != c {
+		t.Errorf("Expected the selected flow, got %v", got)
+	}
+
+	press(m, "gmjm")
+	if act := press(m, "e"); act != actionExport {
+		t.Errorf("Expected export action, got %d", act)
+	}
+	got := m.markedFlows()
+	if len(got) != 2 || got[0] != a || got[1] != c {
+		t.Errorf("Expected flows a and c to be marked, got %v", got)
+	}
+
+	var buf bytes.Buffer
+	if err := flow.Export(&buf, got); err != nil {
+		t.Fatalf("Export failed: %v", err)
+	}
+	var exported []flow.Flow
+	if err := json.Unmarshal(buf.Bytes(), &exported); err != nil {
+		t.Fatalf("Export is not a JSON array of flows: %v", err)
+	}
+	if len(exported) != 2 || exported[1].Host != "c.example" {
+		t.Errorf("Unexpected export: %+v", exported)
+	}
+
+	press(m, "u")
+	if len(m.marked) != 0 {
+		t.Error("Expected u to clear marks")
+	}
+}
+
+func TestModelDetail(t *testing.T) {
+	m := newModel(100)
+	m.width = 60
+	f := testFlow("POST", "http://api.example/users", "api.example", 201)
+	f.RequestHeader = http.Header{"Content-Type": {"application/json"}}
+	f.RequestBody = []byte(`{"name":"gopher"}`)
+	f.RequestSize = int64(len(f.RequestBody))
+	f.ResponseHeader = http.Header{"Content-Type": {"image/png"}}
+	f.ResponseBody = []byte("\x89PNG\r\n\x1a\n")
+	f.ResponseSize = 2048
+	m.add(f)
+
+	press(m, "\r")
+	if m.mode != modeDetail {
+		t.Fatal("Expected enter to open the detail view")
+	}
+	screen := strings.Join(m.render(), "\n")
+	for _, want := range []string{"POST http://api.example/users", "Content-Type: application/json", `  "name": "gopher"`, "binary body"} {
+		if !strings.Contains(screen, want) {
+			t.Errorf("Expected detail view to contain %q:\n%s", want, screen)
+		}
+	}
+	if strings.Contains(screen, "\x1a") {
+		t.Error("Binary body was written to the terminal")
+	}
+
+	press(m, "\x1b")
+	if m.mode != modeList {
+		t.Error("Expected escape to return to the list")
+	}
+}
+
+func TestModelRenderFitsScreen(t *testing.T) {
+	m := newModel(100)
+	m.width, m.height = 70, 5
+	for i := 0; i < 10; i++ {
+		m.add(testFlow("GET", "http://a.example/"+strings.Repeat("x", 100), "a.example", 200))
+	}
+
+	lines := m.render()
+	if len(lines) != 5 {
+		t.Fatalf("Expected 5 lines, got %d", len(lines))
+	}
+	for _, l := range lines {
+		plain := strings.NewReplacer(reverse, "", bold, "", reset, "").Replace(l)
+		if n := len([]rune(plain)); n > 70 {
+			t.Errorf("Line is %d columns wide: %q", n, plain)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package tui is a full-screen terminal view of the flows passing through
+// the MITM proxy, for use where a browser isn't at hand.
+package tui
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+
+	"nproxy/app/flow"
+)
+
+// UI shows the flows recorded in a store and follows new ones live
+type UI struct {
+	Store     *flow.Store
+	ExportDir string // where exported flows are written
+
+	in  *os.File
+	out io.Writer
+	log chan string
+}
+
+// New creates a UI for store on the process's terminal
+func New(store *flow.Store) *UI {
+	return &UI{
+		Store:     store,
+		ExportDir: ".",
+		in:        os.Stdin,
+		out:       os.Stdout,
+		log:       make(chan string, 16),
+	}
+}
+
+// LogWriter returns a writer whose most recent line is shown in the status
+// bar. Use it as the log output while the UI owns the terminal.
+func (u *UI) LogWriter() io.Writer {
+	return logWriter(u.log)
+}
+
+type logWriter chan string
+
+func (w logWriter) Write(p []byte) (int, error) {
+	line := strings.TrimSpace(string(p))
+	if i := strings.LastIndexByte(line, '\n'); i >= 0 {
+		line = line[i+1:]
+	}
+	select {
+	case w <- line:
+	default:
+	}
+	return len(p), nil
+}
+
+// Run takes over the terminal until the user quits or ctx is cancelled
+func (u *UI) Run(ctx context.Context) error {
+	fd := int(u.in.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("terminal UI needs an interactive terminal: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	out := bufio.NewWriter(u.out)
+	// Switch to the alternate screen and hide the cursor, undoing both on exit
+	fmt.Fprint(out, "\x1b[?1049h\x1b[?25l")
+	defer func() {
+		fmt.Fprint(out, "\x1b[?25h\x1b[?1049l")
+		out.Flush()
+	}()
+
+	m := newModel(u.Store.Capacity())
+	flows, cancel := u.Store.Subscribe(1024)
+	defer cancel()
+	for _, f := range u.Store.List() {
+		m.add(f)
+	}
+
+	keys := make(chan []byte)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		buf := make([]byte, 256)
+		for {
+			n, err := u.in.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case keys <- append([]byte(nil), buf[:n]...):
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// The ticker picks up terminal resizes
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if w, h, err := term.GetSize(fd); err == nil {
+			m.width, m.height = w, h
+			m.clamp()
+		}
+		draw(out, m.render())
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		case line := <-u.log:
+			m.status = line
+		case f := <-flows:
+			m.add(f)
+		case b := <-keys:
+			for _, k := range parseKeys(b) {
+				switch m.handleKey(k) {
+				case actionQuit:
+					return nil
+				case actionExport:
+					m.status = u.export(m.markedFlows())
+				}
+			}
+		}
+	}
+}
+
+// draw repaints the screen from the top left
+func draw(w *bufio.Writer, lines []string) {
+	w.WriteString("\x1b[H")
+	for i, l := range lines {
+		if i > 0 {
+			w.WriteString("\r\n")
+		}
+		w.WriteString(l)
+		w.WriteString("\x1b[K")
+	}
+	w.Flush()
+}
+
+// export writes flows to a timestamped file and returns a status message
+func (u *UI) export(flows []*flow.Flow) string {
+	if len(flows) == 0 {
+		return "Nothing to export"
+	}
+	name := filepath.Join(u.ExportDir, "nproxy-flows-"+time.Now().Format("20060102-150405")+".json")
+	file, err := os.Create(name)
+	if err != nil {
+		return "Export failed: " + err.Error()
+	}
+	defer file.Close()
+	if err := flow.Export(file, flows); err != nil {
+		return "Export failed: " + err.Error()
+	}
+	return fmt.Sprintf("Exported %d flows to %s", len(flows), name)
+}
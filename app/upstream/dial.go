@@ -0,0 +1,105 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"nproxy/app/socks5"
+)
+
+// DialFunc connects to an address, like net.Dialer.DialContext
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// Dial connects to addr, a host:port address, through the proxy at u:
+// with a CONNECT request to an HTTP or HTTPS proxy, or a SOCKS5 CONNECT.
+// dial is used to reach the proxy itself. The proxy resolves addr.
+func Dial(ctx context.Context, u *url.URL, addr string, dial DialFunc) (net.Conn, error) {
+	conn, err := dial(ctx, "tcp", u.Host)
+	if err != nil {
+		return nil, err
+	}
+	// The handshake is abandoned when ctx is done
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Unix(1, 0)) })
+	conn, err = handshake(ctx, conn, u, addr)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("upstream proxy %s: %w", u.Redacted(), err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func handshake(ctx context.Context, conn net.Conn, u *url.URL, addr string) (net.Conn, error) {
+	if u.Scheme == "socks5" {
+		var auth *socks5.Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &socks5.Auth{Username: u.User.Username(), Password: password}
+		}
+		return conn, socks5.Connect(conn, addr, auth)
+	}
+
+	if u.Scheme == "https" {
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			return conn, err
+		}
+		conn = tlsConn
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if auth := proxyAuthorization(u); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	// The body of a CONNECT response is the tunnel, so it isn't closed
+	if resp.StatusCode != http.StatusOK {
+		return conn, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if br.Buffered() > 0 {
+		// The target spoke first and the reader holds its opening bytes
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// proxyAuthorization returns the Basic Proxy-Authorization value for the
+// credentials in u, or "" when it has none
+func proxyAuthorization(u *url.URL) string {
+	if u.User == nil {
+		return ""
+	}
+	password, _ := u.User.Password()
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(u.User.Username()+":"+password))
+}
+
+// bufferedConn is a connection whose first bytes were already read into r
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,246 @@
+// Package upstream chains nproxy to other proxies: it picks, per host, the
+// upstream proxy an outbound connection goes through, or none, and dials
+// through HTTP, HTTPS and SOCKS5 proxies.
+package upstream
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Direct names the route that connects without a proxy
+const Direct = "direct"
+
+// ParseURL parses an upstream proxy URL: http://, https:// or socks5://,
+// optionally with user:password@ credentials. The port defaults to 80,
+// 443 and 1080 respectively.
+func ParseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("%q is not a proxy URL such as http://proxy.example.com:3128", s)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("%q: scheme must be http, https or socks5", s)
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" {
+		return nil, fmt.Errorf("%q: a proxy URL has no path, query or fragment", s)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), defaultPorts[u.Scheme])
+	}
+	u.Path = ""
+	return u, nil
+}
+
+var defaultPorts = map[string]string{"http": "80", "https": "443", "socks5": "1080"}
+
+// Route sends connections to the hosts it matches through the proxy named
+// Via, or directly when Via is Direct
+type Route struct {
+	Hosts []string
+	Via   string
+}
+
+// Router picks the upstream proxy for each destination. Routes are tried
+// in order, then the no-proxy list, then the default. A nil *Router
+// connects everything directly.
+type Router struct {
+	routes  []route
+	noProxy HostList
+	def     *url.URL
+}
+
+type route struct {
+	hosts HostList
+	proxy *url.URL // nil for direct
+}
+
+// NewRouter builds a router from named proxy URLs, routes referring to
+// them, the name of the default proxy (empty or Direct for none) and a
+// NO_PROXY-style list of hosts that are always reached directly
+func NewRouter(proxies map[string]string, routes []Route, def, noProxy string) (*Router, error) {
+	urls := make(map[string]*url.URL, len(proxies))
+	for name, s := range proxies {
+		if name == Direct {
+			return nil, fmt.Errorf("%q is reserved for connecting without a proxy", Direct)
+		}
+		u, err := ParseURL(s)
+		if err != nil {
+			return nil, err
+		}
+		urls[name] = u
+	}
+	lookup := func(name string) (*url.URL, error) {
+		if name == Direct {
+			return nil, nil
+		}
+		u, ok := urls[name]
+		if !ok {
+			return nil, fmt.Errorf("no proxy is named %q", name)
+		}
+		return u, nil
+	}
+
+	r := &Router{}
+	var err error
+	for _, rt := range routes {
+		var parsed route
+		if parsed.hosts, err = ParseHostList(rt.Hosts); err != nil {
+			return nil, err
+		}
+		if parsed.proxy, err = lookup(rt.Via); err != nil {
+			return nil, err
+		}
+		r.routes = append(r.routes, parsed)
+	}
+	if r.noProxy, err = ParseHostList(SplitNoProxy(noProxy)); err != nil {
+		return nil, err
+	}
+	if def != "" {
+		if r.def, err = lookup(def); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Proxy returns the upstream proxy for addr, a host:port address, or nil
+// to connect directly
+func (r *Router) Proxy(addr string) *url.URL {
+	if r == nil {
+		return nil
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	port, _ := strconv.Atoi(portStr)
+	for _, rt := range r.routes {
+		if rt.hosts.Match(host, port) {
+			return rt.proxy
+		}
+	}
+	if r.noProxy.Match(host, port) {
+		return nil
+	}
+	return r.def
+}
+
+// SplitNoProxy splits a NO_PROXY value, which separates entries with commas
+// and optional spaces
+func SplitNoProxy(s string) []string {
+	return strings.FieldsFunc(s, func(c rune) bool { return c == ',' || c == ' ' })
+}
+
+// HostList matches hosts the way NO_PROXY does. Each entry is one of
+//
+//   - * for every host
+//   - a domain, matching it and its subdomains: example.com
+//   - a domain with a leading dot or *., matching only subdomains:
+//     .example.com or *.example.com
+//   - an address or CIDR prefix, matching addresses but not names that
+//     resolve to them: 10.0.0.0/8, ::1
+//
+// optionally followed by a port: example.com:8080, [::1]:80.
+type HostList []hostEntry
+
+type hostEntry struct {
+	any    bool
+	domain string // without the leading dot
+	sub    bool   // only subdomains of domain match
+	prefix netip.Prefix
+	port   int // 0 for any port
+}
+
+// ParseHostList parses host list entries
+func ParseHostList(entries []string) (HostList, error) {
+	var list HostList
+	for _, e := range entries {
+		h, err := parseHostEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, h)
+	}
+	return list, nil
+}
+
+func parseHostEntry(s string) (hostEntry, error) {
+	var h hostEntry
+	host := s
+	if i := strings.LastIndex(s, ":"); i >= 0 && (strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1) {
+		var portStr string
+		host, portStr = s[:i], s[i+1:]
+		port, err := strconv.Atoi(portStr)
+		if err != nil || port < 1 || port > 65535 {
+			return h, fmt.Errorf("%q: port %q must be a number from 1 to 65535", s, portStr)
+		}
+		h.port = port
+	}
+	host = strings.Trim(host, "[]")
+
+	switch {
+	case host == "*":
+		h.any = true
+	case strings.Contains(host, "/"):
+		p, err := netip.ParsePrefix(host)
+		if err != nil {
+			return h, fmt.Errorf("%q is not a CIDR prefix such as 10.0.0.0/8", s)
+		}
+		h.prefix = p.Masked()
+	case isAddr(host):
+		addr := netip.MustParseAddr(host).Unmap()
+		h.prefix = netip.PrefixFrom(addr, addr.BitLen())
+	default:
+		host = strings.TrimPrefix(host, "*")
+		h.sub = strings.HasPrefix(host, ".")
+		h.domain = normalizeHost(strings.TrimPrefix(host, "."))
+		if h.domain == "" || strings.ContainsAny(h.domain, "*/ ") {
+			return h, fmt.Errorf("%q is not a host name, *.domain, address or CIDR prefix", s)
+		}
+	}
+	return h, nil
+}
+
+func isAddr(s string) bool {
+	_, err := netip.ParseAddr(s)
+	return err == nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+// Match reports whether host, a name or an address, and port match an
+// entry of the list
+func (l HostList) Match(host string, port int) bool {
+	host = strings.Trim(host, "[]")
+	addr, addrErr := netip.ParseAddr(host)
+	name := normalizeHost(host)
+	for _, h := range l {
+		if h.port != 0 && h.port != port {
+			continue
+		}
+		switch {
+		case h.any:
+			return true
+		case h.prefix.IsValid():
+			if addrErr == nil && h.prefix.Contains(addr.Unmap()) {
+				return true
+			}
+		case name == h.domain:
+			if !h.sub {
+				return true
+			}
+		case strings.HasSuffix(name, "."+h.domain):
+			return true
+		}
+	}
+	return false
+}
@@ -52,15 +52,15 @@ DEMO_TYPE=${1:-"basic"}
 case $DEMO_TYPE in
     "basic")
         print_info "Starting Basic Proxy Demo"
-        PROXY_CMD="go run app/main.go -addr :8080"
+        PROXY_CMD="go run ./app -addr :8080"
         ;;
     "mitm")
         print_info "Starting MITM Proxy Demo"
-        PROXY_CMD="go run app/main.go -mitm -addr :8080"
+        PROXY_CMD="go run ./app mitm -addr :8080"
         ;;
     "mitm-modify")
         print_info "Starting MITM Proxy Demo with Modification"
-        PROXY_CMD="go run app/main.go -mitm -modify -v -addr :8080"
+        PROXY_CMD="go run ./app mitm -modify -v -addr :8080"
         ;;
     *)
         print_error "Unknown demo type: $DEMO_TYPE"
@@ -72,7 +72,7 @@ esac
 # 1. Start mock server
 print_header "Starting Mock Server"
 print_info "Starting mock server on :9090..."
-go run app/main.go -mock -addr :9090 &
+go run ./app mock -addr :9090 &
 MOCK_PID=$!
 print_info "Mock server started (PID: $MOCK_PID)"
 
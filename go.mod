@@ -1,3 +1,12 @@
 module nproxy
 
 go 1.23.0
+
+require (
+	github.com/BurntSushi/toml v1.5.0
+	golang.org/x/crypto v0.38.0
+	golang.org/x/term v0.32.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.33.0 // indirect